@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/config"
+	"github.com/thelastdreamer/MultiWANBond/pkg/nat"
+	"github.com/thelastdreamer/MultiWANBond/pkg/network/ipconfig"
+	"github.com/thelastdreamer/MultiWANBond/pkg/network/tun"
+	"github.com/thelastdreamer/MultiWANBond/pkg/security"
+	"github.com/thelastdreamer/MultiWANBond/pkg/server"
+)
+
+const (
+	version = "1.0.0"
+)
+
+var (
+	listenAddr      = flag.String("listen", "0.0.0.0", "Address to listen on for bonded clients")
+	listenPort      = flag.Int("port", 8888, "UDP port to listen on for bonded clients")
+	tunName         = flag.String("tun-name", "mwbs0", "Name of the egress TUN interface")
+	tunAddress      = flag.String("tun-address", "10.100.255.254/16", "Address of the egress TUN interface (CIDR)")
+	tunMTU          = flag.Int("tun-mtu", tun.DefaultMTU, "MTU of the egress TUN interface")
+	natPoolStart    = flag.String("nat-pool-start", "10.100.0.1", "First address of the per-client NAT pool")
+	natPoolSize     = flag.Int("nat-pool-size", 254, "Number of addresses in the NAT pool")
+	maxClients      = flag.Int("max-clients", 1000, "Maximum simultaneous client sessions")
+	maxClientsPerIP = flag.Int("max-clients-per-ip", 10, "Maximum sessions from the same source IP")
+	clientUpload    = flag.Uint64("client-upload", 100*1024*1024, "Per-client upload limit (bytes/sec)")
+	clientDownload  = flag.Uint64("client-download", 100*1024*1024, "Per-client download limit (bytes/sec)")
+	idleTimeout     = flag.Duration("idle-timeout", 5*time.Minute, "Disconnect clients after this idle time")
+	tunnelCipher    = flag.String("cipher", "chacha20poly1305", "Tunnel cipher (chacha20poly1305 or aes256gcm)")
+	tunnelPSK       = flag.String("psk", "", "Tunnel pre-shared key; empty disables tunnel encryption")
+	replayWindow    = flag.Int("replay-window", 1024, "Packets tracked per client for replay protection")
+	handshake       = flag.String("handshake", "", "Noise handshake for session keys (noise_ik or noise_xx); replaces -psk")
+	privateKey      = flag.String("private-key", "", "Static private key for the handshake (base64)")
+	peers           = flag.String("peers", "", "Trusted client keys for the handshake (id=base64key,...)")
+	genKey          = flag.Bool("genkey", false, "Generate a handshake key pair and exit")
+	stunAddr        = flag.String("stun", "", "Answer STUN requests on this IP:port (empty to disable)")
+	stunAlternate   = flag.String("stun-alternate", "", "Alternate STUN IP:port, on another IP and port, for NAT type detection")
+	stunUsername    = flag.String("stun-username", "", "Username STUN requests must be signed for")
+	stunPassword    = flag.String("stun-password", "", "Password STUN requests must be signed with (empty accepts any)")
+	statsInterval   = flag.Duration("stats-interval", 30*time.Second, "Statistics interval (0 to disable)")
+	showVersion     = flag.Bool("version", false, "Show version and exit")
+)
+
+func main() {
+	flag.Usage = printHelp
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("MultiWANBond Concentrator v%s\n", version)
+		return
+	}
+
+	if *genKey {
+		key, err := security.GenerateStaticKey()
+		if err != nil {
+			log.Fatalf("Failed to generate key: %v", err)
+		}
+		fmt.Printf("private-key: %s\n", base64.StdEncoding.EncodeToString(key.Bytes()))
+		fmt.Printf("public-key:  %s\n", base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()))
+		return
+	}
+
+	// Build server configuration
+	cfg := server.DefaultServerConfig()
+	cfg.ListenAddr = *listenAddr
+	cfg.ListenPort = *listenPort
+	cfg.NATPoolStart = net.ParseIP(*natPoolStart)
+	cfg.NATPoolSize = *natPoolSize
+	cfg.MaxClients = *maxClients
+	cfg.MaxClientsPerIP = *maxClientsPerIP
+	cfg.ClientIdleTimeout = *idleTimeout
+	cfg.DefaultClientConfig.MaxUploadBandwidth = *clientUpload
+	cfg.DefaultClientConfig.MaxDownloadBandwidth = *clientDownload
+	cfg.DefaultClientConfig.IdleTimeout = *idleTimeout
+	cfg.TunnelCipher = *tunnelCipher
+	cfg.TunnelPreSharedKey = *tunnelPSK
+	cfg.TunnelReplayWindow = *replayWindow
+
+	if *handshake != "" {
+		noiseConfig, err := handshakeConfig()
+		if err != nil {
+			log.Fatalf("Invalid handshake configuration: %v", err)
+		}
+		cfg.Handshake = noiseConfig
+		log.Printf("Handshake %s, public key %s", noiseConfig.Pattern,
+			base64.StdEncoding.EncodeToString(noiseConfig.StaticKey.PublicKey().Bytes()))
+	} else if *tunnelPSK == "" {
+		log.Printf("WARNING: tunnel encryption disabled (no -psk or -handshake given)")
+	}
+
+	if *stunAddr != "" {
+		cfg.STUN = &nat.STUNServerConfig{
+			Address:          *stunAddr,
+			AlternateAddress: *stunAlternate,
+			Username:         *stunUsername,
+			Password:         *stunPassword,
+		}
+	}
+
+	if cfg.NATPoolStart == nil {
+		log.Fatalf("Invalid NAT pool start address: %s", *natPoolStart)
+	}
+
+	srv, err := server.NewServer(cfg)
+	if err != nil {
+		log.Fatalf("Failed to create server: %v", err)
+	}
+
+	// Open egress TUN interface
+	log.Printf("Opening TUN interface %s (%s, MTU %d)...", *tunName, *tunAddress, *tunMTU)
+	tunCfg := &tun.Config{
+		Name:    *tunName,
+		Address: *tunAddress,
+		MTU:     *tunMTU,
+	}
+
+	dev, err := tun.Open(tunCfg)
+	if err != nil {
+		log.Fatalf("Failed to open TUN interface: %v", err)
+	}
+
+	ipMgr, err := ipconfig.NewManager()
+	if err != nil {
+		log.Fatalf("Failed to create IP configuration manager: %v", err)
+	}
+
+	if err := tun.Configure(ipMgr, dev, tunCfg); err != nil {
+		log.Fatalf("Failed to configure TUN interface: %v", err)
+	}
+
+	if err := srv.AttachTUN(dev); err != nil {
+		log.Fatalf("Failed to attach TUN interface: %v", err)
+	}
+
+	// Start server
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := srv.Start(ctx); err != nil {
+		log.Fatalf("Failed to start server: %v", err)
+	}
+
+	log.Printf("Concentrator listening on %s", srv.LocalAddr())
+	if stun := srv.GetSTUNServer(); stun != nil {
+		if other := stun.OtherAddr(); other != nil {
+			log.Printf("STUN server on %s, alternate %s", stun.LocalAddr(), other)
+		} else {
+			log.Printf("STUN server on %s", stun.LocalAddr())
+		}
+	}
+	log.Printf("NAT pool: %s (+%d addresses) via %s", cfg.NATPoolStart, cfg.NATPoolSize, dev.Name())
+	log.Println("Ensure IP forwarding and masquerading are enabled, e.g.:")
+	log.Println("  sysctl -w net.ipv4.ip_forward=1")
+	log.Printf("  iptables -t nat -A POSTROUTING -s %s -j MASQUERADE", cfg.InterClientSubnet)
+
+	// Log session events
+	go eventLogger(srv)
+
+	if *statsInterval > 0 {
+		go statsMonitor(srv, *statsInterval)
+	}
+
+	// Wait for termination signal
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+
+	log.Println("Concentrator is running. Press Ctrl+C to stop.")
+	<-sigChan
+
+	log.Println("Shutting down...")
+	if err := srv.Stop(); err != nil {
+		log.Printf("Error during shutdown: %v", err)
+	}
+
+	log.Println("Concentrator stopped")
+}
+
+func eventLogger(srv *server.Server) {
+	for event := range srv.GetSessionManager().GetEventChannel() {
+		log.Printf("[%s] session=%s client=%s %s", event.Type, event.SessionID, event.ClientID, event.Details)
+	}
+}
+
+func statsMonitor(srv *server.Server, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		stats := srv.GetSessionManager().GetStats()
+		fwd := srv.GetForwardingStats()
+		up, down := srv.GetBandwidthManager().GetServerBandwidth()
+
+		log.Printf("Sessions: %d active (%d total) | NAT mappings: %d | Up: %s/s Down: %s/s",
+			stats.ActiveSessions, stats.TotalSessions, srv.GetNATEngine().GetMappingCount(),
+			formatBytes(up), formatBytes(down))
+		log.Printf("Packets: %d forwarded, %d returned | Dropped: %d invalid, %d unauthenticated, %d rejected, %d rate-limited, %d no-mapping",
+			fwd.PacketsForwarded.Load(), fwd.PacketsReturned.Load(),
+			fwd.DroppedInvalid.Load(), fwd.DroppedAuth.Load(), fwd.DroppedRejected.Load(),
+			fwd.DroppedRateLimited.Load(), fwd.DroppedNoMapping.Load())
+
+		for sessionID, reorder := range srv.GetReorderStats() {
+			log.Printf("  Session %s: reorder depth %d (max %d), %d late, %d skipped",
+				sessionID, reorder.Depth, reorder.MaxDepth, reorder.Late, reorder.Skipped)
+		}
+	}
+}
+
+func formatBytes(bytes uint64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := uint64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+// handshakeConfig builds the responder's handshake configuration from flags
+func handshakeConfig() (*security.NoiseConfig, error) {
+	secCfg := &config.SecurityConfig{
+		Enabled:    true,
+		Cipher:     *tunnelCipher,
+		Handshake:  *handshake,
+		PrivateKey: *privateKey,
+	}
+
+	for _, entry := range strings.Split(*peers, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		id, key, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid peer %q, expected id=key", entry)
+		}
+		secCfg.Peers = append(secCfg.Peers, config.PeerConfig{ID: id, PublicKey: key})
+	}
+	if len(secCfg.Peers) == 0 {
+		return nil, fmt.Errorf("no trusted peers given with -peers")
+	}
+
+	return secCfg.ToNoiseConfig()
+}
+
+func printHelp() {
+	fmt.Printf("MultiWANBond Concentrator v%s\n\n", version)
+	fmt.Println("Aggregation server that terminates bonded client sessions and")
+	fmt.Println("forwards their traffic to the internet through NAT.")
+	fmt.Println("")
+	fmt.Println("Usage:")
+	fmt.Println("  multiwanbond-concentrator [flags]")
+	fmt.Println("")
+	fmt.Println("Flags:")
+	flag.PrintDefaults()
+}
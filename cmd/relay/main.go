@@ -0,0 +1,133 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/nat"
+	"github.com/thelastdreamer/MultiWANBond/pkg/security"
+)
+
+const (
+	version = "1.0.0"
+)
+
+var (
+	listenAddr     = flag.String("listen", "0.0.0.0:3479", "UDP address to listen on")
+	maxBandwidth   = flag.Uint64("max-bandwidth", 10*1024*1024, "Per-allocation bandwidth limit (bytes/sec, 0 for none)")
+	idleTimeout    = flag.Duration("idle-timeout", 5*time.Minute, "Release allocations after this idle time")
+	maxAllocations = flag.Int("max-allocations", 1000, "Maximum simultaneous allocations (0 for none)")
+	tokenSecret    = flag.String("token-secret", "", "Secret allocation tokens are signed with; empty allows anyone to allocate")
+	genToken       = flag.String("gentoken", "", "Generate an allocation token for this peer ID and exit (needs -token-secret)")
+	tokenValidity  = flag.Duration("token-validity", 365*24*time.Hour, "Validity of tokens made with -gentoken")
+	statsInterval  = flag.Duration("stats-interval", 30*time.Second, "Statistics interval (0 to disable)")
+	showVersion    = flag.Bool("version", false, "Show version and exit")
+)
+
+func main() {
+	flag.Usage = printHelp
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("MultiWANBond Relay v%s\n", version)
+		return
+	}
+
+	var auth *security.Authenticator
+	if *tokenSecret != "" {
+		auth = security.NewAuthenticator(&security.SecurityConfig{TokenSecret: *tokenSecret})
+	}
+
+	if *genToken != "" {
+		if auth == nil {
+			log.Fatalf("-gentoken needs -token-secret")
+		}
+		token, err := auth.GenerateToken(*genToken, *tokenValidity)
+		if err != nil {
+			log.Fatalf("Failed to generate token: %v", err)
+		}
+		fmt.Println(token)
+		return
+	}
+
+	cfg := nat.DefaultRelayServerConfig()
+	cfg.ListenAddr = *listenAddr
+	cfg.MaxBandwidth = *maxBandwidth
+	cfg.AllocationTimeout = *idleTimeout
+	cfg.MaxAllocations = *maxAllocations
+	cfg.Authenticator = auth
+
+	if auth == nil {
+		log.Printf("WARNING: allocations are not authenticated (no -token-secret given)")
+	}
+
+	relay := nat.NewRelayServer(cfg)
+	if err := relay.Start(); err != nil {
+		log.Fatalf("Failed to start relay: %v", err)
+	}
+
+	log.Printf("Relay listening on %s", relay.LocalAddr())
+
+	if *statsInterval > 0 {
+		go statsMonitor(relay, *statsInterval)
+	}
+
+	// Wait for termination signal
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+
+	log.Println("Relay is running. Press Ctrl+C to stop.")
+	<-sigChan
+
+	log.Println("Shutting down...")
+	if err := relay.Stop(); err != nil {
+		log.Printf("Error during shutdown: %v", err)
+	}
+
+	log.Println("Relay stopped")
+}
+
+func statsMonitor(relay *nat.RelayServer, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		stats := relay.GetStats()
+
+		log.Printf("Allocations: %d active (%d total, %d expired, %d refused) | Relayed: %d packets, %s",
+			len(relay.GetAllocations()), stats.Allocations, stats.Expired, stats.AuthFailures,
+			stats.PacketsRelayed, formatBytes(stats.BytesRelayed))
+		log.Printf("Dropped: %d unbound, %d rate-limited, %d invalid",
+			stats.PacketsDropped, stats.PacketsLimited, stats.InvalidMessages)
+	}
+}
+
+func formatBytes(bytes uint64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := uint64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+func printHelp() {
+	fmt.Printf("MultiWANBond Relay v%s\n\n", version)
+	fmt.Println("Relay server for peers that cannot reach each other directly,")
+	fmt.Println("used as the NAT traversal fallback of last resort.")
+	fmt.Println("")
+	fmt.Println("Usage:")
+	fmt.Println("  multiwanbond-relay [flags]")
+	fmt.Println("")
+	fmt.Println("Flags:")
+	flag.PrintDefaults()
+}
@@ -128,6 +128,11 @@ func runServer() {
 		log.Fatalf("Configuration must have at least one WAN interface")
 	}
 
+	// Keep measured NAT binding lifetimes next to the configuration
+	if cfg.NAT != nil && cfg.NAT.BindingStateFile == "" {
+		cfg.NAT.BindingStateFile = filepath.Join(filepath.Dir(*configFile), "nat_bindings.json")
+	}
+
 	// Create bonder with optional remote address
 	log.Println("Creating MultiWANBond instance...")
 	b, err := bonder.New(cfg)
@@ -179,6 +184,25 @@ func runServer() {
 	// Start metrics bridge to update Web UI
 	go metricsUpdater(b, webServer, 1*time.Second)
 
+	// Publish failovers to the Web UI
+	b.SetFailoverHandler(func(fromWAN, toWAN uint8, reason string) {
+		message := fmt.Sprintf("Traffic moved from WAN %d to WAN %d: %s", fromWAN, toWAN, reason)
+		webServer.PublishEvent(&webui.Event{
+			Type:      webui.EventFailover,
+			Timestamp: time.Now(),
+			Message:   message,
+			Data:      webui.FailoverEvent{FromWAN: fromWAN, ToWAN: toWAN, Reason: reason},
+			Severity:  "warning",
+		})
+		webServer.AddAlert(webui.Alert{
+			ID:        fmt.Sprintf("failover-%d", time.Now().UnixNano()),
+			Type:      "failover",
+			Severity:  "warning",
+			Message:   message,
+			Timestamp: time.Now(),
+		})
+	})
+
 	// Print WAN status
 	wans := b.GetWANs()
 	log.Printf("Active WANs: %d", len(wans))
@@ -314,6 +338,24 @@ func metricsUpdater(b *bonder.Bonder, server *webui.Server, interval time.Durati
 		// Update Web UI statistics
 		server.UpdateStats(metrics, wans)
 
+		// Update FEC recovery statistics
+		fecStats := b.GetFECStats()
+		server.UpdateFECStats(fecStats.Recovered, fecStats.Unrecoverable)
+
+		// Update reorder buffer statistics
+		reorderStats := b.GetReorderStats()
+		server.UpdateReorderStats(reorderStats.Depth, reorderStats.MaxDepth, reorderStats.Late)
+
+		// Update duplicate suppression statistics
+		suppressed := make(map[uint8]uint64)
+		for wanID, dup := range b.GetDuplicateStats() {
+			suppressed[wanID] = dup.Suppressed
+		}
+		server.UpdateDuplicateStats(suppressed)
+
+		// Update routing policy hit counters
+		server.UpdatePolicyStats(b.GetPolicyStats())
+
 		// Update health checks
 		healthChecks := make([]webui.HealthCheckInfo, 0, len(metrics))
 		for id, m := range metrics {
@@ -425,27 +467,8 @@ func metricsUpdater(b *bonder.Bonder, server *webui.Server, interval time.Durati
 			}
 		}
 
-		// Update NAT info if NAT manager is available
-		natMgr := b.GetNATManager()
-		if natMgr != nil {
-			natInfo := &webui.NATInfo{
-				NATType:        natMgr.GetNATType().String(),
-				CGNATDetected:  natMgr.IsCGNATDetected(),
-				CanDirect:      natMgr.GetNATType().CanDirectConnect(),
-				NeedsRelay:     natMgr.GetNATType().NeedsRelay(),
-				RelayAvailable: natMgr.GetRelayID() != "",
-			}
-
-			// Get public and local addresses
-			if publicAddr := natMgr.GetPublicAddr(); publicAddr != nil {
-				natInfo.PublicAddr = publicAddr.String()
-			}
-			if localAddr := natMgr.GetLocalAddr(); localAddr != nil {
-				natInfo.LocalAddr = localAddr.String()
-			}
-
-			server.UpdateNATInfo(natInfo)
-		}
+		// Update NAT info from each WAN's NAT traversal
+		server.UpdateNATInfo(webui.ToWANNATInfo(b.GetWANs(), b.GetNATInfo()))
 
 		// Update flows if DPI classifier is available
 		dpiClassifier := b.GetDPIClassifier()
@@ -173,12 +173,16 @@ func main() {
 			{Version: protocol.ProtocolVersion, Type: protocol.PacketTypeData, SequenceID: 2, Timestamp: time.Now().UnixNano(), Data: []byte("Packet 2")},
 		}
 
+		processor.SetDeliverFunc(func(batch [][]byte) {
+			for _, data := range batch {
+				fmt.Printf("  %s delivered\n", data)
+			}
+		})
+		processor.SetNextExpectedSeq(1)
+
 		// Process out-of-order packets
 		for _, pkt := range testPackets {
-			_, ready, err := processor.Reorder(pkt)
-			if err != nil && ready {
-				fmt.Printf("  Packet %d processed\n", pkt.SequenceID)
-			}
+			processor.Reorder(pkt)
 		}
 
 		fmt.Println("  ✓ Processed 3 out-of-order packets")
@@ -0,0 +1,188 @@
+// Package arq retransmits tunnel packets that the peer reports missing.
+//
+// The receiver lists the sequence IDs its reorder buffer is waiting for in
+// the acks it sends (see protocol.Ack). The sender keeps every data packet
+// until the peer's reorder timeout has passed and resends the reported ones,
+// usually on a healthier WAN than the one that lost them. Packets whose
+// reorder timeout has passed are given up on, since the peer has skipped them.
+package arq
+
+import (
+	"sync"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+)
+
+const (
+	// DefaultMaxPackets is how many sent packets are kept for retransmission
+	DefaultMaxPackets = 4096
+	// NackInterval is how often a receiver repeats its missing ranges while
+	// no data arrives to ack
+	NackInterval = 20 * time.Millisecond
+	// retransmitMargin allows for the time the peer holds acks
+	retransmitMargin = 10 * time.Millisecond
+)
+
+// WANStats counts retransmission activity on a WAN
+type WANStats struct {
+	Lost         uint64        // Packets sent on the WAN that the peer reported missing
+	Retransmits  uint64        // Retransmissions sent on the WAN
+	Expired      uint64        // Reported packets given up on because the peer's reorder timeout passed
+	Recovered    uint64        // Retransmissions from the peer that arrived on the WAN and filled a gap
+	RecoveryTime time.Duration // Average time the peer's retransmissions took to fill a gap
+}
+
+// Retransmission is a packet to send again
+type Retransmission struct {
+	Packet *protocol.Packet // Copy of the packet, flagged FlagRetransmit
+	LostOn uint8            // WAN the packet was last sent on
+}
+
+// sentPacket is a packet kept for retransmission
+type sentPacket struct {
+	pkt       *protocol.Packet
+	wanID     uint8 // WAN of the last copy sent
+	firstSent time.Time
+	lastSent  time.Time
+}
+
+// Retransmitter keeps sent data packets and picks the ones to retransmit
+type Retransmitter struct {
+	mu         sync.Mutex
+	deadline   time.Duration
+	maxPackets int
+	packets    map[uint64]*sentPacket
+	order      []uint64 // Sequence IDs in the order they were first sent
+	stats      map[uint8]*WANStats
+	recovery   map[uint8]time.Duration // Total recovery time of each WAN
+}
+
+// NewRetransmitter creates a retransmitter that gives up on packets once the
+// peer's reorder timeout has passed since they were first sent
+func NewRetransmitter(reorderTimeout time.Duration) *Retransmitter {
+	return &Retransmitter{
+		deadline:   reorderTimeout,
+		maxPackets: DefaultMaxPackets,
+		packets:    make(map[uint64]*sentPacket),
+		stats:      make(map[uint8]*WANStats),
+		recovery:   make(map[uint8]time.Duration),
+	}
+}
+
+// SetDeadline changes how long packets can be retransmitted after they were
+// first sent, normally the peer's reorder timeout
+func (r *Retransmitter) SetDeadline(reorderTimeout time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.deadline = reorderTimeout
+}
+
+// Sent records a data packet sent on a WAN. Copies of a packet already kept,
+// such as duplicates on backup WANs, are ignored unless they are flagged as
+// retransmissions.
+func (r *Retransmitter) Sent(pkt *protocol.Packet, wanID uint8, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if sent, exists := r.packets[pkt.SequenceID]; exists {
+		if pkt.Flags&protocol.FlagRetransmit != 0 {
+			sent.wanID = wanID
+			sent.lastSent = now
+			r.wanStats(wanID).Retransmits++
+		}
+		return
+	}
+
+	r.packets[pkt.SequenceID] = &sentPacket{pkt: pkt, wanID: wanID, firstSent: now, lastSent: now}
+	r.order = append(r.order, pkt.SequenceID)
+	r.expire(now)
+}
+
+// Lost returns the reported missing packets to retransmit now. A packet is
+// only resent once the WAN it was last sent on has had a round trip, as
+// given by rtt, to deliver it: until then it may simply be late.
+func (r *Retransmitter) Lost(missing []protocol.SeqRange, now time.Time, rtt func(wanID uint8) time.Duration) []Retransmission {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var lost []Retransmission
+	for _, span := range missing {
+		if span.Last < span.First {
+			continue
+		}
+		count := min(span.Last-span.First, uint64(r.maxPackets)) + 1
+		for seq := span.First; seq-span.First < count; seq++ {
+			sent, exists := r.packets[seq]
+			if !exists {
+				continue
+			}
+			if now.Sub(sent.firstSent) >= r.deadline {
+				r.wanStats(sent.wanID).Expired++
+				delete(r.packets, seq)
+				continue
+			}
+			if now.Sub(sent.lastSent) < rtt(sent.wanID)+retransmitMargin {
+				continue
+			}
+
+			r.wanStats(sent.wanID).Lost++
+			sent.lastSent = now // Not again before this retransmission had its chance
+
+			pkt := *sent.pkt
+			pkt.Flags |= protocol.FlagRetransmit
+			lost = append(lost, Retransmission{Packet: &pkt, LostOn: sent.wanID})
+		}
+	}
+	return lost
+}
+
+// Recovered records a retransmission from the peer that arrived on a WAN and
+// filled a gap the reorder buffer had waited on for the given time
+func (r *Retransmitter) Recovered(wanID uint8, waited time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.wanStats(wanID).Recovered++
+	r.recovery[wanID] += waited
+}
+
+// Stats returns the counters of every WAN
+func (r *Retransmitter) Stats() map[uint8]WANStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := make(map[uint8]WANStats, len(r.stats))
+	for id, s := range r.stats {
+		wanStats := *s
+		if s.Recovered > 0 {
+			wanStats.RecoveryTime = r.recovery[id] / time.Duration(s.Recovered)
+		}
+		stats[id] = wanStats
+	}
+	return stats
+}
+
+// expire forgets packets past their deadline, and the oldest packets when
+// more than maxPackets are kept
+func (r *Retransmitter) expire(now time.Time) {
+	n := 0
+	for ; n < len(r.order); n++ {
+		seq := r.order[n]
+		sent, exists := r.packets[seq]
+		if exists && now.Sub(sent.firstSent) < r.deadline && len(r.packets) <= r.maxPackets {
+			break
+		}
+		delete(r.packets, seq)
+	}
+	r.order = r.order[n:]
+}
+
+// wanStats returns the counters of a WAN, creating them if needed
+func (r *Retransmitter) wanStats(wanID uint8) *WANStats {
+	s, exists := r.stats[wanID]
+	if !exists {
+		s = &WANStats{}
+		r.stats[wanID] = s
+	}
+	return s
+}
@@ -0,0 +1,76 @@
+package arq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+)
+
+func TestRetransmitter(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewRetransmitter(500 * time.Millisecond)
+	rtt := func(wanID uint8) time.Duration { return time.Duration(wanID) * 50 * time.Millisecond }
+
+	for seq := uint64(1); seq <= 6; seq++ {
+		wanID := uint8(1 + seq%2)
+		r.Sent(&protocol.Packet{SequenceID: seq, WANID: wanID, Data: []byte{byte(seq)}}, wanID, now)
+	}
+	// A duplicate copy on another WAN does not replace the original
+	r.Sent(&protocol.Packet{SequenceID: 4, WANID: 2}, 2, now)
+
+	missing := []protocol.SeqRange{{First: 3, Last: 4}, {First: 9, Last: 12}}
+
+	// Packets are not resent before their WAN had a round trip to deliver them
+	now = now.Add(70 * time.Millisecond)
+	lost := r.Lost(missing, now, rtt)
+	if len(lost) != 1 || lost[0].Packet.SequenceID != 4 || lost[0].LostOn != 1 {
+		t.Fatalf("lost = %+v, want only packet 4 lost on WAN 1", lost)
+	}
+	if pkt := lost[0].Packet; pkt.Flags&protocol.FlagRetransmit == 0 || pkt.Data[0] != 4 {
+		t.Fatalf("retransmission = %+v", pkt)
+	}
+	r.Sent(lost[0].Packet, 2, now)
+
+	// Nor again before the retransmission had its chance
+	now = now.Add(50 * time.Millisecond)
+	lost = r.Lost(missing, now, rtt)
+	if len(lost) != 1 || lost[0].Packet.SequenceID != 3 || lost[0].LostOn != 2 {
+		t.Fatalf("lost = %+v, want only packet 3 lost on WAN 2", lost)
+	}
+
+	// Past the deadline packets are given up on
+	now = now.Add(time.Second)
+	if lost := r.Lost(missing, now, rtt); len(lost) != 0 {
+		t.Fatalf("lost = %+v after the deadline", lost)
+	}
+
+	r.Recovered(1, 30*time.Millisecond)
+	r.Recovered(1, 10*time.Millisecond)
+
+	stats := r.Stats()
+	if s := stats[1]; s.Lost != 1 || s.Retransmits != 0 || s.Expired != 0 || s.Recovered != 2 || s.RecoveryTime != 20*time.Millisecond {
+		t.Errorf("WAN 1 stats = %+v", s)
+	}
+	if s := stats[2]; s.Lost != 1 || s.Retransmits != 1 || s.Expired != 2 {
+		t.Errorf("WAN 2 stats = %+v", s)
+	}
+}
+
+func TestRetransmitterForgetsOldPackets(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewRetransmitter(time.Second)
+	r.maxPackets = 4
+
+	for seq := uint64(1); seq <= 6; seq++ {
+		r.Sent(&protocol.Packet{SequenceID: seq}, 1, now)
+	}
+	if len(r.packets) != 4 || r.packets[2] != nil || r.packets[3] == nil {
+		t.Fatalf("kept %d packets", len(r.packets))
+	}
+
+	r.Sent(&protocol.Packet{SequenceID: 7}, 1, now.Add(time.Second))
+	if len(r.packets) != 1 || r.packets[7] == nil {
+		t.Fatalf("kept %d packets after the deadline", len(r.packets))
+	}
+}
@@ -0,0 +1,141 @@
+package bandwidth
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// deliver delivers size byte packets at rate bytes/sec for d
+func deliver(e *Estimator, now time.Time, rate float64, size int, d time.Duration) time.Time {
+	gap := time.Duration(float64(size) / rate * float64(time.Second))
+	for end := now.Add(d); now.Before(end); now = now.Add(gap) {
+		e.Delivered(size, now)
+	}
+	return now
+}
+
+func near(got, want float64) bool {
+	return math.Abs(got-want) <= want*0.02
+}
+
+func TestEstimatorDeliveryRate(t *testing.T) {
+	now := time.Unix(0, 0)
+	e := NewEstimator(2 * time.Second)
+
+	if rate := e.Rate(now); rate != 0 {
+		t.Fatalf("rate = %v before any traffic", rate)
+	}
+
+	now = deliver(e, now, 1_000_000, 1000, time.Second)
+	if rate := e.Rate(now); !near(rate, 1_000_000) {
+		t.Fatalf("rate = %v, want 1000000", rate)
+	}
+
+	// Lighter traffic does not lower the estimate within the window
+	now = deliver(e, now, 200_000, 1000, time.Second)
+	if rate := e.Rate(now); !near(rate, 1_000_000) {
+		t.Fatalf("rate = %v during the window, want 1000000", rate)
+	}
+	now = deliver(e, now, 200_000, 1000, 2*time.Second)
+	if rate := e.Rate(now); !near(rate, 200_000) {
+		t.Fatalf("rate = %v after the window, want 200000", rate)
+	}
+
+	// Faster delivery raises it at once
+	now = deliver(e, now, 3_000_000, 1000, time.Second)
+	if rate := e.Rate(now); !near(rate, 3_000_000) {
+		t.Fatalf("rate = %v, want 3000000", rate)
+	}
+
+	// Once traffic stops the estimate holds
+	if rate := e.Rate(now.Add(time.Minute)); !near(rate, 3_000_000) {
+		t.Fatalf("rate = %v while idle, want 3000000", rate)
+	}
+}
+
+func TestEstimatorAcksAndTrains(t *testing.T) {
+	now := time.Unix(0, 0)
+	e := NewEstimator(0)
+
+	// Acks carry cumulative counts, starting from whatever came before
+	total := uint64(1 << 20)
+	for i := 0; i < 100; i++ {
+		e.Acked(total, now)
+		e.Acked(total-500, now) // Reordered
+		total += 5000
+		now = now.Add(10 * time.Millisecond)
+	}
+	if rate := e.Rate(now); !near(rate, 500_000) {
+		t.Fatalf("rate = %v, want 500000", rate)
+	}
+
+	// A train measures the capacity beyond the traffic, and a smaller one
+	// after the path slowed down replaces the estimate
+	e.Measured(4_000_000, now)
+	if rate := e.Rate(now); rate != 4_000_000 {
+		t.Fatalf("rate = %v after a train, want 4000000", rate)
+	}
+	e.Measured(2_000_000, now)
+	if rate := e.Rate(now); rate != 2_000_000 {
+		t.Fatalf("rate = %v after a second train, want 2000000", rate)
+	}
+}
+
+func TestTrainMeter(t *testing.T) {
+	now := time.Unix(0, 0)
+	m := NewTrainMeter()
+
+	// 1000 byte packets 1ms apart: 1000000 bytes/sec
+	var result TrainResult
+	var ok bool
+	for i := 0; i < TrainLength; i++ {
+		if ok {
+			t.Fatalf("train done after %d packets", i)
+		}
+		result, ok = m.Received(1, 7, 1000, now)
+		m.Received(2, 7, 1000, now) // Another WAN's train of the same ID
+		now = now.Add(time.Millisecond)
+	}
+	if !ok || result.WANID != 1 || result.ID != 7 || !near(result.Rate, 1_000_000) {
+		t.Fatalf("result = %+v, %v", result, ok)
+	}
+
+	// The train on WAN 2 arrived all at once and cannot be measured
+	now = now.Add(time.Millisecond)
+	if _, ok := m.Received(2, 7, 1000, now); ok {
+		t.Fatal("measured a train without spread")
+	}
+
+	// A train that lost packets is measured once the rest are overdue
+	for i := 0; i < TrainLength/2; i++ {
+		m.Received(1, 8, 500, now)
+		now = now.Add(time.Millisecond)
+	}
+	if results := m.Expire(now); len(results) != 0 {
+		t.Fatalf("results = %+v before the timeout", results)
+	}
+	results := m.Expire(now.Add(TrainTimeout))
+	if len(results) != 1 || results[0].ID != 8 || !near(results[0].Rate, 500_000) {
+		t.Fatalf("results = %+v, want train 8 at 500000", results)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(0, 0)
+	var tb TokenBucket
+
+	// A new bucket holds a second's worth
+	if !tb.Take(600, 1000, now) || tb.Take(600, 1000, now) {
+		t.Fatal("new bucket does not hold exactly a second of 1000 B/s")
+	}
+
+	// Overdrawn buckets pay off the debt first
+	tb.Charge(1400, 1000, now)
+	if tb.Has(1, 1000, now.Add(time.Second)) {
+		t.Error("bucket holds bytes while in debt")
+	}
+	if !tb.Has(500, 1000, now.Add(1500*time.Millisecond)) {
+		t.Error("bucket did not refill after the debt")
+	}
+}
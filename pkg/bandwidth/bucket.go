@@ -0,0 +1,40 @@
+package bandwidth
+
+import "time"
+
+// TokenBucket limits traffic to a byte rate, with up to a second of burst.
+// The zero value is a full bucket. A TokenBucket is not safe for concurrent
+// use.
+type TokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the bytes earned at rate bytes/sec since the bucket was last used
+func (tb *TokenBucket) refill(rate uint64, now time.Time) {
+	tb.tokens = min(tb.tokens+now.Sub(tb.last).Seconds()*float64(rate), float64(rate))
+	tb.last = now
+}
+
+// Has reports whether the bucket holds n bytes
+func (tb *TokenBucket) Has(n int, rate uint64, now time.Time) bool {
+	tb.refill(rate, now)
+	return tb.tokens >= float64(n)
+}
+
+// Charge removes n bytes from the bucket, overdrawing it if it holds fewer;
+// the bucket holds no bytes again until the debt is paid off
+func (tb *TokenBucket) Charge(n int, rate uint64, now time.Time) {
+	tb.refill(rate, now)
+	tb.tokens -= float64(n)
+}
+
+// Take removes n bytes from the bucket if it holds them
+func (tb *TokenBucket) Take(n int, rate uint64, now time.Time) bool {
+	tb.refill(rate, now)
+	if tb.tokens < float64(n) {
+		return false
+	}
+	tb.tokens -= float64(n)
+	return true
+}
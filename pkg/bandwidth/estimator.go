@@ -0,0 +1,145 @@
+// Package bandwidth estimates the capacity of WAN paths.
+//
+// Estimates combine two kinds of measurement. Passively, the rate at which
+// data is delivered is sampled from the traffic the receiver acknowledges;
+// the largest sample over a window is the estimate, as in BBR, since a path
+// delivers no faster than its capacity. Passive samples only see the traffic
+// there is, so a lightly used path is underestimated. Actively, a packet
+// train of TrainLength back-to-back packets is sent on demand: the rate at
+// which the receiver sees them arrive is the capacity of the path's
+// bottleneck, whatever the traffic. A train measurement replaces the
+// estimate, and later passive samples above it raise it again.
+package bandwidth
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultWindow is how long a delivery rate sample counts towards the estimate
+	DefaultWindow = 10 * time.Second
+	// SampleInterval is the shortest interval a delivery rate sample spans,
+	// which evens out acks that arrive in bursts
+	SampleInterval = 250 * time.Millisecond
+)
+
+// Config configures bandwidth estimation. Zero values select the defaults.
+type Config struct {
+	Window        time.Duration // How long a sample counts towards the estimate
+	ProbeInterval time.Duration // How often probe trains are sent; 0 only on demand
+}
+
+// sample is a delivery rate measurement
+type sample struct {
+	rate float64
+	at   time.Time
+}
+
+// Estimator estimates the capacity of one direction of a path
+type Estimator struct {
+	mu      sync.Mutex
+	window  time.Duration
+	samples []sample // Falling rates, oldest first: the first is the estimate
+
+	from  time.Time // Start of the current sampling interval
+	last  time.Time // When data was last delivered
+	bytes uint64    // Bytes delivered in the current sampling interval
+
+	acked    bool   // A cumulative byte count has been seen
+	received uint64 // The last cumulative byte count
+}
+
+// NewEstimator creates an estimator whose samples count for window
+func NewEstimator(window time.Duration) *Estimator {
+	if window <= 0 {
+		window = DefaultWindow
+	}
+	return &Estimator{window: window}
+}
+
+// Delivered records bytes delivered over the path at the given time
+func (e *Estimator) Delivered(bytes int, now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.delivered(uint64(bytes), now)
+}
+
+// Acked records the receiver's total count of bytes delivered, as carried in
+// acks. The first count only sets the baseline; counts below the last one
+// are acks that were reordered and are ignored.
+func (e *Estimator) Acked(total uint64, now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.acked {
+		e.acked = true
+		e.received = total
+		return
+	}
+	if total <= e.received {
+		return
+	}
+	e.delivered(total-e.received, now)
+	e.received = total
+}
+
+// Measured records the rate a probe train measured, which replaces the estimate
+func (e *Estimator) Measured(rate float64, now time.Time) {
+	if rate <= 0 {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.samples = append(e.samples[:0], sample{rate: rate, at: now})
+}
+
+// Rate returns the estimated capacity in bytes/sec, or 0 when there is no
+// estimate yet. Once traffic stops the estimate holds.
+func (e *Estimator) Rate(now time.Time) float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.expire(now)
+	if len(e.samples) == 0 {
+		return 0
+	}
+	return e.samples[0].rate
+}
+
+// delivered adds delivered bytes to the current sampling interval and takes
+// a sample once the interval is long enough
+func (e *Estimator) delivered(bytes uint64, now time.Time) {
+	if e.from.IsZero() || now.Sub(e.last) > SampleInterval {
+		// Time the path spent idle says nothing about its capacity
+		e.from, e.bytes = now, 0
+	} else {
+		e.bytes += bytes
+	}
+	e.last = now
+
+	if elapsed := now.Sub(e.from); elapsed >= SampleInterval {
+		e.add(float64(e.bytes)/elapsed.Seconds(), now)
+		e.from, e.bytes = now, 0
+	}
+}
+
+// add adds a sample, dropping the older samples it outranks
+func (e *Estimator) add(rate float64, now time.Time) {
+	n := len(e.samples)
+	for n > 0 && e.samples[n-1].rate <= rate {
+		n--
+	}
+	e.samples = append(e.samples[:n], sample{rate: rate, at: now})
+	e.expire(now)
+}
+
+// expire drops samples older than the window, keeping the newest
+func (e *Estimator) expire(now time.Time) {
+	n := 0
+	for n < len(e.samples)-1 && now.Sub(e.samples[n].at) > e.window {
+		n++
+	}
+	e.samples = e.samples[n:]
+}
@@ -0,0 +1,110 @@
+package bandwidth
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// TrainLength is how many packets a probe train has
+	TrainLength = 16
+	// TrainTimeout is how long the missing packets of a train are waited for
+	// after the last one arrived
+	TrainTimeout = 500 * time.Millisecond
+	// maxTrains is how many trains may be measured at once
+	maxTrains = 64
+)
+
+// TrainResult is the rate a probe train arrived at
+type TrainResult struct {
+	WANID uint8
+	ID    uint32
+	Rate  float64 // Bytes/sec
+}
+
+// trainKey identifies a train
+type trainKey struct {
+	wanID uint8
+	id    uint32
+}
+
+// train collects the arrivals of one train
+type train struct {
+	first     time.Time
+	last      time.Time
+	packets   int
+	bytes     int // Bytes of the packets after the first
+	firstSize int
+}
+
+// rate returns the rate the packets arrived at, or 0 when it cannot be told
+func (t *train) rate() float64 {
+	spread := t.last.Sub(t.first)
+	if t.packets < 2 || spread <= 0 {
+		return 0
+	}
+	return float64(t.bytes) / spread.Seconds()
+}
+
+// TrainMeter measures the rate probe trains arrive at. The packets of a
+// train leave back to back, so the bottleneck of the path spaces them out by
+// the time it takes to carry each: the bytes after the first packet divided
+// by the time between the first and last arrival is the bottleneck's
+// capacity. Lost packets shorten the train but do not skew it.
+type TrainMeter struct {
+	mu     sync.Mutex
+	trains map[trainKey]*train
+}
+
+// NewTrainMeter creates a train meter
+func NewTrainMeter() *TrainMeter {
+	return &TrainMeter{trains: make(map[trainKey]*train)}
+}
+
+// Received records a packet of size bytes of a train arriving on a WAN. Once
+// all TrainLength packets have arrived it returns the train's result, if the
+// arrivals were spread enough to measure.
+func (m *TrainMeter) Received(wanID uint8, id uint32, size int, now time.Time) (TrainResult, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := trainKey{wanID: wanID, id: id}
+	t, exists := m.trains[key]
+	if !exists {
+		if len(m.trains) >= maxTrains {
+			return TrainResult{}, false
+		}
+		m.trains[key] = &train{first: now, last: now, packets: 1, firstSize: size}
+		return TrainResult{}, false
+	}
+
+	t.last = now
+	t.packets++
+	t.bytes += size
+	if t.packets < TrainLength {
+		return TrainResult{}, false
+	}
+
+	delete(m.trains, key)
+	rate := t.rate()
+	return TrainResult{WANID: wanID, ID: id, Rate: rate}, rate > 0
+}
+
+// Expire returns the results of trains whose missing packets are overdue,
+// measured from the packets that arrived
+func (m *TrainMeter) Expire(now time.Time) []TrainResult {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var results []TrainResult
+	for key, t := range m.trains {
+		if now.Sub(t.last) < TrainTimeout {
+			continue
+		}
+		delete(m.trains, key)
+		if rate := t.rate(); rate > 0 {
+			results = append(results, TrainResult{WANID: key.wanID, ID: key.id, Rate: rate})
+		}
+	}
+	return results
+}
@@ -0,0 +1,213 @@
+package bonder
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/bandwidth"
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+)
+
+// bandwidthInterval is how often bandwidth estimates are published and
+// overdue probe trains measured
+const bandwidthInterval = 250 * time.Millisecond
+
+// wanBandwidth estimates the capacity of one WAN in both directions
+type wanBandwidth struct {
+	up       *bandwidth.Estimator // Towards the peer, from acks and the peer's train reports
+	down     *bandwidth.Estimator // From the peer, from received data and the peer's trains
+	probedAt time.Time            // When probe trains were last asked for
+}
+
+// addEstimator starts estimating the capacity of a new WAN. b.mu must be held.
+func (b *Bonder) addEstimator(wan *protocol.WANInterface) {
+	if b.bandwidthCfg == nil {
+		return
+	}
+	b.estimators[wan.ID] = &wanBandwidth{
+		up:   bandwidth.NewEstimator(b.bandwidthCfg.Window),
+		down: bandwidth.NewEstimator(b.bandwidthCfg.Window),
+	}
+}
+
+// removeEstimator stops estimating the capacity of a removed WAN. b.mu must be held.
+func (b *Bonder) removeEstimator(wanID uint8) {
+	delete(b.estimators, wanID)
+}
+
+// estimator returns the capacity estimates of a WAN, or nil when estimation
+// is disabled
+func (b *Bonder) estimator(wanID uint8) *wanBandwidth {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.estimators[wanID]
+}
+
+// bandwidthAcked samples the upload rate of a WAN from an ack of its data
+func (b *Bonder) bandwidthAcked(wanID uint8, ack *protocol.Ack, received time.Time) {
+	if e := b.estimator(wanID); e != nil {
+		e.up.Acked(ack.Bytes, received)
+	}
+}
+
+// bandwidthReceived samples the download rate of a WAN from data received on it
+func (b *Bonder) bandwidthReceived(wanID uint8, pkt *protocol.Packet, received time.Time) {
+	if e := b.estimator(wanID); e != nil {
+		e.down.Delivered(len(pkt.Data), received)
+	}
+}
+
+// bandwidthLoop measures overdue probe trains, sends the periodic probes and
+// publishes the estimates to the health checker and router
+func (b *Bonder) bandwidthLoop() {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(bandwidthInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+
+		case now := <-ticker.C:
+			for _, result := range b.trains.Expire(now) {
+				b.trainMeasured(result, now)
+			}
+			if b.bandwidthCfg.ProbeInterval > 0 {
+				b.probeDue(now)
+			}
+			b.publishBandwidth(now)
+		}
+	}
+}
+
+// probeDue probes the WANs whose last probe is older than the probe interval
+func (b *Bonder) probeDue(now time.Time) {
+	if !b.peerBandwidth.Load() || !b.SessionEstablished() {
+		return
+	}
+
+	for _, wan := range b.usableWANs() {
+		b.mu.RLock()
+		e := b.estimators[wan.ID]
+		due := e != nil && now.Sub(e.probedAt) >= b.bandwidthCfg.ProbeInterval
+		b.mu.RUnlock()
+
+		if due {
+			b.ProbeBandwidth(wan.ID)
+		}
+	}
+}
+
+// publishBandwidth hands the current estimates to the health checker, and
+// the metrics that include them to the router so its weights follow them
+func (b *Bonder) publishBandwidth(now time.Time) {
+	b.mu.RLock()
+	estimates := make(map[uint8]*wanBandwidth, len(b.estimators))
+	for id, e := range b.estimators {
+		estimates[id] = e
+	}
+	b.mu.RUnlock()
+
+	for id, e := range estimates {
+		b.healthChecker.SetBandwidth(id, uint64(e.up.Rate(now)), uint64(e.down.Rate(now)))
+		if metrics, err := b.healthChecker.GetMetrics(id); err == nil {
+			b.router.UpdateMetrics(id, metrics)
+		}
+	}
+}
+
+// ProbeBandwidth measures the capacity of a WAN in both directions with
+// probe trains: one sent to the peer, which reports the rate it arrived at,
+// and one the peer is asked to send
+func (b *Bonder) ProbeBandwidth(wanID uint8) error {
+	if b.bandwidthCfg == nil {
+		return fmt.Errorf("bandwidth estimation disabled")
+	}
+	if !b.peerBandwidth.Load() {
+		return fmt.Errorf("peer does not support bandwidth probes")
+	}
+
+	b.mu.Lock()
+	wan := b.wans[wanID]
+	e := b.estimators[wanID]
+	if e != nil {
+		e.probedAt = time.Now()
+	}
+	b.mu.Unlock()
+
+	if wan == nil || wan.Conn == nil || wan.RemoteAddr == nil {
+		return fmt.Errorf("WAN %d not found", wanID)
+	}
+
+	if err := b.sendControl(wan, wan.RemoteAddr, &protocol.BandwidthProbe{WANID: wanID}); err != nil {
+		return err
+	}
+	return b.sendTrain(wan)
+}
+
+// sendTrain sends a probe train on a WAN: TrainLength heartbeats padded to
+// the WAN's path MTU, back to back and ahead of any pacing
+func (b *Bonder) sendTrain(wan *protocol.WANInterface) error {
+	id := b.trainID.Add(1)
+	size := b.pathMTU(wan.ID)
+
+	for i := 0; i < bandwidth.TrainLength; i++ {
+		hb := &protocol.Heartbeat{
+			Flags: protocol.HeartbeatTrain,
+			Seq:   id,
+			Sent:  time.Now().UnixNano(),
+		}
+		if err := b.sendPaddedHeartbeat(wan, hb, size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleTrain measures a packet of a probe train from the peer
+func (b *Bonder) handleTrain(wan *protocol.WANInterface, hb *protocol.Heartbeat, size int, received time.Time) {
+	if b.bandwidthCfg == nil {
+		return
+	}
+	if result, ok := b.trains.Received(wan.ID, hb.Seq, size, received); ok {
+		b.trainMeasured(result, received)
+	}
+}
+
+// trainMeasured records the rate a probe train from the peer arrived at as
+// the download capacity of its WAN, and reports it to the peer, for which it
+// is the upload capacity
+func (b *Bonder) trainMeasured(result bandwidth.TrainResult, now time.Time) {
+	b.mu.RLock()
+	wan := b.wans[result.WANID]
+	e := b.estimators[result.WANID]
+	b.mu.RUnlock()
+
+	if e != nil {
+		e.down.Measured(result.Rate, now)
+	}
+	if wan != nil && wan.Conn != nil && wan.RemoteAddr != nil {
+		b.sendControl(wan, wan.RemoteAddr, &protocol.BandwidthReport{WANID: result.WANID, Train: result.ID, Rate: uint64(result.Rate)})
+	}
+}
+
+// handleBandwidthProbe answers the peer's request for a probe train on the
+// WAN the request came in on
+func (b *Bonder) handleBandwidthProbe(wan *protocol.WANInterface, msg protocol.ControlMessage, addr *net.UDPAddr) {
+	if b.bandwidthCfg == nil || msg.(*protocol.BandwidthProbe).WANID != wan.ID {
+		return
+	}
+	b.sendTrain(wan)
+}
+
+// handleBandwidthReport records the rate the peer measured for one of our
+// probe trains as the upload capacity of its WAN
+func (b *Bonder) handleBandwidthReport(wan *protocol.WANInterface, msg protocol.ControlMessage, addr *net.UDPAddr) {
+	m := msg.(*protocol.BandwidthReport)
+	if e := b.estimator(m.WANID); e != nil {
+		e.up.Measured(float64(m.Rate), time.Now())
+	}
+}
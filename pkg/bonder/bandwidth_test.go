@@ -0,0 +1,44 @@
+package bonder
+
+import (
+	"context"
+	"testing"
+)
+
+func TestBandwidthProbesMeasureBothDirections(t *testing.T) {
+	client, server := newLoopbackPair(t)
+
+	ctx := context.Background()
+	if err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	waitFor(t, "bandwidth probe support", client.peerBandwidth.Load)
+
+	if err := client.ProbeBandwidth(1); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "capacity estimates", func() bool {
+		m := client.GetMetrics()[1]
+		return m != nil && m.BandwidthUp > 0 && m.BandwidthDown > 0
+	})
+
+	m := client.GetMetrics()[1]
+	if m.Bandwidth != m.BandwidthUp {
+		t.Errorf("bandwidth = %d, want the upload estimate %d", m.Bandwidth, m.BandwidthUp)
+	}
+	// The server measured the client's train, which is its download
+	waitFor(t, "server download estimate", func() bool {
+		m := server.GetMetrics()[1]
+		return m != nil && m.BandwidthDown > 0
+	})
+
+	if err := client.ProbeBandwidth(9); err == nil {
+		t.Error("probed a WAN that does not exist")
+	}
+}
@@ -0,0 +1,287 @@
+package bonder
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/nat"
+	"github.com/thelastdreamer/MultiWANBond/pkg/packet"
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+)
+
+// bindingRetryInterval is how often a WAN whose NAT binding lifetime is due
+// to be measured checks whether the peer can help yet
+const bindingRetryInterval = time.Second
+
+// bindingRecord is a NAT binding lifetime measured on a WAN, as kept in the
+// binding state file
+type bindingRecord struct {
+	Name     string    `json:"name"`     // Name of the WAN, which must match for the record to apply
+	Lifetime string    `json:"lifetime"` // e.g., "1m36s"
+	Measured time.Time `json:"measured"`
+}
+
+// loadBindings reads the NAT binding lifetimes kept in a binding state
+// file. A file that does not exist yet holds none.
+func loadBindings(path string) (map[uint8]bindingRecord, error) {
+	bindings := make(map[uint8]bindingRecord)
+	if path == "" {
+		return bindings, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return bindings, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &bindings); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return bindings, nil
+}
+
+// saveBindings writes the NAT binding lifetimes to the binding state file,
+// replacing it in one step. b.bindingMu must be held.
+func (b *Bonder) saveBindings() error {
+	if b.bindingFile == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(b.bindings, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal binding state: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(b.bindingFile), filepath.Base(b.bindingFile)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write binding state: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write binding state: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write binding state: %w", err)
+	}
+	return os.Rename(tmp.Name(), b.bindingFile)
+}
+
+// storedBinding returns the NAT binding lifetime last measured on a WAN and
+// when it was measured, or false when there is none for the WAN
+func (b *Bonder) storedBinding(wan *protocol.WANInterface) (time.Duration, time.Time, bool) {
+	b.bindingMu.Lock()
+	record, exists := b.bindings[wan.ID]
+	b.bindingMu.Unlock()
+
+	if !exists || record.Name != wan.Name {
+		return 0, time.Time{}, false
+	}
+	lifetime, err := time.ParseDuration(record.Lifetime)
+	if err != nil || lifetime <= 0 {
+		return 0, time.Time{}, false
+	}
+	return lifetime, record.Measured, true
+}
+
+// storeBinding keeps a NAT binding lifetime measured on a WAN
+func (b *Bonder) storeBinding(wan *protocol.WANInterface, lifetime time.Duration, measured time.Time) error {
+	b.bindingMu.Lock()
+	defer b.bindingMu.Unlock()
+
+	b.bindings[wan.ID] = bindingRecord{Name: wan.Name, Lifetime: lifetime.String(), Measured: measured}
+	return b.saveBindings()
+}
+
+// applyBindingLifetime keeps a WAN's NAT binding alive at its lifetime,
+// with both NAT keep-alives and heartbeats
+func (b *Bonder) applyBindingLifetime(wan *protocol.WANInterface, mgr *nat.Manager, lifetime time.Duration) {
+	mgr.SetBindingLifetime(lifetime)
+	b.healthChecker.SetMaxInterval(wan.ID, lifetime)
+}
+
+// bindingLoop measures how long a WAN's NAT binding survives idle, once the
+// peer can answer binding probes, and measures it again when the lifetime
+// gets old. A lifetime measured before, on an earlier run, applies until then.
+func (b *Bonder) bindingLoop(wan *protocol.WANInterface, mgr *nat.Manager) {
+	defer b.wg.Done()
+
+	ctx, cancel := context.WithCancel(b.ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-mgr.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	cfg := b.natCfg.Binding
+	due := time.Now()
+	if lifetime, measured, ok := b.storedBinding(wan); ok {
+		b.applyBindingLifetime(wan, mgr, lifetime)
+		due = measured.Add(cfg.Interval)
+	}
+
+	timer := time.NewTimer(time.Until(due))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		if !b.canProbeBinding(wan) {
+			timer.Reset(bindingRetryInterval)
+			continue
+		}
+
+		results, err := nat.MeasureBindingLifetime(ctx, cfg, b.bindingTest(wan))
+		if err != nil {
+			timer.Reset(bindingRetryInterval)
+			continue
+		}
+
+		measured := time.Now()
+		if lifetime := mgr.ApplyBindingProbes(results); lifetime > 0 {
+			b.healthChecker.SetMaxInterval(wan.ID, lifetime)
+			if err := b.storeBinding(wan, lifetime, measured); err != nil {
+				b.pluginManager.Alert(protocol.AlertLevelWarning, "NAT binding state not saved", map[string]interface{}{
+					"wan_id": wan.ID,
+					"error":  err.Error(),
+				})
+			}
+		}
+		timer.Reset(cfg.Interval)
+	}
+}
+
+// canProbeBinding reports whether the peer can answer binding probes on a
+// WAN. A relayed WAN's traffic does not go through the NAT binding probed.
+func (b *Bonder) canProbeBinding(wan *protocol.WANInterface) bool {
+	if !b.peerBindings.Load() || !b.SessionEstablished() {
+		return false
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return wan.RemoteAddr != nil && wan.Conn != nil && wan.Relay == nil
+}
+
+// bindingTest returns the test of a fresh NAT binding of a WAN: a binding
+// probe sent from a new socket on the WAN's address, which stays silent
+// until the peer answers after the idle time, if the binding lets it through
+func (b *Bonder) bindingTest(wan *protocol.WANInterface) nat.BindingTest {
+	return func(ctx context.Context, idle time.Duration) (bool, error) {
+		b.mu.RLock()
+		local, remote := wan.Conn.LocalAddr().(*net.UDPAddr), wan.RemoteAddr
+		b.mu.RUnlock()
+
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP, Zone: local.Zone})
+		if err != nil {
+			return false, err
+		}
+		defer conn.Close()
+
+		// Stop waiting when the measurement is called off
+		stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+		defer stop()
+
+		id := b.bindingProbeID.Add(1)
+		if err := b.sendBindingProbe(conn, wan, remote, &protocol.BindingProbe{WANID: wan.ID, Probe: id, Idle: idle}); err != nil {
+			return false, err
+		}
+
+		conn.SetReadDeadline(time.Now().Add(idle + b.natCfg.Binding.Timeout))
+		buf := make([]byte, protocol.MaxPacketSize)
+		for {
+			n, _, err := conn.ReadFromUDP(buf)
+			if ctx.Err() != nil {
+				return false, ctx.Err()
+			}
+			if err != nil {
+				// No answer: the binding expired
+				return false, nil
+			}
+
+			pkt, err := b.decode(buf[:n])
+			if err != nil || pkt.Type != protocol.PacketTypeControl {
+				continue
+			}
+			msg, err := protocol.DecodeControl(pkt.Data)
+			if err != nil {
+				continue
+			}
+			if answer, ok := msg.(*protocol.BindingProbe); ok && answer.Reply && answer.Probe == id {
+				return true, nil
+			}
+		}
+	}
+}
+
+// sendBindingProbe sends a binding probe from a probing socket of a WAN
+func (b *Bonder) sendBindingProbe(conn *net.UDPConn, wan *protocol.WANInterface, addr *net.UDPAddr, probe *protocol.BindingProbe) error {
+	pkt := &protocol.Packet{
+		Version:   protocol.ProtocolVersion,
+		Type:      protocol.PacketTypeControl,
+		SessionID: b.session.ID,
+		Timestamp: time.Now().UnixNano(),
+		WANID:     wan.ID,
+		Priority:  255,
+		Data:      protocol.EncodeControl(probe),
+	}
+
+	encoded, err := b.processor.Encode(pkt)
+	if err != nil {
+		return err
+	}
+	if b.tunnelCipher != nil {
+		if encoded, err = packet.Seal(b.tunnelCipher, encoded); err != nil {
+			return fmt.Errorf("encrypt error: %w", err)
+		}
+	}
+
+	_, err = conn.WriteToUDP(encoded, addr)
+	return err
+}
+
+// handleBindingProbe answers the peer's binding probes once they have been
+// idle as long as they ask, at the address they came from. Probes beyond
+// protocol.MaxPendingBindingProbes waiting on a WAN are dropped.
+func (b *Bonder) handleBindingProbe(wan *protocol.WANInterface, msg protocol.ControlMessage, addr *net.UDPAddr) {
+	probe := msg.(*protocol.BindingProbe)
+	if probe.Reply || probe.Idle > protocol.MaxBindingProbeIdle {
+		return
+	}
+
+	b.bindingMu.Lock()
+	if b.bindingAnswers[wan.ID] >= protocol.MaxPendingBindingProbes {
+		b.bindingMu.Unlock()
+		return
+	}
+	b.bindingAnswers[wan.ID]++
+	b.bindingMu.Unlock()
+
+	reply := *probe
+	reply.Reply = true
+	time.AfterFunc(probe.Idle, func() {
+		b.bindingMu.Lock()
+		b.bindingAnswers[wan.ID]--
+		b.bindingMu.Unlock()
+
+		if b.ctx.Err() == nil {
+			b.sendControl(wan, addr, &reply)
+		}
+	})
+}
@@ -0,0 +1,124 @@
+package bonder
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/config"
+	"github.com/thelastdreamer/MultiWANBond/pkg/nat"
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+)
+
+func TestBindingLifetimeMeasuredAndKept(t *testing.T) {
+	stun := nat.NewSTUNServer(&nat.STUNServerConfig{Address: "127.0.0.1:0"})
+	if err := stun.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stun.Stop()
+
+	cfg := config.DefaultConfig()
+	cfg.NAT = &config.NATConfig{Enabled: true, STUNServer: stun.LocalAddr().String(), ProbeBindings: true}
+	client, server := newLoopbackPairWith(t, cfg, testConfig())
+
+	// Loopback bindings never expire, so the lifetime comes out at the
+	// longest idle time probed, less the safety margin
+	client.natCfg.Binding = &nat.BindingProbeConfig{
+		MinIdle:    50 * time.Millisecond,
+		MaxIdle:    200 * time.Millisecond,
+		Resolution: 10 * time.Millisecond,
+		Timeout:    500 * time.Millisecond,
+		Interval:   time.Hour,
+	}
+	client.bindingFile = filepath.Join(t.TempDir(), "nat_bindings.json")
+	want := 160 * time.Millisecond
+
+	ctx := context.Background()
+	if err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	waitFor(t, "the peer's binding probe support", client.peerBindings.Load)
+	mgr := client.GetNATManager(1)
+	waitFor(t, "the binding lifetime", func() bool { return mgr.GetBindingLifetime() > 0 })
+	if lifetime := mgr.GetBindingLifetime(); lifetime != want {
+		t.Fatalf("binding lifetime = %v, want %v", lifetime, want)
+	}
+	if interval := mgr.GetKeepAliveInterval(); interval != want {
+		t.Errorf("keep-alive interval = %v, want %v", interval, want)
+	}
+
+	// Probes do not take over the WAN on the peer
+	server.mu.RLock()
+	remote := server.wans[1].RemoteAddr
+	server.mu.RUnlock()
+	if remote.String() != client.wans[1].Conn.LocalAddr().String() {
+		t.Errorf("peer sends to %s, want the WAN's %s", remote, client.wans[1].Conn.LocalAddr())
+	}
+
+	waitFor(t, "the binding state file", func() bool {
+		_, err := os.Stat(client.bindingFile)
+		return err == nil
+	})
+
+	// The next run picks the lifetime up without probing again
+	cfg.NAT.BindingStateFile = client.bindingFile
+	restarted, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.AddWAN(&protocol.WANInterface{
+		ID:        1,
+		Name:      "lo",
+		LocalAddr: net.IPv4(127, 0, 0, 1),
+		Metrics:   &protocol.WANMetrics{},
+		State:     protocol.WANStateUp,
+		Config:    protocol.WANConfig{Enabled: true, Weight: 1, HealthCheckInterval: time.Hour},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Stop()
+
+	mgr = restarted.GetNATManager(1)
+	waitFor(t, "the kept binding lifetime", func() bool { return mgr.GetBindingLifetime() == want })
+}
+
+func TestBindingStateIgnoresRedefinedWANs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nat_bindings.json")
+	if err := os.WriteFile(path, []byte(`{"1": {"name": "lte0", "lifetime": "1m36s", "measured": "2026-01-02T03:04:05Z"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.DefaultConfig()
+	cfg.NAT.ProbeBindings = true
+	cfg.NAT.BindingStateFile = path
+	b, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lifetime, measured, ok := b.storedBinding(&protocol.WANInterface{ID: 1, Name: "lte0"})
+	if !ok || lifetime != 96*time.Second || !measured.Equal(time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Errorf("stored binding = %v measured %v (%v)", lifetime, measured, ok)
+	}
+	if _, _, ok := b.storedBinding(&protocol.WANInterface{ID: 1, Name: "fiber0"}); ok {
+		t.Error("binding of another WAN applied")
+	}
+
+	// A corrupt state file is reported rather than overwritten
+	os.WriteFile(path, []byte("{"), 0644)
+	if _, err := New(cfg); err == nil {
+		t.Error("corrupt binding state accepted")
+	}
+}
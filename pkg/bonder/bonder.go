@@ -4,19 +4,27 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/thelastdreamer/MultiWANBond/pkg/arq"
+	"github.com/thelastdreamer/MultiWANBond/pkg/bandwidth"
 	"github.com/thelastdreamer/MultiWANBond/pkg/config"
+	"github.com/thelastdreamer/MultiWANBond/pkg/congestion"
 	"github.com/thelastdreamer/MultiWANBond/pkg/dpi"
 	"github.com/thelastdreamer/MultiWANBond/pkg/fec"
 	"github.com/thelastdreamer/MultiWANBond/pkg/health"
 	"github.com/thelastdreamer/MultiWANBond/pkg/nat"
+	"github.com/thelastdreamer/MultiWANBond/pkg/network/ipconfig"
+	"github.com/thelastdreamer/MultiWANBond/pkg/network/tun"
 	"github.com/thelastdreamer/MultiWANBond/pkg/packet"
 	"github.com/thelastdreamer/MultiWANBond/pkg/plugin"
+	"github.com/thelastdreamer/MultiWANBond/pkg/pmtud"
 	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
 	"github.com/thelastdreamer/MultiWANBond/pkg/router"
+	"github.com/thelastdreamer/MultiWANBond/pkg/security"
 )
 
 // Bonder is the main bonding implementation
@@ -25,11 +33,53 @@ type Bonder struct {
 	session         *protocol.Session
 	healthChecker   *health.Checker
 	router          *router.Router
+	failover        *router.FailoverManager
+	failoverHandler FailoverHandler
+	policies        *router.PolicyEngine
+	duplicator      *router.Duplicator
+	duplicateAll    atomic.Bool // Negotiated SessionConfig.DuplicatePackets
+	priorities      *packet.PriorityMap
+	congestionCfg   *congestion.Config    // nil when congestion control is disabled
+	paths           map[uint8]*pathSender // Per-WAN congestion controllers
+	acks            *congestion.AckTracker
+	peerAcks        atomic.Bool // The peer acks data packets
+	retransmitter   *arq.Retransmitter
+	retransmit      atomic.Bool             // SessionConfig.Retransmit
+	peerRetransmits atomic.Bool             // The peer resends the packets reported missing in acks
+	lastNack        atomic.Int64            // When missing packets were last reported, in Unix nanoseconds
+	mtuCfg          *pmtud.Config           // nil when path MTU discovery is disabled
+	probers         map[uint8]*pmtud.Prober // Per-WAN path MTU discovery
+	announcedMTUs   map[uint8]int           // Path MTUs last acted on
+	peerFragments   atomic.Bool             // The peer reassembles fragmented packets
+	fragmentID      atomic.Uint32
+	reassembler     *packet.Reassembler
+	bandwidthCfg    *bandwidth.Config       // nil when bandwidth estimation is disabled
+	estimators      map[uint8]*wanBandwidth // Per-WAN capacity estimates
+	trains          *bandwidth.TrainMeter   // Measures the peer's probe trains
+	trainID         atomic.Uint32
+	peerBandwidth   atomic.Bool // The peer sends and measures probe trains
 	processor       *packet.Processor
+	duplicates      *packet.DuplicateWindow
 	fecManager      *fec.FECManager
+	fecEncoder      *fec.BlockEncoder
+	fecDecoder      *fec.BlockDecoder
+	fecDataShards   int
+	fecParityShards int
+	tunnelCipher    *security.TunnelCipher
+	noiseSession    *security.NoiseSession
+	keyRotation     time.Duration
 	pluginManager   *plugin.Manager
-	natManager      *nat.Manager
+	natCfg          *nat.NATTraversalConfig // nil when NAT traversal is disabled
+	natManagers     map[uint8]*nat.Manager  // Per-WAN NAT traversal, on each WAN's own socket
+	bindingFile     string                  // Where measured NAT binding lifetimes persist; empty to keep them in memory
+	bindingMu       sync.Mutex              // Guards bindings, bindingFile's contents and bindingAnswers
+	bindings        map[uint8]bindingRecord // Measured NAT binding lifetimes
+	bindingAnswers  map[uint8]int           // Peer's binding probes waiting for their answer, per WAN
+	bindingProbeID  atomic.Uint32
+	peerBindings    atomic.Bool // The peer answers NAT binding probes
 	dpiClassifier   *dpi.Classifier
+	tunDevice       tun.Device
+	tunMTU          int // MTU the TUN device was attached with
 	wans            map[uint8]*protocol.WANInterface
 	sendChan        chan []byte
 	recvChan        chan []byte
@@ -38,6 +88,9 @@ type Bonder struct {
 	wg              sync.WaitGroup
 	running         atomic.Bool
 	sequenceID      atomic.Uint64
+	controlHandlers map[protocol.ControlType]ControlHandler
+	peerMu          sync.Mutex
+	peer            PeerInfo
 }
 
 // New creates a new Bonder instance
@@ -65,37 +118,124 @@ func New(cfg *config.BondConfig) (*Bonder, error) {
 	// Create components
 	routingMode := config.ParseLoadBalanceMode(cfg.Routing.Mode)
 
-	// Create NAT manager (optional, may fail if no internet)
-	natMgr, err := nat.NewManager(nat.DefaultNATTraversalConfig())
-	if err != nil {
-		// NAT manager is optional, continue without it
-		natMgr = nil
-	}
-
 	// Create DPI classifier
 	dpiClass := dpi.NewClassifier(dpi.DefaultDPIConfig())
 
 	bonder := &Bonder{
-		session:       session,
-		healthChecker: health.NewChecker(),
-		router:        router.NewRouter(routingMode),
-		processor:     packet.NewProcessor(sessionConfig.ReorderBuffer, sessionConfig.ReorderTimeout),
-		fecManager:    fec.NewFECManager(),
-		pluginManager: plugin.NewManager(),
-		natManager:    natMgr,
-		dpiClassifier: dpiClass,
-		wans:          make(map[uint8]*protocol.WANInterface),
-		sendChan:      make(chan []byte, 1000),
-		recvChan:      make(chan []byte, 1000),
-	}
-
-	// Configure FEC
+		session:        session,
+		healthChecker:  health.NewChecker(),
+		router:         router.NewRouter(routingMode),
+		processor:      packet.NewProcessor(sessionConfig.ReorderBuffer, sessionConfig.ReorderTimeout),
+		duplicates:     packet.NewDuplicateWindow(packet.DefaultDuplicateWindow, sessionConfig.DuplicateFilter),
+		fecManager:     fec.NewFECManager(),
+		pluginManager:  plugin.NewManager(),
+		natManagers:    make(map[uint8]*nat.Manager),
+		bindingAnswers: make(map[uint8]int),
+		dpiClassifier:  dpiClass,
+		wans:           make(map[uint8]*protocol.WANInterface),
+		paths:          make(map[uint8]*pathSender),
+		acks:           congestion.NewAckTracker(),
+		retransmitter:  arq.NewRetransmitter(sessionConfig.ReorderTimeout),
+		probers:        make(map[uint8]*pmtud.Prober),
+		announcedMTUs:  make(map[uint8]int),
+		reassembler:    packet.NewReassembler(sessionConfig.ReorderTimeout),
+		estimators:     make(map[uint8]*wanBandwidth),
+		trains:         bandwidth.NewTrainMeter(),
+		sendChan:       make(chan []byte, 1000),
+		recvChan:       make(chan []byte, 1000),
+	}
+
+	// Configure FEC; configs without shard counts fall back to the redundancy ratio
+	dataShards, parityShards := cfg.FEC.DataShards, cfg.FEC.ParityShards
+	if dataShards == 0 || parityShards == 0 {
+		dataShards, parityShards = fec.ShardsForRedundancy(cfg.FEC.Redundancy)
+	}
+	if err := bonder.fecManager.SetShardCount(dataShards, parityShards); err != nil {
+		return nil, fmt.Errorf("invalid FEC config: %w", err)
+	}
+	if bonder.fecEncoder, err = fec.NewBlockEncoder(dataShards, parityShards); err != nil {
+		return nil, fmt.Errorf("invalid FEC config: %w", err)
+	}
+	if bonder.fecDecoder, err = fec.NewBlockDecoder(dataShards, parityShards); err != nil {
+		return nil, fmt.Errorf("invalid FEC config: %w", err)
+	}
+	bonder.fecDataShards, bonder.fecParityShards = dataShards, parityShards
+
 	if cfg.FEC.Enabled {
 		bonder.fecManager.Enable()
 		session.Config.FECEnabled = true
 		session.Config.FECRedundancy = cfg.FEC.Redundancy
 	}
 
+	// Configure tunnel encryption
+	if cfg.Security != nil && cfg.Security.Enabled {
+		if err := bonder.configureSecurity(cfg.Security); err != nil {
+			return nil, fmt.Errorf("invalid security config: %w", err)
+		}
+	}
+
+	// Compile routing policies; they are evaluated before the load balancing mode
+	policyRules, err := cfg.Routing.PolicyRules()
+	if err != nil {
+		return nil, fmt.Errorf("invalid routing policy: %w", err)
+	}
+	bonder.policies = router.NewPolicyEngine(policyRules)
+	bonder.router.SetPolicyEngine(bonder.policies)
+
+	duplicationRules, err := cfg.Routing.DuplicationRules()
+	if err != nil {
+		return nil, fmt.Errorf("invalid duplication policy: %w", err)
+	}
+	bonder.duplicator = router.NewDuplicator(duplicationRules)
+	bonder.router.SetDuplicator(bonder.duplicator)
+	bonder.duplicateAll.Store(sessionConfig.DuplicatePackets)
+	bonder.retransmit.Store(sessionConfig.Retransmit)
+
+	// Map DSCP and DPI traffic classes to packet priorities
+	if bonder.priorities, err = cfg.QoS.PriorityMap(); err != nil {
+		return nil, fmt.Errorf("invalid QoS config: %w", err)
+	}
+
+	// Pace each WAN under its own congestion controller
+	if bonder.congestionCfg, err = cfg.Congestion.ControllerConfig(); err != nil {
+		return nil, fmt.Errorf("invalid congestion config: %w", err)
+	}
+
+	// Discover the path MTU of each WAN and fragment larger packets
+	if bonder.mtuCfg, err = cfg.PathMTU.DiscoveryConfig(); err != nil {
+		return nil, fmt.Errorf("invalid path MTU config: %w", err)
+	}
+
+	// Estimate the capacity of each WAN for weighted routing
+	if bonder.bandwidthCfg, err = cfg.Bandwidth.EstimatorConfig(); err != nil {
+		return nil, fmt.Errorf("invalid bandwidth config: %w", err)
+	}
+
+	// Traverse the NAT of each WAN on its own socket
+	if bonder.natCfg, err = cfg.NAT.TraversalConfig(); err != nil {
+		return nil, fmt.Errorf("invalid NAT config: %w", err)
+	}
+
+	// Pick up the NAT binding lifetimes measured before
+	if bonder.natCfg != nil && bonder.natCfg.Binding != nil {
+		bonder.bindingFile = cfg.NAT.BindingStateFile
+		if bonder.bindings, err = loadBindings(bonder.bindingFile); err != nil {
+			return nil, fmt.Errorf("invalid NAT binding state: %w", err)
+		}
+	}
+
+	bonder.registerControlHandlers()
+	bonder.configureFailover(cfg.Routing.FailoverTimers())
+	bonder.healthChecker.SetProbeSender(bonder.sendProbe)
+
+	// Sequence IDs start at 1 (see sendPacket)
+	bonder.processor.SetNextExpectedSeq(1)
+	bonder.processor.SetDeliverFunc(func(batch [][]byte) {
+		for _, data := range batch {
+			bonder.deliver(data)
+		}
+	})
+
 	// Add WANs from config
 	for _, wanCfg := range cfg.WANs {
 		if err := bonder.addWANFromConfig(&wanCfg); err != nil {
@@ -103,9 +243,70 @@ func New(cfg *config.BondConfig) (*Bonder, error) {
 		}
 	}
 
+	// Open TUN interface if configured
+	if cfg.TUN != nil && cfg.TUN.Enabled {
+		if err := bonder.openTUN(cfg.TUN); err != nil {
+			return nil, fmt.Errorf("failed to set up TUN interface: %w", err)
+		}
+	}
+
 	return bonder, nil
 }
 
+// openTUN opens the TUN device and configures its address and MTU
+func (b *Bonder) openTUN(cfg *config.TUNConfig) error {
+	tunCfg := &tun.Config{
+		Name:    cfg.Name,
+		Address: cfg.Address,
+		MTU:     cfg.MTU,
+	}
+
+	dev, err := tun.Open(tunCfg)
+	if err != nil {
+		return err
+	}
+
+	ipMgr, err := ipconfig.NewManager()
+	if err != nil {
+		dev.Close()
+		return err
+	}
+
+	if err := tun.Configure(ipMgr, dev, tunCfg); err != nil {
+		dev.Close()
+		return err
+	}
+
+	return b.AttachTUN(dev)
+}
+
+// AttachTUN attaches a TUN device to the bond.
+// IP packets read from the device are sent over the bond, and packets
+// received from the bond are written to the device instead of Receive().
+func (b *Bonder) AttachTUN(dev tun.Device) error {
+	if b.running.Load() {
+		return fmt.Errorf("cannot attach TUN device while running")
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.tunDevice != nil {
+		return fmt.Errorf("TUN device %s already attached", b.tunDevice.Name())
+	}
+
+	b.tunDevice = dev
+	b.tunMTU = dev.MTU()
+	return nil
+}
+
+// GetTUNDevice returns the attached TUN device, if any
+func (b *Bonder) GetTUNDevice() tun.Device {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.tunDevice
+}
+
 // Start starts the bonding service
 func (b *Bonder) Start(ctx context.Context) error {
 	if b.running.Load() {
@@ -128,14 +329,6 @@ func (b *Bonder) Start(ctx context.Context) error {
 		return fmt.Errorf("failed to start plugins: %w", err)
 	}
 
-	// Initialize and start NAT manager (if available)
-	if b.natManager != nil {
-		if err := b.natManager.Initialize(); err == nil {
-			b.natManager.Start()
-		}
-		// Don't fail if NAT setup fails, continue without it
-	}
-
 	// Start DPI classifier
 	if b.dpiClassifier != nil {
 		b.dpiClassifier.Start()
@@ -145,10 +338,51 @@ func (b *Bonder) Start(ctx context.Context) error {
 	b.wg.Add(1)
 	go b.senderLoop()
 
-	// Start receiver goroutines for each WAN
+	// Start FEC block flusher
+	b.wg.Add(1)
+	go b.fecLoop()
+
+	// Start acking received data and pacing sent data
+	b.wg.Add(1)
+	go b.ackLoop()
+	for _, path := range b.paths {
+		b.wg.Add(1)
+		go b.pacerLoop(path)
+	}
+
+	// Start path MTU discovery
+	if b.mtuCfg != nil {
+		b.wg.Add(1)
+		go b.mtuLoop()
+	}
+
+	// Start bandwidth estimation
+	if b.bandwidthCfg != nil {
+		b.wg.Add(1)
+		go b.bandwidthLoop()
+	}
+
+	// Start handshakes if this end initiates them
+	if b.noiseSession != nil {
+		b.wg.Add(1)
+		go b.handshakeLoop()
+	}
+
+	// Announce this end to the peer
+	b.wg.Add(1)
+	go b.announceLoop()
+
+	// Start TUN reader if a device is attached
+	if b.tunDevice != nil {
+		b.wg.Add(1)
+		go b.tunReaderLoop()
+	}
+
+	// Start receiver goroutines and NAT traversal for each WAN
 	for _, wan := range b.wans {
 		b.wg.Add(1)
 		go b.receiverLoop(wan)
+		b.startNAT(wan)
 	}
 
 	// Start health event handler
@@ -166,12 +400,24 @@ func (b *Bonder) Stop() error {
 		return fmt.Errorf("bonder not running")
 	}
 
+	// Tell the peer before the sockets close
+	if b.SessionEstablished() {
+		b.broadcastControl(&protocol.Close{Reason: protocol.CloseShutdown})
+	}
+
 	b.mu.Lock()
 	if b.cancel != nil {
 		b.cancel()
 	}
+	// Closing the TUN device unblocks tunReaderLoop
+	if b.tunDevice != nil {
+		b.tunDevice.Close()
+	}
 	b.mu.Unlock()
 
+	// Stopping NAT traversal ends discoveries in progress
+	b.stopNAT()
+
 	// Wait for goroutines
 	b.wg.Wait()
 
@@ -179,24 +425,25 @@ func (b *Bonder) Stop() error {
 	b.healthChecker.Stop()
 	b.pluginManager.StopAll()
 
-	// Stop NAT manager
-	if b.natManager != nil {
-		b.natManager.Stop()
-	}
-
 	// Stop DPI classifier
 	if b.dpiClassifier != nil {
 		b.dpiClassifier.Stop()
 	}
 
-	// Close connections
-	b.mu.Lock()
+	// Close connections; closing a TURN relay waits on the TURN server, so
+	// it is done without holding b.mu
+	b.mu.RLock()
+	relays := make([]net.PacketConn, 0, len(b.wans))
+	conns := make([]*net.UDPConn, 0, len(b.wans))
 	for _, wan := range b.wans {
-		if wan.Conn != nil {
-			wan.Conn.Close()
-		}
+		relays = append(relays, wan.Relay)
+		conns = append(conns, wan.Conn)
+	}
+	b.mu.RUnlock()
+
+	for i := range conns {
+		closeWAN(relays[i], conns[i])
 	}
-	b.mu.Unlock()
 
 	b.running.Store(false)
 
@@ -233,11 +480,24 @@ func (b *Bonder) AddWAN(wan *protocol.WANInterface) error {
 	// Add to components
 	b.healthChecker.AddWAN(wan)
 	b.router.AddWAN(wan)
+	b.failover.UpdateWANsByPriority(b.wans)
+	b.addPath(wan)
+	b.addProber(wan)
+	b.addEstimator(wan)
+	b.addNAT(wan)
 
-	// If running, start receiver for this WAN
+	// If running, start receiver and NAT traversal for this WAN and announce it
 	if b.running.Load() {
 		b.wg.Add(1)
 		go b.receiverLoop(wan)
+		b.startNAT(wan)
+
+		b.announceAsync(&protocol.WANAdd{
+			WANID:    wan.ID,
+			Type:     wan.Type,
+			Priority: uint8(min(max(wan.Config.Priority, 0), 0xff)),
+			Weight:   uint16(min(max(wan.Config.Weight, 0), 0xffff)),
+		})
 	}
 
 	return nil
@@ -246,28 +506,51 @@ func (b *Bonder) AddWAN(wan *protocol.WANInterface) error {
 // RemoveWAN removes a WAN interface from the bond
 func (b *Bonder) RemoveWAN(wanID uint8) error {
 	b.mu.Lock()
-	defer b.mu.Unlock()
 
 	wan, exists := b.wans[wanID]
 	if !exists {
+		b.mu.Unlock()
 		return fmt.Errorf("WAN %d not found", wanID)
 	}
 
-	// Close connection
-	if wan.Conn != nil {
-		wan.Conn.Close()
-	}
-
 	// Remove from components
 	b.healthChecker.RemoveWAN(wanID)
 	b.router.RemoveWAN(wanID)
+	b.removePath(wanID)
+	b.removeProber(wanID)
+	b.removeEstimator(wanID)
+	mgr := b.removeNAT(wanID)
+	relay, conn := wan.Relay, wan.Conn
 
 	delete(b.wans, wanID)
 	delete(b.session.WANInterfaces, wanID)
+	b.failover.UpdateWANsByPriority(b.wans)
+
+	if b.running.Load() {
+		b.announceAsync(&protocol.WANRemove{WANID: wanID})
+	}
+	b.mu.Unlock()
+
+	// Releasing a TURN allocation waits on the TURN server, which must not
+	// hold up the WANs still sending
+	if mgr != nil {
+		mgr.Stop()
+	}
+	closeWAN(relay, conn)
 
 	return nil
 }
 
+// closeWAN closes the relay and socket of a WAN, either of which may be nil
+func closeWAN(relay net.PacketConn, conn *net.UDPConn) {
+	if relay != nil {
+		relay.Close()
+	}
+	if conn != nil {
+		conn.Close()
+	}
+}
+
 // GetWANs returns all active WAN interfaces
 func (b *Bonder) GetWANs() map[uint8]*protocol.WANInterface {
 	b.mu.RLock()
@@ -313,6 +596,44 @@ func (b *Bonder) Send(data []byte) error {
 	}
 }
 
+// GetReorderStats returns reorder buffer statistics for the session
+func (b *Bonder) GetReorderStats() packet.ReorderStats {
+	return b.processor.GetReorderStats()
+}
+
+// GetSecurityStats returns tunnel encryption counters, or nil if encryption is disabled
+func (b *Bonder) GetSecurityStats() *security.TunnelStats {
+	if b.tunnelCipher == nil {
+		return nil
+	}
+	return b.tunnelCipher.GetStats()
+}
+
+// GetDuplicateStats returns the duplicate counters of every WAN
+func (b *Bonder) GetDuplicateStats() map[uint8]packet.DuplicateStats {
+	return b.duplicates.Stats()
+}
+
+// GetPolicyStats returns the hit counters of the routing policies
+func (b *Bonder) GetPolicyStats() []router.PolicyStats {
+	return b.policies.Stats()
+}
+
+// GetDuplicationStats returns the counters of the duplication policies
+func (b *Bonder) GetDuplicationStats() []router.DuplicationStats {
+	return b.duplicator.Stats()
+}
+
+// GetRetransmitStats returns the retransmission counters of every WAN
+func (b *Bonder) GetRetransmitStats() map[uint8]arq.WANStats {
+	return b.retransmitter.Stats()
+}
+
+// GetFECStats returns FEC recovery statistics
+func (b *Bonder) GetFECStats() fec.Stats {
+	return b.fecDecoder.Stats()
+}
+
 // Receive returns a channel for receiving data
 func (b *Bonder) Receive() <-chan []byte {
 	return b.recvChan
@@ -328,9 +649,13 @@ func (b *Bonder) GetSession() *protocol.Session {
 // UpdateConfig updates the session configuration
 func (b *Bonder) UpdateConfig(config *protocol.SessionConfig) error {
 	b.mu.Lock()
-	defer b.mu.Unlock()
 
 	b.session.Config = config
+	b.duplicates.SetMode(config.DuplicateFilter)
+	b.duplicateAll.Store(config.DuplicatePackets)
+	b.retransmit.Store(config.Retransmit)
+	b.retransmitter.SetDeadline(config.ReorderTimeout)
+	b.reassembler.SetTimeout(config.ReorderTimeout)
 
 	// Update FEC
 	if config.FECEnabled {
@@ -338,7 +663,10 @@ func (b *Bonder) UpdateConfig(config *protocol.SessionConfig) error {
 	} else {
 		b.fecManager.Disable()
 	}
+	b.mu.Unlock()
 
+	// Parity takes room from the tunnel MTU
+	b.updateTUNMTU()
 	return nil
 }
 
@@ -362,6 +690,258 @@ func (b *Bonder) senderLoop() {
 	}
 }
 
+// TUN read errors other than the device closing are retried after a delay
+// that doubles from tunRetryMin up to tunRetryMax while they persist
+const (
+	tunRetryMin = 10 * time.Millisecond
+	tunRetryMax = time.Second
+)
+
+// tunReaderLoop reads IP packets from the TUN device and sends them over the bond
+func (b *Bonder) tunReaderLoop() {
+	defer b.wg.Done()
+
+	buf := make([]byte, protocol.MaxPacketSize)
+	var retry time.Duration
+
+	for {
+		n, err := b.tunDevice.Read(buf)
+		if err != nil {
+			select {
+			case <-b.ctx.Done():
+				return
+			default:
+			}
+
+			if err == tun.ErrDeviceClosed {
+				return
+			}
+
+			if retry == 0 {
+				b.pluginManager.Alert(protocol.AlertLevelWarning, "TUN read error", map[string]interface{}{
+					"error": err.Error(),
+				})
+				retry = tunRetryMin
+			} else {
+				retry = min(retry*2, tunRetryMax)
+			}
+			select {
+			case <-b.ctx.Done():
+				return
+			case <-time.After(retry):
+			}
+			continue
+		}
+		retry = 0
+
+		if n == 0 {
+			continue
+		}
+
+		// Copy packet since buf is reused
+		data := make([]byte, n)
+		copy(data, buf[:n])
+
+		if err := b.sendPacket(data); err != nil {
+			b.pluginManager.Alert(protocol.AlertLevelWarning, "TUN send error", map[string]interface{}{
+				"error": err.Error(),
+			})
+		}
+	}
+}
+
+// fecLoop flushes incomplete FEC blocks and expires stale receive blocks
+func (b *Bonder) fecLoop() {
+	defer b.wg.Done()
+
+	b.mu.RLock()
+	reorderTimeout := b.session.Config.ReorderTimeout
+	b.mu.RUnlock()
+
+	// Parity for partial blocks must reach the peer well within its reorder timeout
+	interval := reorderTimeout / 4
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+
+		case <-ticker.C:
+			if !b.fecManager.IsEnabled() {
+				continue
+			}
+
+			for _, block := range b.fecEncoder.Flush(interval) {
+				b.sendParity(block)
+			}
+			b.fecDecoder.Expire(reorderTimeout)
+		}
+	}
+}
+
+// sendParity sends the parity shards of a block, preferring the WANs that
+// carried the fewest of its data packets so a single WAN failure is recoverable
+func (b *Bonder) sendParity(block *fec.ParityBlock) {
+	b.mu.RLock()
+	candidates := make([]*protocol.WANInterface, 0, len(b.wans))
+	for _, wan := range b.wans {
+		if !wan.Config.Enabled || wan.RemoteAddr == nil || wan.Conn == nil {
+			continue
+		}
+		if state := b.wanState(wan); state != protocol.WANStateUp && state != protocol.WANStateRecovering {
+			continue
+		}
+		candidates = append(candidates, wan)
+	}
+	b.mu.RUnlock()
+
+	if len(candidates) == 0 {
+		return
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		ui, uj := block.WANs[candidates[i].ID], block.WANs[candidates[j].ID]
+		if ui != uj {
+			return ui < uj
+		}
+		return candidates[i].ID < candidates[j].ID
+	})
+
+	for i := range block.Parity {
+		wan := candidates[i%len(candidates)]
+
+		pkt := &protocol.Packet{
+			Version:    protocol.ProtocolVersion,
+			Type:       protocol.PacketTypeFEC,
+			Flags:      protocol.FlagFEC,
+			SessionID:  b.session.ID,
+			SequenceID: block.BaseSeq,
+			Timestamp:  time.Now().UnixNano(),
+			WANID:      wan.ID,
+			Priority:   128,
+			Data:       block.Payload(i),
+		}
+
+		encoded, err := b.processor.Encode(pkt)
+		if err != nil {
+			continue
+		}
+		datagrams, err := b.datagrams(wan, pkt, encoded)
+		if err != nil {
+			continue
+		}
+
+		// Parity is not acked, so it stays out of the congestion window
+		sent := true
+		for _, datagram := range datagrams {
+			if err := b.writeTo(wan, datagram, wan.RemoteAddr); err != nil {
+				sent = false
+				break
+			}
+		}
+		if sent {
+			b.pluginManager.RecordPacket(wan.ID, pkt, true)
+		}
+	}
+}
+
+// handleData feeds a received data packet to the FEC decoder and delivers it
+// together with any packets it allowed to be rebuilt
+func (b *Bonder) handleData(pkt *protocol.Packet) {
+	if !b.fecManager.IsEnabled() {
+		b.reorderAndDeliver(pkt)
+		return
+	}
+
+	recovered := b.fecDecoder.AddData(pkt.SequenceID, pkt.Data)
+	b.reorderAndDeliver(append(b.recoveredPackets(pkt.SessionID, recovered), pkt)...)
+}
+
+// handleParity feeds a received parity shard to the FEC decoder and delivers
+// the packets it rebuilt
+func (b *Bonder) handleParity(pkt *protocol.Packet) {
+	if !b.fecManager.IsEnabled() {
+		return
+	}
+
+	recovered, err := b.fecDecoder.AddParity(pkt.SequenceID, pkt.Data)
+	if err != nil {
+		return
+	}
+
+	b.reorderAndDeliver(b.recoveredPackets(pkt.SessionID, recovered)...)
+}
+
+// recoveredPackets wraps data rebuilt by FEC as data packets
+func (b *Bonder) recoveredPackets(sessionID uint64, recovered []fec.Recovered) []*protocol.Packet {
+	pkts := make([]*protocol.Packet, 0, len(recovered)+1)
+	for _, r := range recovered {
+		// A copy may have arrived on another WAN in the meantime
+		if !b.duplicates.Mark(r.Seq) {
+			continue
+		}
+		pkts = append(pkts, &protocol.Packet{
+			Version:    protocol.ProtocolVersion,
+			Type:       protocol.PacketTypeData,
+			SessionID:  sessionID,
+			SequenceID: r.Seq,
+			Timestamp:  time.Now().UnixNano(),
+			Data:       r.Data,
+		})
+	}
+	return pkts
+}
+
+// duplicateScore ranks a copy of a data packet for the duplicate window; lower is better
+func (b *Bonder) duplicateScore(wan *protocol.WANInterface, pkt *protocol.Packet) int64 {
+	switch b.duplicates.Mode() {
+	case protocol.DuplicateKeepFastest:
+		// One-way transit time; copies share the send timestamp
+		return time.Now().UnixNano() - pkt.Timestamp
+	case protocol.DuplicateKeepBest:
+		// Failover priority, then average latency
+		var latency time.Duration
+		if wan.Metrics != nil {
+			latency = wan.Metrics.AvgLatency
+		}
+		return int64(wan.Config.Priority)<<40 + int64(latency/time.Microsecond)
+	default:
+		return 0
+	}
+}
+
+// reorderAndDeliver passes packets through the reorder buffer in sequence order.
+// Released packets are delivered by the processor's deliver function.
+func (b *Bonder) reorderAndDeliver(pkts ...*protocol.Packet) {
+	sort.Slice(pkts, func(i, j int) bool {
+		return pkts[i].SequenceID < pkts[j].SequenceID
+	})
+
+	for _, pkt := range pkts {
+		b.processor.Reorder(pkt)
+	}
+}
+
+// deliver hands received data to the TUN device or the receive channel
+func (b *Bonder) deliver(data []byte) {
+	if b.tunDevice != nil {
+		b.tunDevice.Write(data)
+		return
+	}
+
+	select {
+	case b.recvChan <- data:
+	default:
+		// Receive buffer full
+	}
+}
+
 // sendPacket sends a single packet
 func (b *Bonder) sendPacket(data []byte) error {
 	// Create packet
@@ -371,7 +951,7 @@ func (b *Bonder) sendPacket(data []byte) error {
 		SessionID:  b.session.ID,
 		SequenceID: b.sequenceID.Add(1),
 		Timestamp:  time.Now().UnixNano(),
-		Priority:   128, // Default priority
+		Priority:   packet.DefaultPriority,
 		Data:       data,
 	}
 
@@ -386,12 +966,39 @@ func (b *Bonder) sendPacket(data []byte) error {
 	}
 	pkt = filtered
 
+	// With session-wide duplication every packet also goes out on a backup WAN
+	if b.duplicateAll.Load() {
+		pkt.Flags |= protocol.FlagDuplicate
+	}
+
+	// Tunneled IP packets are routed, classified and prioritized by flow
+	var flow protocol.FlowKey
+	traffic := router.Traffic{Flow: &flow}
+	if payload, err := packet.ParseFlow(pkt.Data, &flow); err != nil {
+		traffic.Flow = nil
+	} else {
+		trafficClass := dpi.ClassDefault
+		traffic.DSCP = packet.DSCP(pkt.Data)
+		if b.dpiClassifier != nil {
+			class, _ := b.dpiClassifier.ClassifyPacket(flow.SrcIP, flow.DstIP, flow.SrcPort, flow.DstPort, flow.Protocol, payload, true)
+			if class != nil && class.Protocol != dpi.ProtocolUnknown {
+				traffic.App = class.Protocol.String()
+				traffic.Category = class.Category.String()
+				trafficClass = class.Protocol.GetTrafficClass()
+			}
+		}
+		pkt.Priority = b.priorities.Priority(traffic.DSCP, trafficClass)
+	}
+
 	// Get routing decision
-	decision, err := b.router.Route(pkt, nil)
+	decision, err := b.router.RouteTraffic(pkt, &traffic)
 	if err != nil {
 		return fmt.Errorf("routing error: %w", err)
 	}
 
+	// Tag with the sending WAN so the peer can track per-WAN state
+	pkt.WANID = decision.PrimaryWAN
+
 	// Encode packet
 	encoded, err := b.processor.Encode(pkt)
 	if err != nil {
@@ -407,29 +1014,119 @@ func (b *Bonder) sendPacket(data []byte) error {
 		return fmt.Errorf("primary WAN not available")
 	}
 
-	_, err = primaryWAN.Conn.WriteToUDP(encoded, primaryWAN.RemoteAddr)
-	if err != nil {
+	if err := b.transmit(primaryWAN, pkt, encoded, false, nil); err != nil {
 		return fmt.Errorf("send error: %w", err)
 	}
 
-	// Record metrics
-	b.pluginManager.RecordPacket(decision.PrimaryWAN, pkt, true)
-
 	// Send on backup WANs if needed
 	for _, wanID := range decision.BackupWANs {
 		b.mu.RLock()
 		backupWAN := b.wans[wanID]
 		b.mu.RUnlock()
 
-		if backupWAN != nil && backupWAN.RemoteAddr != nil {
-			backupWAN.Conn.WriteToUDP(encoded, backupWAN.RemoteAddr)
-			b.pluginManager.RecordPacket(wanID, pkt, true)
+		if backupWAN == nil || backupWAN.RemoteAddr == nil {
+			continue
+		}
+
+		// Copies count against their duplication rule's budget once sent
+		var sent func()
+		if decision.Duplication != 0 {
+			sent = func() { b.duplicator.Sent(decision.Duplication, wanID, len(pkt.Data)) }
+		}
+		b.transmit(backupWAN, pkt, encoded, false, sent)
+	}
+
+	// Add to the current FEC block; parity goes out once the block is full
+	if b.fecManager.IsEnabled() {
+		block, err := b.fecEncoder.Add(pkt.SequenceID, decision.PrimaryWAN, pkt.Data)
+		if err != nil {
+			return fmt.Errorf("FEC error: %w", err)
+		}
+		if block != nil {
+			b.sendParity(block)
 		}
 	}
 
 	return nil
 }
 
+// writeTo sends an encoded packet on a WAN, encrypting it first when tunnel
+// security is enabled. Each copy is sealed separately, so packets duplicated
+// across WANs never share a nonce.
+func (b *Bonder) writeTo(wan *protocol.WANInterface, encoded []byte, addr *net.UDPAddr) error {
+	if b.tunnelCipher != nil {
+		sealed, err := packet.Seal(b.tunnelCipher, encoded)
+		if err != nil {
+			return fmt.Errorf("encrypt error: %w", err)
+		}
+		encoded = sealed
+	}
+
+	return b.writeDatagram(wan, encoded, addr)
+}
+
+// relay returns the relay carrying a WAN's traffic, or nil. NAT traversal
+// can put a WAN behind a relay while it runs, so this takes b.mu.
+func (b *Bonder) relay(wan *protocol.WANInterface) net.PacketConn {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return wan.Relay
+}
+
+// writeDatagram sends a datagram on a WAN, through its relay if it has one
+func (b *Bonder) writeDatagram(wan *protocol.WANInterface, data []byte, addr *net.UDPAddr) error {
+	if relay := b.relay(wan); relay != nil {
+		_, err := relay.WriteTo(data, addr)
+		return err
+	}
+
+	_, err := wan.Conn.WriteToUDP(data, addr)
+	return err
+}
+
+// readDatagram receives a datagram on a WAN, through its relay if it has one
+func (b *Bonder) readDatagram(wan *protocol.WANInterface, buf []byte, deadline time.Time) (int, *net.UDPAddr, error) {
+	relay := b.relay(wan)
+	if relay == nil {
+		wan.Conn.SetReadDeadline(deadline)
+		return wan.Conn.ReadFromUDP(buf)
+	}
+
+	relay.SetReadDeadline(deadline)
+	n, addr, err := relay.ReadFrom(buf)
+	if err != nil {
+		return 0, nil, err
+	}
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, nil, fmt.Errorf("relay returned non-UDP address %v", addr)
+	}
+	return n, udpAddr, nil
+}
+
+// decode decodes a received datagram, authenticating and decrypting it first
+// when tunnel security is enabled. Tampered, replayed and unencrypted packets
+// are rejected, except handshake messages sent before any session key exists.
+// Encrypted packets are rejected when security is disabled.
+func (b *Bonder) decode(data []byte) (*protocol.Packet, error) {
+	if b.tunnelCipher == nil {
+		if packet.IsEncrypted(data) {
+			return nil, fmt.Errorf("encrypted packet but tunnel security is disabled")
+		}
+		return b.processor.Decode(data)
+	}
+
+	if !packet.IsEncrypted(data) {
+		return b.decodeClearHandshake(data)
+	}
+
+	opened, err := packet.Open(b.tunnelCipher, data)
+	if err != nil {
+		return nil, err
+	}
+	return b.processor.Decode(opened)
+}
+
 // receiverLoop handles receiving packets on a WAN
 func (b *Bonder) receiverLoop(wan *protocol.WANInterface) {
 	defer b.wg.Done()
@@ -442,10 +1139,7 @@ func (b *Bonder) receiverLoop(wan *protocol.WANInterface) {
 			return
 
 		default:
-			// Set read deadline
-			wan.Conn.SetReadDeadline(time.Now().Add(1 * time.Second))
-
-			n, addr, err := wan.Conn.ReadFromUDP(buf)
+			n, addr, err := b.readDatagram(wan, buf, time.Now().Add(1*time.Second))
 			if err != nil {
 				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 					continue
@@ -453,6 +1147,12 @@ func (b *Bonder) receiverLoop(wan *protocol.WANInterface) {
 				// Other error
 				continue
 			}
+			received := time.Now()
+
+			// STUN responses and hole punching belong to the WAN's NAT traversal
+			if mgr := b.natManager(wan.ID); mgr != nil && mgr.HandlePacket(buf[:n], addr) {
+				continue
+			}
 
 			// Update remote address if not set
 			if wan.RemoteAddr == nil {
@@ -460,7 +1160,7 @@ func (b *Bonder) receiverLoop(wan *protocol.WANInterface) {
 			}
 
 			// Decode packet
-			pkt, err := b.processor.Decode(buf[:n])
+			pkt, err := b.decode(buf[:n])
 			if err != nil {
 				continue
 			}
@@ -478,23 +1178,44 @@ func (b *Bonder) receiverLoop(wan *protocol.WANInterface) {
 			// Handle packet based on type
 			switch pkt.Type {
 			case protocol.PacketTypeHeartbeat:
-				// Echo heartbeat back
-				wan.Conn.WriteToUDP(buf[:n], addr)
+				b.handleHeartbeat(wan, pkt, addr, received)
+
+			case protocol.PacketTypeAck:
+				b.handleAck(wan, pkt, received)
 
 			case protocol.PacketTypeData:
-				// Reorder and deliver
-				data, ready, err := b.processor.Reorder(pkt)
-				if err == nil && ready {
-					select {
-					case b.recvChan <- data:
-					default:
-						// Receive buffer full
+				// Every copy is acked on its own WAN for congestion control
+				b.ackData(wan, pkt, addr, received)
+
+				// Fragments wait for the rest of their packet
+				if pkt.Flags&protocol.FlagFragment != 0 {
+					if pkt, _ = b.reassembler.Add(pkt, received); pkt == nil {
+						break
+					}
+				}
+
+				// Drop copies already received on another WAN, then
+				// recover lost packets, reorder and deliver
+				if b.duplicates.Accept(pkt.SequenceID, wan.ID, b.duplicateScore(wan, pkt)) {
+					if pkt.Flags&protocol.FlagRetransmit != 0 {
+						b.retransmissionReceived(wan, pkt)
 					}
+					b.handleData(pkt)
 				}
 
+			case protocol.PacketTypeFEC:
+				// Parity of packets larger than the path MTU comes in fragments
+				if pkt.Flags&protocol.FlagFragment != 0 {
+					if pkt, _ = b.reassembler.Add(pkt, received); pkt == nil {
+						break
+					}
+				}
+
+				// Rebuild lost data packets from parity
+				b.handleParity(pkt)
+
 			case protocol.PacketTypeControl:
-				// Handle control packet
-				// TODO: Implement control message handling
+				b.handleControl(wan, pkt, addr)
 
 			case protocol.PacketTypeMulticast:
 				// Handle multicast
@@ -510,17 +1231,31 @@ func (b *Bonder) healthEventLoop() {
 
 	events := b.healthChecker.Subscribe()
 
+	ticker := time.NewTicker(failbackCheckInterval)
+	defer ticker.Stop()
+
 	for {
 		select {
 		case <-b.ctx.Done():
 			return
 
+		case <-ticker.C:
+			// Fail back once a recovered WAN has been stable long enough
+			if b.failoverActive() {
+				b.failover.CheckFailback()
+			}
+
 		case event := <-events:
 			// Update router with new metrics
 			if event.Metrics != nil {
 				b.router.UpdateMetrics(event.WANID, event.Metrics)
 			}
 
+			// Move traffic off failed WANs in failover mode
+			if b.failoverActive() {
+				b.failover.UpdateWANHealth(event.WANID, event.NewState != protocol.WANStateDown)
+			}
+
 			// Send alerts for state changes
 			if event.OldState != event.NewState {
 				level := protocol.AlertLevelInfo
@@ -574,13 +1309,6 @@ func (b *Bonder) addWANFromConfig(cfg *config.WANInterfaceConfig) error {
 	return b.AddWAN(wan)
 }
 
-// GetNATManager returns the NAT traversal manager
-func (b *Bonder) GetNATManager() *nat.Manager {
-	b.mu.RLock()
-	defer b.mu.RUnlock()
-	return b.natManager
-}
-
 // GetDPIClassifier returns the DPI traffic classifier
 func (b *Bonder) GetDPIClassifier() *dpi.Classifier {
 	b.mu.RLock()
@@ -0,0 +1,356 @@
+package bonder
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+	"github.com/thelastdreamer/MultiWANBond/pkg/security"
+)
+
+// ControlHandler handles a control message received on a WAN.
+// addr is the address the message came from.
+type ControlHandler func(wan *protocol.WANInterface, msg protocol.ControlMessage, addr *net.UDPAddr)
+
+// PeerInfo is what the peer has announced in control messages
+type PeerInfo struct {
+	Capabilities protocol.Capability
+	WANs         map[uint8]protocol.WANAdd // Announced WANs; only IDs are known for WANs listed in a Hello
+	Settings     *protocol.SessionSettings // Negotiated settings, nil until negotiated
+	RTT          time.Duration             // Round trip time from the last answered keepalive
+	Closed       bool                      // The peer announced it is closing
+	LastError    *protocol.Error           // Last error reported by the peer
+	PathMTUs     map[uint8]int             // Path MTUs the peer discovered on its WANs
+}
+
+// RegisterControlHandler sets the handler for a control message type,
+// replacing the built-in one
+func (b *Bonder) RegisterControlHandler(controlType protocol.ControlType, handler ControlHandler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.controlHandlers[controlType] = handler
+}
+
+// registerControlHandlers installs the built-in control message handlers
+func (b *Bonder) registerControlHandlers() {
+	b.controlHandlers = map[protocol.ControlType]ControlHandler{
+		protocol.ControlHandshake:       b.handleHandshake,
+		protocol.ControlHello:           b.handleHello,
+		protocol.ControlWANAdd:          b.handleWANAnnouncement,
+		protocol.ControlWANRemove:       b.handleWANAnnouncement,
+		protocol.ControlKeepalive:       b.handleKeepalive,
+		protocol.ControlConfigRequest:   b.handleConfigRequest,
+		protocol.ControlConfigAck:       b.handleConfigAck,
+		protocol.ControlClose:           b.handleClose,
+		protocol.ControlError:           b.handleError,
+		protocol.ControlPathMTU:         b.handlePathMTU,
+		protocol.ControlBandwidthProbe:  b.handleBandwidthProbe,
+		protocol.ControlBandwidthReport: b.handleBandwidthReport,
+		protocol.ControlBindingProbe:    b.handleBindingProbe,
+	}
+}
+
+// GetPeerInfo returns what the peer has announced so far
+func (b *Bonder) GetPeerInfo() PeerInfo {
+	b.peerMu.Lock()
+	defer b.peerMu.Unlock()
+
+	info := b.peer
+	info.WANs = make(map[uint8]protocol.WANAdd, len(b.peer.WANs))
+	for id, wan := range b.peer.WANs {
+		info.WANs[id] = wan
+	}
+	info.PathMTUs = make(map[uint8]int, len(b.peer.PathMTUs))
+	for id, mtu := range b.peer.PathMTUs {
+		info.PathMTUs[id] = mtu
+	}
+	return info
+}
+
+// SendControl sends a control message to the peer on a WAN
+func (b *Bonder) SendControl(wanID uint8, msg protocol.ControlMessage) error {
+	b.mu.RLock()
+	wan := b.wans[wanID]
+	b.mu.RUnlock()
+
+	if wan == nil || wan.RemoteAddr == nil || wan.Conn == nil {
+		return fmt.Errorf("WAN %d not available", wanID)
+	}
+	return b.sendControl(wan, wan.RemoteAddr, msg)
+}
+
+// sendControl sends a control message. Handshake messages go out in the
+// clear, since Noise protects them on its own and a peer that restarted has
+// no keys to open them with. Only the confirmation is sealed, as it proves
+// the new session keys work.
+func (b *Bonder) sendControl(wan *protocol.WANInterface, addr *net.UDPAddr, msg protocol.ControlMessage) error {
+	pkt := &protocol.Packet{
+		Version:   protocol.ProtocolVersion,
+		Type:      protocol.PacketTypeControl,
+		SessionID: b.session.ID,
+		Timestamp: time.Now().UnixNano(),
+		WANID:     wan.ID,
+		Priority:  255,
+		Data:      protocol.EncodeControl(msg),
+	}
+
+	encoded, err := b.processor.Encode(pkt)
+	if err != nil {
+		return err
+	}
+
+	if hs, ok := msg.(*protocol.Handshake); ok && !security.IsHandshakeConfirm(hs.Payload) {
+		return b.writeDatagram(wan, encoded, addr)
+	}
+
+	return b.writeTo(wan, encoded, addr)
+}
+
+// broadcastControl sends a control message on every usable WAN
+func (b *Bonder) broadcastControl(msg protocol.ControlMessage) {
+	for _, wan := range b.usableWANs() {
+		b.sendControl(wan, wan.RemoteAddr, msg)
+	}
+}
+
+// usableWANs returns the WANs that can reach the peer, sorted by ID.
+// WANs that are still starting count, since heartbeats only begin once the
+// handshake sent over them has completed.
+func (b *Bonder) usableWANs() []*protocol.WANInterface {
+	b.mu.RLock()
+	wans := make([]*protocol.WANInterface, 0, len(b.wans))
+	for _, wan := range b.wans {
+		if !wan.Config.Enabled || wan.RemoteAddr == nil || wan.Conn == nil {
+			continue
+		}
+		switch b.wanState(wan) {
+		case protocol.WANStateStarting, protocol.WANStateUp, protocol.WANStateRecovering:
+		default:
+			continue
+		}
+		wans = append(wans, wan)
+	}
+	b.mu.RUnlock()
+
+	sort.Slice(wans, func(i, j int) bool {
+		return wans[i].ID < wans[j].ID
+	})
+	return wans
+}
+
+// wanState returns the health state of a WAN. The health checker changes it
+// under its own lock rather than b.mu, so it is read through the checker.
+func (b *Bonder) wanState(wan *protocol.WANInterface) protocol.WANState {
+	if state, exists := b.healthChecker.GetState(wan.ID); exists {
+		return state
+	}
+	// Not monitored, so nothing changes it
+	return wan.State
+}
+
+// handleControl decodes a received control message and passes it to its handler.
+// Messages that cannot be decoded are answered with an error.
+func (b *Bonder) handleControl(wan *protocol.WANInterface, pkt *protocol.Packet, addr *net.UDPAddr) {
+	msg, err := protocol.DecodeControl(pkt.Data)
+	if err != nil {
+		// Never answer an error with an error
+		if len(pkt.Data) < 2 || protocol.ControlType(pkt.Data[1]) != protocol.ControlError {
+			b.sendControl(wan, addr, &protocol.Error{Code: protocol.ControlErrorCode(err), Message: err.Error()})
+		}
+		return
+	}
+
+	b.mu.RLock()
+	handler := b.controlHandlers[msg.ControlType()]
+	b.mu.RUnlock()
+
+	if handler != nil {
+		handler(wan, msg, addr)
+	}
+}
+
+// announceLoop sends a Hello once packets can be sent over the tunnel
+func (b *Bonder) announceLoop() {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+
+	for !b.SessionEstablished() {
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+
+	if wans := b.usableWANs(); len(wans) > 0 {
+		b.sendControl(wans[0], wans[0].RemoteAddr, b.hello(false))
+	}
+}
+
+// announceAsync sends a control message on every usable WAN without holding up the caller
+func (b *Bonder) announceAsync(msg protocol.ControlMessage) {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		b.broadcastControl(msg)
+	}()
+}
+
+// hello builds a Hello describing this end
+func (b *Bonder) hello(response bool) *protocol.Hello {
+	msg := &protocol.Hello{
+		Capabilities: protocol.CapabilityFEC | protocol.CapabilityDuplication | protocol.CapabilityConfig | protocol.CapabilityAck | protocol.CapabilityFragment | protocol.CapabilityBindingProbe,
+		Response:     response,
+	}
+	if b.tunnelCipher != nil {
+		msg.Capabilities |= protocol.CapabilityEncryption
+	}
+	if b.retransmit.Load() {
+		msg.Capabilities |= protocol.CapabilityRetransmit
+	}
+	if b.bandwidthCfg != nil {
+		msg.Capabilities |= protocol.CapabilityBandwidth
+	}
+	for _, wan := range b.usableWANs() {
+		msg.WANs = append(msg.WANs, wan.ID)
+	}
+	return msg
+}
+
+// localSettings returns the session settings this end asks for
+func (b *Bonder) localSettings() protocol.SessionSettings {
+	b.mu.RLock()
+	cfg := b.session.Config
+	b.mu.RUnlock()
+
+	return protocol.SessionSettings{
+		FECEnabled:       cfg.FECEnabled,
+		FECDataShards:    uint8(b.fecDataShards),
+		FECParityShards:  uint8(b.fecParityShards),
+		DuplicatePackets: cfg.DuplicatePackets,
+		ReorderBuffer:    uint16(min(cfg.ReorderBuffer, 0xffff)),
+		ReorderTimeout:   cfg.ReorderTimeout,
+	}
+}
+
+// applySettings switches to negotiated session settings
+func (b *Bonder) applySettings(settings protocol.SessionSettings) {
+	if settings.FECEnabled {
+		b.fecManager.Enable()
+	} else {
+		b.fecManager.Disable()
+	}
+	b.processor.SetReorderWindow(int(settings.ReorderBuffer), settings.ReorderTimeout)
+	b.duplicateAll.Store(settings.DuplicatePackets)
+	b.retransmitter.SetDeadline(settings.ReorderTimeout)
+	b.reassembler.SetTimeout(settings.ReorderTimeout)
+
+	b.peerMu.Lock()
+	b.peer.Settings = &settings
+	b.peerMu.Unlock()
+
+	// Parity takes room from the tunnel MTU
+	b.updateTUNMTU()
+}
+
+func (b *Bonder) handleHandshake(wan *protocol.WANInterface, msg protocol.ControlMessage, addr *net.UDPAddr) {
+	if b.noiseSession == nil {
+		return
+	}
+	reply, err := b.noiseSession.HandleMessage(msg.(*protocol.Handshake).Payload)
+	if err != nil || reply == nil {
+		return
+	}
+	b.sendControl(wan, addr, &protocol.Handshake{Payload: reply})
+}
+
+// handleHello records the peer's capabilities and WANs. The end that sent
+// the first Hello proposes session settings once it gets the response.
+func (b *Bonder) handleHello(wan *protocol.WANInterface, msg protocol.ControlMessage, addr *net.UDPAddr) {
+	hello := msg.(*protocol.Hello)
+
+	b.peerMu.Lock()
+	b.peer.Capabilities = hello.Capabilities
+	b.peerAcks.Store(hello.Capabilities&protocol.CapabilityAck != 0)
+	b.peerRetransmits.Store(hello.Capabilities&protocol.CapabilityRetransmit != 0)
+	b.peerFragments.Store(hello.Capabilities&protocol.CapabilityFragment != 0)
+	b.peerBandwidth.Store(hello.Capabilities&protocol.CapabilityBandwidth != 0)
+	b.peerBindings.Store(hello.Capabilities&protocol.CapabilityBindingProbe != 0)
+	b.peer.Closed = false
+	b.peer.WANs = make(map[uint8]protocol.WANAdd, len(hello.WANs))
+	for _, id := range hello.WANs {
+		b.peer.WANs[id] = protocol.WANAdd{WANID: id}
+	}
+	b.peerMu.Unlock()
+
+	// Path MTUs are announced again, as the peer may have restarted
+	b.mu.Lock()
+	clear(b.announcedMTUs)
+	b.mu.Unlock()
+
+	if !hello.Response {
+		b.sendControl(wan, addr, b.hello(true))
+		return
+	}
+	if hello.Capabilities&protocol.CapabilityConfig != 0 {
+		b.sendControl(wan, addr, &protocol.ConfigRequest{Settings: b.localSettings()})
+	}
+}
+
+func (b *Bonder) handleWANAnnouncement(wan *protocol.WANInterface, msg protocol.ControlMessage, addr *net.UDPAddr) {
+	b.peerMu.Lock()
+	defer b.peerMu.Unlock()
+
+	if b.peer.WANs == nil {
+		b.peer.WANs = make(map[uint8]protocol.WANAdd)
+	}
+	switch m := msg.(type) {
+	case *protocol.WANAdd:
+		b.peer.WANs[m.WANID] = *m
+	case *protocol.WANRemove:
+		delete(b.peer.WANs, m.WANID)
+	}
+}
+
+// handleKeepalive answers new keepalives and measures the round trip of answered ones
+func (b *Bonder) handleKeepalive(wan *protocol.WANInterface, msg protocol.ControlMessage, addr *net.UDPAddr) {
+	keepalive := msg.(*protocol.Keepalive)
+	now := time.Now().UnixNano()
+
+	if keepalive.Echo == 0 {
+		b.sendControl(wan, addr, &protocol.Keepalive{Timestamp: now, Echo: keepalive.Timestamp})
+		return
+	}
+
+	if rtt := time.Duration(now - keepalive.Echo); rtt >= 0 {
+		b.peerMu.Lock()
+		b.peer.RTT = rtt
+		b.peerMu.Unlock()
+	}
+}
+
+func (b *Bonder) handleConfigRequest(wan *protocol.WANInterface, msg protocol.ControlMessage, addr *net.UDPAddr) {
+	settings := b.localSettings().Negotiate(msg.(*protocol.ConfigRequest).Settings)
+	b.applySettings(settings)
+	b.sendControl(wan, addr, &protocol.ConfigAck{Settings: settings})
+}
+
+func (b *Bonder) handleConfigAck(wan *protocol.WANInterface, msg protocol.ControlMessage, addr *net.UDPAddr) {
+	b.applySettings(msg.(*protocol.ConfigAck).Settings)
+}
+
+func (b *Bonder) handleClose(wan *protocol.WANInterface, msg protocol.ControlMessage, addr *net.UDPAddr) {
+	b.peerMu.Lock()
+	b.peer.Closed = true
+	b.peerMu.Unlock()
+}
+
+func (b *Bonder) handleError(wan *protocol.WANInterface, msg protocol.ControlMessage, addr *net.UDPAddr) {
+	b.peerMu.Lock()
+	b.peer.LastError = msg.(*protocol.Error)
+	b.peerMu.Unlock()
+}
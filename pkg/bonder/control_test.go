@@ -0,0 +1,147 @@
+package bonder
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+)
+
+// waitFor polls cond until it holds or the timeout expires
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestControlNegotiatesSettings(t *testing.T) {
+	client, server := newLoopbackPair(t)
+
+	clientCfg := *client.session.Config
+	clientCfg.FECEnabled = true
+	clientCfg.DuplicatePackets = true
+	clientCfg.ReorderTimeout = 300 * time.Millisecond
+	client.UpdateConfig(&clientCfg)
+
+	serverCfg := *server.session.Config
+	serverCfg.FECEnabled = true
+	serverCfg.ReorderTimeout = 100 * time.Millisecond
+	server.UpdateConfig(&serverCfg)
+
+	ctx := context.Background()
+	if err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	for _, b := range []*Bonder{client, server} {
+		waitFor(t, "negotiated settings", func() bool { return b.GetPeerInfo().Settings != nil })
+
+		peer := b.GetPeerInfo()
+		if peer.Capabilities&protocol.CapabilityConfig == 0 || len(peer.WANs) != 1 {
+			t.Fatalf("unexpected peer info: %+v", peer)
+		}
+		if s := peer.Settings; !s.FECEnabled || s.DuplicatePackets || s.ReorderTimeout != 300*time.Millisecond {
+			t.Fatalf("unexpected settings: %+v", s)
+		}
+		if !b.fecManager.IsEnabled() {
+			t.Fatal("FEC not enabled after negotiation")
+		}
+	}
+
+	// Keepalives are echoed
+	if err := client.SendControl(1, &protocol.Keepalive{Timestamp: time.Now().UnixNano()}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "keepalive echo", func() bool { return client.GetPeerInfo().RTT > 0 })
+
+	// Graceful close
+	client.Stop()
+	waitFor(t, "close", func() bool { return server.GetPeerInfo().Closed })
+}
+
+func TestControlHandlerRegistration(t *testing.T) {
+	client, server := newLoopbackPair(t)
+
+	received := make(chan *protocol.WANAdd, 1)
+	server.RegisterControlHandler(protocol.ControlWANAdd, func(wan *protocol.WANInterface, msg protocol.ControlMessage, addr *net.UDPAddr) {
+		received <- msg.(*protocol.WANAdd)
+	})
+
+	ctx := context.Background()
+	if err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	want := &protocol.WANAdd{WANID: 9, Type: protocol.WANTypeLTE, Weight: 3}
+	if err := client.SendControl(1, want); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case got := <-received:
+		if *got != *want {
+			t.Fatalf("got %+v, want %+v", got, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler not called")
+	}
+
+	// The built-in handler was replaced
+	if _, exists := server.GetPeerInfo().WANs[9]; exists {
+		t.Fatal("built-in handler still ran")
+	}
+}
+
+func TestControlAnswersMalformedMessages(t *testing.T) {
+	client, server := newLoopbackPair(t)
+
+	ctx := context.Background()
+	if err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client.mu.RLock()
+	wan := client.wans[1]
+	client.mu.RUnlock()
+
+	encoded, err := client.processor.Encode(&protocol.Packet{
+		Version:   protocol.ProtocolVersion,
+		Type:      protocol.PacketTypeControl,
+		SessionID: client.session.ID,
+		WANID:     1,
+		Data:      []byte{protocol.ControlVersion, 0xee},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.writeTo(wan, encoded, wan.RemoteAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "error report", func() bool { return client.GetPeerInfo().LastError != nil })
+	if code := client.GetPeerInfo().LastError.Code; code != protocol.ErrorUnknownMessage {
+		t.Fatalf("error code = %v, want %v", code, protocol.ErrorUnknownMessage)
+	}
+}
@@ -0,0 +1,100 @@
+package bonder
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+)
+
+func TestDuplicatesSuppressedAcrossWANs(t *testing.T) {
+	b, err := New(testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	var wanAddrs []*net.UDPAddr
+	for id := uint8(1); id <= 2; id++ {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		wanAddrs = append(wanAddrs, conn.LocalAddr().(*net.UDPAddr))
+
+		err = b.AddWAN(&protocol.WANInterface{
+			ID:         id,
+			Name:       "lo",
+			LocalAddr:  net.IPv4(127, 0, 0, 1),
+			RemoteAddr: peer.LocalAddr().(*net.UDPAddr),
+			Conn:       conn,
+			Metrics:    &protocol.WANMetrics{},
+			State:      protocol.WANStateUp,
+			Config: protocol.WANConfig{
+				Enabled:             true,
+				Weight:              1,
+				HealthCheckInterval: time.Hour,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := b.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Stop()
+
+	// Every packet arrives on both WANs
+	payloads := []string{"one", "two", "three"}
+	for i, p := range payloads {
+		encoded, err := b.processor.Encode(&protocol.Packet{
+			Version:    protocol.ProtocolVersion,
+			Type:       protocol.PacketTypeData,
+			SessionID:  1,
+			SequenceID: uint64(i + 1),
+			Timestamp:  time.Now().UnixNano(),
+			Data:       []byte(p),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, addr := range wanAddrs {
+			if _, err := peer.WriteToUDP(encoded, addr); err != nil {
+				t.Fatal(err)
+			}
+			// Keep the copies in WAN order
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	for _, want := range payloads {
+		select {
+		case got := <-b.Receive():
+			if string(got) != want {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+
+	select {
+	case got := <-b.Receive():
+		t.Fatalf("duplicate delivered: %q", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	stats := b.GetDuplicateStats()
+	if stats[1].Accepted != 3 || stats[2].Suppressed != 3 {
+		t.Fatalf("duplicate stats = %+v", stats)
+	}
+}
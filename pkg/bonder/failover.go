@@ -0,0 +1,64 @@
+package bonder
+
+import (
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+	"github.com/thelastdreamer/MultiWANBond/pkg/router"
+)
+
+// failbackCheckInterval is how often failback to a recovered WAN is considered
+const failbackCheckInterval = time.Second
+
+// FailoverHandler is called when traffic moves from one WAN to another in
+// failover mode
+type FailoverHandler func(fromWAN, toWAN uint8, reason string)
+
+// configureFailover creates the failover manager that picks the active WAN
+// in LoadBalanceFailover mode
+func (b *Bonder) configureFailover(holdDown, stability time.Duration) {
+	b.failover = router.NewFailoverManager(b.router)
+	b.failover.SetTimers(holdDown, stability)
+	b.failover.SetFailoverCallback(b.onFailover)
+	b.router.SetFailoverManager(b.failover)
+}
+
+// SetFailoverHandler sets the function called on every failover and failback
+func (b *Bonder) SetFailoverHandler(handler FailoverHandler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failoverHandler = handler
+}
+
+// failoverActive reports whether the failover manager moves traffic, which
+// it only does in LoadBalanceFailover mode
+func (b *Bonder) failoverActive() bool {
+	return b.router.GetMode() == protocol.LoadBalanceFailover
+}
+
+// GetFailoverManager returns the failover manager
+func (b *Bonder) GetFailoverManager() *router.FailoverManager {
+	return b.failover
+}
+
+// onFailover raises an alert and tells the failover handler, unless the
+// routing mode leaves the move without effect on traffic
+func (b *Bonder) onFailover(fromWAN, toWAN uint8, reason string) {
+	if !b.failoverActive() {
+		return
+	}
+
+	b.pluginManager.Alert(protocol.AlertLevelWarning, "WAN failover", map[string]interface{}{
+		"from_wan": fromWAN,
+		"to_wan":   toWAN,
+		"reason":   reason,
+	})
+
+	b.mu.RLock()
+	handler := b.failoverHandler
+	b.mu.RUnlock()
+
+	if handler != nil {
+		handler(fromWAN, toWAN, reason)
+	}
+}
@@ -0,0 +1,84 @@
+package bonder
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+)
+
+func TestFailoverOnlyInFailoverMode(t *testing.T) {
+	for _, tt := range []struct {
+		mode string
+		want bool
+	}{
+		{"failover", true},
+		{"round_robin", false},
+		{"adaptive", false},
+	} {
+		t.Run(tt.mode, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Routing.Mode = tt.mode
+			client, server := newLoopbackPairWith(t, cfg, testConfig())
+
+			var called atomic.Bool
+			client.SetFailoverHandler(func(fromWAN, toWAN uint8, reason string) { called.Store(true) })
+
+			// The primary WAN leads nowhere, so it goes down once probed
+			conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := client.AddWAN(&protocol.WANInterface{
+				ID:         2,
+				Name:       "dead",
+				LocalAddr:  net.IPv4(127, 0, 0, 1),
+				RemoteAddr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1},
+				Conn:       conn,
+				Metrics:    &protocol.WANMetrics{},
+				State:      protocol.WANStateUp,
+				Config: protocol.WANConfig{
+					Enabled:             true,
+					Weight:              1,
+					Priority:            0,
+					HealthCheckInterval: 20 * time.Millisecond,
+					FailureThreshold:    1,
+				},
+			}); err != nil {
+				t.Fatal(err)
+			}
+			client.wans[1].Config.Priority = 1
+			client.configureFailover(cfg.Routing.FailoverTimers())
+			client.failover.UpdateWANsByPriority(client.wans)
+			if active := client.failover.GetActiveWAN(); active != 2 {
+				t.Fatalf("active WAN = %d, want 2", active)
+			}
+
+			ctx := context.Background()
+			if err := client.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer client.Stop()
+			if err := server.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer server.Stop()
+
+			waitFor(t, "the primary WAN to go down", func() bool {
+				state, _ := client.healthChecker.GetState(2)
+				return state == protocol.WANStateDown
+			})
+
+			deadline := time.Now().Add(500 * time.Millisecond)
+			for !called.Load() && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if called.Load() != tt.want {
+				t.Errorf("failover handler called = %v, want %v", called.Load(), tt.want)
+			}
+		})
+	}
+}
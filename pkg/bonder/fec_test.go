@@ -0,0 +1,76 @@
+package bonder
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/plugin"
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+)
+
+// lossFilter drops incoming data packets with the given sequence IDs
+type lossFilter struct {
+	*plugin.BasePlugin
+	drop map[uint64]bool
+}
+
+func (f *lossFilter) FilterOutgoing(pkt *protocol.Packet) (*protocol.Packet, error) {
+	return pkt, nil
+}
+
+func (f *lossFilter) FilterIncoming(pkt *protocol.Packet) (*protocol.Packet, error) {
+	if pkt.Type == protocol.PacketTypeData && f.drop[pkt.SequenceID] {
+		return nil, nil
+	}
+	return pkt, nil
+}
+
+func (f *lossFilter) Priority() int { return 0 }
+
+func TestFECRecoversLostPacket(t *testing.T) {
+	client, server := newLoopbackPair(t)
+	for _, b := range []*Bonder{client, server} {
+		cfg := *b.session.Config
+		cfg.FECEnabled = true
+		b.UpdateConfig(&cfg)
+	}
+
+	// Lose the last packet of the first block on the way in
+	filter := &lossFilter{BasePlugin: plugin.NewBasePlugin("loss", "1.0"), drop: map[uint64]bool{4: true}}
+	if err := server.pluginManager.Register(filter); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	payloads := []string{"one", "two", "three", "four"}
+	for _, p := range payloads {
+		if err := client.Send([]byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, want := range payloads {
+		select {
+		case got := <-server.Receive():
+			if string(got) != want {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+
+	if stats := server.GetFECStats(); stats.Recovered != 1 {
+		t.Fatalf("recovered = %d, want 1", stats.Recovered)
+	}
+}
@@ -0,0 +1,110 @@
+package bonder
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/config"
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+	"github.com/thelastdreamer/MultiWANBond/pkg/security"
+)
+
+// configureSecurity sets up tunnel encryption, either from a pre-shared key
+// or from session keys agreed in a Noise handshake
+func (b *Bonder) configureSecurity(cfg *config.SecurityConfig) error {
+	encType, err := security.ParseEncryptionType(cfg.Cipher)
+	if err != nil {
+		return err
+	}
+
+	if cfg.Handshake == "" {
+		b.tunnelCipher, err = security.NewTunnelCipher(encType, []byte(cfg.PreSharedKey), cfg.ReplayWindow)
+		return err
+	}
+
+	noiseConfig, err := cfg.ToNoiseConfig()
+	if err != nil {
+		return err
+	}
+	if b.tunnelCipher, err = security.NewSessionCipher(encType, cfg.ReplayWindow); err != nil {
+		return err
+	}
+	if b.noiseSession, err = security.NewNoiseSession(*noiseConfig, b.tunnelCipher); err != nil {
+		return err
+	}
+	b.keyRotation = cfg.KeyRotation()
+
+	return nil
+}
+
+// GetHandshakeStats returns handshake counters, or nil if no handshake is configured
+func (b *Bonder) GetHandshakeStats() *security.NoiseStats {
+	if b.noiseSession == nil {
+		return nil
+	}
+	return b.noiseSession.GetStats()
+}
+
+// SessionEstablished reports whether packets can be sent over the tunnel.
+// It is always true unless a handshake is configured and has not completed.
+func (b *Bonder) SessionEstablished() bool {
+	return b.noiseSession == nil || b.noiseSession.Established()
+}
+
+// handshakeLoop starts the first handshake, retries it until it completes
+// and rekeys every key rotation interval. Only initiators send anything.
+func (b *Bonder) handshakeLoop() {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+
+	attempt := 0
+	for {
+		if b.noiseSession.NeedsHandshake(b.keyRotation) {
+			if msg, err := b.noiseSession.Initiate(); err == nil {
+				b.sendHandshake(attempt, msg)
+				attempt++
+			}
+		}
+
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sendHandshake sends a handshake initiation on one usable WAN.
+// Retries move to the next WAN, so a dead link cannot stall the handshake.
+func (b *Bonder) sendHandshake(attempt int, msg []byte) {
+	wans := b.usableWANs()
+	if len(wans) == 0 {
+		return
+	}
+
+	wan := wans[attempt%len(wans)]
+	b.sendControl(wan, wan.RemoteAddr, &protocol.Handshake{Payload: msg})
+}
+
+// decodeClearHandshake decodes an unencrypted packet, which is only accepted
+// when it carries a handshake message
+func (b *Bonder) decodeClearHandshake(data []byte) (*protocol.Packet, error) {
+	if b.noiseSession == nil {
+		return nil, fmt.Errorf("unencrypted packet")
+	}
+
+	pkt, err := b.processor.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	if pkt.Type != protocol.PacketTypeControl {
+		return nil, fmt.Errorf("unencrypted packet")
+	}
+	if msg, err := protocol.DecodeControl(pkt.Data); err != nil || msg.ControlType() != protocol.ControlHandshake {
+		return nil, fmt.Errorf("unencrypted packet")
+	}
+
+	return pkt, nil
+}
@@ -0,0 +1,86 @@
+package bonder
+
+import (
+	"net"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/health"
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+)
+
+// sendProbe sends a health checker probe to the peer. Probes wait for the
+// session keys, since the peer cannot read them before.
+func (b *Bonder) sendProbe(wan *protocol.WANInterface, hb *protocol.Heartbeat) error {
+	if !b.SessionEstablished() {
+		return health.ErrProbeSkipped
+	}
+	return b.sendHeartbeat(wan, wan.RemoteAddr, hb)
+}
+
+// sendHeartbeat sends a heartbeat on a WAN
+func (b *Bonder) sendHeartbeat(wan *protocol.WANInterface, addr *net.UDPAddr, hb *protocol.Heartbeat) error {
+	pkt := &protocol.Packet{
+		Version:   protocol.ProtocolVersion,
+		Type:      protocol.PacketTypeHeartbeat,
+		SessionID: b.session.ID,
+		Timestamp: time.Now().UnixNano(),
+		WANID:     wan.ID,
+		Priority:  255,
+		Data:      protocol.EncodeHeartbeat(hb),
+	}
+
+	encoded, err := b.processor.Encode(pkt)
+	if err != nil {
+		return err
+	}
+	return b.writeTo(wan, encoded, addr)
+}
+
+// sendPaddedHeartbeat sends a heartbeat padded to a datagram of the given size
+func (b *Bonder) sendPaddedHeartbeat(wan *protocol.WANInterface, hb *protocol.Heartbeat, size int) error {
+	data := protocol.EncodeHeartbeat(hb)
+	if pad := size - b.datagramOverhead() - len(data); pad > 0 {
+		data = append(data, make([]byte, pad)...)
+	}
+
+	pkt := &protocol.Packet{
+		Version:   protocol.ProtocolVersion,
+		Type:      protocol.PacketTypeHeartbeat,
+		SessionID: b.session.ID,
+		Timestamp: time.Now().UnixNano(),
+		WANID:     wan.ID,
+		Priority:  255,
+		Data:      data,
+	}
+
+	encoded, err := b.processor.Encode(pkt)
+	if err != nil {
+		return err
+	}
+	return b.writeTo(wan, encoded, wan.RemoteAddr)
+}
+
+// handleHeartbeat answers probes from the peer on the WAN they came in on and
+// passes replies to our own probes to the health checker, or to the path MTU
+// prober for path MTU probes. Packets of probe trains are measured instead.
+func (b *Bonder) handleHeartbeat(wan *protocol.WANInterface, pkt *protocol.Packet, addr *net.UDPAddr, received time.Time) {
+	hb, err := protocol.DecodeHeartbeat(pkt.Data)
+	if err != nil {
+		return
+	}
+
+	if hb.IsTrain() {
+		b.handleTrain(wan, hb, len(pkt.Data)+b.datagramOverhead(), received)
+		return
+	}
+
+	if hb.IsReply() {
+		if hb.IsMTUProbe() {
+			b.handleMTUProbeReply(wan, hb, received)
+			return
+		}
+		b.healthChecker.HandleHeartbeat(wan.ID, hb, received)
+		return
+	}
+	b.sendHeartbeat(wan, addr, hb.Reply(received.UnixNano(), time.Now().UnixNano()))
+}
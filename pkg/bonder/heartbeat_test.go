@@ -0,0 +1,64 @@
+package bonder
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/plugin"
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+)
+
+// replyFilter drops incoming heartbeat replies with the given probe numbers
+type replyFilter struct {
+	*plugin.BasePlugin
+	drop map[uint32]bool
+}
+
+func (f *replyFilter) FilterOutgoing(pkt *protocol.Packet) (*protocol.Packet, error) {
+	return pkt, nil
+}
+
+func (f *replyFilter) FilterIncoming(pkt *protocol.Packet) (*protocol.Packet, error) {
+	if pkt.Type == protocol.PacketTypeHeartbeat {
+		if hb, err := protocol.DecodeHeartbeat(pkt.Data); err == nil && hb.IsReply() && f.drop[hb.Seq] {
+			return nil, nil
+		}
+	}
+	return pkt, nil
+}
+
+func (f *replyFilter) Priority() int { return 0 }
+
+func TestHeartbeatsMeasureWAN(t *testing.T) {
+	client, server := newLoopbackPair(t)
+	client.wans[1].Config.HealthCheckInterval = 20 * time.Millisecond
+
+	filter := &replyFilter{BasePlugin: plugin.NewBasePlugin("loss", "1.0"), drop: map[uint32]bool{3: true}}
+	if err := client.pluginManager.Register(filter); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	var metrics *protocol.WANMetrics
+	waitFor(t, "heartbeat replies", func() bool {
+		metrics = client.GetMetrics()[1]
+		return metrics != nil && metrics.PacketsLost > 0 && metrics.Latency > 0
+	})
+
+	if metrics.PacketsLost != 1 || metrics.PacketLoss <= 0 {
+		t.Fatalf("expected one lost probe, got %d (%.1f%%)", metrics.PacketsLost, metrics.PacketLoss)
+	}
+	if metrics.ForwardDelay <= 0 && metrics.ReverseDelay <= 0 {
+		t.Fatalf("expected one-way delay estimates, got %+v", metrics)
+	}
+}
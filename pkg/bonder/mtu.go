@@ -0,0 +1,244 @@
+package bonder
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/fec"
+	"github.com/thelastdreamer/MultiWANBond/pkg/network/tun"
+	"github.com/thelastdreamer/MultiWANBond/pkg/packet"
+	"github.com/thelastdreamer/MultiWANBond/pkg/pmtud"
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+)
+
+// mtuInterval is how often the path MTU probers are asked for probes
+const mtuInterval = 100 * time.Millisecond
+
+// addProber starts path MTU discovery on a new WAN. b.mu must be held.
+func (b *Bonder) addProber(wan *protocol.WANInterface) {
+	if b.mtuCfg == nil {
+		return
+	}
+
+	// Without the don't-fragment bit, as on platforms that cannot set it,
+	// probes may be fragmented on the way and discovery finds the largest size
+	pmtud.SetDontFragment(wan.Conn)
+	b.probers[wan.ID] = pmtud.NewProber(*b.mtuCfg)
+}
+
+// removeProber stops path MTU discovery on a removed WAN. b.mu must be held.
+func (b *Bonder) removeProber(wanID uint8) {
+	delete(b.probers, wanID)
+	delete(b.announcedMTUs, wanID)
+}
+
+// pathMTU returns the largest datagram to send on a WAN: the size discovered
+// on it, or else the size the peer discovered in the other direction
+func (b *Bonder) pathMTU(wanID uint8) int {
+	b.mu.RLock()
+	prober := b.probers[wanID]
+	b.mu.RUnlock()
+
+	if prober != nil {
+		return prober.MTU()
+	}
+
+	b.peerMu.Lock()
+	defer b.peerMu.Unlock()
+	if mtu, exists := b.peer.PathMTUs[wanID]; exists {
+		return mtu
+	}
+	return pmtud.DefaultMaxMTU
+}
+
+// datagramOverhead returns how many bytes the tunnel adds to packet data
+func (b *Bonder) datagramOverhead() int {
+	if b.tunnelCipher != nil {
+		return packet.HeaderSize + b.tunnelCipher.Overhead()
+	}
+	return packet.HeaderSize
+}
+
+// datagrams returns what carries an encoded data or parity packet on a WAN: the packet
+// itself, or its fragments when it does not fit the WAN's path MTU and the
+// peer reassembles fragments
+func (b *Bonder) datagrams(wan *protocol.WANInterface, pkt *protocol.Packet, encoded []byte) ([][]byte, error) {
+	maxData := b.pathMTU(wan.ID) - b.datagramOverhead()
+	if len(pkt.Data) <= maxData || !b.peerFragments.Load() {
+		return [][]byte{encoded}, nil
+	}
+
+	fragments, err := packet.Fragment(pkt, b.fragmentID.Add(1), maxData)
+	if err != nil {
+		return nil, fmt.Errorf("fragment error: %w", err)
+	}
+
+	datagrams := make([][]byte, len(fragments))
+	for i, fragment := range fragments {
+		if datagrams[i], err = b.processor.Encode(fragment); err != nil {
+			return nil, fmt.Errorf("encode error: %w", err)
+		}
+	}
+	return datagrams, nil
+}
+
+// mtuLoop sends the probes the path MTU probers ask for and announces the
+// sizes they find
+func (b *Bonder) mtuLoop() {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(mtuInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+
+		case now := <-ticker.C:
+			// Probes are heartbeats, which the peer cannot read before the session keys
+			if !b.SessionEstablished() {
+				continue
+			}
+
+			for _, wan := range b.usableWANs() {
+				b.mu.RLock()
+				prober := b.probers[wan.ID]
+				b.mu.RUnlock()
+
+				if prober == nil {
+					continue
+				}
+				if size, ok := prober.Probe(now); ok {
+					if err := b.sendMTUProbe(wan, size); pmtud.IsMessageTooLong(err) {
+						prober.Failed(size, now)
+					}
+				}
+			}
+			b.announcePathMTUs()
+		}
+	}
+}
+
+// sendMTUProbe sends a path MTU probe padded to a datagram of the given size
+func (b *Bonder) sendMTUProbe(wan *protocol.WANInterface, size int) error {
+	hb := &protocol.Heartbeat{
+		Flags: protocol.HeartbeatMTUProbe,
+		Seq:   uint32(size),
+		Sent:  time.Now().UnixNano(),
+	}
+	return b.sendPaddedHeartbeat(wan, hb, size)
+}
+
+// handleMTUProbeReply passes the peer's answer to a path MTU probe to the
+// WAN's prober
+func (b *Bonder) handleMTUProbeReply(wan *protocol.WANInterface, hb *protocol.Heartbeat, received time.Time) {
+	b.mu.RLock()
+	prober := b.probers[wan.ID]
+	b.mu.RUnlock()
+
+	if prober != nil {
+		prober.Acked(int(hb.Seq), received)
+	}
+}
+
+// announcePathMTUs tells the peer about path MTUs that changed, so it can
+// size its datagrams by them, and fits the TUN device to the new sizes
+func (b *Bonder) announcePathMTUs() {
+	changed := false
+	for _, wan := range b.usableWANs() {
+		b.mu.Lock()
+		prober := b.probers[wan.ID]
+		mtu, announced := 0, true
+		if prober != nil {
+			mtu = prober.MTU()
+			announced = b.announcedMTUs[wan.ID] == mtu
+			b.announcedMTUs[wan.ID] = mtu
+		}
+		b.mu.Unlock()
+
+		if !announced {
+			if b.peerFragments.Load() {
+				b.sendControl(wan, wan.RemoteAddr, &protocol.PathMTU{WANID: wan.ID, MTU: uint16(mtu)})
+			}
+			changed = true
+		}
+	}
+
+	if changed {
+		b.updateTUNMTU()
+	}
+}
+
+// TunnelMTU returns the largest packet the bond carries on every usable WAN
+// without fragmenting it, or the parity FEC sends for it
+func (b *Bonder) TunnelMTU() int {
+	mtu := 0
+	for _, wan := range b.usableWANs() {
+		if wanMTU := b.pathMTU(wan.ID); mtu == 0 || wanMTU < mtu {
+			mtu = wanMTU
+		}
+	}
+	if mtu == 0 {
+		mtu = pmtud.DefaultMaxMTU
+	}
+	if b.fecManager.IsEnabled() {
+		mtu -= fec.ParityOverhead
+	}
+	return mtu - b.datagramOverhead()
+}
+
+// updateTUNMTU advertises the tunnel MTU to the TUN device, so the host
+// sends packets that are not fragmented. The device never gets a larger MTU
+// than it was attached with.
+func (b *Bonder) updateTUNMTU() {
+	b.mu.RLock()
+	dev, ok := b.tunDevice.(tun.MTUSetter)
+	limit := b.tunMTU
+	b.mu.RUnlock()
+
+	if !ok {
+		return
+	}
+
+	mtu := max(min(b.TunnelMTU(), limit), tun.MinMTU)
+	if mtu != b.tunDevice.MTU() {
+		dev.SetMTU(mtu)
+	}
+}
+
+// handlePathMTU records the path MTU the peer discovered on a WAN
+func (b *Bonder) handlePathMTU(wan *protocol.WANInterface, msg protocol.ControlMessage, addr *net.UDPAddr) {
+	m := msg.(*protocol.PathMTU)
+
+	b.peerMu.Lock()
+	defer b.peerMu.Unlock()
+
+	if b.peer.PathMTUs == nil {
+		b.peer.PathMTUs = make(map[uint8]int)
+	}
+	b.peer.PathMTUs[m.WANID] = int(m.MTU)
+}
+
+// GetPathMTUStats returns the path MTU discovery state of every WAN, or nil
+// when discovery is disabled
+func (b *Bonder) GetPathMTUStats() map[uint8]pmtud.Stats {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.mtuCfg == nil {
+		return nil
+	}
+
+	stats := make(map[uint8]pmtud.Stats, len(b.probers))
+	for id, prober := range b.probers {
+		stats[id] = prober.Stats()
+	}
+	return stats
+}
+
+// GetReassemblyStats returns the counters of fragments received from the peer
+func (b *Bonder) GetReassemblyStats() packet.ReassemblyStats {
+	return b.reassembler.Stats()
+}
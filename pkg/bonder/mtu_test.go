@@ -0,0 +1,154 @@
+package bonder
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/network/tun"
+	"github.com/thelastdreamer/MultiWANBond/pkg/pmtud"
+)
+
+// mtuDevice is a fakeDevice whose MTU can be changed
+type mtuDevice struct {
+	*fakeDevice
+	mtu atomic.Int32
+}
+
+func (d *mtuDevice) MTU() int { return int(d.mtu.Load()) }
+
+func (d *mtuDevice) SetMTU(mtu int) error {
+	d.mtu.Store(int32(mtu))
+	return nil
+}
+
+func TestPathMTUDiscoveryAndFragmentation(t *testing.T) {
+	const proxyMTU = 1300
+
+	client, server := newLoopbackPair(t)
+
+	proxy := newLossyProxy(t, server.wans[1].Conn.LocalAddr().(*net.UDPAddr))
+	proxy.mu.Lock()
+	proxy.mtu = proxyMTU
+	proxy.mu.Unlock()
+	client.wans[1].RemoteAddr = proxy.conn.LocalAddr().(*net.UDPAddr)
+	client.probers[1] = pmtud.NewProber(pmtud.Config{ProbeTimeout: 50 * time.Millisecond})
+
+	dev := &mtuDevice{fakeDevice: newFakeDevice("tun-client")}
+	dev.mtu.Store(tun.DefaultMTU)
+	if err := client.AttachTUN(dev); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	waitFor(t, "fragmentation support", client.peerFragments.Load)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for client.GetPathMTUStats()[1].State != pmtud.StateSearchComplete {
+		if time.Now().After(deadline) {
+			t.Fatalf("path MTU search did not complete: %+v", client.GetPathMTUStats()[1])
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	stats := client.GetPathMTUStats()[1]
+	if stats.MTU > proxyMTU || stats.MTU <= proxyMTU-8 {
+		t.Fatalf("discovered MTU %d, want just under %d", stats.MTU, proxyMTU)
+	}
+	if want := stats.MTU - client.datagramOverhead(); client.TunnelMTU() != want {
+		t.Errorf("tunnel MTU = %d, want %d", client.TunnelMTU(), want)
+	}
+	waitFor(t, "TUN MTU update", func() bool { return dev.MTU() == client.TunnelMTU() })
+
+	// A packet larger than the path MTU arrives whole
+	payload := make([]byte, 4000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	if err := client.Send(payload); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-server.Receive():
+		if !bytes.Equal(got, payload) {
+			t.Fatalf("got %d bytes, want the %d byte payload", len(got), len(payload))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the fragmented packet")
+	}
+
+	if reassembly := server.GetReassemblyStats(); reassembly.Reassembled != 1 || reassembly.Invalid != 0 {
+		t.Errorf("server reassembly stats = %+v", reassembly)
+	}
+}
+
+func TestFECRecoversAtPathMTU(t *testing.T) {
+	const proxyMTU = 1300
+
+	client, server := newLoopbackPair(t)
+	for _, b := range []*Bonder{client, server} {
+		cfg := *b.session.Config
+		cfg.FECEnabled = true
+		b.UpdateConfig(&cfg)
+	}
+
+	// Lose the last packet of each of the first two blocks
+	proxy := newLossyProxy(t, server.wans[1].Conn.LocalAddr().(*net.UDPAddr), 4, 8)
+	proxy.mu.Lock()
+	proxy.mtu = proxyMTU
+	proxy.mu.Unlock()
+	client.wans[1].RemoteAddr = proxy.conn.LocalAddr().(*net.UDPAddr)
+	client.probers[1] = pmtud.NewProber(pmtud.Config{ProbeTimeout: 50 * time.Millisecond})
+
+	ctx := context.Background()
+	if err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	waitFor(t, "fragmentation support", client.peerFragments.Load)
+	waitFor(t, "the path MTU", func() bool { return client.GetPathMTUStats()[1].State == pmtud.StateSearchComplete })
+
+	// Full-size packets, whose parity must fit the path too, then packets
+	// fragmented along with their parity
+	var payloads [][]byte
+	for i, size := range []int{client.TunnelMTU(), client.TunnelMTU(), client.TunnelMTU(), client.TunnelMTU(), 2000, 2000, 2000, 2000} {
+		payloads = append(payloads, bytes.Repeat([]byte{byte(i + 1)}, size))
+	}
+	for _, payload := range payloads {
+		if err := client.Send(payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, want := range payloads {
+		select {
+		case got := <-server.Receive():
+			if !bytes.Equal(got, want) {
+				t.Fatalf("packet %d: got %d bytes of %d, want %d bytes of %d", i+1, len(got), got[0], len(want), want[0])
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for packet %d", i+1)
+		}
+	}
+
+	if stats := server.GetFECStats(); stats.Recovered < 2 {
+		t.Errorf("recovered = %d, want at least 2", stats.Recovered)
+	}
+}
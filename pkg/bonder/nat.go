@@ -0,0 +1,194 @@
+package bonder
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/nat"
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+)
+
+// natInfoInterval is how often each WAN's NAT info is brought up to date,
+// and failed NAT discovery retried
+const natInfoInterval = 30 * time.Second
+
+// relayGrace is how long after NAT discovery a session has to come up
+// before the WANs that may need a relay fall back to one
+const relayGrace = natInfoInterval
+
+// addNAT sets up NAT traversal on a new WAN's own socket, as each WAN sits
+// behind a NAT of its own. WANs carried by a relay have no NAT of their own
+// to traverse. b.mu must be held.
+func (b *Bonder) addNAT(wan *protocol.WANInterface) {
+	if b.natCfg == nil || wan.Relay != nil {
+		return
+	}
+	b.natManagers[wan.ID] = nat.NewWANManager(wan.Conn, b.natCfg)
+}
+
+// removeNAT detaches NAT traversal from a removed WAN and returns its
+// manager, or nil. Stopping the manager releases its TURN allocation, which
+// waits on the TURN server, so it is left to the caller once b.mu is
+// released. b.mu must be held.
+func (b *Bonder) removeNAT(wanID uint8) *nat.Manager {
+	mgr := b.natManagers[wanID]
+	delete(b.natManagers, wanID)
+	return mgr
+}
+
+// startNAT starts NAT traversal on a WAN. b.mu must be held.
+func (b *Bonder) startNAT(wan *protocol.WANInterface) {
+	if mgr := b.natManagers[wan.ID]; mgr != nil {
+		b.wg.Add(1)
+		go b.natLoop(wan, mgr)
+
+		if b.natCfg.Binding != nil {
+			b.wg.Add(1)
+			go b.bindingLoop(wan, mgr)
+		}
+	}
+}
+
+// stopNAT stops NAT traversal on all WANs, ending discoveries in progress
+func (b *Bonder) stopNAT() {
+	b.mu.RLock()
+	managers := make([]*nat.Manager, 0, len(b.natManagers))
+	for _, mgr := range b.natManagers {
+		managers = append(managers, mgr)
+	}
+	b.mu.RUnlock()
+
+	for _, mgr := range managers {
+		mgr.Stop()
+	}
+}
+
+// natManager returns the NAT traversal manager of a WAN, or nil
+func (b *Bonder) natManager(wanID uint8) *nat.Manager {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.natManagers[wanID]
+}
+
+// natLoop discovers the NAT a WAN is behind, retrying until discovery
+// succeeds, and then keeps the WAN's NAT info up to date
+func (b *Bonder) natLoop(wan *protocol.WANInterface, mgr *nat.Manager) {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(natInfoInterval)
+	defer ticker.Stop()
+
+	started := false
+	var discovered time.Time
+	for {
+		if !started && mgr.Initialize() == nil {
+			started = mgr.Start() == nil
+			discovered = time.Now()
+		}
+		if started {
+			b.updateNATInfo(wan, mgr)
+			b.relayNAT(wan, mgr, discovered)
+		}
+
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-mgr.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// relayNAT puts a WAN behind a TURN allocation made on the WAN's address
+// when it needs a relay to reach the peer
+func (b *Bonder) relayNAT(wan *protocol.WANInterface, mgr *nat.Manager, discovered time.Time) {
+	if b.natCfg.TURN == nil || !b.needsRelay(wan, mgr.GetNATType(), discovered) {
+		return
+	}
+
+	// The manager releases the allocation when the WAN goes
+	relay, err := mgr.Relay()
+	if errors.Is(err, net.ErrClosed) {
+		// The WAN went meanwhile
+		return
+	}
+	if err != nil {
+		b.pluginManager.Alert(protocol.AlertLevelWarning, "TURN allocation failed", map[string]interface{}{
+			"wan_id": wan.ID,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	b.mu.Lock()
+	wan.Relay = relay
+	b.mu.Unlock()
+}
+
+// needsRelay reports whether a WAN behind a NAT of natType, discovered at
+// the given time, needs a relay: the NAT type may need one, and the direct
+// path to the peer fails. It fails when heartbeats on the WAN go unanswered,
+// or when no session has come up within relayGrace. A peer with a public
+// address is reached directly even from behind a symmetric NAT, so the type
+// alone does not decide.
+func (b *Bonder) needsRelay(wan *protocol.WANInterface, natType nat.NATType, discovered time.Time) bool {
+	if !natType.NeedsRelay() {
+		return false
+	}
+
+	b.mu.RLock()
+	relayed, peer, state := wan.Relay != nil, wan.RemoteAddr, b.wanState(wan)
+	b.mu.RUnlock()
+	if relayed || peer == nil {
+		return false
+	}
+
+	if b.SessionEstablished() {
+		return state == protocol.WANStateDown
+	}
+	return time.Since(discovered) >= relayGrace
+}
+
+// updateNATInfo stores what a WAN's NAT traversal has learned on the WAN
+func (b *Bonder) updateNATInfo(wan *protocol.WANInterface, mgr *nat.Manager) {
+	natType := mgr.GetNATType()
+	info := &protocol.WANNATInfo{
+		LocalAddr:         mgr.GetLocalAddr(),
+		PublicAddr:        mgr.GetPublicAddr(),
+		NATType:           natType.String(),
+		CanDirectConnect:  natType.CanDirectConnect(),
+		NeedsRelay:        natType.NeedsRelay(),
+		RelayAvailable:    mgr.GetTraversalCapabilities().RelayAvailable,
+		CGNATDetected:     mgr.IsCGNATDetected(),
+		KeepAliveInterval: mgr.GetKeepAliveInterval(),
+		BindingLifetime:   mgr.GetBindingLifetime(),
+		Updated:           time.Now(),
+	}
+
+	b.mu.Lock()
+	wan.NAT = info
+	b.mu.Unlock()
+}
+
+// GetNATManager returns the NAT traversal manager of a WAN, or nil when the
+// WAN has none
+func (b *Bonder) GetNATManager(wanID uint8) *nat.Manager {
+	return b.natManager(wanID)
+}
+
+// GetNATInfo returns what NAT traversal has learned about each WAN whose
+// discovery succeeded
+func (b *Bonder) GetNATInfo() map[uint8]protocol.WANNATInfo {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	info := make(map[uint8]protocol.WANNATInfo)
+	for id, wan := range b.wans {
+		if wan.NAT != nil {
+			info[id] = *wan.NAT
+		}
+	}
+	return info
+}
@@ -0,0 +1,233 @@
+package bonder
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/config"
+	"github.com/thelastdreamer/MultiWANBond/pkg/nat"
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+)
+
+func TestNATTraversalPerWAN(t *testing.T) {
+	stun := nat.NewSTUNServer(&nat.STUNServerConfig{Address: "127.0.0.1:0"})
+	if err := stun.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stun.Stop()
+
+	cfg := config.DefaultConfig()
+	cfg.NAT = &config.NATConfig{
+		Enabled:    true,
+		STUNServer: stun.LocalAddr().String(),
+		Timeout:    "300ms",
+		TURNServer: "127.0.0.1:1", // available, but not needed behind no NAT
+	}
+	b, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two WANs without a peer yet, each discovering its own mapping
+	for id := uint8(1); id <= 2; id++ {
+		wan := &protocol.WANInterface{
+			ID:        id,
+			Name:      "lo",
+			LocalAddr: net.IPv4(127, 0, 0, 1),
+			Metrics:   &protocol.WANMetrics{},
+			State:     protocol.WANStateUp,
+			Config: protocol.WANConfig{
+				Enabled:             true,
+				Weight:              1,
+				HealthCheckInterval: time.Hour, // keep the checker off the socket
+			},
+		}
+		if err := b.AddWAN(wan); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := b.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Stop()
+
+	waitFor(t, "NAT discovery on both WANs", func() bool { return len(b.GetNATInfo()) == 2 })
+
+	wans := b.GetWANs()
+	for id, info := range b.GetNATInfo() {
+		local := wans[id].Conn.LocalAddr().(*net.UDPAddr)
+		if info.PublicAddr.String() != local.String() {
+			t.Errorf("WAN %d: public address = %s, want its own socket's %s", id, info.PublicAddr, local)
+		}
+		if info.NATType != nat.NATTypeOpen.String() || !info.CanDirectConnect || !info.RelayAvailable || info.KeepAliveInterval <= 0 {
+			t.Errorf("WAN %d: NAT info = %+v", id, info)
+		}
+		if wans[id].Relay != nil {
+			t.Errorf("WAN %d relayed behind no NAT", id)
+		}
+		if b.GetNATManager(id) == nil {
+			t.Errorf("WAN %d has no NAT manager", id)
+		}
+	}
+
+	// STUN responses never pass for the peer
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for id, wan := range b.wans {
+		if wan.RemoteAddr != nil {
+			t.Errorf("WAN %d took %s as the peer", id, wan.RemoteAddr)
+		}
+	}
+}
+
+func TestNATTraversalStopsWithWAN(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.NAT = &config.NATConfig{Enabled: true, STUNServer: "127.0.0.1:1", Timeout: "10s"}
+	b, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddWAN(&protocol.WANInterface{
+		ID:        1,
+		Name:      "lo",
+		LocalAddr: net.IPv4(127, 0, 0, 1),
+		Metrics:   &protocol.WANMetrics{},
+		State:     protocol.WANStateUp,
+		Config:    protocol.WANConfig{Enabled: true, Weight: 1, HealthCheckInterval: time.Hour},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	mgr := b.GetNATManager(1)
+	if err := b.RemoveWAN(1); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-mgr.Done():
+	default:
+		t.Error("NAT traversal still running on a removed WAN")
+	}
+
+	// Stopping does not wait out discoveries in progress
+	stopped := make(chan struct{})
+	go func() {
+		b.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Stop waited for NAT discovery")
+	}
+}
+
+// slowRelay is a relay whose Close waits, as releasing a TURN allocation
+// waits on the TURN server
+type slowRelay struct {
+	net.PacketConn
+	closing chan struct{}
+	release chan struct{}
+}
+
+func (r *slowRelay) Close() error {
+	close(r.closing)
+	<-r.release
+	return r.PacketConn.Close()
+}
+
+func TestRemoveWANClosesRelayUnlocked(t *testing.T) {
+	client, _ := newLoopbackPair(t)
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay := &slowRelay{PacketConn: conn, closing: make(chan struct{}), release: make(chan struct{})}
+	client.wans[1].Relay = relay
+
+	removed := make(chan error, 1)
+	go func() { removed <- client.RemoveWAN(1) }()
+	<-relay.closing
+
+	// The bond carries on while the relay closes
+	wans := make(chan int, 1)
+	go func() { wans <- len(client.GetWANs()) }()
+	select {
+	case n := <-wans:
+		if n != 0 {
+			t.Errorf("%d WANs left", n)
+		}
+	case <-time.After(time.Second):
+		t.Error("bond locked while the relay closes")
+	}
+
+	close(relay.release)
+	if err := <-removed; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRelayOnlyWhenDirectPathFails(t *testing.T) {
+	client, server := newLoopbackPair(t)
+	configureHandshake(t, client, server, "noise_ik", time.Hour)
+
+	// A second WAN whose direct path leads nowhere
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.AddWAN(&protocol.WANInterface{
+		ID:         2,
+		Name:       "dead",
+		LocalAddr:  net.IPv4(127, 0, 0, 1),
+		RemoteAddr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1},
+		Conn:       conn,
+		Metrics:    &protocol.WANMetrics{},
+		State:      protocol.WANStateUp,
+		Config:     protocol.WANConfig{Enabled: true, Weight: 1, HealthCheckInterval: 20 * time.Millisecond, FailureThreshold: 1},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Before any session, WANs get the grace period to reach the peer
+	discovered := time.Now()
+	if client.needsRelay(client.wans[1], nat.NATTypeSymmetric, discovered) {
+		t.Error("relayed before the grace period ran out")
+	}
+	if !client.needsRelay(client.wans[1], nat.NATTypeSymmetric, discovered.Add(-relayGrace)) {
+		t.Error("not relayed without a session after the grace period")
+	}
+
+	ctx := context.Background()
+	if err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	waitFor(t, "the session", client.SessionEstablished)
+	waitFor(t, "the dead WAN to go down", func() bool {
+		state, _ := client.healthChecker.GetState(2)
+		return state == protocol.WANStateDown
+	})
+
+	// A symmetric NAT that reaches the peer directly stays direct
+	if client.needsRelay(client.wans[1], nat.NATTypeSymmetric, discovered.Add(-relayGrace)) {
+		t.Error("working WAN relayed")
+	}
+	if !client.needsRelay(client.wans[2], nat.NATTypeSymmetric, discovered) {
+		t.Error("failing WAN not relayed")
+	}
+	if client.needsRelay(client.wans[2], nat.NATTypeFullCone, discovered) {
+		t.Error("WAN relayed behind a NAT that needs no relay")
+	}
+}
@@ -0,0 +1,296 @@
+package bonder
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/congestion"
+	"github.com/thelastdreamer/MultiWANBond/pkg/packet"
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+)
+
+// pathQueueSize is how many data packets may wait for a WAN's congestion
+// window before new ones are dropped
+const pathQueueSize = 512
+
+// PathStats describes the congestion control state of a WAN
+type PathStats struct {
+	congestion.Stats
+	Queued  int    // Packets waiting to be sent
+	Dropped uint64 // Packets dropped because the queue was full
+}
+
+// pacedPacket is a data packet waiting for its WAN, encoded as the
+// datagrams that carry it
+type pacedPacket struct {
+	pkt       *protocol.Packet
+	datagrams [][]byte
+	sent      func() // Called once the packet is written, when set
+}
+
+// pathSender paces the data packets of one WAN under its congestion controller
+type pathSender struct {
+	wan     *protocol.WANInterface
+	cc      *congestion.Controller
+	queue   chan pacedPacket
+	urgent  chan pacedPacket // Retransmissions, sent before the queue
+	wake    chan struct{}    // Signalled when an ack may have opened the window
+	done    chan struct{}    // Closed when the WAN is removed
+	dropped atomic.Uint64
+}
+
+func newPathSender(wan *protocol.WANInterface, cfg congestion.Config) *pathSender {
+	return &pathSender{
+		wan:    wan,
+		cc:     congestion.NewController(cfg),
+		queue:  make(chan pacedPacket, pathQueueSize),
+		urgent: make(chan pacedPacket, pathQueueSize/8),
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+}
+
+// congestionActive reports whether data packets go through the per-WAN
+// congestion controllers, which needs the peer to ack them
+func (b *Bonder) congestionActive() bool {
+	return b.congestionCfg != nil && b.peerAcks.Load()
+}
+
+// addPath creates the congestion controller of a new WAN. b.mu must be held.
+func (b *Bonder) addPath(wan *protocol.WANInterface) {
+	if b.congestionCfg == nil {
+		return
+	}
+
+	path := newPathSender(wan, *b.congestionCfg)
+	b.paths[wan.ID] = path
+	b.router.SetCapacityEstimator(wan.ID, path.cc)
+
+	if b.running.Load() {
+		b.wg.Add(1)
+		go b.pacerLoop(path)
+	}
+}
+
+// removePath stops the pacer of a removed WAN. b.mu must be held.
+func (b *Bonder) removePath(wanID uint8) {
+	if path, exists := b.paths[wanID]; exists {
+		close(path.done)
+		delete(b.paths, wanID)
+	}
+	b.acks.Remove(wanID)
+}
+
+// transmit sends an encoded data packet on a WAN, fragmented to the WAN's
+// path MTU, queueing it behind the WAN's congestion controller when
+// congestion control is active. Urgent packets go ahead of the queue.
+// Packets that do not fit in the queue are dropped, as a full router queue
+// would. sent, when set, is called once the packet is written.
+func (b *Bonder) transmit(wan *protocol.WANInterface, pkt *protocol.Packet, encoded []byte, urgent bool, sent func()) error {
+	datagrams, err := b.datagrams(wan, pkt, encoded)
+	if err != nil {
+		return err
+	}
+
+	if b.congestionActive() {
+		b.mu.RLock()
+		path := b.paths[wan.ID]
+		b.mu.RUnlock()
+
+		if path != nil {
+			queue := path.queue
+			if urgent {
+				queue = path.urgent
+			}
+			select {
+			case queue <- pacedPacket{pkt: pkt, datagrams: datagrams, sent: sent}:
+			default:
+				path.dropped.Add(1)
+			}
+			return nil
+		}
+	}
+
+	for _, datagram := range datagrams {
+		if err := b.writeTo(wan, datagram, wan.RemoteAddr); err != nil {
+			return err
+		}
+	}
+	b.dataSent(wan.ID, pkt, sent)
+	return nil
+}
+
+// dataSent records a data packet written to a WAN
+func (b *Bonder) dataSent(wanID uint8, pkt *protocol.Packet, sent func()) {
+	if sent != nil {
+		sent()
+	}
+	if b.retransmit.Load() {
+		b.retransmitter.Sent(pkt, wanID, time.Now())
+	}
+	b.pluginManager.RecordPacket(wanID, pkt, true)
+}
+
+// pacerLoop sends the queued packets of a WAN as its congestion window and
+// pacing rate allow. The fragments of a packet are paced like packets.
+func (b *Bonder) pacerLoop(path *pathSender) {
+	defer b.wg.Done()
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		var queued pacedPacket
+		select {
+		case queued = <-path.urgent:
+		default:
+			select {
+			case <-b.ctx.Done():
+				return
+			case <-path.done:
+				return
+			case queued = <-path.urgent:
+			case queued = <-path.queue:
+			}
+		}
+
+		if !b.pace(path, queued.pkt.SequenceID, queued.datagrams, timer) {
+			return
+		}
+		b.dataSent(path.wan.ID, queued.pkt, queued.sent)
+	}
+}
+
+// pace writes the datagrams of a packet to a WAN, each as soon as the WAN's
+// congestion controller allows. It returns false when the pacer must stop.
+func (b *Bonder) pace(path *pathSender, seq uint64, datagrams [][]byte, timer *time.Timer) bool {
+	for _, datagram := range datagrams {
+		// Congestion control counts data bytes, as acks do
+		size := len(datagram) - packet.HeaderSize
+		for {
+			wait := path.cc.Delay(size, time.Now())
+			if wait == 0 {
+				break
+			}
+
+			timer.Reset(wait)
+			select {
+			case <-b.ctx.Done():
+				return false
+			case <-path.done:
+				return false
+			case <-path.wake:
+			case <-timer.C:
+			}
+		}
+
+		if err := b.writeTo(path.wan, datagram, path.wan.RemoteAddr); err != nil {
+			continue
+		}
+		path.cc.OnSent(seq, size, time.Now())
+	}
+	return true
+}
+
+// ackData records a data packet received on a WAN and acks it when due
+func (b *Bonder) ackData(wan *protocol.WANInterface, pkt *protocol.Packet, addr *net.UDPAddr, received time.Time) {
+	if ack := b.acks.Received(wan.ID, pkt.SequenceID, len(pkt.Data), received); ack != nil {
+		b.sendAck(wan, addr, ack)
+	}
+	b.bandwidthReceived(wan.ID, pkt, received)
+}
+
+// sendAck sends an ack on a WAN
+func (b *Bonder) sendAck(wan *protocol.WANInterface, addr *net.UDPAddr, ack *protocol.Ack) error {
+	pkt := &protocol.Packet{
+		Version:   protocol.ProtocolVersion,
+		Type:      protocol.PacketTypeAck,
+		SessionID: b.session.ID,
+		Timestamp: time.Now().UnixNano(),
+		WANID:     wan.ID,
+		Priority:  255,
+		Data:      protocol.EncodeAck(b.withMissing(ack)),
+	}
+
+	encoded, err := b.processor.Encode(pkt)
+	if err != nil {
+		return err
+	}
+	return b.writeTo(wan, encoded, addr)
+}
+
+// handleAck feeds an ack from the peer to the congestion controller of the
+// WAN it came in on
+func (b *Bonder) handleAck(wan *protocol.WANInterface, pkt *protocol.Packet, received time.Time) {
+	ack, err := protocol.DecodeAck(pkt.Data)
+	if err != nil {
+		return
+	}
+
+	b.bandwidthAcked(wan.ID, ack, received)
+
+	b.mu.RLock()
+	path := b.paths[wan.ID]
+	b.mu.RUnlock()
+
+	if path != nil {
+		path.cc.OnAck(ack, received)
+		select {
+		case path.wake <- struct{}{}:
+		default:
+		}
+	}
+
+	if len(ack.Missing) > 0 && b.retransmit.Load() {
+		b.retransmitLost(ack.Missing, received)
+	}
+}
+
+// ackLoop sends the acks of packets that have waited long enough
+func (b *Bonder) ackLoop() {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(congestion.AckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+
+		case now := <-ticker.C:
+			for wanID, ack := range b.acks.Due(now) {
+				b.mu.RLock()
+				wan := b.wans[wanID]
+				b.mu.RUnlock()
+
+				if wan != nil && wan.RemoteAddr != nil && wan.Conn != nil {
+					b.sendAck(wan, wan.RemoteAddr, ack)
+				}
+			}
+			b.repeatMissing(now)
+		}
+	}
+}
+
+// GetPathStats returns the congestion control state of every WAN, or nil
+// when congestion control is disabled
+func (b *Bonder) GetPathStats() map[uint8]PathStats {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.congestionCfg == nil {
+		return nil
+	}
+
+	stats := make(map[uint8]PathStats, len(b.paths))
+	for id, path := range b.paths {
+		stats[id] = PathStats{
+			Stats:   path.cc.Stats(),
+			Queued:  len(path.queue),
+			Dropped: path.dropped.Load(),
+		}
+	}
+	return stats
+}
@@ -0,0 +1,53 @@
+package bonder
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDataPacedUnderCongestionControl(t *testing.T) {
+	client, server := newLoopbackPair(t)
+
+	ctx := context.Background()
+	if err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	waitFor(t, "peer acks", client.congestionActive)
+
+	const count = 200
+	go func() {
+		for i := 0; i < count; i++ {
+			for client.Send([]byte(fmt.Sprintf("packet %d", i))) != nil {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+
+	for i := 0; i < count; i++ {
+		select {
+		case got := <-server.Receive():
+			if want := fmt.Sprintf("packet %d", i); string(got) != want {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for packet %d", i)
+		}
+	}
+
+	// Every packet went through the WAN's controller and was acked
+	waitFor(t, "acks", func() bool {
+		stats := client.GetPathStats()[1]
+		return stats.InFlight == 0 && stats.SmoothRTT > 0
+	})
+	if stats := client.GetPathStats()[1]; stats.Dropped != 0 || stats.Timeouts != 0 {
+		t.Fatalf("unexpected path stats: %+v", stats)
+	}
+}
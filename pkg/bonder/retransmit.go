@@ -0,0 +1,128 @@
+package bonder
+
+import (
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/arq"
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+)
+
+// defaultRTT is assumed for WANs without a round trip measurement
+const defaultRTT = 100 * time.Millisecond
+
+// withMissing adds the sequence IDs the reorder buffer is waiting for to an
+// ack, when the peer retransmits them
+func (b *Bonder) withMissing(ack *protocol.Ack) *protocol.Ack {
+	if !b.peerRetransmits.Load() {
+		return ack
+	}
+
+	ack.Missing = b.processor.Missing(protocol.MaxMissingRanges)
+	if len(ack.Missing) > 0 {
+		b.lastNack.Store(time.Now().UnixNano())
+	}
+	return ack
+}
+
+// repeatMissing reports missing packets again when no ack has carried them
+// for a while, as happens when the peer has stopped sending. The report goes
+// out on the WAN that received data last.
+func (b *Bonder) repeatMissing(now time.Time) {
+	if !b.peerRetransmits.Load() || b.processor.GetBufferSize() == 0 {
+		return
+	}
+	if now.Sub(time.Unix(0, b.lastNack.Load())) < arq.NackInterval {
+		return
+	}
+
+	wanID, ack, ok := b.acks.Latest(now)
+	if !ok {
+		return
+	}
+
+	b.mu.RLock()
+	wan := b.wans[wanID]
+	b.mu.RUnlock()
+
+	if wan != nil && wan.RemoteAddr != nil && wan.Conn != nil {
+		b.sendAck(wan, wan.RemoteAddr, ack)
+	}
+}
+
+// retransmitLost resends the reported missing packets that are due, each on
+// the healthiest WAN other than the one that lost it
+func (b *Bonder) retransmitLost(missing []protocol.SeqRange, now time.Time) {
+	for _, lost := range b.retransmitter.Lost(missing, now, b.wanRTT) {
+		wan := b.retransmitWAN(lost.LostOn)
+		if wan == nil {
+			continue
+		}
+
+		lost.Packet.WANID = wan.ID
+		encoded, err := b.processor.Encode(lost.Packet)
+		if err != nil {
+			continue
+		}
+		b.transmit(wan, lost.Packet, encoded, true, nil)
+	}
+}
+
+// retransmissionReceived records how long a retransmission from the peer
+// kept the reorder buffer waiting, when it fills a gap
+func (b *Bonder) retransmissionReceived(wan *protocol.WANInterface, pkt *protocol.Packet) {
+	if waited, ok := b.processor.Waited(pkt.SequenceID); ok {
+		b.retransmitter.Recovered(wan.ID, waited)
+	}
+}
+
+// wanRTT returns the best known round trip time of a WAN: the congestion
+// controller's smoothed RTT, then the health checker's average latency
+func (b *Bonder) wanRTT(wanID uint8) time.Duration {
+	b.mu.RLock()
+	path := b.paths[wanID]
+	b.mu.RUnlock()
+
+	if path != nil {
+		if rtt := path.cc.Stats().SmoothRTT; rtt > 0 {
+			return rtt
+		}
+	}
+	if m, err := b.healthChecker.GetMetrics(wanID); err == nil && m.AvgLatency > 0 {
+		return m.AvgLatency
+	}
+	return defaultRTT
+}
+
+// retransmitWAN picks the WAN for a retransmission: the usable WAN with the
+// least loss and then the lowest latency, avoiding the one that lost the
+// packet unless it is the only one left
+func (b *Bonder) retransmitWAN(lostOn uint8) *protocol.WANInterface {
+	var best, fallback *protocol.WANInterface
+	var bestLoss float64
+	var bestLatency time.Duration
+
+	for _, wan := range b.usableWANs() {
+		if wan.ID == lostOn {
+			fallback = wan
+			continue
+		}
+
+		var loss float64
+		latency := defaultRTT
+		if m, err := b.healthChecker.GetMetrics(wan.ID); err == nil {
+			loss = m.PacketLoss
+			if m.AvgLatency > 0 {
+				latency = m.AvgLatency
+			}
+		}
+
+		if best == nil || loss < bestLoss || (loss == bestLoss && latency < bestLatency) {
+			best, bestLoss, bestLatency = wan, loss, latency
+		}
+	}
+
+	if best == nil {
+		return fallback
+	}
+	return best
+}
@@ -0,0 +1,143 @@
+package bonder
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/packet"
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+)
+
+// lossyProxy relays datagrams between a client and a server, dropping the
+// first copy of chosen data packets from the client and, when mtu is set,
+// datagrams larger than mtu in either direction
+type lossyProxy struct {
+	conn   *net.UDPConn
+	server *net.UDPAddr
+	codec  *packet.Processor
+
+	mu      sync.Mutex
+	client  *net.UDPAddr
+	drop    map[uint64]bool
+	dropped []uint64
+	mtu     int
+}
+
+func newLossyProxy(t *testing.T, server *net.UDPAddr, drop ...uint64) *lossyProxy {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &lossyProxy{
+		conn:   conn,
+		server: server,
+		codec:  packet.NewProcessor(0, 0),
+		drop:   make(map[uint64]bool),
+	}
+	for _, seq := range drop {
+		p.drop[seq] = true
+	}
+	go p.run()
+	t.Cleanup(func() { conn.Close() })
+	return p
+}
+
+func (p *lossyProxy) run() {
+	buf := make([]byte, protocol.MaxPacketSize)
+	for {
+		n, addr, err := p.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		p.mu.Lock()
+		tooBig := p.mtu > 0 && n > p.mtu
+		p.mu.Unlock()
+		if tooBig {
+			continue
+		}
+
+		if addr.String() == p.server.String() {
+			p.mu.Lock()
+			client := p.client
+			p.mu.Unlock()
+			if client != nil {
+				p.conn.WriteToUDP(buf[:n], client)
+			}
+			continue
+		}
+
+		p.mu.Lock()
+		p.client = addr
+		pkt, err := p.codec.Decode(buf[:n])
+		drop := err == nil && pkt.Type == protocol.PacketTypeData && p.drop[pkt.SequenceID]
+		if drop {
+			delete(p.drop, pkt.SequenceID)
+			p.dropped = append(p.dropped, pkt.SequenceID)
+		}
+		p.mu.Unlock()
+
+		if !drop {
+			p.conn.WriteToUDP(buf[:n], p.server)
+		}
+	}
+}
+
+func TestLostPacketsRetransmitted(t *testing.T) {
+	client, server := newLoopbackPair(t)
+	client.retransmit.Store(true)
+
+	proxy := newLossyProxy(t, server.wans[1].Conn.LocalAddr().(*net.UDPAddr), 5, 6, 12)
+	client.wans[1].RemoteAddr = proxy.conn.LocalAddr().(*net.UDPAddr)
+
+	ctx := context.Background()
+	if err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	waitFor(t, "retransmission support", server.peerRetransmits.Load)
+
+	// Every packet arrives in order despite the losses. Packet 12 is only
+	// recovered because missing packets are reported again once data stops.
+	const count = 13
+	for i := 1; i <= count; i++ {
+		if err := client.Send([]byte(fmt.Sprintf("packet %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i <= count; i++ {
+		select {
+		case got := <-server.Receive():
+			if want := fmt.Sprintf("packet %d", i); string(got) != want {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for packet %d", i)
+		}
+	}
+
+	proxy.mu.Lock()
+	dropped := len(proxy.dropped)
+	proxy.mu.Unlock()
+	if dropped != 3 {
+		t.Fatalf("proxy dropped %d packets, want 3", dropped)
+	}
+
+	if stats := client.GetRetransmitStats()[1]; stats.Lost != 3 || stats.Retransmits != 3 {
+		t.Errorf("client stats = %+v, want 3 lost and retransmitted", stats)
+	}
+	if stats := server.GetRetransmitStats()[1]; stats.Recovered != 3 || stats.RecoveryTime <= 0 {
+		t.Errorf("server stats = %+v, want 3 recovered", stats)
+	}
+}
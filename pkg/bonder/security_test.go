@@ -0,0 +1,189 @@
+package bonder
+
+import (
+	"context"
+	"crypto/ecdh"
+	"encoding/base64"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/config"
+	"github.com/thelastdreamer/MultiWANBond/pkg/packet"
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+	"github.com/thelastdreamer/MultiWANBond/pkg/security"
+)
+
+func TestEncryptedTunnel(t *testing.T) {
+	client, server := newLoopbackPair(t)
+
+	secret := []byte("a shared secret for both bond ends")
+	for _, b := range []*Bonder{client, server} {
+		var err error
+		if b.tunnelCipher, err = security.NewTunnelCipher(security.EncryptionChaCha20Poly1305, secret, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx := context.Background()
+	if err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	if err := client.Send([]byte("secret payload")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-server.Receive():
+		if string(got) != "secret payload" {
+			t.Fatalf("got %q, want %q", got, "secret payload")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for encrypted packet")
+	}
+
+	// An attacker on the path replays and tampers with a valid packet
+	attacker, err := net.DialUDP("udp", nil, server.wans[1].Conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer attacker.Close()
+
+	encoded, err := client.processor.Encode(&protocol.Packet{
+		Version:    protocol.ProtocolVersion,
+		Type:       protocol.PacketTypeData,
+		SessionID:  client.session.ID,
+		SequenceID: 2,
+		Timestamp:  time.Now().UnixNano(),
+		WANID:      1,
+		Data:       []byte("injected"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := packet.Seal(client.tunnelCipher, encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := append([]byte(nil), sealed...)
+	tampered[29] ^= 0xff // Priority byte in the header
+
+	attacker.Write(tampered)
+	attacker.Write(sealed)
+	attacker.Write(sealed)
+	attacker.Write(encoded) // Plaintext is no longer accepted
+
+	select {
+	case got := <-server.Receive():
+		if string(got) != "injected" {
+			t.Fatalf("got %q, want %q", got, "injected")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for authentic packet")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	stats := server.GetSecurityStats()
+	for stats.Replayed.Load() < 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if got := stats.AuthFailures.Load(); got != 1 {
+		t.Fatalf("auth failures = %d, want 1", got)
+	}
+	if got := stats.Replayed.Load(); got != 1 {
+		t.Fatalf("replayed = %d, want 1", got)
+	}
+
+	select {
+	case got := <-server.Receive():
+		t.Fatalf("unexpected delivery of %q", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// configureHandshake sets up a Noise handshake between client and server
+func configureHandshake(t *testing.T, client, server *Bonder, pattern string, rotation time.Duration) {
+	t.Helper()
+
+	keys := make([]*ecdh.PrivateKey, 2)
+	for i := range keys {
+		var err error
+		if keys[i], err = security.GenerateStaticKey(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	encode := func(b []byte) string { return base64.StdEncoding.EncodeToString(b) }
+
+	for i, b := range []*Bonder{client, server} {
+		peer := keys[1-i].PublicKey().Bytes()
+		cfg := &config.SecurityConfig{
+			Enabled:             true,
+			Handshake:           pattern,
+			PrivateKey:          encode(keys[i].Bytes()),
+			Initiator:           b == client,
+			Peers:               []config.PeerConfig{{ID: "peer", PublicKey: encode(peer)}},
+			KeyRotationInterval: rotation.String(),
+		}
+		if err := b.configureSecurity(cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestHandshakeRekeysWithoutLoss(t *testing.T) {
+	for _, pattern := range []string{"noise_ik", "noise_xx"} {
+		t.Run(pattern, func(t *testing.T) {
+			client, server := newLoopbackPair(t)
+			configureHandshake(t, client, server, pattern, 200*time.Millisecond)
+
+			ctx := context.Background()
+			if err := client.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer client.Stop()
+			if err := server.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer server.Stop()
+
+			deadline := time.Now().Add(3 * time.Second)
+			for !(client.SessionEstablished() && server.SessionEstablished()) {
+				if time.Now().After(deadline) {
+					t.Fatal("handshake did not complete")
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+
+			// Keep traffic flowing across several rekeys
+			stop := time.Now().Add(time.Second)
+			for i := 0; time.Now().Before(stop); i++ {
+				if err := client.Send([]byte{byte(i)}); err != nil {
+					t.Fatalf("send %d: %v", i, err)
+				}
+				select {
+				case got := <-server.Receive():
+					if got[0] != byte(i) {
+						t.Fatalf("got packet %d, want %d", got[0], i)
+					}
+				case <-time.After(time.Second):
+					t.Fatalf("packet %d lost", i)
+				}
+				time.Sleep(8 * time.Millisecond)
+			}
+
+			if rekeys := client.GetHandshakeStats().Rekeys.Load(); rekeys < 2 {
+				t.Fatalf("rekeys = %d, want at least 2", rekeys)
+			}
+			if failures := server.GetSecurityStats().AuthFailures.Load(); failures != 0 {
+				t.Fatalf("auth failures = %d, want 0", failures)
+			}
+		})
+	}
+}
@@ -0,0 +1,301 @@
+package bonder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/config"
+	"github.com/thelastdreamer/MultiWANBond/pkg/network/tun"
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+)
+
+// fakeDevice is an in-memory tun.Device
+type fakeDevice struct {
+	name   string
+	in     chan []byte // packets "read" from the device (sent by the host)
+	out    chan []byte // packets written to the device (delivered to the host)
+	closed chan struct{}
+}
+
+func newFakeDevice(name string) *fakeDevice {
+	return &fakeDevice{
+		name:   name,
+		in:     make(chan []byte, 16),
+		out:    make(chan []byte, 16),
+		closed: make(chan struct{}),
+	}
+}
+
+func (d *fakeDevice) Name() string { return d.name }
+func (d *fakeDevice) MTU() int     { return tun.DefaultMTU }
+
+func (d *fakeDevice) Read(buf []byte) (int, error) {
+	select {
+	case pkt := <-d.in:
+		return copy(buf, pkt), nil
+	case <-d.closed:
+		return 0, tun.ErrDeviceClosed
+	}
+}
+
+func (d *fakeDevice) Write(pkt []byte) (int, error) {
+	select {
+	case d.out <- append([]byte(nil), pkt...):
+		return len(pkt), nil
+	case <-d.closed:
+		return 0, tun.ErrDeviceClosed
+	}
+}
+
+func (d *fakeDevice) Close() error {
+	select {
+	case <-d.closed:
+	default:
+		close(d.closed)
+	}
+	return nil
+}
+
+// testConfig returns the default configuration without NAT traversal, which
+// would query public STUN servers
+func testConfig() *config.BondConfig {
+	cfg := config.DefaultConfig()
+	cfg.NAT = nil
+	return cfg
+}
+
+// newLoopbackPair creates two bonders connected by a single loopback WAN
+func newLoopbackPair(t *testing.T) (*Bonder, *Bonder) {
+	t.Helper()
+	return newLoopbackPairWith(t, testConfig(), testConfig())
+}
+
+// newLoopbackPairWith creates two bonders with the given configurations,
+// connected by a single loopback WAN
+func newLoopbackPairWith(t *testing.T, cfgA, cfgB *config.BondConfig) (*Bonder, *Bonder) {
+	t.Helper()
+
+	connA, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	connB, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pair := make([]*Bonder, 2)
+	conns := []*net.UDPConn{connA, connB}
+	cfgs := []*config.BondConfig{cfgA, cfgB}
+	for i := range pair {
+		b, err := New(cfgs[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wan := &protocol.WANInterface{
+			ID:         1,
+			Name:       "lo",
+			LocalAddr:  net.IPv4(127, 0, 0, 1),
+			RemoteAddr: conns[1-i].LocalAddr().(*net.UDPAddr),
+			Conn:       conns[i],
+			Metrics:    &protocol.WANMetrics{},
+			State:      protocol.WANStateUp,
+			Config: protocol.WANConfig{
+				Enabled:             true,
+				Weight:              1,
+				HealthCheckInterval: time.Hour, // keep the checker off the socket
+			},
+		}
+		if err := b.AddWAN(wan); err != nil {
+			t.Fatal(err)
+		}
+		pair[i] = b
+	}
+
+	return pair[0], pair[1]
+}
+
+func TestTUNPacketsCrossBond(t *testing.T) {
+	client, server := newLoopbackPair(t)
+
+	clientDev := newFakeDevice("tun-client")
+	serverDev := newFakeDevice("tun-server")
+	if err := client.AttachTUN(clientDev); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.AttachTUN(serverDev); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	// Minimal IPv4 header followed by a payload
+	packets := [][]byte{
+		append([]byte{0x45, 0, 0, 24, 0, 1, 0, 0, 64, 17, 0, 0, 10, 200, 0, 2, 10, 200, 0, 1}, []byte("ping")...),
+		append([]byte{0x45, 0, 0, 24, 0, 2, 0, 0, 64, 17, 0, 0, 10, 200, 0, 2, 10, 200, 0, 1}, []byte("pong")...),
+	}
+
+	for _, pkt := range packets {
+		clientDev.in <- pkt
+	}
+
+	for i, want := range packets {
+		select {
+		case got := <-serverDev.out:
+			if !bytes.Equal(got, want) {
+				t.Fatalf("packet %d: got %x, want %x", i, got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for packet %d on server TUN", i)
+		}
+	}
+
+	// Reverse direction
+	serverDev.in <- packets[0]
+	select {
+	case got := <-clientDev.out:
+		if !bytes.Equal(got, packets[0]) {
+			t.Fatalf("reverse packet: got %x, want %x", got, packets[0])
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for packet on client TUN")
+	}
+}
+
+func TestAttachTUNWhileRunning(t *testing.T) {
+	b, err := New(testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Stop()
+
+	if err := b.AttachTUN(newFakeDevice("tun0")); err == nil {
+		t.Fatal("expected error attaching TUN to running bonder")
+	}
+}
+
+// failingDevice is a TUN device whose reads fail without it closing
+type failingDevice struct {
+	*fakeDevice
+	reads atomic.Int64
+}
+
+func (d *failingDevice) Read(buf []byte) (int, error) {
+	d.reads.Add(1)
+	return 0, errors.New("input/output error")
+}
+
+func TestTUNReadErrorsBackOff(t *testing.T) {
+	b, err := New(testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := &failingDevice{fakeDevice: newFakeDevice("tun0")}
+	if err := b.AttachTUN(dev); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Retries wait 10ms, 20ms, 40ms, 80ms, 160ms, ...
+	time.Sleep(400 * time.Millisecond)
+	if reads := dev.reads.Load(); reads > 8 {
+		t.Errorf("%d reads in 400ms of failing reads", reads)
+	}
+
+	// Stopping does not wait out a retry
+	start := time.Now()
+	b.Stop()
+	if elapsed := time.Since(start); elapsed > tunRetryMax/2 {
+		t.Errorf("Stop took %v", elapsed)
+	}
+}
+
+// countingPacketConn counts the datagrams written through a net.PacketConn
+type countingPacketConn struct {
+	net.PacketConn
+	writes atomic.Int64
+}
+
+func (c *countingPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.writes.Add(1)
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func TestTUNPacketsCrossRelayedWAN(t *testing.T) {
+	client, server := newLoopbackPair(t)
+
+	// The client's WAN talks through a relay, which the server sees as the
+	// client's address
+	relayConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay := &countingPacketConn{PacketConn: relayConn}
+	client.wans[1].Relay = relay
+	server.wans[1].RemoteAddr = relayConn.LocalAddr().(*net.UDPAddr)
+
+	clientDev := newFakeDevice("tun-client")
+	serverDev := newFakeDevice("tun-server")
+	if err := client.AttachTUN(clientDev); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.AttachTUN(serverDev); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	pkt := append([]byte{0x45, 0, 0, 24, 0, 1, 0, 0, 64, 17, 0, 0, 10, 200, 0, 2, 10, 200, 0, 1}, []byte("ping")...)
+
+	clientDev.in <- pkt
+	select {
+	case got := <-serverDev.out:
+		if !bytes.Equal(got, pkt) {
+			t.Fatalf("got %x, want %x", got, pkt)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for packet on server TUN")
+	}
+
+	// Replies only reach the client through the relay
+	serverDev.in <- pkt
+	select {
+	case got := <-clientDev.out:
+		if !bytes.Equal(got, pkt) {
+			t.Fatalf("reverse packet: got %x, want %x", got, pkt)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for packet on client TUN")
+	}
+
+	if relay.writes.Load() == 0 {
+		t.Error("client did not send through the relay")
+	}
+}
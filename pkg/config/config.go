@@ -1,13 +1,20 @@
 package config
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"os"
 	"sync"
 	"time"
 
+	"github.com/thelastdreamer/MultiWANBond/pkg/bandwidth"
+	"github.com/thelastdreamer/MultiWANBond/pkg/congestion"
+	"github.com/thelastdreamer/MultiWANBond/pkg/nat"
+	"github.com/thelastdreamer/MultiWANBond/pkg/pmtud"
 	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+	"github.com/thelastdreamer/MultiWANBond/pkg/router"
+	"github.com/thelastdreamer/MultiWANBond/pkg/security"
 )
 
 // Config represents the main configuration structure
@@ -41,6 +48,27 @@ type BondConfig struct {
 
 	// Web UI configuration
 	WebUI *WebUIConfig `json:"webui,omitempty"`
+
+	// TUN interface configuration
+	TUN *TUNConfig `json:"tun,omitempty"`
+
+	// Tunnel security configuration
+	Security *SecurityConfig `json:"security,omitempty"`
+
+	// Packet priority mapping
+	QoS *QoSConfig `json:"qos,omitempty"`
+
+	// Per-WAN congestion control
+	Congestion *CongestionConfig `json:"congestion,omitempty"`
+
+	// Per-WAN path MTU discovery
+	PathMTU *PathMTUConfig `json:"path_mtu,omitempty"`
+
+	// Per-WAN bandwidth estimation
+	Bandwidth *BandwidthConfig `json:"bandwidth,omitempty"`
+
+	// Per-WAN NAT traversal
+	NAT *NATConfig `json:"nat,omitempty"`
 }
 
 // SessionConfig contains session-level configuration
@@ -51,6 +79,7 @@ type SessionConfig struct {
 	DuplicateMode    string `json:"duplicate_mode"` // "first", "fastest", "best"
 	ReorderBuffer    int    `json:"reorder_buffer"`
 	ReorderTimeout   string `json:"reorder_timeout"` // e.g., "500ms"
+	Retransmit       bool   `json:"retransmit"`      // Resend packets the peer reports missing, within the reorder timeout
 	MulticastEnabled bool   `json:"multicast_enabled"`
 	MulticastGroups  []string `json:"multicast_groups"`
 }
@@ -69,26 +98,107 @@ type WANInterfaceConfig struct {
 	HealthCheckInterval string `json:"health_check_interval"` // e.g., "200ms"
 	FailureThreshold    int    `json:"failure_threshold"`
 	Weight              int    `json:"weight"` // for weighted routing
+	Priority            int    `json:"priority"` // for failover; 0 = primary, higher = backup
 	Enabled             bool   `json:"enabled"`
 }
 
 // RoutingConfig contains routing configuration
 type RoutingConfig struct {
-	Mode                string          `json:"mode"` // "round_robin", "weighted", "least_used", etc.
-	BandwidthResetInterval string       `json:"bandwidth_reset_interval"` // e.g., "1m"
-	Policies            []RoutingPolicy `json:"policies,omitempty"` // Routing policies
+	Mode                   string              `json:"mode"`                         // "round_robin", "weighted", "least_used", etc.
+	BandwidthResetInterval string              `json:"bandwidth_reset_interval"`     // e.g., "1m"
+	FailoverHoldDown       string              `json:"failover_hold_down,omitempty"` // No failback this long after a switch, e.g., "5s"
+	FailbackStability      string              `json:"failback_stability,omitempty"` // How long a WAN must be healthy before failback, e.g., "10s"
+	Policies               []RoutingPolicy     `json:"policies,omitempty"`           // Routing policies
+	Duplication            []DuplicationPolicy `json:"duplication,omitempty"`        // Duplication policies, checked in order
 }
 
 // RoutingPolicy defines a routing policy rule
 type RoutingPolicy struct {
-	ID          int    `json:"id"`
-	Name        string `json:"name"`
-	Description string `json:"description"`
-	Type        string `json:"type"` // "source", "destination", "application"
-	Match       string `json:"match"` // IP, CIDR, domain, or app name
-	TargetWAN   uint8  `json:"target_wan"` // WAN ID to use
-	Priority    int    `json:"priority"` // Lower = higher priority
+	ID           int     `json:"id"`
+	Name         string  `json:"name"`
+	Description  string  `json:"description"`
+	Type         string  `json:"type"`                    // "source", "destination", "application", or "" to match on the fields below only
+	Match        string  `json:"match"`                   // Comma-separated IPs or CIDRs, or DPI application or category names
+	Protocol     string  `json:"protocol,omitempty"`      // e.g., "tcp", "udp,icmp" or "47"
+	Ports        string  `json:"ports,omitempty"`         // Destination ports, e.g., "443" or "80,8000-8100"
+	DSCP         string  `json:"dscp,omitempty"`          // e.g., "46", "ef" or "af41,cs5"
+	TargetWAN    uint8   `json:"target_wan"`              // WAN ID to use
+	FallbackWANs []uint8 `json:"fallback_wans,omitempty"` // Tried in order when the target WAN is down
+	Priority     int     `json:"priority"`                // Lower = higher priority
+	Enabled      bool    `json:"enabled"`
+}
+
+// QoSConfig maps tunneled traffic to packet priorities (0-255). Packets above
+// 200 get the lowest-latency WAN and a duplicate copy; packets below 50 get
+// the least-used WAN.
+type QoSConfig struct {
+	DSCP       map[string]uint8 `json:"dscp,omitempty"`    // DSCP value or name -> priority, e.g., {"ef": 240, "cs1": 20}
+	DPIClasses bool             `json:"dpi_classes"`       // Prioritize unmarked traffic by its DPI traffic class
+	Classes    map[string]uint8 `json:"classes,omitempty"` // DPI traffic class -> priority, e.g., {"bulk": 40}
+}
+
+// CongestionConfig enables per-WAN congestion control and pacing of data
+// packets. It takes effect once the peer announces that it acks data packets.
+type CongestionConfig struct {
 	Enabled     bool   `json:"enabled"`
+	TargetDelay string `json:"target_delay"` // Queueing delay each WAN may build, e.g., "25ms"
+	MaxWindow   int    `json:"max_window"`   // Largest congestion window in bytes; 0 for the default
+}
+
+// PathMTUConfig enables path MTU discovery on each WAN. Data packets larger
+// than the path MTU of their WAN are fragmented when the peer can reassemble
+// them; without discovery they are fragmented at the largest MTU.
+type PathMTUConfig struct {
+	Enabled       bool   `json:"enabled"`
+	MaxMTU        int    `json:"max_mtu"`        // Largest UDP payload in bytes; 0 for 1472 (Ethernet)
+	ProbeTimeout  string `json:"probe_timeout"`  // How long a probe is waited for, e.g., "1s"
+	RaiseInterval string `json:"raise_interval"` // How often larger sizes are tried again, e.g., "10m"
+}
+
+// BandwidthConfig enables estimating the upload and download capacity of
+// each WAN from acknowledged traffic and, when the peer supports them,
+// packet-train probes. Estimates feed weighted routing.
+type BandwidthConfig struct {
+	Enabled       bool   `json:"enabled"`
+	Window        string `json:"window"`         // How long a delivery rate sample counts, e.g., "10s"
+	ProbeInterval string `json:"probe_interval"` // How often each WAN is probed with packet trains, e.g., "5m"; empty only on demand
+}
+
+// NATConfig enables NAT traversal on each WAN's own socket: STUN discovery
+// of the NAT type and public address, CGNAT detection, adaptive keep-alives
+// of the NAT mapping and hole punching. With a TURN server, WANs behind NATs
+// that may need a relay fall back to an allocation made on the WAN when they
+// cannot reach the peer directly.
+// With ProbeBindings, how long each WAN's NAT binding survives idle is
+// measured with the peer's help, and keep-alives and heartbeats are spaced
+// to match.
+type NATConfig struct {
+	Enabled         bool   `json:"enabled"`
+	STUNServer      string `json:"stun_server"`      // host:port; empty for a public default
+	SecondaryServer string `json:"secondary_server"` // host:port for symmetric NAT detection with servers lacking RFC 5780
+	STUNUsername    string `json:"stun_username"`    // Short-term credentials, for servers that need them
+	STUNPassword    string `json:"stun_password"`    // Password requests are signed with
+	Timeout         string `json:"timeout"`          // STUN request timeout, e.g., "5s"
+
+	TURNServer   string `json:"turn_server"`   // host:port; empty to relay through no TURN server
+	TURNUsername string `json:"turn_username"` // Long-term credentials
+	TURNPassword string `json:"turn_password"`
+
+	ProbeBindings    bool   `json:"probe_bindings"`     // Measure binding lifetimes with the peer; off by default
+	MaxBindingIdle   string `json:"max_binding_idle"`   // Longest idle time probed, e.g., "10m"
+	BindingInterval  string `json:"binding_interval"`   // How long a measured lifetime holds before it is measured again, e.g., "24h"
+	BindingStateFile string `json:"binding_state_file"` // Where measured lifetimes are kept across restarts; empty to measure on every start
+}
+
+// DuplicationPolicy sends matching traffic on the lowest-latency WANs, the
+// lowest first unless a routing policy pins the WAN, with copies on the next
+type DuplicationPolicy struct {
+	Name            string `json:"name"`
+	Match           string `json:"match"`                      // Comma-separated DPI application or category names, e.g., "DNS" or "Zoom,Gaming"
+	RoutingPolicies []int  `json:"routing_policies,omitempty"` // IDs of routing policies whose traffic is duplicated
+	Copies          int    `json:"copies"`                     // WANs each packet goes out on, the routed one included; 0 = all
+	MaxBandwidth    uint64 `json:"max_bandwidth"`              // Bytes/sec of copies each WAN may carry; 0 = unlimited
+	Enabled         bool   `json:"enabled"`
 }
 
 // FECConfig contains FEC configuration
@@ -120,6 +230,41 @@ type WebUIConfig struct {
 	Enabled  bool   `json:"enabled"`
 }
 
+// TUNConfig contains TUN interface settings for carrying IP traffic over the bond
+type TUNConfig struct {
+	Enabled bool   `json:"enabled"`
+	Name    string `json:"name"`    // e.g., "mwb0"
+	Address string `json:"address"` // CIDR, e.g., "10.200.0.2/24"
+	MTU     int    `json:"mtu"`
+}
+
+// SecurityConfig contains tunnel encryption settings.
+// Both ends of the bond must use the same cipher, and either the same
+// pre-shared key or the same handshake pattern with each other's public keys
+// listed as peers. A handshake, when configured, replaces the pre-shared key.
+// With a pre-shared key, the clocks of both ends must agree to within five
+// minutes, as older packets are rejected as possible replays.
+type SecurityConfig struct {
+	Enabled      bool   `json:"enabled"`
+	Cipher       string `json:"cipher"`         // "chacha20poly1305" or "aes256gcm"
+	PreSharedKey string `json:"pre_shared_key"` // at least 16 bytes
+	ReplayWindow int    `json:"replay_window"`  // packets, default 1024
+
+	// Noise handshake
+	Handshake           string       `json:"handshake,omitempty"`             // "noise_ik" or "noise_xx"
+	PrivateKey          string       `json:"private_key,omitempty"`           // base64 X25519 static key
+	Initiator           bool         `json:"initiator,omitempty"`             // this end starts handshakes
+	RemotePeer          string       `json:"remote_peer,omitempty"`           // responder peer ID, for noise_ik initiators
+	Peers               []PeerConfig `json:"peers,omitempty"`                 // trusted peers
+	KeyRotationInterval string       `json:"key_rotation_interval,omitempty"` // e.g., "2m"; default 24h
+}
+
+// PeerConfig describes a trusted handshake peer
+type PeerConfig struct {
+	ID        string `json:"id"`
+	PublicKey string `json:"public_key"` // base64 X25519 public key
+}
+
 // NewConfig creates a new configuration instance
 func NewConfig(filePath string) *Config {
 	return &Config{
@@ -313,6 +458,7 @@ func (sc *SessionConfig) ToSessionConfig() (*protocol.SessionConfig, error) {
 		DuplicateFilter:  duplicateMode,
 		ReorderBuffer:    sc.ReorderBuffer,
 		ReorderTimeout:   reorderTimeout,
+		Retransmit:       sc.Retransmit,
 		MulticastEnabled: sc.MulticastEnabled,
 		MulticastGroups:  sc.MulticastGroups,
 	}, nil
@@ -344,10 +490,206 @@ func (wc *WANInterfaceConfig) ToWANConfig() (*protocol.WANConfig, error) {
 		HealthCheckInterval: healthCheckInterval,
 		FailureThreshold:    wc.FailureThreshold,
 		Weight:              wc.Weight,
+		Priority:            wc.Priority,
 		Enabled:             wc.Enabled,
 	}, nil
 }
 
+// ToNoiseConfig converts the handshake settings to security.NoiseConfig.
+// Every configured peer is added to a new trust store as trusted.
+func (sc *SecurityConfig) ToNoiseConfig() (*security.NoiseConfig, error) {
+	pattern, err := security.ParseHandshakePattern(sc.Handshake)
+	if err != nil {
+		return nil, err
+	}
+
+	rawKey, err := base64.StdEncoding.DecodeString(sc.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+	staticKey, err := security.ParseStaticKey(rawKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+
+	noiseConfig := &security.NoiseConfig{
+		Pattern:    pattern,
+		Initiator:  sc.Initiator,
+		StaticKey:  staticKey,
+		TrustStore: security.NewTrustStore(),
+	}
+
+	for _, peerCfg := range sc.Peers {
+		publicKey, err := base64.StdEncoding.DecodeString(peerCfg.PublicKey)
+		if err != nil || len(publicKey) != 32 {
+			return nil, fmt.Errorf("invalid public key for peer %s", peerCfg.ID)
+		}
+
+		peer := security.NewPeer(peerCfg.ID, publicKey, "", nil)
+		peer.SetTrusted(true)
+		noiseConfig.TrustStore.AddPeer(peer)
+
+		if peerCfg.ID == sc.RemotePeer || (sc.RemotePeer == "" && len(sc.Peers) == 1) {
+			noiseConfig.RemoteKey = publicKey
+		}
+	}
+
+	if pattern == security.HandshakeIK && sc.Initiator && noiseConfig.RemoteKey == nil {
+		return nil, fmt.Errorf("remote peer %q not found in peers", sc.RemotePeer)
+	}
+
+	return noiseConfig, nil
+}
+
+// KeyRotation returns the session rekey interval
+func (sc *SecurityConfig) KeyRotation() time.Duration {
+	interval, err := time.ParseDuration(sc.KeyRotationInterval)
+	if err != nil || interval <= 0 {
+		return security.DefaultSecurityConfig().KeyRotationInterval
+	}
+	return interval
+}
+
+// FailoverTimers returns the failback hold-down and stability periods
+func (rc *RoutingConfig) FailoverTimers() (holdDown, stability time.Duration) {
+	holdDown, err := time.ParseDuration(rc.FailoverHoldDown)
+	if err != nil || holdDown < 0 {
+		holdDown = router.DefaultFailoverHoldDown
+	}
+	stability, err = time.ParseDuration(rc.FailbackStability)
+	if err != nil || stability < 0 {
+		stability = router.DefaultFailbackStability
+	}
+	return holdDown, stability
+}
+
+// ControllerConfig returns the congestion controller settings, or nil when
+// congestion control is disabled
+func (cc *CongestionConfig) ControllerConfig() (*congestion.Config, error) {
+	if cc == nil || !cc.Enabled {
+		return nil, nil
+	}
+
+	cfg := &congestion.Config{MaxWindow: cc.MaxWindow}
+	if cc.TargetDelay != "" {
+		targetDelay, err := time.ParseDuration(cc.TargetDelay)
+		if err != nil || targetDelay <= 0 {
+			return nil, fmt.Errorf("invalid target delay %q", cc.TargetDelay)
+		}
+		cfg.TargetDelay = targetDelay
+	}
+	if cc.MaxWindow < 0 {
+		return nil, fmt.Errorf("invalid max window %d", cc.MaxWindow)
+	}
+	return cfg, nil
+}
+
+// DiscoveryConfig returns the path MTU discovery settings, or nil when
+// discovery is disabled
+func (pc *PathMTUConfig) DiscoveryConfig() (*pmtud.Config, error) {
+	if pc == nil || !pc.Enabled {
+		return nil, nil
+	}
+
+	if pc.MaxMTU != 0 && (pc.MaxMTU < pmtud.MinMTU || pc.MaxMTU > protocol.MaxPacketSize) {
+		return nil, fmt.Errorf("invalid max MTU %d", pc.MaxMTU)
+	}
+	cfg := &pmtud.Config{MaxMTU: pc.MaxMTU}
+	if pc.ProbeTimeout != "" {
+		probeTimeout, err := time.ParseDuration(pc.ProbeTimeout)
+		if err != nil || probeTimeout <= 0 {
+			return nil, fmt.Errorf("invalid probe timeout %q", pc.ProbeTimeout)
+		}
+		cfg.ProbeTimeout = probeTimeout
+	}
+	if pc.RaiseInterval != "" {
+		raiseInterval, err := time.ParseDuration(pc.RaiseInterval)
+		if err != nil || raiseInterval <= 0 {
+			return nil, fmt.Errorf("invalid raise interval %q", pc.RaiseInterval)
+		}
+		cfg.RaiseInterval = raiseInterval
+	}
+	return cfg, nil
+}
+
+// EstimatorConfig returns the bandwidth estimation settings, or nil when
+// estimation is disabled
+func (bc *BandwidthConfig) EstimatorConfig() (*bandwidth.Config, error) {
+	if bc == nil || !bc.Enabled {
+		return nil, nil
+	}
+
+	cfg := &bandwidth.Config{}
+	if bc.Window != "" {
+		window, err := time.ParseDuration(bc.Window)
+		if err != nil || window <= 0 {
+			return nil, fmt.Errorf("invalid window %q", bc.Window)
+		}
+		cfg.Window = window
+	}
+	if bc.ProbeInterval != "" {
+		probeInterval, err := time.ParseDuration(bc.ProbeInterval)
+		if err != nil || probeInterval <= 0 {
+			return nil, fmt.Errorf("invalid probe interval %q", bc.ProbeInterval)
+		}
+		cfg.ProbeInterval = probeInterval
+	}
+	return cfg, nil
+}
+
+// TraversalConfig returns the NAT traversal settings, or nil when NAT
+// traversal is disabled
+func (nc *NATConfig) TraversalConfig() (*nat.NATTraversalConfig, error) {
+	if nc == nil || !nc.Enabled {
+		return nil, nil
+	}
+
+	cfg := nat.DefaultNATTraversalConfig()
+	if nc.STUNServer != "" {
+		cfg.STUN.PrimaryServer = nc.STUNServer
+		cfg.STUN.SecondaryServer = nc.SecondaryServer
+	} else if nc.SecondaryServer != "" {
+		return nil, fmt.Errorf("secondary server without a STUN server")
+	}
+	cfg.STUN.Username = nc.STUNUsername
+	cfg.STUN.Password = nc.STUNPassword
+	if nc.Timeout != "" {
+		timeout, err := time.ParseDuration(nc.Timeout)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid timeout %q", nc.Timeout)
+		}
+		cfg.STUN.Timeout = timeout
+	}
+
+	if nc.TURNServer != "" {
+		cfg.TURN = nat.DefaultTURNConfig()
+		cfg.TURN.Server = nc.TURNServer
+		cfg.TURN.Username = nc.TURNUsername
+		cfg.TURN.Password = nc.TURNPassword
+	} else if nc.TURNUsername != "" || nc.TURNPassword != "" {
+		return nil, fmt.Errorf("TURN credentials without a TURN server")
+	}
+
+	if nc.ProbeBindings {
+		cfg.Binding = nat.DefaultBindingProbeConfig()
+		if nc.MaxBindingIdle != "" {
+			maxIdle, err := time.ParseDuration(nc.MaxBindingIdle)
+			if err != nil || maxIdle < cfg.Binding.MinIdle || maxIdle > protocol.MaxBindingProbeIdle {
+				return nil, fmt.Errorf("invalid max binding idle %q", nc.MaxBindingIdle)
+			}
+			cfg.Binding.MaxIdle = maxIdle
+		}
+		if nc.BindingInterval != "" {
+			interval, err := time.ParseDuration(nc.BindingInterval)
+			if err != nil || interval <= 0 {
+				return nil, fmt.Errorf("invalid binding interval %q", nc.BindingInterval)
+			}
+			cfg.Binding.Interval = interval
+		}
+	}
+	return cfg, nil
+}
+
 // ParseWANType converts string to WANType
 func ParseWANType(typeStr string) protocol.WANType {
 	switch typeStr {
@@ -387,6 +729,10 @@ func ParseLoadBalanceMode(mode string) protocol.LoadBalanceMode {
 		return protocol.LoadBalancePerFlow
 	case "adaptive":
 		return protocol.LoadBalanceAdaptive
+	case "failover":
+		return protocol.LoadBalanceFailover
+	case "earliest_delivery":
+		return protocol.LoadBalanceEarliestDelivery
 	default:
 		return protocol.LoadBalanceAdaptive
 	}
@@ -422,5 +768,19 @@ func DefaultConfig() *BondConfig {
 			AlertsEnabled:   true,
 		},
 		Plugins: []PluginConfig{},
+		Congestion: &CongestionConfig{
+			Enabled:     true,
+			TargetDelay: "25ms",
+		},
+		PathMTU: &PathMTUConfig{
+			Enabled: true,
+		},
+		Bandwidth: &BandwidthConfig{
+			Enabled: true,
+			Window:  "10s",
+		},
+		NAT: &NATConfig{
+			Enabled: true,
+		},
 	}
 }
@@ -0,0 +1,225 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/router"
+)
+
+// ipProtocols maps protocol names accepted in routing policies to IP protocol numbers
+var ipProtocols = map[string]uint8{
+	"icmp":   1,
+	"tcp":    6,
+	"udp":    17,
+	"gre":    47,
+	"esp":    50,
+	"icmpv6": 58,
+	"sctp":   132,
+}
+
+// PolicyRules compiles the enabled routing policies
+func (rc *RoutingConfig) PolicyRules() ([]router.PolicyRule, error) {
+	rules := make([]router.PolicyRule, 0, len(rc.Policies))
+	for i := range rc.Policies {
+		policy := &rc.Policies[i]
+		if !policy.Enabled {
+			continue
+		}
+		rule, err := policy.Rule()
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Rule compiles the policy into a router policy rule
+func (p *RoutingPolicy) Rule() (router.PolicyRule, error) {
+	rule := router.PolicyRule{
+		ID:       p.ID,
+		Name:     p.Name,
+		Priority: p.Priority,
+	}
+
+	if p.TargetWAN == 0 {
+		return rule, fmt.Errorf("policy %d: no target WAN", p.ID)
+	}
+	rule.WANs = append([]uint8{p.TargetWAN}, p.FallbackWANs...)
+
+	var err error
+	switch p.Type {
+	case "source":
+		rule.SrcNets, err = parseNets(p.Match)
+	case "destination":
+		rule.DstNets, err = parseNets(p.Match)
+	case "application":
+		rule.Apps = splitList(p.Match)
+		if len(rule.Apps) == 0 {
+			err = fmt.Errorf("no application")
+		}
+	case "":
+	default:
+		err = fmt.Errorf("unknown type %q", p.Type)
+	}
+	if err != nil {
+		return rule, fmt.Errorf("policy %d: %w", p.ID, err)
+	}
+
+	if rule.Protocols, err = parseProtocols(p.Protocol); err != nil {
+		return rule, fmt.Errorf("policy %d: %w", p.ID, err)
+	}
+	if rule.Ports, err = parsePorts(p.Ports); err != nil {
+		return rule, fmt.Errorf("policy %d: %w", p.ID, err)
+	}
+	if rule.DSCP, err = parseDSCP(p.DSCP); err != nil {
+		return rule, fmt.Errorf("policy %d: %w", p.ID, err)
+	}
+
+	return rule, nil
+}
+
+// DuplicationRules compiles the enabled duplication policies
+func (rc *RoutingConfig) DuplicationRules() ([]router.DuplicationRule, error) {
+	rules := make([]router.DuplicationRule, 0, len(rc.Duplication))
+	for _, policy := range rc.Duplication {
+		if !policy.Enabled {
+			continue
+		}
+		rule := router.DuplicationRule{
+			Name:     policy.Name,
+			Apps:     splitList(policy.Match),
+			Policies: policy.RoutingPolicies,
+			Copies:   policy.Copies,
+			Budget:   policy.MaxBandwidth,
+		}
+		if len(rule.Apps) == 0 && len(rule.Policies) == 0 {
+			return nil, fmt.Errorf("duplication policy %q matches nothing", policy.Name)
+		}
+		if rule.Copies < 0 || rule.Copies == 1 {
+			return nil, fmt.Errorf("duplication policy %q: invalid copy count %d", policy.Name, rule.Copies)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// splitList splits a comma-separated list, dropping empty entries
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseNets parses a list of IPs and CIDRs
+func parseNets(list string) ([]*net.IPNet, error) {
+	items := splitList(list)
+	if len(items) == 0 {
+		return nil, fmt.Errorf("no address")
+	}
+
+	nets := make([]*net.IPNet, 0, len(items))
+	for _, item := range items {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", item)
+			}
+			bits := 128
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", item)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// parseProtocols parses a list of IP protocol names and numbers
+func parseProtocols(list string) ([]uint8, error) {
+	var protocols []uint8
+	for _, item := range splitList(list) {
+		if proto, ok := ipProtocols[strings.ToLower(item)]; ok {
+			protocols = append(protocols, proto)
+			continue
+		}
+		proto, err := strconv.ParseUint(item, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid protocol %q", item)
+		}
+		protocols = append(protocols, uint8(proto))
+	}
+	return protocols, nil
+}
+
+// parsePorts parses a list of ports and low-high port ranges
+func parsePorts(list string) ([]router.PortRange, error) {
+	var ranges []router.PortRange
+	for _, item := range splitList(list) {
+		lowStr, highStr, isRange := strings.Cut(item, "-")
+		if !isRange {
+			highStr = lowStr
+		}
+		low, err := strconv.ParseUint(strings.TrimSpace(lowStr), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", item)
+		}
+		high, err := strconv.ParseUint(strings.TrimSpace(highStr), 10, 16)
+		if err != nil || high < low {
+			return nil, fmt.Errorf("invalid port %q", item)
+		}
+		ranges = append(ranges, router.PortRange{Low: uint16(low), High: uint16(high)})
+	}
+	return ranges, nil
+}
+
+// parseDSCP parses a list of DSCP values and names such as "ef", "af41" or "cs5"
+func parseDSCP(list string) ([]uint8, error) {
+	var values []uint8
+	for _, item := range splitList(list) {
+		value, ok := dscpValue(strings.ToLower(item))
+		if !ok {
+			return nil, fmt.Errorf("invalid DSCP %q", item)
+		}
+		if !slices.Contains(values, value) {
+			values = append(values, value)
+		}
+	}
+	return values, nil
+}
+
+// dscpValue converts a DSCP number or name to its code point
+func dscpValue(name string) (uint8, bool) {
+	switch {
+	case name == "ef":
+		return 46, true
+	case name == "be" || name == "default":
+		return 0, true
+	case len(name) == 3 && strings.HasPrefix(name, "cs") && name[2] >= '0' && name[2] <= '7':
+		return (name[2] - '0') << 3, true
+	case len(name) == 4 && strings.HasPrefix(name, "af") &&
+		name[2] >= '1' && name[2] <= '4' && name[3] >= '1' && name[3] <= '3':
+		return (name[2]-'0')<<3 | (name[3]-'0')<<1, true
+	}
+
+	value, err := strconv.ParseUint(name, 10, 8)
+	if err != nil || value > 63 {
+		return 0, false
+	}
+	return uint8(value), true
+}
@@ -0,0 +1,84 @@
+package config
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/router"
+)
+
+func TestPolicyRule(t *testing.T) {
+	policy := RoutingPolicy{
+		ID:           7,
+		Type:         "destination",
+		Match:        "10.0.0.0/8, 2001:db8::1",
+		Protocol:     "udp,47",
+		Ports:        "53, 8000-8100",
+		DSCP:         "ef,af41,cs1,10",
+		TargetWAN:    2,
+		FallbackWANs: []uint8{3, 1},
+		Enabled:      true,
+	}
+
+	rule, err := policy.Rule()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rule.DstNets) != 2 || rule.DstNets[1].String() != "2001:db8::1/128" {
+		t.Errorf("DstNets = %v", rule.DstNets)
+	}
+	if !slices.Equal(rule.Protocols, []uint8{17, 47}) {
+		t.Errorf("Protocols = %v", rule.Protocols)
+	}
+	if !slices.Equal(rule.Ports, []router.PortRange{{Low: 53, High: 53}, {Low: 8000, High: 8100}}) {
+		t.Errorf("Ports = %v", rule.Ports)
+	}
+	if !slices.Equal(rule.DSCP, []uint8{46, 34, 8, 10}) {
+		t.Errorf("DSCP = %v", rule.DSCP)
+	}
+	if !slices.Equal(rule.WANs, []uint8{2, 3, 1}) {
+		t.Errorf("WANs = %v", rule.WANs)
+	}
+
+	invalid := []RoutingPolicy{
+		{Type: "source", Match: "example.com", TargetWAN: 1},
+		{Type: "application", TargetWAN: 1},
+		{Type: "domain", Match: "example.com", TargetWAN: 1},
+		{Ports: "100-10", TargetWAN: 1},
+		{DSCP: "af51", TargetWAN: 1},
+		{DSCP: "64", TargetWAN: 1},
+		{Protocol: "quic", TargetWAN: 1},
+		{Type: "source", Match: "10.0.0.1"},
+	}
+	for _, p := range invalid {
+		if _, err := p.Rule(); err == nil {
+			t.Errorf("policy %+v compiled without error", p)
+		}
+	}
+}
+
+func TestDuplicationRules(t *testing.T) {
+	rc := RoutingConfig{Duplication: []DuplicationPolicy{
+		{Name: "realtime", Match: "VoIP, Gaming", Copies: 2, MaxBandwidth: 50000, Enabled: true},
+		{Name: "disabled", Match: "DNS", Enabled: false},
+		{Name: "pinned", RoutingPolicies: []int{3}, Enabled: true},
+	}}
+	rules, err := rc.DuplicationRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || !slices.Equal(rules[0].Apps, []string{"VoIP", "Gaming"}) || rules[0].Budget != 50000 ||
+		!slices.Equal(rules[1].Policies, []int{3}) || rules[1].Copies != 0 {
+		t.Errorf("rules = %+v", rules)
+	}
+
+	for _, bad := range []DuplicationPolicy{
+		{Name: "empty", Enabled: true},
+		{Name: "single copy", Match: "DNS", Copies: 1, Enabled: true},
+	} {
+		rc := RoutingConfig{Duplication: []DuplicationPolicy{bad}}
+		if _, err := rc.DuplicationRules(); err == nil {
+			t.Errorf("policy %q compiled without error", bad.Name)
+		}
+	}
+}
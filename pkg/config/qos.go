@@ -0,0 +1,51 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/dpi"
+	"github.com/thelastdreamer/MultiWANBond/pkg/packet"
+)
+
+// PriorityMap builds the packet priority mapping; a nil config gives the
+// defaults
+func (qc *QoSConfig) PriorityMap() (*packet.PriorityMap, error) {
+	m := packet.NewPriorityMap()
+	if qc == nil {
+		return m, nil
+	}
+
+	for name, priority := range qc.DSCP {
+		dscp, ok := dscpValue(strings.ToLower(strings.TrimSpace(name)))
+		if !ok {
+			return nil, fmt.Errorf("invalid DSCP %q", name)
+		}
+		m.SetDSCP(dscp, priority)
+	}
+
+	if qc.DPIClasses {
+		m.EnableClasses()
+	}
+	for name, priority := range qc.Classes {
+		class, ok := parseTrafficClass(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown traffic class %q", name)
+		}
+		m.SetClass(class, priority)
+	}
+
+	return m, nil
+}
+
+// parseTrafficClass converts a DPI traffic class name such as "real-time" or
+// "bulk" to its class
+func parseTrafficClass(name string) (dpi.TrafficClass, bool) {
+	name = strings.ReplaceAll(strings.TrimSpace(name), "_", "-")
+	for class := dpi.ClassRealTime; class <= dpi.ClassDefault; class++ {
+		if strings.EqualFold(class.String(), name) {
+			return class, true
+		}
+	}
+	return dpi.ClassDefault, false
+}
@@ -0,0 +1,56 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/dpi"
+	"github.com/thelastdreamer/MultiWANBond/pkg/packet"
+)
+
+func TestQoSPriorityMap(t *testing.T) {
+	var unset *QoSConfig
+	defaults, err := unset.PriorityMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := defaults.Priority(46, dpi.ClassDefault); got != packet.RealTimePriority {
+		t.Errorf("default EF priority = %d, want %d", got, packet.RealTimePriority)
+	}
+
+	qos := &QoSConfig{
+		DSCP:       map[string]uint8{"cs1": 20, "AF11": 30, "12": 35},
+		DPIClasses: true,
+		Classes:    map[string]uint8{"real_time": 250, "Bulk": 45},
+	}
+	m, err := qos.PriorityMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		dscp  uint8
+		class dpi.TrafficClass
+		want  uint8
+	}{
+		{8, dpi.ClassDefault, 20},
+		{10, dpi.ClassDefault, 30},
+		{12, dpi.ClassDefault, 35},
+		{0, dpi.ClassRealTime, 250},
+		{0, dpi.ClassBulk, 45},
+		{0, dpi.ClassStreaming, 160},
+	}
+	for _, tt := range tests {
+		if got := m.Priority(tt.dscp, tt.class); got != tt.want {
+			t.Errorf("DSCP %d, class %v: priority = %d, want %d", tt.dscp, tt.class, got, tt.want)
+		}
+	}
+
+	for _, bad := range []*QoSConfig{
+		{DSCP: map[string]uint8{"af51": 1}},
+		{Classes: map[string]uint8{"voice": 1}},
+	} {
+		if _, err := bad.PriorityMap(); err == nil {
+			t.Errorf("%+v built without error", bad)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package congestion
+
+import (
+	"sync"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+)
+
+const (
+	// AckEvery is how many data packets a WAN receives before they are acked
+	AckEvery = 4
+	// AckInterval is the longest a received data packet waits for its ack
+	AckInterval = 10 * time.Millisecond
+)
+
+// ackState is what arrived on one WAN
+type ackState struct {
+	seq        uint64
+	bytes      uint64
+	receivedAt time.Time // When seq arrived
+	lastAt     time.Time // When the last packet arrived
+	pending    int       // Packets received since the last ack
+}
+
+// AckTracker records the data packets received on each WAN and decides when
+// to ack them
+type AckTracker struct {
+	mu   sync.Mutex
+	wans map[uint8]*ackState
+}
+
+// NewAckTracker creates an ack tracker
+func NewAckTracker() *AckTracker {
+	return &AckTracker{
+		wans: make(map[uint8]*ackState),
+	}
+}
+
+// Received records a data packet of size payload bytes and returns the ack to
+// send now, or nil when the ack can wait
+func (t *AckTracker) Received(wanID uint8, seq uint64, size int, now time.Time) *protocol.Ack {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state, exists := t.wans[wanID]
+	if !exists {
+		state = &ackState{}
+		t.wans[wanID] = state
+	}
+
+	state.bytes += uint64(size)
+	state.lastAt = now
+	state.pending++
+	if seq > state.seq {
+		state.seq = seq
+		state.receivedAt = now
+	}
+
+	if state.pending < AckEvery {
+		return nil
+	}
+	return state.ack(now)
+}
+
+// Due returns the acks of WANs whose packets have waited AckInterval
+func (t *AckTracker) Due(now time.Time) map[uint8]*protocol.Ack {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var acks map[uint8]*protocol.Ack
+	for wanID, state := range t.wans {
+		if state.pending == 0 || now.Sub(state.receivedAt) < AckInterval {
+			continue
+		}
+		if acks == nil {
+			acks = make(map[uint8]*protocol.Ack)
+		}
+		acks[wanID] = state.ack(now)
+	}
+	return acks
+}
+
+// Latest returns the ack of the WAN that received data most recently, even
+// when nothing new arrived since its last ack, and false before any data
+// arrived. It carries reports that must reach the sender when data has
+// stopped, such as missing packets.
+func (t *AckTracker) Latest(now time.Time) (uint8, *protocol.Ack, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var latestID uint8
+	var latest *ackState
+	for wanID, state := range t.wans {
+		if latest == nil || state.lastAt.After(latest.lastAt) || (state.lastAt.Equal(latest.lastAt) && wanID < latestID) {
+			latestID, latest = wanID, state
+		}
+	}
+	if latest == nil {
+		return 0, nil, false
+	}
+	return latestID, latest.ack(now), true
+}
+
+// Remove forgets a WAN
+func (t *AckTracker) Remove(wanID uint8) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.wans, wanID)
+}
+
+// ack builds the ack for what has arrived so far
+func (s *ackState) ack(now time.Time) *protocol.Ack {
+	s.pending = 0
+	return &protocol.Ack{
+		Seq:   s.seq,
+		Bytes: s.bytes,
+		Delay: max(now.Sub(s.receivedAt), 0),
+	}
+}
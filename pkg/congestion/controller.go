@@ -0,0 +1,349 @@
+package congestion
+
+import (
+	"sync"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+)
+
+const (
+	// MaxSegment is the packet size congestion windows are counted in
+	MaxSegment = 1400
+	// InitialWindow is the congestion window of a new path
+	InitialWindow = 10 * MaxSegment
+	// MinWindow is the smallest congestion window
+	MinWindow = 2 * MaxSegment
+	// DefaultMaxWindow caps the congestion window
+	DefaultMaxWindow = 8 << 20
+	// DefaultTargetDelay is the queueing delay a path is allowed to build
+	DefaultTargetDelay = 25 * time.Millisecond
+)
+
+const (
+	baseDelayBucket     = time.Minute // The base delay is the minimum RTT over the last two buckets
+	delaySamples        = 4           // Recent RTT samples filtered for the current delay
+	pacingGain          = 1.25
+	slowStartPacingGain = 2.0
+	initialRTO          = time.Second
+	minRTO              = 200 * time.Millisecond
+	maxTracked          = 8192 // Sent packets remembered while waiting for acks
+)
+
+// Config contains congestion controller settings
+type Config struct {
+	TargetDelay time.Duration // Queueing delay to aim for; 0 uses DefaultTargetDelay
+	MaxWindow   int           // Largest congestion window in bytes; 0 uses DefaultMaxWindow
+}
+
+// Stats is a snapshot of a controller's state
+type Stats struct {
+	Window     int     // Congestion window in bytes
+	InFlight   int     // Bytes sent and not yet acked
+	PacingRate float64 // Bytes/sec, 0 before the first RTT sample
+	SmoothRTT  time.Duration
+	BaseRTT    time.Duration // RTT of the path with empty queues
+	SlowStart  bool
+	Losses     uint64 // Window reductions after loss
+	Timeouts   uint64 // Window collapses after acks stopped
+}
+
+// sentPacket is a packet waiting for its ack
+type sentPacket struct {
+	seq    uint64
+	size   int
+	sentAt time.Time
+}
+
+// Controller is a delay-based congestion controller for one WAN, in the
+// style of LEDBAT (RFC 6817). It grows the window while the path's queueing
+// delay, the RTT above the path's base RTT, is below a target and shrinks it
+// when the delay is above, so a saturated WAN keeps a short queue instead of
+// filling its modem's buffer. Sends are paced at a little over the window
+// per RTT.
+//
+// The receiver acks each WAN with the highest sequence ID and the total
+// payload bytes it got there. Packets up to the acked sequence ID leave
+// flight; those the byte count says never arrived are lost.
+type Controller struct {
+	mu          sync.Mutex
+	targetDelay time.Duration
+	maxWindow   float64
+
+	cwnd      float64
+	slowStart bool
+	inFlight  int
+	sent      []sentPacket // In send order
+
+	acked      bool   // An ack has been seen
+	delivered  uint64 // The receiver's byte count at the last ack
+	lastAck    time.Time
+	recoveryAt time.Time // Losses and delays of packets sent before this are already answered
+
+	srtt       time.Duration
+	recent     [delaySamples]time.Duration
+	nRecent    int
+	baseDelay  [2]time.Duration // Minimum RTT of the previous and current bucket
+	bucketFrom time.Time
+
+	nextSend time.Time // Earliest send allowed by pacing
+	losses   uint64
+	timeouts uint64
+}
+
+// NewController creates a congestion controller
+func NewController(cfg Config) *Controller {
+	if cfg.TargetDelay <= 0 {
+		cfg.TargetDelay = DefaultTargetDelay
+	}
+	if cfg.MaxWindow <= 0 {
+		cfg.MaxWindow = DefaultMaxWindow
+	}
+	return &Controller{
+		targetDelay: cfg.TargetDelay,
+		maxWindow:   float64(max(cfg.MaxWindow, MinWindow)),
+		cwnd:        InitialWindow,
+		slowStart:   true,
+	}
+}
+
+// Delay returns how long a packet of size bytes must wait before it may be
+// sent, or 0 to send it now. A packet waiting for window space waits until
+// the acks are overdue; callers should try again sooner when an ack arrives.
+func (c *Controller) Delay(size int, now time.Time) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.inFlight > 0 && c.inFlight+size > int(c.cwnd) {
+		overdue := c.lastActivity().Add(c.rto())
+		if now.Before(overdue) {
+			return overdue.Sub(now)
+		}
+		c.timeout()
+	}
+
+	if wait := c.nextSend.Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// OnSent records a packet sent with data sequence ID seq and size payload bytes
+func (c *Controller) OnSent(seq uint64, size int, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.sent) == maxTracked {
+		c.inFlight -= c.sent[0].size
+		c.sent = c.sent[1:]
+	}
+	c.sent = append(c.sent, sentPacket{seq: seq, size: size, sentAt: now})
+	c.inFlight += size
+
+	if rate := c.pacingRate(); rate > 0 {
+		c.nextSend = later(c.nextSend, now).Add(time.Duration(float64(size) / rate * float64(time.Second)))
+	}
+}
+
+// OnAck updates the window with an ack from the receiver
+func (c *Controller) OnAck(ack *protocol.Ack, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.acked && ack.Bytes < c.delivered {
+		return // Reordered behind a newer ack
+	}
+	delivered := int(ack.Bytes - c.delivered)
+	c.delivered = ack.Bytes
+	c.lastAck = now
+
+	// Everything up to the acked packet has arrived or is lost
+	removed, sample := 0, time.Duration(-1)
+	n := 0
+	for ; n < len(c.sent) && c.sent[n].seq <= ack.Seq; n++ {
+		removed += c.sent[n].size
+		if c.sent[n].seq == ack.Seq {
+			sample = now.Sub(c.sent[n].sentAt) - ack.Delay
+		}
+	}
+	sentAt := time.Time{}
+	if n > 0 {
+		sentAt = c.sent[n-1].sentAt
+	}
+	c.sent = append(c.sent[:0], c.sent[n:]...)
+	c.inFlight -= removed
+
+	if sample > 0 {
+		c.updateRTT(sample, now)
+	}
+
+	if !c.acked {
+		// The receiver's byte count may include packets sent before this
+		// controller, so the first ack only sets the baseline
+		c.acked = true
+		return
+	}
+
+	if removed > delivered && sentAt.After(c.recoveryAt) {
+		// Halve the window once per round trip of losses
+		c.cwnd = max(c.cwnd/2, MinWindow)
+		c.slowStart = false
+		c.recoveryAt = now
+		c.losses++
+		return
+	}
+
+	c.grow(delivered, sentAt, now)
+}
+
+// grow opens or closes the window for newly delivered bytes by how far the
+// queueing delay is from the target. sentAt is when the newest acked packet
+// was sent.
+func (c *Controller) grow(delivered int, sentAt, now time.Time) {
+	if delivered <= 0 || c.nRecent == 0 {
+		return
+	}
+
+	queueing := c.queueingDelay()
+	if queueing > c.targetDelay && sentAt.After(c.recoveryAt) {
+		// Shrink the window to what the path carries with the target queue,
+		// once per round trip: the delay of packets sent before that still
+		// reflects the old window. This drains the overshoot of slow start
+		// in one round trip rather than one segment per round trip.
+		base := c.baseRTT()
+		c.cwnd = max(c.cwnd*float64(base+c.targetDelay)/float64(base+queueing), MinWindow)
+		c.slowStart = false
+		c.recoveryAt = now
+		return
+	}
+
+	if c.slowStart {
+		if queueing < c.targetDelay/2 {
+			if c.inFlight+delivered >= int(c.cwnd)/2 { // Only grow windows that are used
+				c.cwnd = min(c.cwnd+float64(delivered), c.maxWindow)
+			}
+			return
+		}
+		c.slowStart = false
+	}
+
+	offTarget := float64(c.targetDelay-queueing) / float64(c.targetDelay)
+	if offTarget > 0 && c.inFlight+delivered < int(c.cwnd)/2 {
+		return
+	}
+	c.cwnd += offTarget * float64(delivered) * MaxSegment / c.cwnd
+	c.cwnd = min(max(c.cwnd, MinWindow), c.maxWindow)
+}
+
+// updateRTT adds an RTT sample
+func (c *Controller) updateRTT(sample time.Duration, now time.Time) {
+	if c.srtt == 0 {
+		c.srtt = sample
+	} else {
+		c.srtt += (sample - c.srtt) / 8
+	}
+
+	c.recent[c.nRecent%delaySamples] = sample
+	c.nRecent++
+
+	if c.bucketFrom.IsZero() || now.Sub(c.bucketFrom) >= baseDelayBucket {
+		c.baseDelay[0], c.baseDelay[1] = c.baseDelay[1], 0
+		c.bucketFrom = now
+	}
+	if c.baseDelay[1] == 0 || sample < c.baseDelay[1] {
+		c.baseDelay[1] = sample
+	}
+}
+
+// baseRTT returns the RTT of the path with empty queues
+func (c *Controller) baseRTT() time.Duration {
+	if c.baseDelay[0] > 0 && c.baseDelay[0] < c.baseDelay[1] {
+		return c.baseDelay[0]
+	}
+	return c.baseDelay[1]
+}
+
+// queueingDelay returns how much of the current RTT is spent in queues
+func (c *Controller) queueingDelay() time.Duration {
+	current := c.recent[0]
+	for _, sample := range c.recent[:min(c.nRecent, delaySamples)] {
+		current = min(current, sample)
+	}
+	return max(current-c.baseRTT(), 0)
+}
+
+// pacingRate returns the send rate in bytes/sec, or 0 before the first RTT sample
+func (c *Controller) pacingRate() float64 {
+	if c.srtt <= 0 {
+		return 0
+	}
+	gain := pacingGain
+	if c.slowStart {
+		gain = slowStartPacingGain
+	}
+	return gain * c.cwnd / c.srtt.Seconds()
+}
+
+// rto returns how long acks may be missing before the window collapses
+func (c *Controller) rto() time.Duration {
+	if c.srtt == 0 {
+		return initialRTO
+	}
+	return max(3*c.srtt, minRTO)
+}
+
+// lastActivity returns when the oldest packet in flight was sent or the
+// last ack arrived, whichever is later
+func (c *Controller) lastActivity() time.Time {
+	if len(c.sent) == 0 {
+		return c.lastAck
+	}
+	return later(c.sent[0].sentAt, c.lastAck)
+}
+
+// timeout collapses the window when acks stopped coming: everything in
+// flight is taken as lost and the path starts over
+func (c *Controller) timeout() {
+	c.sent = c.sent[:0]
+	c.inFlight = 0
+	c.cwnd = MinWindow
+	c.slowStart = true
+	c.timeouts++
+}
+
+// Capacity returns the rate the window allows, in bytes/sec, or 0 before the
+// first RTT sample
+func (c *Controller) Capacity() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.srtt <= 0 {
+		return 0
+	}
+	return c.cwnd / c.srtt.Seconds()
+}
+
+// Stats returns a snapshot of the controller
+func (c *Controller) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return Stats{
+		Window:     int(c.cwnd),
+		InFlight:   c.inFlight,
+		PacingRate: c.pacingRate(),
+		SmoothRTT:  c.srtt,
+		BaseRTT:    c.baseRTT(),
+		SlowStart:  c.slowStart,
+		Losses:     c.losses,
+		Timeouts:   c.timeouts,
+	}
+}
+
+// later returns the later of two times
+func later(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,233 @@
+package congestion
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+)
+
+// emulatedLink is a WAN with a fixed propagation delay each way behind a
+// FIFO bottleneck of fixed rate, whose buffer drops packets beyond a limit
+type emulatedLink struct {
+	rate      float64       // bytes/sec
+	delay     time.Duration // One way
+	buffer    time.Duration // Queueing the bottleneck buffer holds
+	busyUntil time.Time
+}
+
+// send returns when a packet sent at now arrives at the receiver, and false
+// when the bottleneck drops it
+func (l *emulatedLink) send(now time.Time, size int) (time.Time, bool) {
+	start := later(l.busyUntil, now)
+	if start.Sub(now) > l.buffer {
+		return time.Time{}, false
+	}
+	l.busyUntil = start.Add(time.Duration(float64(size) / l.rate * float64(time.Second)))
+	return l.busyUntil.Add(l.delay), true
+}
+
+// linkResult describes a saturating transfer over an emulated link
+type linkResult struct {
+	Throughput float64       // bytes/sec delivered after the warm-up
+	Queueing   time.Duration // Mean bottleneck queueing after the warm-up
+	Stats      Stats
+}
+
+// saturate sends as fast as the controller allows over an emulated link on a
+// virtual clock for the given duration, with the receiver acking through an
+// AckTracker, and measures the second half of the transfer
+func saturate(t *testing.T, link *emulatedLink, duration time.Duration) linkResult {
+	t.Helper()
+
+	const step = 100 * time.Microsecond
+	const size = MaxSegment
+
+	type event struct {
+		at  time.Time
+		seq uint64
+		ack *protocol.Ack
+	}
+
+	start := time.Unix(0, 0)
+	warmUp := start.Add(duration / 2)
+	cc := NewController(Config{})
+	tracker := NewAckTracker()
+
+	var arrivals, acks []event
+	var seq, delivered uint64
+	var queueing time.Duration
+	var queued int
+	nextDue := start
+
+	for now := start; now.Before(start.Add(duration)); now = now.Add(step) {
+		// Data reaching the receiver; acks travel back over the same delay
+		for len(arrivals) > 0 && !arrivals[0].at.After(now) {
+			arrival := arrivals[0]
+			arrivals = arrivals[1:]
+			if arrival.at.After(warmUp) {
+				delivered += size
+			}
+			if ack := tracker.Received(1, arrival.seq, size, arrival.at); ack != nil {
+				acks = append(acks, event{at: arrival.at.Add(link.delay), ack: ack})
+			}
+		}
+		if !now.Before(nextDue) {
+			if ack := tracker.Due(now)[1]; ack != nil {
+				acks = append(acks, event{at: now.Add(link.delay), ack: ack})
+			}
+			nextDue = now.Add(AckInterval)
+		}
+
+		// Acks reaching the sender, through the wire format
+		for len(acks) > 0 && !acks[0].at.After(now) {
+			ack, err := protocol.DecodeAck(protocol.EncodeAck(acks[0].ack))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cc.OnAck(ack, now)
+			acks = acks[1:]
+		}
+
+		for cc.Delay(size, now) == 0 {
+			seq++
+			cc.OnSent(seq, size, now)
+			if now.After(warmUp) {
+				queueing += max(link.busyUntil.Sub(now), 0)
+				queued++
+			}
+			if at, ok := link.send(now, size); ok {
+				arrivals = append(arrivals, event{at: at, seq: seq})
+			}
+		}
+	}
+
+	result := linkResult{
+		Throughput: float64(delivered) / (duration / 2).Seconds(),
+		Stats:      cc.Stats(),
+	}
+	if queued > 0 {
+		result.Queueing = queueing / time.Duration(queued)
+	}
+	return result
+}
+
+func TestControllerSaturatesLinkWithShortQueue(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		link emulatedLink
+	}{
+		{"DSL", emulatedLink{rate: 1_250_000, delay: 20 * time.Millisecond, buffer: 500 * time.Millisecond}},
+		{"fiber", emulatedLink{rate: 12_500_000, delay: 5 * time.Millisecond, buffer: 200 * time.Millisecond}},
+		{"satellite", emulatedLink{rate: 2_500_000, delay: 300 * time.Millisecond, buffer: time.Second}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			link := tc.link
+			result := saturate(t, &link, 20*time.Second)
+			t.Logf("throughput %.0f of %.0f bytes/sec, mean queueing %v, %+v", result.Throughput, link.rate, result.Queueing, result.Stats)
+
+			if result.Throughput < 0.85*link.rate {
+				t.Errorf("throughput %.0f bytes/sec, want at least 85%% of %.0f", result.Throughput, link.rate)
+			}
+			if result.Queueing > 2*DefaultTargetDelay {
+				t.Errorf("mean queueing %v, want at most %v", result.Queueing, 2*DefaultTargetDelay)
+			}
+		})
+	}
+}
+
+func TestControllerHalvesWindowOncePerRoundTrip(t *testing.T) {
+	now := time.Unix(0, 0)
+	cc := NewController(Config{})
+
+	// Establish the byte count baseline
+	cc.OnSent(1, 1000, now)
+	now = now.Add(50 * time.Millisecond)
+	cc.OnAck(&protocol.Ack{Seq: 1, Bytes: 1000}, now)
+
+	for seq := uint64(2); seq <= 9; seq++ {
+		cc.OnSent(seq, 1000, now)
+	}
+	window := cc.Stats().Window
+
+	// Packet 3 is lost: packets 2-5 are acked with only 3000 bytes received
+	now = now.Add(50 * time.Millisecond)
+	cc.OnAck(&protocol.Ack{Seq: 5, Bytes: 4000}, now)
+	stats := cc.Stats()
+	if stats.Losses != 1 || stats.Window != window/2 || stats.SlowStart {
+		t.Fatalf("after loss: %+v, want window %d", stats, window/2)
+	}
+
+	// More losses from the same round trip do not shrink the window again
+	cc.OnAck(&protocol.Ack{Seq: 9, Bytes: 6000}, now)
+	if stats := cc.Stats(); stats.Losses != 1 || stats.Window != window/2 {
+		t.Fatalf("after second loss in the round trip: %+v", stats)
+	}
+	if stats := cc.Stats(); stats.InFlight != 0 {
+		t.Fatalf("%d bytes in flight after every packet was acked", stats.InFlight)
+	}
+}
+
+func TestControllerTimeout(t *testing.T) {
+	now := time.Unix(0, 0)
+	cc := NewController(Config{})
+
+	var seq uint64
+	for cc.Delay(MaxSegment, now) == 0 {
+		seq++
+		cc.OnSent(seq, MaxSegment, now)
+	}
+	if seq != InitialWindow/MaxSegment {
+		t.Fatalf("sent %d packets before the window filled, want %d", seq, InitialWindow/MaxSegment)
+	}
+
+	// Without acks the sender waits until they are overdue
+	wait := cc.Delay(MaxSegment, now)
+	if wait != initialRTO {
+		t.Fatalf("waiting %v for window space, want %v", wait, initialRTO)
+	}
+
+	now = now.Add(wait)
+	if wait := cc.Delay(MaxSegment, now); wait != 0 {
+		t.Fatalf("still waiting %v after the timeout", wait)
+	}
+	stats := cc.Stats()
+	if stats.Timeouts != 1 || stats.Window != MinWindow || stats.InFlight != 0 || !stats.SlowStart {
+		t.Fatalf("after timeout: %+v", stats)
+	}
+}
+
+func TestAckTracker(t *testing.T) {
+	now := time.Unix(0, 0)
+	tracker := NewAckTracker()
+
+	for seq := uint64(1); seq < AckEvery; seq++ {
+		if ack := tracker.Received(1, seq, 100, now); ack != nil {
+			t.Fatalf("packet %d acked immediately", seq)
+		}
+	}
+	if acks := tracker.Due(now.Add(AckInterval / 2)); len(acks) != 0 {
+		t.Fatalf("acks due before the interval: %v", acks)
+	}
+
+	// Acks are due once the interval has passed, with the time they were held
+	acks := tracker.Due(now.Add(AckInterval))
+	if ack := acks[1]; ack == nil || !reflect.DeepEqual(*ack, protocol.Ack{Seq: AckEvery - 1, Bytes: 100 * (AckEvery - 1), Delay: AckInterval}) {
+		t.Fatalf("due acks = %v", acks)
+	}
+
+	// Every AckEvery packets are acked at once, counting late arrivals
+	now = now.Add(time.Second)
+	tracker.Received(1, 10, 100, now)
+	tracker.Received(1, 8, 100, now)
+	tracker.Received(2, 9, 100, now)
+	tracker.Received(1, 11, 100, now)
+	ack := tracker.Received(1, 12, 100, now)
+	if ack == nil || !reflect.DeepEqual(*ack, protocol.Ack{Seq: 12, Bytes: 100 * (AckEvery - 1 + AckEvery)}) {
+		t.Fatalf("ack = %+v", ack)
+	}
+	if acks := tracker.Due(now.Add(time.Second)); len(acks) != 1 || acks[2].Seq != 9 {
+		t.Fatalf("due acks = %v", acks)
+	}
+}
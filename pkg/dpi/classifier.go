@@ -92,10 +92,10 @@ func (c *Classifier) ClassifyPacket(srcIP, dstIP net.IP, srcPort, dstPort uint16
 			return nil, nil
 		}
 
-		// Create new flow
+		// Create new flow; the addresses may point into the packet
 		flow = &Flow{
-			SrcIP:     srcIP,
-			DstIP:     dstIP,
+			SrcIP:     append(net.IP(nil), srcIP...),
+			DstIP:     append(net.IP(nil), dstIP...),
 			SrcPort:   srcPort,
 			DstPort:   dstPort,
 			Proto:     proto,
@@ -0,0 +1,469 @@
+package fec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Block FEC groups consecutive data packets into blocks of DataShards
+// sequence numbers. Each data shard is the packet payload prefixed with its
+// 2-byte length and zero-padded to the largest payload in the block, so the
+// receiver can rebuild the original packet from a recovered shard. Parity
+// shards travel as PacketTypeFEC packets whose SequenceID is the first
+// sequence number of the block.
+
+const (
+	// MaxDataShards is the maximum number of data shards per block
+	MaxDataShards = 32
+
+	// ParityHeaderSize is the size of the header preceding a parity shard
+	ParityHeaderSize = 8
+
+	// shardLenSize is the size of the length prefix of a data shard
+	shardLenSize = 2
+
+	// ParityOverhead is how much larger a parity payload is than the largest
+	// data packet of its block
+	ParityOverhead = ParityHeaderSize + shardLenSize
+)
+
+// ShardsForRedundancy returns the data and parity shard counts for a redundancy ratio
+func ShardsForRedundancy(redundancy float64) (int, int) {
+	dataShards := 4
+	parityShards := int(float64(dataShards) * redundancy)
+	if parityShards < 1 {
+		parityShards = 1
+	}
+	return dataShards, parityShards
+}
+
+// blockBase returns the first sequence number of the block containing seq
+func blockBase(seq uint64, dataShards int) uint64 {
+	return seq - (seq-1)%uint64(dataShards)
+}
+
+// ParityHeader describes a parity shard on the wire
+type ParityHeader struct {
+	DataShards   int    // Data shards per block
+	ParityShards int    // Parity shards per block
+	Index        int    // Index of this parity shard
+	Present      uint32 // Bitmap of data shards that carry a packet
+}
+
+// ParseParity splits a PacketTypeFEC payload into its header and shard
+func ParseParity(data []byte) (*ParityHeader, []byte, error) {
+	if len(data) < ParityHeaderSize+shardLenSize {
+		return nil, nil, fmt.Errorf("parity payload too small: %d bytes", len(data))
+	}
+
+	hdr := &ParityHeader{
+		DataShards:   int(data[0]),
+		ParityShards: int(data[1]),
+		Index:        int(data[2]),
+		Present:      binary.BigEndian.Uint32(data[4:8]),
+	}
+
+	if hdr.DataShards < 1 || hdr.DataShards > MaxDataShards {
+		return nil, nil, fmt.Errorf("invalid data shard count: %d", hdr.DataShards)
+	}
+	if hdr.ParityShards < 1 || hdr.Index >= hdr.ParityShards {
+		return nil, nil, fmt.Errorf("invalid parity index %d of %d", hdr.Index, hdr.ParityShards)
+	}
+
+	return hdr, data[ParityHeaderSize:], nil
+}
+
+// ParityBlock holds the parity shards of a finished block
+type ParityBlock struct {
+	BaseSeq    uint64        // First sequence number of the block
+	DataShards int           // Data shards per block
+	Present    uint32        // Bitmap of data shards that carry a packet
+	Parity     [][]byte      // Parity shards
+	WANs       map[uint8]int // Number of data shards sent per WAN
+}
+
+// Payload returns the PacketTypeFEC payload for parity shard i
+func (pb *ParityBlock) Payload(i int) []byte {
+	buf := make([]byte, ParityHeaderSize+len(pb.Parity[i]))
+	buf[0] = uint8(pb.DataShards)
+	buf[1] = uint8(len(pb.Parity))
+	buf[2] = uint8(i)
+	binary.BigEndian.PutUint32(buf[4:8], pb.Present)
+	copy(buf[ParityHeaderSize:], pb.Parity[i])
+	return buf
+}
+
+// encodeBlock is a block being filled by the sender
+type encodeBlock struct {
+	payloads [][]byte
+	present  uint32
+	count    int
+	wans     map[uint8]int
+	created  time.Time
+}
+
+// BlockEncoder groups outgoing data packets into FEC blocks
+type BlockEncoder struct {
+	mu     sync.Mutex
+	codec  *ReedSolomonEncoder
+	blocks map[uint64]*encodeBlock
+}
+
+// NewBlockEncoder creates a new block encoder
+func NewBlockEncoder(dataShards, parityShards int) (*BlockEncoder, error) {
+	if dataShards > MaxDataShards {
+		return nil, fmt.Errorf("data shards must be <= %d", MaxDataShards)
+	}
+
+	codec := NewReedSolomonEncoder()
+	if err := codec.SetShardCount(dataShards, parityShards); err != nil {
+		return nil, err
+	}
+
+	return &BlockEncoder{
+		codec:  codec,
+		blocks: make(map[uint64]*encodeBlock),
+	}, nil
+}
+
+// Add adds a sent data packet to its block.
+// Returns the parity block once every data packet of the block has been added.
+func (e *BlockEncoder) Add(seq uint64, wanID uint8, data []byte) (*ParityBlock, error) {
+	if seq == 0 {
+		return nil, fmt.Errorf("sequence IDs start at 1")
+	}
+	if len(data) > 0xffff {
+		return nil, fmt.Errorf("packet too large for FEC: %d bytes", len(data))
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	k := e.codec.DataShards()
+	base := blockBase(seq, k)
+	idx := int(seq - base)
+
+	block, exists := e.blocks[base]
+	if !exists {
+		block = &encodeBlock{
+			payloads: make([][]byte, k),
+			wans:     make(map[uint8]int),
+			created:  time.Now(),
+		}
+		e.blocks[base] = block
+	}
+
+	if block.present&(1<<idx) != 0 {
+		return nil, fmt.Errorf("sequence %d already added", seq)
+	}
+
+	block.payloads[idx] = append([]byte(nil), data...)
+	block.present |= 1 << idx
+	block.count++
+	block.wans[wanID]++
+
+	if block.count < k {
+		return nil, nil
+	}
+
+	delete(e.blocks, base)
+	return e.finish(base, block)
+}
+
+// Flush finishes blocks that have been incomplete for longer than maxAge.
+// Missing data packets are encoded as empty shards.
+func (e *BlockEncoder) Flush(maxAge time.Duration) []*ParityBlock {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	cutoff := time.Now().Add(-maxAge)
+	var flushed []*ParityBlock
+
+	for base, block := range e.blocks {
+		if block.created.After(cutoff) {
+			continue
+		}
+
+		delete(e.blocks, base)
+		if pb, err := e.finish(base, block); err == nil {
+			flushed = append(flushed, pb)
+		}
+	}
+
+	return flushed
+}
+
+// finish computes the parity shards of a block
+func (e *BlockEncoder) finish(base uint64, block *encodeBlock) (*ParityBlock, error) {
+	shardSize := shardLenSize
+	for _, payload := range block.payloads {
+		if shardLenSize+len(payload) > shardSize {
+			shardSize = shardLenSize + len(payload)
+		}
+	}
+
+	shards := make([][]byte, len(block.payloads))
+	for i, payload := range block.payloads {
+		shards[i] = makeShard(payload, shardSize)
+	}
+
+	parity, err := e.codec.EncodeShards(shards)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ParityBlock{
+		BaseSeq:    base,
+		DataShards: len(block.payloads),
+		Present:    block.present,
+		Parity:     parity,
+		WANs:       block.wans,
+	}, nil
+}
+
+// makeShard builds a length-prefixed, zero-padded data shard
+func makeShard(payload []byte, shardSize int) []byte {
+	shard := make([]byte, shardSize)
+	binary.BigEndian.PutUint16(shard, uint16(len(payload)))
+	copy(shard[shardLenSize:], payload)
+	return shard
+}
+
+// Recovered is a data packet rebuilt from parity
+type Recovered struct {
+	Seq  uint64
+	Data []byte
+}
+
+// Stats contains FEC recovery statistics
+type Stats struct {
+	Recovered     uint64 // Data packets rebuilt from parity
+	Unrecoverable uint64 // Lost data packets that could not be rebuilt
+}
+
+// decodeBlock is a block being collected by the receiver
+type decodeBlock struct {
+	payloads  [][]byte
+	received  int
+	parity    [][]byte
+	present   uint32
+	hasParity bool
+	done      bool
+	created   time.Time
+}
+
+// BlockDecoder rebuilds lost data packets from received parity
+type BlockDecoder struct {
+	mu     sync.Mutex
+	codec  *ReedSolomonEncoder
+	blocks map[uint64]*decodeBlock
+	stats  Stats
+}
+
+// NewBlockDecoder creates a new block decoder
+func NewBlockDecoder(dataShards, parityShards int) (*BlockDecoder, error) {
+	if dataShards > MaxDataShards {
+		return nil, fmt.Errorf("data shards must be <= %d", MaxDataShards)
+	}
+
+	codec := NewReedSolomonEncoder()
+	if err := codec.SetShardCount(dataShards, parityShards); err != nil {
+		return nil, err
+	}
+
+	return &BlockDecoder{
+		codec:  codec,
+		blocks: make(map[uint64]*decodeBlock),
+	}, nil
+}
+
+// getBlock returns the block starting at base, creating it if needed
+func (d *BlockDecoder) getBlock(base uint64) *decodeBlock {
+	block, exists := d.blocks[base]
+	if !exists {
+		block = &decodeBlock{
+			payloads: make([][]byte, d.codec.DataShards()),
+			parity:   make([][]byte, d.codec.ParityShards()),
+			created:  time.Now(),
+		}
+		d.blocks[base] = block
+	}
+	return block
+}
+
+// AddData records a received data packet.
+// Returns any packets of the same block that can now be rebuilt.
+func (d *BlockDecoder) AddData(seq uint64, data []byte) []Recovered {
+	if seq == 0 || len(data) > 0xffff {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	base := blockBase(seq, d.codec.DataShards())
+	block := d.getBlock(base)
+	idx := int(seq - base)
+
+	if block.done || block.payloads[idx] != nil {
+		return nil
+	}
+
+	// Keep empty payloads non-nil so they are not mistaken for losses
+	block.payloads[idx] = append(make([]byte, 0, len(data)), data...)
+	block.received++
+
+	// A full block needs no parity
+	if block.received == len(block.payloads) {
+		block.finish()
+		return nil
+	}
+
+	return d.recover(base, block)
+}
+
+// AddParity records a received parity shard for the block starting at baseSeq.
+// Returns the data packets that can now be rebuilt.
+func (d *BlockDecoder) AddParity(baseSeq uint64, payload []byte) ([]Recovered, error) {
+	hdr, shard, err := ParseParity(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	k := d.codec.DataShards()
+	if hdr.DataShards != k || hdr.ParityShards != d.codec.ParityShards() {
+		return nil, fmt.Errorf("shard count mismatch: got %d+%d, want %d+%d",
+			hdr.DataShards, hdr.ParityShards, k, d.codec.ParityShards())
+	}
+	if baseSeq == 0 || blockBase(baseSeq, k) != baseSeq {
+		return nil, fmt.Errorf("invalid block sequence: %d", baseSeq)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	block := d.getBlock(baseSeq)
+	if block.done || block.parity[hdr.Index] != nil {
+		return nil, nil
+	}
+
+	for _, p := range block.parity {
+		if p != nil && len(p) != len(shard) {
+			return nil, fmt.Errorf("parity shard size mismatch")
+		}
+	}
+
+	block.parity[hdr.Index] = append([]byte(nil), shard...)
+	block.present = hdr.Present
+	block.hasParity = true
+
+	return d.recover(baseSeq, block), nil
+}
+
+// recover rebuilds missing data shards once enough parity has arrived
+func (d *BlockDecoder) recover(base uint64, block *decodeBlock) []Recovered {
+	if block.done || !block.hasParity {
+		return nil
+	}
+
+	var missing []int
+	for i, payload := range block.payloads {
+		if block.present&(1<<i) != 0 && payload == nil {
+			missing = append(missing, i)
+		}
+	}
+
+	if len(missing) == 0 {
+		block.finish()
+		return nil
+	}
+
+	parityCount := 0
+	shardSize := 0
+	for _, p := range block.parity {
+		if p != nil {
+			parityCount++
+			shardSize = len(p)
+		}
+	}
+	if len(missing) > parityCount {
+		return nil
+	}
+
+	shards := make([][]byte, len(block.payloads)+len(block.parity))
+	for i, payload := range block.payloads {
+		switch {
+		case block.present&(1<<i) == 0:
+			shards[i] = makeShard(nil, shardSize)
+		case payload != nil:
+			if shardLenSize+len(payload) > shardSize {
+				return nil
+			}
+			shards[i] = makeShard(payload, shardSize)
+		}
+	}
+	copy(shards[len(block.payloads):], block.parity)
+
+	if err := d.codec.ReconstructShards(shards); err != nil {
+		return nil
+	}
+
+	recovered := make([]Recovered, 0, len(missing))
+	for _, i := range missing {
+		n := int(binary.BigEndian.Uint16(shards[i]))
+		if shardLenSize+n > shardSize {
+			continue
+		}
+
+		data := make([]byte, n)
+		copy(data, shards[i][shardLenSize:])
+		recovered = append(recovered, Recovered{Seq: base + uint64(i), Data: data})
+	}
+
+	d.stats.Recovered += uint64(len(recovered))
+	block.finish()
+
+	return recovered
+}
+
+// finish marks a block as complete and releases its buffers
+func (b *decodeBlock) finish() {
+	b.done = true
+	b.payloads = nil
+	b.parity = nil
+}
+
+// Expire drops blocks older than maxAge, counting data packets that were
+// lost and could not be rebuilt. Blocks whose parity never arrived are not
+// counted since the receiver cannot tell which packets they contained.
+func (d *BlockDecoder) Expire(maxAge time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	cutoff := time.Now().Add(-maxAge)
+
+	for base, block := range d.blocks {
+		if block.created.After(cutoff) {
+			continue
+		}
+
+		if !block.done && block.hasParity {
+			for i, payload := range block.payloads {
+				if block.present&(1<<i) != 0 && payload == nil {
+					d.stats.Unrecoverable++
+				}
+			}
+		}
+
+		delete(d.blocks, base)
+	}
+}
+
+// Stats returns the recovery statistics
+func (d *BlockDecoder) Stats() Stats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.stats
+}
@@ -0,0 +1,158 @@
+package fec
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBlockRecoversLostPacket(t *testing.T) {
+	payloads := [][]byte{
+		[]byte("first packet"),
+		[]byte("second, somewhat longer packet"),
+		{},
+		[]byte("last"),
+	}
+
+	for lost := range payloads {
+		t.Run(fmt.Sprintf("lost=%d", lost), func(t *testing.T) {
+			enc, err := NewBlockEncoder(4, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dec, err := NewBlockDecoder(4, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var block *ParityBlock
+			for i, p := range payloads {
+				block, err = enc.Add(uint64(5+i), 1, p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if i != lost {
+					if r := dec.AddData(uint64(5+i), p); len(r) != 0 {
+						t.Fatalf("unexpected recovery before parity: %v", r)
+					}
+				}
+			}
+			if block == nil || block.BaseSeq != 5 {
+				t.Fatalf("expected parity block for seq 5, got %+v", block)
+			}
+
+			recovered, err := dec.AddParity(block.BaseSeq, block.Payload(0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(recovered) != 1 {
+				t.Fatalf("expected 1 recovered packet, got %d", len(recovered))
+			}
+			if recovered[0].Seq != uint64(5+lost) || !bytes.Equal(recovered[0].Data, payloads[lost]) {
+				t.Fatalf("recovered seq=%d data=%q, want seq=%d data=%q",
+					recovered[0].Seq, recovered[0].Data, 5+lost, payloads[lost])
+			}
+			if dec.Stats().Recovered != 1 {
+				t.Fatalf("recovered count = %d, want 1", dec.Stats().Recovered)
+			}
+		})
+	}
+}
+
+func TestBlockFlushPartial(t *testing.T) {
+	enc, _ := NewBlockEncoder(4, 1)
+	dec, _ := NewBlockDecoder(4, 1)
+
+	// Only seqs 1 and 2 of the block are sent; seq 2 is lost
+	enc.Add(1, 1, []byte("one"))
+	enc.Add(2, 2, []byte("two"))
+	dec.AddData(1, []byte("one"))
+
+	blocks := enc.Flush(0)
+	if len(blocks) != 1 {
+		t.Fatalf("expected 1 flushed block, got %d", len(blocks))
+	}
+	if blocks[0].Present != 0b11 {
+		t.Fatalf("present bitmap = %b, want 11", blocks[0].Present)
+	}
+
+	recovered, err := dec.AddParity(1, blocks[0].Payload(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recovered) != 1 || recovered[0].Seq != 2 || string(recovered[0].Data) != "two" {
+		t.Fatalf("unexpected recovery: %+v", recovered)
+	}
+}
+
+func TestBlockUnrecoverable(t *testing.T) {
+	enc, _ := NewBlockEncoder(4, 1)
+	dec, _ := NewBlockDecoder(4, 1)
+
+	var block *ParityBlock
+	for seq := uint64(1); seq <= 4; seq++ {
+		block, _ = enc.Add(seq, 1, []byte{byte(seq)})
+	}
+
+	// Two losses exceed a single parity shard
+	dec.AddData(1, []byte{1})
+	dec.AddData(2, []byte{2})
+	if recovered, _ := dec.AddParity(1, block.Payload(0)); len(recovered) != 0 {
+		t.Fatalf("unexpected recovery: %+v", recovered)
+	}
+
+	dec.Expire(-time.Second)
+
+	stats := dec.Stats()
+	if stats.Recovered != 0 || stats.Unrecoverable != 2 {
+		t.Fatalf("stats = %+v, want 0 recovered and 2 unrecoverable", stats)
+	}
+}
+
+func TestParseParityRejectsMismatch(t *testing.T) {
+	enc, _ := NewBlockEncoder(4, 1)
+	dec, _ := NewBlockDecoder(8, 1)
+
+	var block *ParityBlock
+	for seq := uint64(1); seq <= 4; seq++ {
+		block, _ = enc.Add(seq, 1, []byte("x"))
+	}
+
+	if _, err := dec.AddParity(1, block.Payload(0)); err == nil {
+		t.Fatal("expected shard count mismatch error")
+	}
+	if _, _, err := ParseParity([]byte{1, 2}); err == nil {
+		t.Fatal("expected error for truncated parity")
+	}
+}
+
+func TestBlockRecoversMultipleLosses(t *testing.T) {
+	enc, _ := NewBlockEncoder(4, 2)
+	dec, _ := NewBlockDecoder(4, 2)
+
+	var block *ParityBlock
+	for seq := uint64(1); seq <= 4; seq++ {
+		block, _ = enc.Add(seq, 1, bytes.Repeat([]byte{byte(seq)}, int(seq)*10))
+	}
+
+	// Two of four data packets lost, both parity shards arrive
+	dec.AddData(2, bytes.Repeat([]byte{2}, 20))
+	dec.AddData(4, bytes.Repeat([]byte{4}, 40))
+	if recovered, _ := dec.AddParity(1, block.Payload(0)); len(recovered) != 0 {
+		t.Fatalf("recovered %d packets from one parity shard", len(recovered))
+	}
+	recovered, err := dec.AddParity(1, block.Payload(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(recovered) != 2 {
+		t.Fatalf("expected 2 recovered packets, got %d", len(recovered))
+	}
+	for _, r := range recovered {
+		if !bytes.Equal(r.Data, bytes.Repeat([]byte{byte(r.Seq)}, int(r.Seq)*10)) {
+			t.Fatalf("seq %d recovered incorrectly", r.Seq)
+		}
+	}
+}
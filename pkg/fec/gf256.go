@@ -0,0 +1,169 @@
+package fec
+
+import "fmt"
+
+// Arithmetic over GF(2^8) with the primitive polynomial
+// x^8 + x^4 + x^3 + x^2 + 1 (0x11d), as used by most Reed-Solomon codecs.
+
+const gfPolynomial = 0x11d
+
+var (
+	gfExp [510]byte
+	gfLog [256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= gfPolynomial
+		}
+	}
+	// Duplicate the table so gfMul can skip the modulo
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+// gfMul multiplies two field elements
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+// gfInv returns the multiplicative inverse of a non-zero element
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// gfPow raises a to the power n
+func gfPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])*n)%255]
+}
+
+// gfMulSliceXor computes out ^= c * in over the whole slice
+func gfMulSliceXor(c byte, in, out []byte) {
+	if c == 0 {
+		return
+	}
+	if c == 1 {
+		for i, v := range in {
+			out[i] ^= v
+		}
+		return
+	}
+
+	logC := int(gfLog[c])
+	for i, v := range in {
+		if v != 0 {
+			out[i] ^= gfExp[logC+int(gfLog[v])]
+		}
+	}
+}
+
+// gfMatrix is a row-major matrix over GF(2^8)
+type gfMatrix [][]byte
+
+// newGFMatrix creates a zero matrix
+func newGFMatrix(rows, cols int) gfMatrix {
+	m := make(gfMatrix, rows)
+	for i := range m {
+		m[i] = make([]byte, cols)
+	}
+	return m
+}
+
+// identityMatrix creates an n x n identity matrix
+func identityMatrix(n int) gfMatrix {
+	m := newGFMatrix(n, n)
+	for i := range m {
+		m[i][i] = 1
+	}
+	return m
+}
+
+// vandermondeMatrix creates a matrix with m[r][c] = r^c.
+// Any square subset of its rows is invertible.
+func vandermondeMatrix(rows, cols int) gfMatrix {
+	m := newGFMatrix(rows, cols)
+	for r := range m {
+		for c := range m[r] {
+			m[r][c] = gfPow(byte(r), c)
+		}
+	}
+	return m
+}
+
+// multiply returns m * other
+func (m gfMatrix) multiply(other gfMatrix) gfMatrix {
+	result := newGFMatrix(len(m), len(other[0]))
+	for r := range m {
+		for c := range result[r] {
+			var v byte
+			for i := range other {
+				v ^= gfMul(m[r][i], other[i][c])
+			}
+			result[r][c] = v
+		}
+	}
+	return result
+}
+
+// invert returns the inverse of a square matrix using Gauss-Jordan elimination
+func (m gfMatrix) invert() (gfMatrix, error) {
+	n := len(m)
+
+	// Work on [m | I]
+	work := newGFMatrix(n, 2*n)
+	for r := range m {
+		copy(work[r], m[r])
+		work[r][n+r] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		// Find a pivot row
+		pivot := -1
+		for r := col; r < n; r++ {
+			if work[r][col] != 0 {
+				pivot = r
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, fmt.Errorf("matrix is singular")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+
+		// Scale pivot row to 1
+		if scale := work[col][col]; scale != 1 {
+			inv := gfInv(scale)
+			for c := range work[col] {
+				work[col][c] = gfMul(work[col][c], inv)
+			}
+		}
+
+		// Eliminate the column from every other row
+		for r := 0; r < n; r++ {
+			if r != col && work[r][col] != 0 {
+				gfMulSliceXor(work[r][col], work[col], work[r])
+			}
+		}
+	}
+
+	inverse := newGFMatrix(n, n)
+	for r := range inverse {
+		copy(inverse[r], work[r][n:])
+	}
+	return inverse, nil
+}
@@ -2,27 +2,47 @@ package fec
 
 import (
 	"fmt"
+	"sync/atomic"
 
 	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
 )
 
-// ReedSolomonEncoder implements FEC using Reed-Solomon coding
-// This is a simplified implementation - in production, use a library like github.com/klauspost/reedsolomon
+// MaxTotalShards is the maximum number of data plus parity shards in GF(2^8)
+const MaxTotalShards = 256
+
+// ReedSolomonEncoder implements systematic Reed-Solomon erasure coding over GF(2^8).
+// Any dataShards of the dataShards+parityShards shards are enough to rebuild the rest.
 type ReedSolomonEncoder struct {
 	dataShards   int
 	parityShards int
+	matrix       gfMatrix // (data+parity) x data encoding matrix, identity on top
 }
 
 // NewReedSolomonEncoder creates a new Reed-Solomon FEC encoder
 func NewReedSolomonEncoder() *ReedSolomonEncoder {
-	return &ReedSolomonEncoder{
-		dataShards:   4, // Default: 4 data shards
-		parityShards: 2, // Default: 2 parity shards (50% redundancy)
+	e := &ReedSolomonEncoder{}
+	// Default: 4 data shards, 2 parity shards (50% redundancy)
+	e.SetShardCount(4, 2)
+	return e
+}
+
+// buildMatrix creates the systematic encoding matrix.
+// A Vandermonde matrix is multiplied by the inverse of its top square so the
+// data rows become the identity while any dataShards rows stay invertible.
+func buildMatrix(dataShards, parityShards int) (gfMatrix, error) {
+	vm := vandermondeMatrix(dataShards+parityShards, dataShards)
+
+	top, err := vm[:dataShards].invert()
+	if err != nil {
+		return nil, err
 	}
+
+	return vm.multiply(top), nil
 }
 
-// Encode adds FEC redundancy to data
-// Returns multiple packets: data packets + FEC parity packets
+// Encode splits data into the configured number of data shards and appends
+// the parity shards. The shard counts come from SetShardCount; redundancy is
+// only validated.
 func (e *ReedSolomonEncoder) Encode(data []byte, redundancy float64) ([][]byte, error) {
 	if len(data) == 0 {
 		return nil, fmt.Errorf("empty data")
@@ -32,24 +52,17 @@ func (e *ReedSolomonEncoder) Encode(data []byte, redundancy float64) ([][]byte,
 		return nil, fmt.Errorf("redundancy must be between 0 and 1")
 	}
 
-	// Calculate number of data and parity shards based on redundancy
-	dataShards := 4
-	parityShards := int(float64(dataShards) * redundancy)
-	if parityShards < 1 {
-		parityShards = 1
-	}
-
-	e.dataShards = dataShards
-	e.parityShards = parityShards
-
 	// Calculate shard size
-	shardSize := (len(data) + dataShards - 1) / dataShards
+	shardSize := (len(data) + e.dataShards - 1) / e.dataShards
 
 	// Create data shards
-	dataPackets := make([][]byte, dataShards)
-	for i := 0; i < dataShards; i++ {
+	dataPackets := make([][]byte, e.dataShards)
+	for i := range dataPackets {
 		start := i * shardSize
 		end := start + shardSize
+		if start > len(data) {
+			start = len(data)
+		}
 		if end > len(data) {
 			end = len(data)
 		}
@@ -60,33 +73,19 @@ func (e *ReedSolomonEncoder) Encode(data []byte, redundancy float64) ([][]byte,
 		dataPackets[i] = shard
 	}
 
-	// Generate parity shards (simplified XOR-based for demonstration)
-	// In production, use proper Reed-Solomon library
-	parityPackets := make([][]byte, parityShards)
-	for i := 0; i < parityShards; i++ {
-		parity := make([]byte, shardSize)
-
-		// Simple XOR-based parity (not true Reed-Solomon, but demonstrates concept)
-		for j := 0; j < dataShards; j++ {
-			for k := 0; k < shardSize; k++ {
-				parity[k] ^= dataPackets[j][k]
-			}
-		}
-
-		parityPackets[i] = parity
+	parityPackets, err := e.EncodeShards(dataPackets)
+	if err != nil {
+		return nil, err
 	}
 
 	// Combine data and parity packets
-	allPackets := make([][]byte, dataShards+parityShards)
-	copy(allPackets, dataPackets)
-	copy(allPackets[dataShards:], parityPackets)
-
-	return allPackets, nil
+	return append(dataPackets, parityPackets...), nil
 }
 
 // Decode recovers data from FEC packets (may have missing packets)
-// packets: all received packets (data + parity, may have nils for missing)
+// packets: all packets (data + parity, nil for missing)
 // missing: indices of missing packets
+// The result is the concatenation of the data shards, including padding.
 func (e *ReedSolomonEncoder) Decode(packets [][]byte, missing []int) ([]byte, error) {
 	if len(packets) == 0 {
 		return nil, fmt.Errorf("no packets to decode")
@@ -97,47 +96,21 @@ func (e *ReedSolomonEncoder) Decode(packets [][]byte, missing []int) ([]byte, er
 		return nil, fmt.Errorf("not enough packets: got %d, need %d", len(packets), totalShards)
 	}
 
-	// Count how many packets we have
-	receivedCount := 0
-	for _, pkt := range packets {
-		if pkt != nil {
-			receivedCount++
+	shards := make([][]byte, totalShards)
+	copy(shards, packets)
+	for _, idx := range missing {
+		if idx >= 0 && idx < totalShards {
+			shards[idx] = nil
 		}
 	}
 
-	// Check if we can recover
-	if !e.CanRecover(totalShards, receivedCount) {
-		return nil, fmt.Errorf("cannot recover: need at least %d packets, have %d", e.dataShards, receivedCount)
-	}
-
-	// If no packets are missing, just reconstruct from data shards
-	if len(missing) == 0 {
-		return e.reconstructData(packets[:e.dataShards])
-	}
-
-	// Recover missing data shards using parity
-	// Simplified recovery - in production, use proper Reed-Solomon decoding
-	shardSize := len(packets[0])
-	for _, missIdx := range missing {
-		if missIdx < e.dataShards {
-			// Recover missing data shard
-			recovered := make([]byte, shardSize)
-
-			// XOR all available shards (simplified recovery)
-			for i, pkt := range packets {
-				if pkt != nil && i != missIdx {
-					for k := 0; k < shardSize; k++ {
-						recovered[k] ^= pkt[k]
-					}
-				}
-			}
-
-			packets[missIdx] = recovered
-		}
+	if err := e.ReconstructShards(shards); err != nil {
+		return nil, err
 	}
+	copy(packets, shards)
 
 	// Reconstruct data from (now complete) data shards
-	return e.reconstructData(packets[:e.dataShards])
+	return e.reconstructData(shards[:e.dataShards])
 }
 
 // reconstructData combines data shards back into original data
@@ -156,6 +129,134 @@ func (e *ReedSolomonEncoder) reconstructData(dataShards [][]byte) ([]byte, error
 	return data, nil
 }
 
+// DataShards returns the number of data shards per block
+func (e *ReedSolomonEncoder) DataShards() int {
+	return e.dataShards
+}
+
+// ParityShards returns the number of parity shards per block
+func (e *ReedSolomonEncoder) ParityShards() int {
+	return e.parityShards
+}
+
+// EncodeShards computes parity shards for a block of equally sized data shards
+func (e *ReedSolomonEncoder) EncodeShards(dataShards [][]byte) ([][]byte, error) {
+	if len(dataShards) != e.dataShards {
+		return nil, fmt.Errorf("expected %d data shards, got %d", e.dataShards, len(dataShards))
+	}
+
+	shardSize := len(dataShards[0])
+	for _, shard := range dataShards {
+		if len(shard) != shardSize {
+			return nil, fmt.Errorf("data shards must have equal size")
+		}
+	}
+
+	parityShards := make([][]byte, e.parityShards)
+	for i := range parityShards {
+		parity := make([]byte, shardSize)
+		row := e.matrix[e.dataShards+i]
+		for j, shard := range dataShards {
+			gfMulSliceXor(row[j], shard, parity)
+		}
+		parityShards[i] = parity
+	}
+
+	return parityShards, nil
+}
+
+// ReconstructShards rebuilds missing data and parity shards in place.
+// shards holds the data shards followed by the parity shards; missing shards
+// are nil. Up to parityShards missing shards can be rebuilt.
+func (e *ReedSolomonEncoder) ReconstructShards(shards [][]byte) error {
+	totalShards := e.dataShards + e.parityShards
+	if len(shards) != totalShards {
+		return fmt.Errorf("expected %d shards, got %d", totalShards, len(shards))
+	}
+
+	shardSize := -1
+	present := make([]int, 0, e.dataShards)
+	for i, shard := range shards {
+		if shard == nil {
+			continue
+		}
+		if shardSize < 0 {
+			shardSize = len(shard)
+		} else if len(shard) != shardSize {
+			return fmt.Errorf("shards must have equal size")
+		}
+		if len(present) < e.dataShards {
+			present = append(present, i)
+		}
+	}
+
+	if !hasMissing(shards) {
+		return nil
+	}
+	if len(present) < e.dataShards {
+		return fmt.Errorf("cannot recover: need at least %d shards, have %d", e.dataShards, len(present))
+	}
+
+	// Rebuild missing data shards by inverting the rows of the shards we have
+	dataMissing := false
+	for i := 0; i < e.dataShards; i++ {
+		if shards[i] == nil {
+			dataMissing = true
+			break
+		}
+	}
+
+	if dataMissing {
+		sub := newGFMatrix(e.dataShards, e.dataShards)
+		for r, idx := range present {
+			copy(sub[r], e.matrix[idx])
+		}
+
+		decode, err := sub.invert()
+		if err != nil {
+			return fmt.Errorf("cannot recover: %w", err)
+		}
+
+		for i := 0; i < e.dataShards; i++ {
+			if shards[i] != nil {
+				continue
+			}
+
+			recovered := make([]byte, shardSize)
+			for j, idx := range present {
+				gfMulSliceXor(decode[i][j], shards[idx], recovered)
+			}
+			shards[i] = recovered
+		}
+	}
+
+	// Recompute missing parity shards from the complete data
+	for i := 0; i < e.parityShards; i++ {
+		if shards[e.dataShards+i] != nil {
+			continue
+		}
+
+		parity := make([]byte, shardSize)
+		row := e.matrix[e.dataShards+i]
+		for j := 0; j < e.dataShards; j++ {
+			gfMulSliceXor(row[j], shards[j], parity)
+		}
+		shards[e.dataShards+i] = parity
+	}
+
+	return nil
+}
+
+// hasMissing reports whether any shard is nil
+func hasMissing(shards [][]byte) bool {
+	for _, shard := range shards {
+		if shard == nil {
+			return true
+		}
+	}
+	return false
+}
+
 // CanRecover checks if data can be recovered given packet loss
 func (e *ReedSolomonEncoder) CanRecover(totalPackets, receivedPackets int) bool {
 	// We need at least as many packets as data shards
@@ -170,44 +271,63 @@ func (e *ReedSolomonEncoder) SetShardCount(dataShards, parityShards int) error {
 	if parityShards < 1 {
 		return fmt.Errorf("parity shards must be >= 1")
 	}
+	if dataShards+parityShards > MaxTotalShards {
+		return fmt.Errorf("data + parity shards must be <= %d", MaxTotalShards)
+	}
+
+	matrix, err := buildMatrix(dataShards, parityShards)
+	if err != nil {
+		return err
+	}
 
 	e.dataShards = dataShards
 	e.parityShards = parityShards
+	e.matrix = matrix
 	return nil
 }
 
 // FECManager manages FEC encoding/decoding for the protocol
 type FECManager struct {
 	encoder protocol.FECEncoder
-	enabled bool
+	enabled atomic.Bool
 }
 
 // NewFECManager creates a new FEC manager
 func NewFECManager() *FECManager {
 	return &FECManager{
 		encoder: NewReedSolomonEncoder(),
-		enabled: false,
 	}
 }
 
+// SetShardCount configures the number of data and parity shards
+func (m *FECManager) SetShardCount(dataShards, parityShards int) error {
+	configurable, ok := m.encoder.(interface {
+		SetShardCount(dataShards, parityShards int) error
+	})
+	if !ok {
+		return fmt.Errorf("encoder does not support shard configuration")
+	}
+	return configurable.SetShardCount(dataShards, parityShards)
+}
+
 // Enable enables FEC
 func (m *FECManager) Enable() {
-	m.enabled = true
+	m.enabled.Store(true)
 }
 
 // Disable disables FEC
 func (m *FECManager) Disable() {
-	m.enabled = false
+	m.enabled.Store(false)
 }
 
 // IsEnabled returns whether FEC is enabled
 func (m *FECManager) IsEnabled() bool {
-	return m.enabled
+	return m.enabled.Load()
 }
 
 // EncodePacket encodes a packet with FEC
 func (m *FECManager) EncodePacket(data []byte, redundancy float64) ([][]byte, error) {
-	if !m.enabled {
+	if !m.enabled.Load() {
 		return [][]byte{data}, nil
 	}
 
@@ -216,7 +336,7 @@ func (m *FECManager) EncodePacket(data []byte, redundancy float64) ([][]byte, er
 
 // DecodePackets decodes packets with FEC
 func (m *FECManager) DecodePackets(packets [][]byte, missing []int) ([]byte, error) {
-	if !m.enabled || len(missing) == 0 {
+	if !m.enabled.Load() || len(missing) == 0 {
 		// If FEC disabled or no missing packets, return first packet
 		for _, pkt := range packets {
 			if pkt != nil {
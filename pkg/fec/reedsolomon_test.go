@@ -0,0 +1,191 @@
+package fec
+
+import (
+	"bytes"
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"testing"
+)
+
+// randomShards returns n random shards of the given size
+func randomShards(rng *rand.Rand, n, size int) [][]byte {
+	shards := make([][]byte, n)
+	for i := range shards {
+		shards[i] = make([]byte, size)
+		rng.Read(shards[i])
+	}
+	return shards
+}
+
+func TestGFInverse(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if got := gfMul(byte(a), gfInv(byte(a))); got != 1 {
+			t.Fatalf("%d * inv(%d) = %d", a, a, got)
+		}
+	}
+}
+
+func TestReedSolomonEveryErasurePattern(t *testing.T) {
+	tests := []struct {
+		dataShards   int
+		parityShards int
+	}{
+		{1, 1},
+		{2, 1},
+		{4, 2},
+		{5, 3},
+		{3, 5},
+		{10, 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d+%d", tt.dataShards, tt.parityShards), func(t *testing.T) {
+			rs := NewReedSolomonEncoder()
+			if err := rs.SetShardCount(tt.dataShards, tt.parityShards); err != nil {
+				t.Fatal(err)
+			}
+
+			rng := rand.New(rand.NewSource(int64(tt.dataShards*100 + tt.parityShards)))
+			data := randomShards(rng, tt.dataShards, 64)
+
+			parity, err := rs.EncodeShards(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			original := append(append([][]byte{}, data...), parity...)
+
+			total := tt.dataShards + tt.parityShards
+			for mask := 1; mask < 1<<total; mask++ {
+				shards := make([][]byte, total)
+				for i := range shards {
+					if mask&(1<<i) == 0 {
+						shards[i] = append([]byte(nil), original[i]...)
+					}
+				}
+
+				err := rs.ReconstructShards(shards)
+
+				if bits.OnesCount(uint(mask)) > tt.parityShards {
+					if err == nil {
+						t.Fatalf("erasures %b: expected error with %d missing shards", mask, bits.OnesCount(uint(mask)))
+					}
+					continue
+				}
+
+				if err != nil {
+					t.Fatalf("erasures %b: %v", mask, err)
+				}
+				for i := range shards {
+					if !bytes.Equal(shards[i], original[i]) {
+						t.Fatalf("erasures %b: shard %d not rebuilt correctly", mask, i)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestReedSolomonParityShardsDiffer(t *testing.T) {
+	rs := NewReedSolomonEncoder()
+	if err := rs.SetShardCount(4, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	parity, err := rs.EncodeShards(randomShards(rand.New(rand.NewSource(1)), 4, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(parity); i++ {
+		if bytes.Equal(parity[0], parity[i]) {
+			t.Fatalf("parity shards 0 and %d are identical", i)
+		}
+	}
+}
+
+func TestReedSolomonEncodeDecode(t *testing.T) {
+	rs := NewReedSolomonEncoder()
+	if err := rs.SetShardCount(4, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("the quick brown fox jumps over the lazy dog")
+	packets, err := rs.Encode(data, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packets) != 6 {
+		t.Fatalf("expected 6 packets, got %d", len(packets))
+	}
+
+	packets[0], packets[3] = nil, nil
+	decoded, err := rs.Decode(packets, []int{0, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(decoded, data) {
+		t.Fatalf("decoded %q, want prefix %q", decoded, data)
+	}
+}
+
+func TestReedSolomonShardCountLimits(t *testing.T) {
+	tests := []struct {
+		dataShards   int
+		parityShards int
+		valid        bool
+	}{
+		{0, 1, false},
+		{1, 0, false},
+		{200, 56, true},
+		{200, 57, false},
+	}
+
+	for _, tt := range tests {
+		err := NewReedSolomonEncoder().SetShardCount(tt.dataShards, tt.parityShards)
+		if (err == nil) != tt.valid {
+			t.Errorf("SetShardCount(%d, %d) error = %v, valid = %v", tt.dataShards, tt.parityShards, err, tt.valid)
+		}
+	}
+}
+
+func BenchmarkEncodeShards(b *testing.B) {
+	for _, cfg := range [][2]int{{4, 2}, {10, 4}, {20, 10}} {
+		b.Run(fmt.Sprintf("%d+%d", cfg[0], cfg[1]), func(b *testing.B) {
+			rs := NewReedSolomonEncoder()
+			rs.SetShardCount(cfg[0], cfg[1])
+			data := randomShards(rand.New(rand.NewSource(1)), cfg[0], 1400)
+
+			b.SetBytes(int64(cfg[0] * 1400))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				rs.EncodeShards(data)
+			}
+		})
+	}
+}
+
+func BenchmarkReconstructShards(b *testing.B) {
+	for _, cfg := range [][2]int{{4, 2}, {10, 4}, {20, 10}} {
+		b.Run(fmt.Sprintf("%d+%d", cfg[0], cfg[1]), func(b *testing.B) {
+			rs := NewReedSolomonEncoder()
+			rs.SetShardCount(cfg[0], cfg[1])
+			data := randomShards(rand.New(rand.NewSource(1)), cfg[0], 1400)
+			parity, _ := rs.EncodeShards(data)
+			original := append(data, parity...)
+
+			shards := make([][]byte, len(original))
+			b.SetBytes(int64(cfg[0] * 1400))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				copy(shards, original)
+				// Lose as many data shards as there are parity shards
+				for j := 0; j < cfg[1] && j < cfg[0]; j++ {
+					shards[j] = nil
+				}
+				if err := rs.ReconstructShards(shards); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -2,9 +2,9 @@ package health
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math"
-	"net"
 	"sync"
 	"time"
 
@@ -20,8 +20,18 @@ const (
 	DefaultProbeTimeout = 150 * time.Millisecond
 	// Sample size for calculating moving averages
 	SampleSize = 10
+	// Number of recent probes packet loss is computed over
+	LossWindow = 100
 )
 
+// ErrProbeSkipped is returned by a ProbeSender when a probe cannot be sent
+// yet, for example before session keys exist. Skipped probes are neither
+// failures nor losses.
+var ErrProbeSkipped = errors.New("probe skipped")
+
+// ProbeSender sends a heartbeat probe to the peer on a WAN
+type ProbeSender func(wan *protocol.WANInterface, hb *protocol.Heartbeat) error
+
 // Checker implements the HealthChecker interface
 type Checker struct {
 	mu              sync.RWMutex
@@ -30,6 +40,10 @@ type Checker struct {
 	samples         map[uint8]*LatencySamples
 	eventChan       chan protocol.HealthEvent
 	failureCount    map[uint8]int
+	probes          map[uint8]*probeState
+	maxIntervals    map[uint8]time.Duration
+	intervalChanged map[uint8]chan struct{}
+	sender          ProbeSender
 	ctx             context.Context
 	cancel          context.CancelFunc
 	wg              sync.WaitGroup
@@ -46,6 +60,21 @@ type LatencySamples struct {
 	Count      int
 }
 
+// probeState tracks the heartbeat probes of one WAN
+type probeState struct {
+	nextSeq  uint32
+	highest  uint32 // Highest probe answered
+	answered [LossWindow]bool
+	lost     uint64
+	waiters  map[uint32]chan struct{}
+
+	measured bool
+	minRTT   time.Duration
+	offset   int64   // Clock offset of the peer, measured at minRTT
+	transit  int64   // Forward transit time of the last probe, offset included
+	jitter   float64 // RFC 3550 interarrival jitter estimate
+}
+
 // NewChecker creates a new health checker
 func NewChecker() *Checker {
 	return &Checker{
@@ -54,11 +83,22 @@ func NewChecker() *Checker {
 		samples:         make(map[uint8]*LatencySamples),
 		eventChan:       make(chan protocol.HealthEvent, 100),
 		failureCount:    make(map[uint8]int),
+		probes:          make(map[uint8]*probeState),
+		maxIntervals:    make(map[uint8]time.Duration),
+		intervalChanged: make(map[uint8]chan struct{}),
 		checkInterval:   DefaultCheckInterval,
 		failureThreshold: DefaultFailureThreshold,
 	}
 }
 
+// SetProbeSender sets the function heartbeat probes are sent with.
+// Without one, no WAN can be probed.
+func (c *Checker) SetProbeSender(sender ProbeSender) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sender = sender
+}
+
 // Start begins health monitoring
 func (c *Checker) Start(ctx context.Context) error {
 	c.mu.Lock()
@@ -113,6 +153,8 @@ func (c *Checker) AddWAN(wan *protocol.WANInterface) error {
 		PacketLoss: make([]float64, SampleSize),
 	}
 	c.failureCount[wan.ID] = 0
+	c.probes[wan.ID] = &probeState{waiters: make(map[uint32]chan struct{})}
+	c.intervalChanged[wan.ID] = make(chan struct{}, 1)
 
 	// If already running, start monitoring this WAN
 	if c.cancel != nil {
@@ -132,18 +174,52 @@ func (c *Checker) RemoveWAN(wanID uint8) error {
 	delete(c.metrics, wanID)
 	delete(c.samples, wanID)
 	delete(c.failureCount, wanID)
+	delete(c.probes, wanID)
+	delete(c.maxIntervals, wanID)
+	delete(c.intervalChanged, wanID)
 
 	return nil
 }
 
-// monitorWAN continuously monitors a WAN interface
-func (c *Checker) monitorWAN(wan *protocol.WANInterface) {
-	defer c.wg.Done()
+// SetMaxInterval caps how far apart the heartbeats of a WAN are, so they
+// keep its NAT binding open. Zero removes the cap.
+func (c *Checker) SetMaxInterval(wanID uint8, interval time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if interval > 0 {
+		c.maxIntervals[wanID] = interval
+	} else {
+		delete(c.maxIntervals, wanID)
+	}
+
+	select {
+	case c.intervalChanged[wanID] <- struct{}{}:
+	default:
+	}
+}
+
+// interval returns how often a WAN is probed, and the channel that tells
+// when that changes
+func (c *Checker) interval(wan *protocol.WANInterface) (time.Duration, chan struct{}) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 
 	interval := c.checkInterval
 	if wan.Config.HealthCheckInterval > 0 {
 		interval = wan.Config.HealthCheckInterval
 	}
+	if limit, exists := c.maxIntervals[wan.ID]; exists && limit < interval {
+		interval = limit
+	}
+	return interval, c.intervalChanged[wan.ID]
+}
+
+// monitorWAN continuously monitors a WAN interface
+func (c *Checker) monitorWAN(wan *protocol.WANInterface) {
+	defer c.wg.Done()
+
+	interval, changed := c.interval(wan)
 
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
@@ -152,8 +228,14 @@ func (c *Checker) monitorWAN(wan *protocol.WANInterface) {
 		select {
 		case <-c.ctx.Done():
 			return
+		case <-changed:
+			interval, _ = c.interval(wan)
+			ticker.Reset(interval)
 		case <-ticker.C:
 			metrics, err := c.CheckWAN(wan)
+			if errors.Is(err, ErrProbeSkipped) {
+				continue
+			}
 			if err != nil {
 				c.handleCheckFailure(wan)
 			} else {
@@ -163,77 +245,121 @@ func (c *Checker) monitorWAN(wan *protocol.WANInterface) {
 	}
 }
 
-// CheckWAN performs a health check on a specific WAN
+// CheckWAN sends a heartbeat probe on a WAN and waits for its reply.
+// Replies are read by whoever owns the WAN's socket and passed in through
+// HandleHeartbeat, which also updates the metrics.
 func (c *Checker) CheckWAN(wan *protocol.WANInterface) (*protocol.WANMetrics, error) {
 	if wan.RemoteAddr == nil {
 		return nil, fmt.Errorf("no remote address configured")
 	}
 
-	// Send probe with timeout
-	sendTime := time.Now()
-
-	// Encode packet (simplified for now)
-	// TODO: Use proper packet encoding with full protocol.Packet structure
-	probeData := []byte{byte(protocol.PacketTypeHeartbeat)}
-
-	// Set deadline for response
-	wan.Conn.SetReadDeadline(time.Now().Add(DefaultProbeTimeout))
+	c.mu.Lock()
+	send := c.sender
+	probes, exists := c.probes[wan.ID]
+	if send == nil || !exists {
+		c.mu.Unlock()
+		return nil, fmt.Errorf("WAN %d cannot be probed", wan.ID)
+	}
+	probes.nextSeq++
+	seq := probes.nextSeq
+	probes.answered[seq%LossWindow] = false
+	reply := make(chan struct{}, 1)
+	probes.waiters[seq] = reply
+	c.mu.Unlock()
 
-	// Send probe
-	_, err := wan.Conn.WriteToUDP(probeData, wan.RemoteAddr)
+	defer func() {
+		c.mu.Lock()
+		delete(probes.waiters, seq)
+		c.mu.Unlock()
+	}()
+
+	err := send(wan, &protocol.Heartbeat{Seq: seq, Sent: time.Now().UnixNano()})
+	if errors.Is(err, ErrProbeSkipped) {
+		// Give the sequence number back, so it is not counted as lost
+		c.mu.Lock()
+		if probes.nextSeq == seq {
+			probes.nextSeq--
+		}
+		c.mu.Unlock()
+		return nil, err
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to send probe: %w", err)
 	}
 
-	// Wait for response (echo server should respond)
-	buf := make([]byte, 1024)
-	n, _, err := wan.Conn.ReadFromUDP(buf)
-	recvTime := time.Now()
+	timer := time.NewTimer(DefaultProbeTimeout)
+	defer timer.Stop()
 
-	if err != nil {
-		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-			return nil, fmt.Errorf("probe timeout")
-		}
-		return nil, fmt.Errorf("failed to receive probe response: %w", err)
+	select {
+	case <-reply:
+		return c.GetMetrics(wan.ID)
+	case <-timer.C:
+		return nil, fmt.Errorf("probe timeout")
 	}
+}
 
-	if n == 0 {
-		return nil, fmt.Errorf("empty probe response")
+// HandleHeartbeat processes a heartbeat reply received on a WAN at the
+// given time. Round trip time leaves out the time the peer took to answer;
+// one-way delays are estimated with the clock offset measured on the
+// fastest exchange so far, where queueing distorts it least. Jitter is the
+// RFC 3550 interarrival jitter of the probes, and loss comes from the gaps
+// in the sequence numbers of the replies.
+func (c *Checker) HandleHeartbeat(wanID uint8, hb *protocol.Heartbeat, received time.Time) {
+	if !hb.IsReply() {
+		return
 	}
 
-	// Calculate metrics
-	latency := recvTime.Sub(sendTime)
-
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	// Get or create metrics
-	metrics, exists := c.metrics[wan.ID]
-	if !exists {
-		metrics = &protocol.WANMetrics{}
-		c.metrics[wan.ID] = metrics
+	probes, exists := c.probes[wanID]
+	if !exists || hb.Seq == 0 || hb.Seq > probes.nextSeq || probes.nextSeq-hb.Seq >= LossWindow {
+		return
+	}
+	if !probes.answer(hb.Seq) {
+		return
+	}
+
+	now := received.UnixNano()
+	rtt := time.Duration(max((now-hb.Sent)-(hb.Replied-hb.Received), 0))
+	forward := hb.Received - hb.Sent
+	reverse := now - hb.Replied
+
+	if !probes.measured || rtt <= probes.minRTT {
+		probes.minRTT = rtt
+		probes.offset = (forward - reverse) / 2
 	}
 
-	// Calculate jitter (variance from average latency)
-	jitter := time.Duration(0)
-	if metrics.Latency > 0 {
-		diff := latency - metrics.Latency
-		if diff < 0 {
-			jitter = -diff
-		} else {
-			jitter = diff
+	// J(i) = J(i-1) + (|D(i-1,i)| - J(i-1)) / 16
+	if probes.measured {
+		d := forward - probes.transit
+		if d < 0 {
+			d = -d
 		}
+		probes.jitter += (float64(d) - probes.jitter) / 16
+	}
+	probes.transit = forward
+	probes.measured = true
+
+	metrics, exists := c.metrics[wanID]
+	if !exists {
+		metrics = &protocol.WANMetrics{}
+		c.metrics[wanID] = metrics
 	}
 
-	// Update current metrics
-	metrics.Latency = latency
-	metrics.Jitter = jitter
-	metrics.LastUpdate = time.Now()
+	metrics.Latency = rtt
+	metrics.Jitter = time.Duration(probes.jitter)
+	metrics.ForwardDelay = time.Duration(max(forward-probes.offset, 0))
+	metrics.ReverseDelay = time.Duration(max(reverse+probes.offset, 0))
+	metrics.PacketLoss = probes.loss()
+	metrics.PacketsLost = probes.lost
+	metrics.LastUpdate = received
 
 	// Update samples for moving average
-	samples := c.samples[wan.ID]
-	samples.Latencies[samples.Index] = latency
-	samples.Jitters[samples.Index] = jitter
+	samples := c.samples[wanID]
+	samples.Latencies[samples.Index] = metrics.Latency
+	samples.Jitters[samples.Index] = metrics.Jitter
+	samples.PacketLoss[samples.Index] = metrics.PacketLoss
 	samples.Index = (samples.Index + 1) % SampleSize
 	if samples.Count < SampleSize {
 		samples.Count++
@@ -242,19 +368,54 @@ func (c *Checker) CheckWAN(wan *protocol.WANInterface) (*protocol.WANMetrics, er
 	// Calculate moving averages
 	metrics.AvgLatency = c.calculateAvgDuration(samples.Latencies, samples.Count)
 	metrics.AvgJitter = c.calculateAvgDuration(samples.Jitters, samples.Count)
+	metrics.AvgPacketLoss = c.calculateAvg(samples.PacketLoss, samples.Count)
 
-	// Estimate packet loss (based on consecutive failures)
-	failCount := c.failureCount[wan.ID]
-	totalChecks := samples.Count
-	if totalChecks > 0 {
-		metrics.PacketLoss = float64(failCount) / float64(totalChecks) * 100.0
+	// Update WAN metrics reference
+	if wan, exists := c.wans[wanID]; exists {
+		wan.Metrics = metrics
+		wan.LastSeen = received
 	}
 
-	// Update WAN metrics reference
-	wan.Metrics = metrics
-	wan.LastSeen = time.Now()
+	if reply, waiting := probes.waiters[hb.Seq]; waiting {
+		select {
+		case reply <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// answer records the reply to probe seq and reports whether it is the first
+func (p *probeState) answer(seq uint32) bool {
+	if p.answered[seq%LossWindow] {
+		return false
+	}
+	p.answered[seq%LossWindow] = true
+
+	if seq > p.highest {
+		// Probes skipped over are lost, unless their replies turn up later
+		p.lost += uint64(seq - p.highest - 1)
+		p.highest = seq
+	} else if p.lost > 0 {
+		p.lost--
+	}
+	return true
+}
 
-	return metrics, nil
+// loss returns the percentage of probes without a reply among the last
+// LossWindow probes up to the highest one answered
+func (p *probeState) loss() float64 {
+	first := uint32(1)
+	if p.highest > LossWindow {
+		first = p.highest - LossWindow + 1
+	}
+
+	var missing int
+	for seq := first; seq <= p.highest; seq++ {
+		if !p.answered[seq%LossWindow] {
+			missing++
+		}
+	}
+	return float64(missing) / float64(p.highest-first+1) * 100.0
 }
 
 // handleCheckFailure handles a failed health check
@@ -345,6 +506,35 @@ func (c *Checker) handleCheckSuccess(wan *protocol.WANInterface, metrics *protoc
 	}
 }
 
+// SetBandwidth records the capacity of a WAN estimated outside the checker,
+// in bytes/sec. Bandwidth is the upload capacity, which is what sending on
+// the WAN can use.
+func (c *Checker) SetBandwidth(wanID uint8, up, down uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	metrics, exists := c.metrics[wanID]
+	if !exists {
+		return
+	}
+	metrics.Bandwidth = up
+	metrics.BandwidthUp = up
+	metrics.BandwidthDown = down
+}
+
+// GetState returns the health state of a WAN. The checker changes states
+// under its own lock, so they must be read through here while it runs.
+func (c *Checker) GetState(wanID uint8) (protocol.WANState, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	wan, exists := c.wans[wanID]
+	if !exists {
+		return protocol.WANStateDown, false
+	}
+	return wan.State, true
+}
+
 // GetMetrics returns current metrics for a WAN
 func (c *Checker) GetMetrics(wanID uint8) (*protocol.WANMetrics, error) {
 	c.mu.RLock()
@@ -379,6 +569,20 @@ func (c *Checker) calculateAvgDuration(samples []time.Duration, count int) time.
 	return sum / time.Duration(count)
 }
 
+// calculateAvg calculates average of float samples
+func (c *Checker) calculateAvg(samples []float64, count int) float64 {
+	if count == 0 {
+		return 0
+	}
+
+	var sum float64
+	for i := 0; i < count; i++ {
+		sum += samples[i]
+	}
+
+	return sum / float64(count)
+}
+
 // calculateStdDev calculates standard deviation of duration samples
 func (c *Checker) calculateStdDev(samples []time.Duration, count int, avg time.Duration) time.Duration {
 	if count == 0 {
@@ -0,0 +1,138 @@
+package health
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+)
+
+// fakePeer answers probes with a clock one second ahead of ours
+type fakePeer struct {
+	checker *Checker
+	forward time.Duration
+	reverse time.Duration
+	drop    map[uint32]bool
+	dropped []*protocol.Heartbeat
+}
+
+func (p *fakePeer) send(wan *protocol.WANInterface, hb *protocol.Heartbeat) error {
+	received := hb.Sent + int64(p.forward+time.Second)
+	reply := hb.Reply(received, received+int64(time.Millisecond))
+	arrival := time.Unix(0, reply.Replied-int64(time.Second)+int64(p.reverse))
+
+	if p.drop[hb.Seq] {
+		p.dropped = append(p.dropped, reply)
+		return nil
+	}
+	p.checker.HandleHeartbeat(wan.ID, reply, arrival)
+	return nil
+}
+
+func TestHeartbeatMetrics(t *testing.T) {
+	c := NewChecker()
+	peer := &fakePeer{checker: c, forward: 10 * time.Millisecond, reverse: 10 * time.Millisecond}
+	c.SetProbeSender(peer.send)
+
+	wan := &protocol.WANInterface{ID: 1, RemoteAddr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}}
+	c.AddWAN(wan)
+
+	check := func() *protocol.WANMetrics {
+		t.Helper()
+		metrics, err := c.CheckWAN(wan)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return metrics
+	}
+
+	metrics := check()
+	if metrics.Latency != 20*time.Millisecond {
+		t.Fatalf("expected 20ms RTT without the peer's turnaround, got %v", metrics.Latency)
+	}
+	if metrics.ForwardDelay != 10*time.Millisecond || metrics.ReverseDelay != 10*time.Millisecond {
+		t.Fatalf("expected 10ms each way, got %v and %v", metrics.ForwardDelay, metrics.ReverseDelay)
+	}
+
+	// Queueing on the way out shows up in the forward delay and the jitter
+	peer.forward = 26 * time.Millisecond
+	metrics = check()
+	if metrics.ForwardDelay != 26*time.Millisecond || metrics.ReverseDelay != 10*time.Millisecond {
+		t.Fatalf("expected 26ms out and 10ms back, got %v and %v", metrics.ForwardDelay, metrics.ReverseDelay)
+	}
+	if metrics.Jitter != time.Millisecond {
+		t.Fatalf("expected 1ms jitter, got %v", metrics.Jitter)
+	}
+
+	// A missing reply is lost once a later one arrives
+	peer.drop = map[uint32]bool{3: true}
+	if _, err := c.CheckWAN(wan); err == nil {
+		t.Fatal("expected probe 3 to time out")
+	}
+	metrics = check()
+	if metrics.PacketsLost != 1 || metrics.PacketLoss != 25 {
+		t.Fatalf("expected 1 of 4 probes lost, got %d (%.1f%%)", metrics.PacketsLost, metrics.PacketLoss)
+	}
+
+	// Late replies are reordered, not lost
+	late := peer.dropped[0]
+	c.HandleHeartbeat(wan.ID, late, time.Unix(0, late.Replied-int64(time.Second)))
+	if metrics, _ = c.GetMetrics(wan.ID); metrics.PacketsLost != 0 || metrics.PacketLoss != 0 {
+		t.Fatalf("expected no loss after the late reply, got %d (%.1f%%)", metrics.PacketsLost, metrics.PacketLoss)
+	}
+}
+
+func TestSkippedProbesAreNotLost(t *testing.T) {
+	c := NewChecker()
+	wan := &protocol.WANInterface{ID: 1, RemoteAddr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}}
+	c.AddWAN(wan)
+
+	c.SetProbeSender(func(*protocol.WANInterface, *protocol.Heartbeat) error { return ErrProbeSkipped })
+	for i := 0; i < 3; i++ {
+		if _, err := c.CheckWAN(wan); err != ErrProbeSkipped {
+			t.Fatalf("expected the probe to be skipped, got %v", err)
+		}
+	}
+
+	peer := &fakePeer{checker: c}
+	c.SetProbeSender(peer.send)
+	metrics, err := c.CheckWAN(wan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metrics.PacketsLost != 0 || metrics.PacketLoss != 0 {
+		t.Fatalf("expected no loss, got %d (%.1f%%)", metrics.PacketsLost, metrics.PacketLoss)
+	}
+}
+
+func TestMaxIntervalSpeedsUpHeartbeats(t *testing.T) {
+	c := NewChecker()
+	probes := make(chan struct{}, 100)
+	c.SetProbeSender(func(*protocol.WANInterface, *protocol.Heartbeat) error {
+		probes <- struct{}{}
+		return ErrProbeSkipped
+	})
+
+	wan := &protocol.WANInterface{
+		ID:         1,
+		RemoteAddr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9},
+		Config:     protocol.WANConfig{HealthCheckInterval: time.Hour},
+	}
+	c.AddWAN(wan)
+	if err := c.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+
+	// A binding that expires sooner than the configured interval takes over
+	c.SetMaxInterval(wan.ID, 10*time.Millisecond)
+	for i := 0; i < 3; i++ {
+		select {
+		case <-probes:
+		case <-time.After(time.Second):
+			t.Fatalf("%d heartbeats at the capped interval, want 3", i)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package nat
+
+import (
+	"context"
+	"time"
+)
+
+// BindingTest tests whether a fresh NAT binding survives being idle for the
+// given time. It reports false when the binding expired, and an error when
+// the test could not be run.
+type BindingTest func(ctx context.Context, idle time.Duration) (bool, error)
+
+// MeasureBindingLifetime measures how long a NAT binding survives idle. Idle
+// times double from config.MinIdle until a binding expires or config.MaxIdle
+// is reached, and a binary search then narrows the lifetime down between the
+// longest idle time survived and the shortest one not. The results can be
+// turned into a lifetime with CGNATDetector.EstimatePortLifetime.
+//
+// A lost answer looks like an expired binding, so loss can only make the
+// lifetime come out shorter than it is, never longer.
+func MeasureBindingLifetime(ctx context.Context, config *BindingProbeConfig, test BindingTest) ([]KeepAliveResult, error) {
+	if config == nil {
+		config = DefaultBindingProbeConfig()
+	}
+
+	var results []KeepAliveResult
+	run := func(idle time.Duration) (bool, error) {
+		survived, err := test(ctx, idle)
+		if err != nil {
+			return false, err
+		}
+		results = append(results, KeepAliveResult{Interval: idle, Success: survived})
+		return survived, nil
+	}
+
+	// Grow the idle time until a binding expires
+	var survived, expired time.Duration
+	for idle := config.MinIdle; ; idle *= 2 {
+		idle = min(idle, config.MaxIdle)
+		ok, err := run(idle)
+		if err != nil {
+			return results, err
+		}
+		if !ok {
+			expired = idle
+			break
+		}
+		survived = idle
+		if idle >= config.MaxIdle {
+			return results, nil
+		}
+	}
+
+	// Narrow the lifetime down
+	for expired-survived > config.Resolution {
+		idle := survived + (expired-survived)/2
+		ok, err := run(idle)
+		if err != nil {
+			return results, err
+		}
+		if ok {
+			survived = idle
+		} else {
+			expired = idle
+		}
+	}
+
+	return results, nil
+}
@@ -0,0 +1,121 @@
+package nat
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// bindingLasting returns a binding test for a NAT whose bindings last lifetime
+func bindingLasting(lifetime time.Duration, tried *[]time.Duration) BindingTest {
+	return func(ctx context.Context, idle time.Duration) (bool, error) {
+		*tried = append(*tried, idle)
+		return idle <= lifetime, nil
+	}
+}
+
+func TestMeasureBindingLifetime(t *testing.T) {
+	config := DefaultBindingProbeConfig()
+
+	var tried []time.Duration
+	results, err := MeasureBindingLifetime(context.Background(), config, bindingLasting(47*time.Second, &tried))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Idle times double until a binding expires
+	for i, want := range []time.Duration{15 * time.Second, 30 * time.Second, 60 * time.Second} {
+		if tried[i] != want {
+			t.Fatalf("idle times tried = %v, want them to start %v, %v, %v", tried, 15*time.Second, 30*time.Second, 60*time.Second)
+		}
+	}
+
+	var survived time.Duration
+	expired := config.MaxIdle
+	for _, result := range results {
+		if result.Success {
+			survived = max(survived, result.Interval)
+		} else {
+			expired = min(expired, result.Interval)
+		}
+	}
+	if survived > 47*time.Second || expired <= 47*time.Second || expired-survived > config.Resolution {
+		t.Errorf("lifetime narrowed down to %v-%v, want 47s within %v", survived, expired, config.Resolution)
+	}
+
+	detector := NewCGNATDetector(DefaultCGNATConfig())
+	if lifetime := detector.EstimatePortLifetime(results); lifetime != survived*8/10 {
+		t.Errorf("estimated lifetime = %v, want %v", lifetime, survived*8/10)
+	}
+}
+
+func TestMeasureBindingLifetimeStopsAtMaxIdle(t *testing.T) {
+	config := &BindingProbeConfig{MinIdle: time.Second, MaxIdle: 5 * time.Second, Resolution: time.Second}
+
+	var tried []time.Duration
+	results, err := MeasureBindingLifetime(context.Background(), config, bindingLasting(time.Hour, &tried))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second}
+	if len(tried) != len(want) || tried[len(tried)-1] != config.MaxIdle {
+		t.Fatalf("idle times tried = %v, want %v", tried, want)
+	}
+	for _, result := range results {
+		if !result.Success {
+			t.Errorf("binding expired after %v", result.Interval)
+		}
+	}
+}
+
+func TestMeasureBindingLifetimeStopsOnError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	runs := 0
+	test := func(ctx context.Context, idle time.Duration) (bool, error) {
+		runs++
+		cancel()
+		return false, ctx.Err()
+	}
+
+	if _, err := MeasureBindingLifetime(ctx, nil, test); !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want %v", err, context.Canceled)
+	}
+	if runs != 1 {
+		t.Errorf("tested %d times after the error", runs-1)
+	}
+}
+
+func TestManagerKeepsAliveAtBindingLifetime(t *testing.T) {
+	m, err := NewManager(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	lifetime := m.ApplyBindingProbes([]KeepAliveResult{
+		{Interval: 2 * time.Minute, Success: true},
+		{Interval: 4 * time.Minute, Success: false},
+	})
+	if lifetime != 96*time.Second {
+		t.Fatalf("lifetime = %v, want %v", lifetime, 96*time.Second)
+	}
+	if m.GetBindingLifetime() != lifetime || m.GetKeepAliveInterval() != lifetime {
+		t.Errorf("binding lifetime %v, keep-alive interval %v, want both %v", m.GetBindingLifetime(), m.GetKeepAliveInterval(), lifetime)
+	}
+
+	// Keep-alives that hold do not stretch the interval past the lifetime
+	m.keepAlive.lastAdjustment = time.Now().Add(-time.Hour)
+	for i := 0; i < 10; i++ {
+		m.keepAlive.RecordSuccess()
+	}
+	if interval := m.GetKeepAliveInterval(); interval > lifetime {
+		t.Errorf("keep-alive interval grew to %v", interval)
+	}
+
+	// No binding survived: nothing to go by
+	m.ApplyBindingProbes([]KeepAliveResult{{Interval: 15 * time.Second, Success: false}})
+	if m.GetBindingLifetime() != lifetime {
+		t.Errorf("binding lifetime = %v after no binding survived", m.GetBindingLifetime())
+	}
+}
@@ -446,6 +446,20 @@ func (aka *AdaptiveKeepAlive) GetInterval() time.Duration {
 	return aka.currentInterval
 }
 
+// SetMaxInterval caps the interval at a known NAT binding lifetime and moves
+// the interval to it, since keep-alives that far apart hold the binding
+func (aka *AdaptiveKeepAlive) SetMaxInterval(interval time.Duration) {
+	aka.mu.Lock()
+	defer aka.mu.Unlock()
+
+	aka.maxInterval = interval
+	aka.minInterval = min(aka.minInterval, interval)
+	aka.currentInterval = interval
+	aka.successfulTests = 0
+	aka.failedTests = 0
+	aka.lastAdjustment = time.Now()
+}
+
 // Reset resets the adaptive keep-alive state
 func (aka *AdaptiveKeepAlive) Reset() {
 	aka.mu.Lock()
@@ -26,6 +26,12 @@ type HolePuncher struct {
 	// Active punch sessions
 	sessions map[string]*punchSession
 
+	// Punch messages handed over by the reader of a shared socket; nil
+	// when the hole puncher reads the socket itself
+	incoming  chan datagram
+	done      chan struct{}
+	closeOnce sync.Once
+
 	// Stats
 	attempts  uint64
 	successes uint64
@@ -55,7 +61,31 @@ func NewHolePuncher(conn *net.UDPConn, config *HolePunchConfig) *HolePuncher {
 		config:   config,
 		conn:     conn,
 		sessions: make(map[string]*punchSession),
+		done:     make(chan struct{}),
+	}
+}
+
+// newSharedHolePuncher creates a hole puncher on a socket something else
+// reads, which hands punch messages over to deliver
+func newSharedHolePuncher(conn *net.UDPConn, config *HolePunchConfig) *HolePuncher {
+	hp := NewHolePuncher(conn, config)
+	hp.incoming = make(chan datagram, sharedQueueSize)
+	return hp
+}
+
+// deliver takes a datagram read from a shared socket if it is a punch
+// message, reporting whether it was
+func (hp *HolePuncher) deliver(data []byte, from *net.UDPAddr) bool {
+	if hp.incoming == nil || !isPunchMessage(data) {
+		return false
 	}
+	handOver(hp.incoming, data, from)
+	return true
+}
+
+// Close stops the keep-alive routine. The socket stays open.
+func (hp *HolePuncher) Close() {
+	hp.closeOnce.Do(func() { close(hp.done) })
 }
 
 // Punch attempts to establish a P2P connection with a peer via hole punching
@@ -234,8 +264,7 @@ func (hp *HolePuncher) listenForPunchResponse(peerID string, responseChan chan *
 		case <-stopChan:
 			return
 		default:
-			hp.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
-			n, remoteAddr, err := hp.conn.ReadFromUDP(buffer)
+			n, remoteAddr, err := receiveDatagram(hp.conn, hp.incoming, hp.done, buffer, time.Now().Add(100*time.Millisecond))
 			if err != nil {
 				continue
 			}
@@ -283,7 +312,13 @@ func (hp *HolePuncher) StartKeepAliveRoutine() {
 		ticker := time.NewTicker(hp.config.KeepAliveInterval)
 		defer ticker.Stop()
 
-		for range ticker.C {
+		for {
+			select {
+			case <-hp.done:
+				return
+			case <-ticker.C:
+			}
+
 			hp.mu.RLock()
 			peerIDs := make([]string, 0, len(hp.sessions))
 			for peerID, session := range hp.sessions {
@@ -438,8 +473,7 @@ func (hp *HolePuncher) listenForSimultaneousPunchResponse(peerID string, respons
 		case <-stopChan:
 			return
 		default:
-			hp.conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
-			n, remoteAddr, err := hp.conn.ReadFromUDP(buffer)
+			n, remoteAddr, err := receiveDatagram(hp.conn, hp.incoming, hp.done, buffer, time.Now().Add(50*time.Millisecond))
 			if err != nil {
 				continue
 			}
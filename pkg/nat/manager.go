@@ -18,6 +18,12 @@ type Manager struct {
 	relayClient   *RelayClient
 	cgnatDetector *CGNATDetector
 
+	// TURN client, allocated on first use on a socket of its own, bound
+	// to the address traversal runs on
+	turnMu     sync.Mutex
+	turnClient *TURNClient
+	turnConn   *net.UDPConn
+
 	// State
 	localAddr  *net.UDPAddr
 	publicAddr *net.UDPAddr
@@ -30,9 +36,17 @@ type Manager struct {
 	// Stats
 	stats *TraversalStats
 
+	// Keep-alive interval for the NAT mapping, adapted to how long it holds
+	keepAlive *AdaptiveKeepAlive
+
+	// How long the NAT binding survives idle, when it was measured
+	bindingLifetime time.Duration
+
 	// Control
-	running bool
-	stopCh  chan struct{}
+	shared   bool // The socket belongs to a WAN, whose reader hands packets over
+	running  bool
+	stopCh   chan struct{}
+	stopOnce sync.Once
 }
 
 // NewManager creates a new NAT traversal manager
@@ -71,6 +85,37 @@ func NewManager(config *NATTraversalConfig) (*Manager, error) {
 	return m, nil
 }
 
+// NewWANManager creates a NAT traversal manager that runs on a WAN's own
+// socket, so what it learns applies to that WAN. The WAN's reader keeps
+// reading the socket and passes what it receives to HandlePacket first.
+// The RELAY: client needs a socket of its own and is not used.
+func NewWANManager(conn *net.UDPConn, config *NATTraversalConfig) *Manager {
+	if config == nil {
+		config = DefaultNATTraversalConfig()
+	}
+
+	return &Manager{
+		config:        config,
+		stunClient:    newSharedSTUNClient(conn, config.STUN),
+		holePuncher:   newSharedHolePuncher(conn, config.HolePunch),
+		cgnatDetector: NewCGNATDetector(config.CGNAT),
+		connections:   make(map[string]*ConnectionInfo),
+		stats:         &TraversalStats{},
+		shared:        true,
+		stopCh:        make(chan struct{}),
+	}
+}
+
+// HandlePacket takes the STUN responses and hole punching messages among
+// the packets read from a WAN manager's socket, reporting whether the
+// packet was one of them
+func (m *Manager) HandlePacket(data []byte, from *net.UDPAddr) bool {
+	if !m.shared {
+		return false
+	}
+	return m.stunClient.deliver(data, from) || m.holePuncher.deliver(data, from)
+}
+
 // Initialize performs initial NAT discovery
 func (m *Manager) Initialize() error {
 	m.mu.Lock()
@@ -100,6 +145,15 @@ func (m *Manager) Initialize() error {
 		}
 	}
 
+	// Keep the mapping alive as the NAT behind it needs
+	if m.keepAlive == nil {
+		interval := m.cgnatDetector.GetRecommendedStrategy().KeepAliveInterval
+		if refresh := m.config.STUN.RefreshInterval; refresh > 0 && refresh < interval {
+			interval = refresh
+		}
+		m.keepAlive = NewAdaptiveKeepAlive(interval)
+	}
+
 	return nil
 }
 
@@ -110,11 +164,20 @@ func (m *Manager) Start() error {
 		m.mu.Unlock()
 		return fmt.Errorf("already running")
 	}
+	if m.keepAlive == nil {
+		m.keepAlive = NewAdaptiveKeepAlive(m.config.STUN.RefreshInterval)
+	}
+	select {
+	case <-m.stopCh:
+		m.mu.Unlock()
+		return fmt.Errorf("stopped")
+	default:
+	}
 	m.running = true
 	m.mu.Unlock()
 
-	// Start STUN refresh routine
-	m.stunClient.StartRefreshRoutine()
+	// Keep the NAT mapping alive
+	go m.keepAliveLoop()
 
 	// Start hole puncher keep-alive
 	m.holePuncher.StartKeepAliveRoutine()
@@ -127,26 +190,120 @@ func (m *Manager) Start() error {
 	return nil
 }
 
-// Stop stops the NAT traversal manager
+// Stop stops the NAT traversal manager, also interrupting a discovery in
+// progress
 func (m *Manager) Stop() error {
-	m.mu.Lock()
-	if !m.running {
-		m.mu.Unlock()
+	stopped := false
+	m.stopOnce.Do(func() { stopped = true })
+	if !stopped {
 		return nil
 	}
-	m.running = false
-	m.mu.Unlock()
 
 	close(m.stopCh)
 
-	// Close STUN client
+	// Closing the STUN client ends any discovery holding the lock
+	m.holePuncher.Close()
 	if err := m.stunClient.Close(); err != nil {
 		return err
 	}
 
+	m.mu.Lock()
+	m.running = false
+	m.mu.Unlock()
+
+	// Release the TURN allocation
+	m.turnMu.Lock()
+	if m.turnClient != nil {
+		m.turnClient.Close()
+		m.turnConn.Close()
+		m.turnClient, m.turnConn = nil, nil
+	}
+	m.turnMu.Unlock()
+
 	return nil
 }
 
+// Done returns a channel that is closed when the manager stops
+func (m *Manager) Done() <-chan struct{} {
+	return m.stopCh
+}
+
+// keepAliveLoop refreshes the NAT mapping at the adaptive keep-alive
+// interval. A public address that changed between refreshes means the
+// mapping expired, so the interval shrinks; one that held lets it grow.
+func (m *Manager) keepAliveLoop() {
+	for {
+		m.mu.RLock()
+		keepAlive, previous := m.keepAlive, m.publicAddr
+		m.mu.RUnlock()
+
+		timer := time.NewTimer(keepAlive.GetInterval())
+		select {
+		case <-m.stopCh:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if err := m.RefreshNATMapping(); err != nil {
+			// Refresh failed, try to rediscover
+			m.Initialize()
+			continue
+		}
+
+		if current := m.GetPublicAddr(); previous != nil && current != nil && current.String() != previous.String() {
+			keepAlive.RecordFailure()
+		} else {
+			keepAlive.RecordSuccess()
+		}
+	}
+}
+
+// GetKeepAliveInterval returns the interval the NAT mapping is kept alive
+// at, or 0 before discovery
+func (m *Manager) GetKeepAliveInterval() time.Duration {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.keepAlive == nil {
+		return 0
+	}
+	return m.keepAlive.GetInterval()
+}
+
+// ApplyBindingProbes estimates the NAT binding lifetime from the results of
+// MeasureBindingLifetime and keeps the mapping alive accordingly. It returns
+// the lifetime, or 0 when no binding survived.
+func (m *Manager) ApplyBindingProbes(results []KeepAliveResult) time.Duration {
+	lifetime := m.cgnatDetector.EstimatePortLifetime(results)
+	m.SetBindingLifetime(lifetime)
+	return lifetime
+}
+
+// SetBindingLifetime sets how long the NAT binding survives idle, as
+// measured now or before, keeping the mapping alive at that interval
+func (m *Manager) SetBindingLifetime(lifetime time.Duration) {
+	if lifetime <= 0 {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.bindingLifetime = lifetime
+	if m.keepAlive == nil {
+		m.keepAlive = NewAdaptiveKeepAlive(lifetime)
+	}
+	m.keepAlive.SetMaxInterval(lifetime)
+}
+
+// GetBindingLifetime returns how long the NAT binding survives idle, or 0
+// when that has not been measured
+func (m *Manager) GetBindingLifetime() time.Duration {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.bindingLifetime
+}
+
 // Connect establishes a connection to a peer
 func (m *Manager) Connect(peerInfo *PeerInfo) (*ConnectionInfo, error) {
 	m.mu.RLock()
@@ -209,7 +366,7 @@ func (m *Manager) selectConnectionMethod(peerInfo *PeerInfo) TraversalMethod {
 
 	// If either is symmetric NAT, prefer relay (or try aggressive hole punch)
 	if m.natType.NeedsRelay() || peerInfo.NATType.NeedsRelay() {
-		if m.relayClient != nil && m.config.Relay.EnableRelay {
+		if m.relayAvailable() {
 			return TraversalMethodRelay
 		}
 		// Try aggressive hole punch as fallback
@@ -254,7 +411,7 @@ func (m *Manager) connectViaHolePunch(peerInfo *PeerInfo) (*ConnectionInfo, erro
 		m.mu.Unlock()
 
 		// Fallback to relay if hole punch fails
-		if m.relayClient != nil && m.config.Relay.PreferDirect {
+		if m.relayAvailable() && m.config.Relay.PreferDirect {
 			return m.connectViaRelay(peerInfo)
 		}
 
@@ -278,16 +435,27 @@ func (m *Manager) connectViaHolePunch(peerInfo *PeerInfo) (*ConnectionInfo, erro
 	return connInfo, nil
 }
 
-// connectViaRelay establishes connection via relay server
+// connectViaRelay establishes connection via relay server, preferring the
+// TURN server when one is configured
 func (m *Manager) connectViaRelay(peerInfo *PeerInfo) (*ConnectionInfo, error) {
+	if m.config.TURN != nil {
+		connInfo, err := m.connectViaTURN(peerInfo)
+		if err == nil || m.relayClient == nil {
+			return connInfo, err
+		}
+		// Fall back to the relay server
+	}
+
 	if m.relayClient == nil {
 		return nil, fmt.Errorf("relay client not available")
 	}
 
-	// Get peer's relay ID (would be exchanged via signaling)
-	peerRelayID := peerInfo.PeerID + "_relay" // Placeholder
+	// The peer's relay ID is exchanged via signaling
+	if peerInfo.RelayID == "" {
+		return nil, fmt.Errorf("peer %s has no relay allocation", peerInfo.PeerID)
+	}
 
-	relayConn, err := m.relayClient.EstablishRelayConnection(peerInfo.PeerID, peerRelayID)
+	relayConn, err := m.relayClient.EstablishRelayConnection(peerInfo.PeerID, peerInfo.RelayID)
 	if err != nil {
 		return nil, fmt.Errorf("relay connection failed: %w", err)
 	}
@@ -308,6 +476,93 @@ func (m *Manager) connectViaRelay(peerInfo *PeerInfo) (*ConnectionInfo, error) {
 	return connInfo, nil
 }
 
+// connectViaTURN establishes connection through the TURN allocation,
+// binding a channel to the peer
+func (m *Manager) connectViaTURN(peerInfo *PeerInfo) (*ConnectionInfo, error) {
+	if peerInfo.PublicAddr == nil {
+		return nil, fmt.Errorf("peer %s has no public address", peerInfo.PeerID)
+	}
+
+	turn, err := m.turn()
+	if err != nil {
+		return nil, fmt.Errorf("TURN allocation failed: %w", err)
+	}
+
+	if _, err := turn.ChannelBind(peerInfo.PublicAddr); err != nil {
+		return nil, fmt.Errorf("TURN channel bind failed: %w", err)
+	}
+
+	m.mu.Lock()
+	m.stats.RelayConnections++
+	m.mu.Unlock()
+
+	connInfo := &ConnectionInfo{
+		PeerID:       peerInfo.PeerID,
+		LocalAddr:    turn.RelayedAddr(),
+		RemoteAddr:   peerInfo.PublicAddr,
+		Method:       TraversalMethodRelay,
+		Established:  time.Now(),
+		LastActivity: time.Now(),
+		Relay:        turn,
+	}
+
+	return connInfo, nil
+}
+
+// Relay returns the TURN allocation, made on first use, for carrying
+// traffic through the TURN server when the NAT needs a relay. Its socket is
+// bound to the address traversal runs on, so a WAN manager's relay goes out
+// on the WAN. The allocation is released when the manager stops.
+func (m *Manager) Relay() (*TURNClient, error) {
+	if m.config.TURN == nil {
+		return nil, fmt.Errorf("no TURN server configured")
+	}
+	return m.turn()
+}
+
+// turn returns the TURN client, making the allocation on first use
+func (m *Manager) turn() (*TURNClient, error) {
+	m.turnMu.Lock()
+	defer m.turnMu.Unlock()
+
+	if m.turnClient != nil {
+		return m.turnClient, nil
+	}
+
+	// Stop releases allocations made before it, not after
+	select {
+	case <-m.stopCh:
+		return nil, net.ErrClosed
+	default:
+	}
+
+	local := m.stunClient.conn.LocalAddr().(*net.UDPAddr)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP, Zone: local.Zone})
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := NewTURNClient(conn, m.config.TURN)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if _, err := client.Allocate(); err != nil {
+		client.Close()
+		conn.Close()
+		return nil, err
+	}
+
+	m.turnClient, m.turnConn = client, conn
+	return client, nil
+}
+
+// relayAvailable reports whether peers can be reached through a relay
+func (m *Manager) relayAvailable() bool {
+	return (m.relayClient != nil && m.config.Relay.EnableRelay) || m.config.TURN != nil
+}
+
 // Disconnect closes connection to a peer
 func (m *Manager) Disconnect(peerID string) error {
 	m.mu.Lock()
@@ -443,7 +698,7 @@ func (m *Manager) GetTraversalCapabilities() *TraversalCapabilities {
 		NATType:          m.natType,
 		CanDirectConnect: m.natType.CanDirectConnect(),
 		NeedsRelay:       m.natType.NeedsRelay(),
-		RelayAvailable:   m.relayClient != nil,
+		RelayAvailable:   m.relayAvailable(),
 		CGNATDetected:    m.cgnatInfo != nil && m.cgnatInfo.Detected,
 	}
 
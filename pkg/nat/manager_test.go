@@ -0,0 +1,128 @@
+package nat
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// readWAN reads a WAN manager's socket as the WAN's reader would, handing
+// the manager its packets and returning the others
+func readWAN(conn *net.UDPConn, m *Manager) chan string {
+	others := make(chan string, 16)
+	go func() {
+		buffer := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			if !m.HandlePacket(buffer[:n], from) {
+				others <- string(buffer[:n])
+			}
+		}
+	}()
+	return others
+}
+
+func TestWANManagerSharesSocket(t *testing.T) {
+	s := startSTUNServer(t, &STUNServerConfig{Address: "127.0.0.1:0", AlternateAddress: "127.0.0.2:0"})
+
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	config := DefaultNATTraversalConfig()
+	config.STUN.PrimaryServer = s.LocalAddr().String()
+	config.STUN.Timeout = 300 * time.Millisecond
+	m := NewWANManager(conn, config)
+	others := readWAN(conn, m)
+
+	if err := m.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	if m.GetPublicAddr().Port != conn.LocalAddr().(*net.UDPAddr).Port {
+		t.Errorf("public address = %s, want port %d", m.GetPublicAddr(), conn.LocalAddr().(*net.UDPAddr).Port)
+	}
+	// Nothing filters or remaps on loopback
+	if m.GetNATType() != NATTypeFullCone {
+		t.Errorf("NAT type = %s, want %s", m.GetNATType(), NATTypeFullCone)
+	}
+	if interval := m.GetKeepAliveInterval(); interval != config.STUN.RefreshInterval {
+		t.Errorf("keep-alive interval = %v, want %v", interval, config.STUN.RefreshInterval)
+	}
+
+	// Punch messages are the manager's, anything else stays with the WAN
+	peer, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: conn.LocalAddr().(*net.UDPAddr).Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	peer.Write([]byte("PUNCH:peer"))
+	peer.Write([]byte("bond traffic"))
+	select {
+	case got := <-others:
+		if got != "bond traffic" {
+			t.Errorf("WAN reader got %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("bond traffic was not left to the WAN reader")
+	}
+
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	m.Stop()
+	select {
+	case <-m.Done():
+	default:
+		t.Error("manager not done after Stop")
+	}
+
+	// The socket belongs to the WAN and stays open
+	if _, err := peer.Write([]byte("still open")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-others:
+	case <-time.After(time.Second):
+		t.Error("WAN socket closed by Stop")
+	}
+}
+
+func TestWANManagerStopInterruptsDiscovery(t *testing.T) {
+	// A STUN server that never answers
+	silent, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	config := DefaultNATTraversalConfig()
+	config.STUN.PrimaryServer = silent.LocalAddr().String()
+	config.STUN.Timeout = 10 * time.Second
+	m := NewWANManager(conn, config)
+
+	done := make(chan error, 1)
+	go func() { done <- m.Initialize() }()
+
+	time.Sleep(100 * time.Millisecond)
+	m.Stop()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("discovery succeeded without a server")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Stop did not interrupt discovery")
+	}
+}
@@ -85,8 +85,11 @@ func (rc *RelayClient) connectToRelay(relayServer string) error {
 	rc.relayAddr = addr
 	rc.mu.Unlock()
 
-	// Send allocation request
+	// Send allocation request, with our token if the relay requires one
 	allocMsg := []byte("RELAY:ALLOC")
+	if rc.config.Token != "" {
+		allocMsg = []byte("RELAY:ALLOC:" + rc.config.Token)
+	}
 	_, err = rc.conn.WriteToUDP(allocMsg, addr)
 	if err != nil {
 		return fmt.Errorf("failed to send allocation request: %w", err)
@@ -102,7 +105,11 @@ func (rc *RelayClient) connectToRelay(relayServer string) error {
 
 	// Parse response to get relay ID
 	if n > 12 && string(buffer[:12]) == "RELAY:ALLOC:" {
+		rc.mu.Lock()
 		rc.relayID = string(buffer[12:n])
+		rc.mu.Unlock()
+	} else if reason, ok := relayError(buffer[:n]); ok {
+		return fmt.Errorf("relay refused allocation: %s", reason)
 	} else {
 		return fmt.Errorf("invalid allocation response")
 	}
@@ -155,6 +162,9 @@ func (rc *RelayClient) EstablishRelayConnection(peerID, peerRelayID string) (*Re
 		rc.mu.Lock()
 		rc.failed++
 		rc.mu.Unlock()
+		if reason, ok := relayError(buffer[:n]); ok {
+			return nil, fmt.Errorf("relay connection failed: %s", reason)
+		}
 		return nil, fmt.Errorf("relay connection failed")
 	}
 
@@ -285,6 +295,15 @@ func (rc *RelayClient) ReceiveViaRelay() (peerID string, data []byte, err error)
 	return foundPeerID, data, nil
 }
 
+// relayError returns the reason of a RELAY:ERROR response
+func relayError(msg []byte) (string, bool) {
+	const prefix = "RELAY:ERROR:"
+	if len(msg) < len(prefix) || string(msg[:len(prefix)]) != prefix {
+		return "", false
+	}
+	return string(msg[len(prefix):]), true
+}
+
 // checkBandwidthLimit checks if bandwidth limit is exceeded
 func (rc *RelayClient) checkBandwidthLimit() error {
 	rc.mu.Lock()
@@ -0,0 +1,477 @@
+package nat
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/bandwidth"
+)
+
+var (
+	// ErrRelayServerRunning is returned when starting a running relay server
+	ErrRelayServerRunning = errors.New("relay server already running")
+)
+
+// relayAllocation is a client's allocation on the relay
+type relayAllocation struct {
+	id           string
+	addr         *net.UDPAddr
+	peerID       string          // From the client's token, if authenticated
+	peers        map[string]bool // Allocations this one is bound to send to
+	created      time.Time
+	lastActivity time.Time
+	bandwidth    bandwidth.TokenBucket // Limits the allocation to MaxBandwidth
+}
+
+// RelayAllocationInfo describes an allocation on the relay
+type RelayAllocationInfo struct {
+	ID           string
+	Addr         *net.UDPAddr
+	PeerID       string
+	Peers        int
+	Created      time.Time
+	LastActivity time.Time
+}
+
+// RelayServerStats contains relay server statistics
+type RelayServerStats struct {
+	Allocations     uint64 // Allocations made
+	Expired         uint64 // Allocations expired while idle
+	AuthFailures    uint64 // Allocations refused for a missing or invalid token
+	PacketsRelayed  uint64
+	BytesRelayed    uint64 // Payload bytes
+	PacketsDropped  uint64 // Data without a binding or to an unknown allocation
+	PacketsLimited  uint64 // Data over the allocation's bandwidth limit
+	InvalidMessages uint64
+}
+
+// RelayServer relays UDP between clients that cannot reach each other
+// directly, speaking the RELAY: protocol of RelayClient:
+//
+//	RELAY:ALLOC[:token]           -> RELAY:ALLOC:<id>
+//	RELAY:CONNECT:<id>:<peer>     -> RELAY:CONNOK:<peer>
+//	RELAY:DATA:<id>:<peer>:<data>    forwarded to the peer unchanged
+//	RELAY:KEEPALIVE:<id>
+//	RELAY:PING:<id>               -> RELAY:PONG:<id>
+//	RELAY:DISCONNECT:<id>:<peer>     removes the binding
+//	RELAY:DISCONNECT:<id>            releases the allocation
+//
+// Refused requests are answered with RELAY:ERROR:<reason>. An allocation
+// belongs to the address it was made from, and only messages from that
+// address may use it. Data is relayed only to peers the sender has bound
+// with CONNECT, and is subject to the allocation's bandwidth limit.
+type RelayServer struct {
+	config *RelayServerConfig
+	conn   *net.UDPConn
+
+	mu          sync.Mutex
+	allocations map[string]*relayAllocation
+	byAddr      map[string]*relayAllocation
+	stats       RelayServerStats
+	running     bool
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewRelayServer creates a new relay server
+func NewRelayServer(config *RelayServerConfig) *RelayServer {
+	if config == nil {
+		config = DefaultRelayServerConfig()
+	}
+	if config.AllocationTimeout <= 0 {
+		config.AllocationTimeout = DefaultRelayServerConfig().AllocationTimeout
+	}
+
+	return &RelayServer{
+		config:      config,
+		allocations: make(map[string]*relayAllocation),
+		byAddr:      make(map[string]*relayAllocation),
+	}
+}
+
+// Start listens on the configured address and starts relaying
+func (rs *RelayServer) Start() error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if rs.running {
+		return ErrRelayServerRunning
+	}
+
+	addr, err := net.ResolveUDPAddr("udp4", rs.config.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to resolve listen address: %w", err)
+	}
+
+	conn, err := net.ListenUDP("udp4", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+
+	rs.conn = conn
+	rs.running = true
+	rs.stopCh = make(chan struct{})
+
+	rs.wg.Add(2)
+	go rs.receiveLoop()
+	go rs.expireLoop()
+
+	return nil
+}
+
+// Stop stops the relay server and releases all allocations
+func (rs *RelayServer) Stop() error {
+	rs.mu.Lock()
+	if !rs.running {
+		rs.mu.Unlock()
+		return nil
+	}
+	rs.running = false
+	close(rs.stopCh)
+	rs.conn.Close()
+	rs.mu.Unlock()
+
+	rs.wg.Wait()
+
+	rs.mu.Lock()
+	rs.allocations = make(map[string]*relayAllocation)
+	rs.byAddr = make(map[string]*relayAllocation)
+	rs.mu.Unlock()
+
+	return nil
+}
+
+// LocalAddr returns the address the relay server listens on
+func (rs *RelayServer) LocalAddr() *net.UDPAddr {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.conn == nil {
+		return nil
+	}
+	return rs.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// receiveLoop handles incoming relay messages
+func (rs *RelayServer) receiveLoop() {
+	defer rs.wg.Done()
+
+	buffer := make([]byte, 65535)
+	for {
+		n, addr, err := rs.conn.ReadFromUDP(buffer)
+		if err != nil {
+			select {
+			case <-rs.stopCh:
+				return
+			default:
+				continue
+			}
+		}
+
+		rs.handleMessage(buffer[:n], addr)
+	}
+}
+
+// expireLoop releases allocations that have been idle too long
+func (rs *RelayServer) expireLoop() {
+	defer rs.wg.Done()
+
+	ticker := time.NewTicker(rs.config.AllocationTimeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-rs.stopCh:
+			return
+		case now := <-ticker.C:
+			rs.expire(now)
+		}
+	}
+}
+
+// expire releases allocations idle for longer than the allocation timeout
+func (rs *RelayServer) expire(now time.Time) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	for _, alloc := range rs.allocations {
+		if now.Sub(alloc.lastActivity) > rs.config.AllocationTimeout {
+			rs.release(alloc)
+			rs.stats.Expired++
+		}
+	}
+}
+
+// handleMessage dispatches a relay message by its command
+func (rs *RelayServer) handleMessage(msg []byte, addr *net.UDPAddr) {
+	if !bytes.HasPrefix(msg, []byte("RELAY:")) {
+		rs.invalid()
+		return
+	}
+
+	// Data is forwarded as is, so its payload is not split off as text
+	if bytes.HasPrefix(msg, []byte("RELAY:DATA:")) {
+		rs.handleData(msg, addr)
+		return
+	}
+
+	command, args, _ := strings.Cut(string(msg[len("RELAY:"):]), ":")
+	switch command {
+	case "ALLOC":
+		rs.handleAlloc(args, addr)
+	case "CONNECT":
+		rs.handleConnect(args, addr)
+	case "KEEPALIVE":
+		rs.handleKeepAlive(args, addr)
+	case "PING":
+		rs.handlePing(args, addr)
+	case "DISCONNECT":
+		rs.handleDisconnect(args, addr)
+	default:
+		rs.invalid()
+	}
+}
+
+// handleAlloc allocates a relay ID for the sender, or returns the one it
+// already has so a lost response can be retried
+func (rs *RelayServer) handleAlloc(token string, addr *net.UDPAddr) {
+	var peerID string
+	if rs.config.Authenticator != nil {
+		t, err := rs.config.Authenticator.VerifyToken(token)
+		if err != nil {
+			rs.mu.Lock()
+			rs.stats.AuthFailures++
+			rs.mu.Unlock()
+			rs.sendError(addr, "authentication failed")
+			return
+		}
+		peerID = t.PeerID
+	}
+
+	rs.mu.Lock()
+	alloc, exists := rs.byAddr[addr.String()]
+	if !exists {
+		if rs.config.MaxAllocations > 0 && len(rs.allocations) >= rs.config.MaxAllocations {
+			rs.mu.Unlock()
+			rs.sendError(addr, "allocation quota reached")
+			return
+		}
+
+		now := time.Now()
+		alloc = &relayAllocation{
+			id:           rs.newAllocationID(),
+			addr:         addr,
+			peerID:       peerID,
+			peers:        make(map[string]bool),
+			created:      now,
+			lastActivity: now,
+		}
+		rs.allocations[alloc.id] = alloc
+		rs.byAddr[addr.String()] = alloc
+		rs.stats.Allocations++
+	}
+	alloc.lastActivity = time.Now()
+	id := alloc.id
+	rs.mu.Unlock()
+
+	rs.send(addr, []byte("RELAY:ALLOC:"+id))
+}
+
+// handleConnect binds the sender's allocation to a peer's
+func (rs *RelayServer) handleConnect(args string, addr *net.UDPAddr) {
+	fromID, toID, ok := strings.Cut(args, ":")
+	if !ok {
+		rs.invalid()
+		return
+	}
+
+	rs.mu.Lock()
+	alloc := rs.owned(fromID, addr)
+	if alloc == nil {
+		rs.mu.Unlock()
+		rs.sendError(addr, "unknown allocation")
+		return
+	}
+	if _, exists := rs.allocations[toID]; !exists || toID == fromID {
+		rs.mu.Unlock()
+		rs.sendError(addr, "unknown peer")
+		return
+	}
+	alloc.peers[toID] = true
+	alloc.lastActivity = time.Now()
+	rs.mu.Unlock()
+
+	rs.send(addr, []byte("RELAY:CONNOK:"+toID))
+}
+
+// handleData forwards data from the sender to a peer it is bound to
+func (rs *RelayServer) handleData(msg []byte, addr *net.UDPAddr) {
+	header := msg[len("RELAY:DATA:"):]
+	fromEnd := bytes.IndexByte(header, ':')
+	if fromEnd < 0 {
+		rs.invalid()
+		return
+	}
+	toEnd := bytes.IndexByte(header[fromEnd+1:], ':')
+	if toEnd < 0 {
+		rs.invalid()
+		return
+	}
+	fromID := string(header[:fromEnd])
+	toID := string(header[fromEnd+1 : fromEnd+1+toEnd])
+	payload := len(header) - (fromEnd + 1 + toEnd + 1)
+
+	now := time.Now()
+
+	rs.mu.Lock()
+	alloc := rs.owned(fromID, addr)
+	var peer *relayAllocation
+	if alloc != nil && alloc.peers[toID] {
+		peer = rs.allocations[toID]
+	}
+	if peer == nil {
+		rs.stats.PacketsDropped++
+		rs.mu.Unlock()
+		return
+	}
+	alloc.lastActivity = now
+	if rs.config.MaxBandwidth > 0 && !alloc.bandwidth.Take(payload, rs.config.MaxBandwidth, now) {
+		rs.stats.PacketsLimited++
+		rs.mu.Unlock()
+		return
+	}
+	rs.stats.PacketsRelayed++
+	rs.stats.BytesRelayed += uint64(payload)
+	peerAddr := peer.addr
+	rs.mu.Unlock()
+
+	rs.send(peerAddr, msg)
+}
+
+// handleKeepAlive keeps the sender's allocation from expiring
+func (rs *RelayServer) handleKeepAlive(id string, addr *net.UDPAddr) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if alloc := rs.owned(id, addr); alloc != nil {
+		alloc.lastActivity = time.Now()
+	}
+}
+
+// handlePing answers a ping on the sender's allocation, which also keeps it
+// from expiring
+func (rs *RelayServer) handlePing(id string, addr *net.UDPAddr) {
+	rs.mu.Lock()
+	alloc := rs.owned(id, addr)
+	if alloc != nil {
+		alloc.lastActivity = time.Now()
+	}
+	rs.mu.Unlock()
+
+	if alloc == nil {
+		rs.sendError(addr, "unknown allocation")
+		return
+	}
+	rs.send(addr, []byte("RELAY:PONG:"+id))
+}
+
+// handleDisconnect removes a binding, or releases the allocation when no
+// peer is given
+func (rs *RelayServer) handleDisconnect(args string, addr *net.UDPAddr) {
+	id, peerID, hasPeer := strings.Cut(args, ":")
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	alloc := rs.owned(id, addr)
+	if alloc == nil {
+		return
+	}
+	if hasPeer {
+		delete(alloc.peers, peerID)
+		alloc.lastActivity = time.Now()
+		return
+	}
+	rs.release(alloc)
+}
+
+// owned returns the allocation with the given ID if it belongs to addr.
+// rs.mu must be held.
+func (rs *RelayServer) owned(id string, addr *net.UDPAddr) *relayAllocation {
+	alloc, exists := rs.allocations[id]
+	if !exists || alloc.addr.String() != addr.String() {
+		return nil
+	}
+	return alloc
+}
+
+// release removes an allocation and the bindings to it. rs.mu must be held.
+func (rs *RelayServer) release(alloc *relayAllocation) {
+	delete(rs.allocations, alloc.id)
+	delete(rs.byAddr, alloc.addr.String())
+	for _, other := range rs.allocations {
+		delete(other.peers, alloc.id)
+	}
+}
+
+// newAllocationID returns an unused random allocation ID. rs.mu must be held.
+func (rs *RelayServer) newAllocationID() string {
+	buf := make([]byte, 8)
+	for {
+		rand.Read(buf)
+		id := hex.EncodeToString(buf)
+		if _, exists := rs.allocations[id]; !exists {
+			return id
+		}
+	}
+}
+
+// invalid counts a malformed message
+func (rs *RelayServer) invalid() {
+	rs.mu.Lock()
+	rs.stats.InvalidMessages++
+	rs.mu.Unlock()
+}
+
+// send writes a message to addr
+func (rs *RelayServer) send(addr *net.UDPAddr, msg []byte) {
+	rs.conn.WriteToUDP(msg, addr)
+}
+
+// sendError refuses a request
+func (rs *RelayServer) sendError(addr *net.UDPAddr, reason string) {
+	rs.send(addr, []byte("RELAY:ERROR:"+reason))
+}
+
+// GetAllocations returns the current allocations
+func (rs *RelayServer) GetAllocations() []RelayAllocationInfo {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	allocations := make([]RelayAllocationInfo, 0, len(rs.allocations))
+	for _, alloc := range rs.allocations {
+		allocations = append(allocations, RelayAllocationInfo{
+			ID:           alloc.id,
+			Addr:         alloc.addr,
+			PeerID:       alloc.peerID,
+			Peers:        len(alloc.peers),
+			Created:      alloc.created,
+			LastActivity: alloc.lastActivity,
+		})
+	}
+	return allocations
+}
+
+// GetStats returns relay server statistics
+func (rs *RelayServer) GetStats() RelayServerStats {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.stats
+}
@@ -0,0 +1,204 @@
+package nat
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/security"
+)
+
+func startRelay(t *testing.T, config *RelayServerConfig) *RelayServer {
+	t.Helper()
+
+	config.ListenAddr = "127.0.0.1:0"
+	rs := NewRelayServer(config)
+	if err := rs.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rs.Stop() })
+	return rs
+}
+
+func listenLoopback(t *testing.T) *net.UDPConn {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func newTestRelayClient(t *testing.T, rs *RelayServer, token string) (*RelayClient, error) {
+	t.Helper()
+
+	config := DefaultRelayConfig()
+	config.RelayServers = []string{rs.LocalAddr().String()}
+	config.Timeout = 2 * time.Second
+	config.MaxBandwidth = 0
+	config.Token = token
+	return NewRelayClient(listenLoopback(t), config)
+}
+
+// connectRelayPair allocates two clients on the relay and binds them to each other
+func connectRelayPair(t *testing.T, rs *RelayServer, tokenA, tokenB string) (a, b *RelayClient) {
+	t.Helper()
+
+	a, err := newTestRelayClient(t, rs, tokenA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = newTestRelayClient(t, rs, tokenB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.EstablishRelayConnection("b", b.GetRelayID()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.EstablishRelayConnection("a", a.GetRelayID()); err != nil {
+		t.Fatal(err)
+	}
+	return a, b
+}
+
+// receiveRelayed reads relayed data until none arrives for a while
+func receiveRelayed(rc *RelayClient) (received []string) {
+	for {
+		peerID, data, err := rc.ReceiveViaRelay()
+		if err != nil {
+			return received
+		}
+		received = append(received, peerID+":"+string(data))
+	}
+}
+
+func TestRelayForwardsBetweenClients(t *testing.T) {
+	auth := security.NewAuthenticator(&security.SecurityConfig{TokenSecret: "relay-secret"})
+	rs := startRelay(t, &RelayServerConfig{Authenticator: auth})
+
+	tokenA, _ := auth.GenerateToken("a", time.Hour)
+	tokenB, _ := auth.GenerateToken("b", time.Hour)
+	a, b := connectRelayPair(t, rs, tokenA, tokenB)
+
+	if err := a.SendViaRelay("b", []byte("hello b")); err != nil {
+		t.Fatal(err)
+	}
+	if got := receiveRelayed(b); len(got) != 1 || got[0] != "a:hello b" {
+		t.Fatalf("b received %q", got)
+	}
+	if err := b.SendViaRelay("a", []byte("hello a")); err != nil {
+		t.Fatal(err)
+	}
+	if got := receiveRelayed(a); len(got) != 1 || got[0] != "b:hello a" {
+		t.Fatalf("a received %q", got)
+	}
+
+	// Only the address that made an allocation may send from it
+	spoofer := listenLoopback(t)
+	spoofed := "RELAY:DATA:" + a.GetRelayID() + ":" + b.GetRelayID() + ":spoofed"
+	if _, err := spoofer.WriteToUDP([]byte(spoofed), rs.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if got := receiveRelayed(b); len(got) != 0 {
+		t.Fatalf("b received spoofed data %q", got)
+	}
+
+	if _, err := a.MeasureRelayRTT(); err != nil {
+		t.Fatal(err)
+	}
+
+	peers := make(map[string]string)
+	for _, alloc := range rs.GetAllocations() {
+		peers[alloc.ID] = alloc.PeerID
+	}
+	if peers[a.GetRelayID()] != "a" || peers[b.GetRelayID()] != "b" {
+		t.Errorf("allocations = %v, want the token peer IDs", peers)
+	}
+
+	stats := rs.GetStats()
+	if stats.Allocations != 2 || stats.PacketsRelayed != 2 || stats.PacketsDropped != 1 {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	// Releasing a binding stops its data
+	a.CloseRelayConnection("b")
+	if err := b.SendViaRelay("a", []byte("unbound")); err != nil {
+		t.Fatal(err)
+	}
+	if got := receiveRelayed(a); len(got) != 0 {
+		t.Fatalf("a received %q after unbinding", got)
+	}
+}
+
+func TestRelayRequiresValidToken(t *testing.T) {
+	auth := security.NewAuthenticator(&security.SecurityConfig{TokenSecret: "relay-secret"})
+	rs := startRelay(t, &RelayServerConfig{Authenticator: auth})
+
+	other := security.NewAuthenticator(&security.SecurityConfig{TokenSecret: "other-secret"})
+	forged, _ := other.GenerateToken("a", time.Hour)
+	expired, _ := auth.GenerateToken("a", -time.Hour)
+
+	for _, token := range []string{"", forged, expired} {
+		_, err := newTestRelayClient(t, rs, token)
+		if err == nil || !strings.Contains(err.Error(), "authentication failed") {
+			t.Errorf("allocation with token %q: err = %v", token, err)
+		}
+	}
+
+	if stats := rs.GetStats(); stats.AuthFailures != 3 || stats.Allocations != 0 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestRelayBandwidthLimit(t *testing.T) {
+	const limit = 10000
+
+	rs := startRelay(t, &RelayServerConfig{MaxBandwidth: limit})
+	a, b := connectRelayPair(t, rs, "", "")
+
+	payload := make([]byte, 1000)
+	for i := 0; i < 40; i++ {
+		if err := a.SendViaRelay("b", payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A second's worth of burst gets through
+	got := receiveRelayed(b)
+	if len(got) < limit/len(payload) || len(got) > limit/len(payload)+1 {
+		t.Fatalf("received %d packets, want %d", len(got), limit/len(payload))
+	}
+	if stats := rs.GetStats(); stats.PacketsLimited != uint64(40-len(got)) {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestRelayExpiresIdleAllocations(t *testing.T) {
+	rs := startRelay(t, &RelayServerConfig{AllocationTimeout: 200 * time.Millisecond})
+	a, b := connectRelayPair(t, rs, "", "")
+
+	// Pings keep a's allocation alive while b's idles
+	for end := time.Now().Add(600 * time.Millisecond); time.Now().Before(end); {
+		if _, err := a.MeasureRelayRTT(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	allocations := rs.GetAllocations()
+	if len(allocations) != 1 || allocations[0].ID != a.GetRelayID() {
+		t.Fatalf("allocations = %+v, want only a's", allocations)
+	}
+	if allocations[0].Peers != 0 {
+		t.Errorf("a is still bound to %d peers", allocations[0].Peers)
+	}
+	if _, err := b.MeasureRelayRTT(); err == nil {
+		t.Error("ping on an expired allocation succeeded")
+	}
+	if stats := rs.GetStats(); stats.Expired != 1 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
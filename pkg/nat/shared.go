@@ -0,0 +1,65 @@
+package nat
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// sharedQueueSize is how many handed-over datagrams wait to be read
+const sharedQueueSize = 16
+
+// datagram is a datagram handed over by the reader of a shared socket
+type datagram struct {
+	data []byte
+	from *net.UDPAddr
+}
+
+// receiveDatagram reads a datagram from conn, or, when incoming is set
+// because something else reads conn, waits for one to be handed over.
+// Waiting ends at the deadline or when done is closed.
+func receiveDatagram(conn *net.UDPConn, incoming chan datagram, done chan struct{}, buffer []byte, deadline time.Time) (int, *net.UDPAddr, error) {
+	if incoming == nil {
+		conn.SetReadDeadline(deadline)
+		return conn.ReadFromUDP(buffer)
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case dg := <-incoming:
+		return copy(buffer, dg.data), dg.from, nil
+	case <-timer.C:
+		return 0, nil, os.ErrDeadlineExceeded
+	case <-done:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+// handOver queues a datagram for receiveDatagram, dropping it when nobody
+// keeps up with the queue
+func handOver(incoming chan datagram, data []byte, from *net.UDPAddr) {
+	select {
+	case incoming <- datagram{data: append([]byte(nil), data...), from: from}:
+	default:
+	}
+}
+
+// isSTUNMessage reports whether a datagram is framed as a STUN message
+func isSTUNMessage(data []byte) bool {
+	return len(data) >= stunHeaderSize &&
+		data[0]&0xC0 == 0 &&
+		binary.BigEndian.Uint32(data[4:8]) == stunMagicCookie &&
+		int(binary.BigEndian.Uint16(data[2:4])) == len(data)-stunHeaderSize
+}
+
+// isPunchMessage reports whether a datagram is a hole punching message
+func isPunchMessage(data []byte) bool {
+	message := string(data[:min(len(data), 10)])
+	return strings.HasPrefix(message, "PUNCH:") ||
+		strings.HasPrefix(message, "SIMPUNCH:") ||
+		strings.HasPrefix(message, "KEEPALIVE:")
+}
@@ -1,6 +1,7 @@
 package nat
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/binary"
 	"fmt"
@@ -38,6 +39,12 @@ type STUNClient struct {
 	// Current NAT mapping
 	mapping *NATMapping
 
+	// Responses handed over by the reader of a shared socket; nil when
+	// the client reads the socket itself
+	incoming  chan datagram
+	done      chan struct{}
+	closeOnce sync.Once
+
 	// Stats
 	requests  uint64
 	successes uint64
@@ -64,11 +71,41 @@ func NewSTUNClient(config *STUNConfig) (*STUNClient, error) {
 	return &STUNClient{
 		config: config,
 		conn:   conn,
+		done:   make(chan struct{}),
 	}, nil
 }
 
-// Close closes the STUN client
+// newSharedSTUNClient creates a STUN client on a socket something else
+// reads, which hands STUN messages over to deliver
+func newSharedSTUNClient(conn *net.UDPConn, config *STUNConfig) *STUNClient {
+	if config == nil {
+		config = DefaultSTUNConfig()
+	}
+
+	return &STUNClient{
+		config:   config,
+		conn:     conn,
+		incoming: make(chan datagram, sharedQueueSize),
+		done:     make(chan struct{}),
+	}
+}
+
+// deliver takes a datagram read from a shared socket if it is a STUN
+// message, reporting whether it was
+func (c *STUNClient) deliver(data []byte, from *net.UDPAddr) bool {
+	if c.incoming == nil || !isSTUNMessage(data) {
+		return false
+	}
+	handOver(c.incoming, data, from)
+	return true
+}
+
+// Close closes the STUN client, and its socket unless it is shared
 func (c *STUNClient) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	if c.incoming != nil {
+		return nil
+	}
 	return c.conn.Close()
 }
 
@@ -83,7 +120,7 @@ func (c *STUNClient) DiscoverNATMapping() (*NATMapping, error) {
 	defer c.mu.Unlock()
 
 	// Test 1: Basic binding request to primary server
-	publicAddr, err := c.sendBindingRequest(c.config.PrimaryServer, false, false)
+	resp, err := c.sendBindingRequest(c.config.PrimaryServer, false, false)
 	if err != nil {
 		c.failures++
 		return nil, fmt.Errorf("test 1 failed: %w", err)
@@ -92,6 +129,8 @@ func (c *STUNClient) DiscoverNATMapping() (*NATMapping, error) {
 	c.requests++
 	c.successes++
 
+	publicAddr := resp.MappedAddr
+
 	// Create initial mapping
 	mapping := &NATMapping{
 		LocalAddr:   c.conn.LocalAddr().(*net.UDPAddr),
@@ -114,28 +153,27 @@ func (c *STUNClient) DiscoverNATMapping() (*NATMapping, error) {
 	if err == nil {
 		// Response from different IP:port means Full Cone NAT
 		mapping.MappingType = NATTypeFullCone
-		c.mapping = mapping
-		return mapping, nil
-	}
-
-	// Test 3: Request with change port only
-	_, err = c.sendBindingRequest(c.config.PrimaryServer, false, true)
-	if err == nil {
-		// Response from different port means Restricted Cone
+	} else if _, err = c.sendBindingRequest(c.config.PrimaryServer, false, true); err == nil {
+		// Test 3: Response from different port means Restricted Cone
 		mapping.MappingType = NATTypeRestrictedCone
-		c.mapping = mapping
-		return mapping, nil
 	} else {
 		// No response means Port-Restricted Cone
 		mapping.MappingType = NATTypePortRestrictedCone
 	}
 
-	// Test 4: Request to secondary server to check for symmetric NAT
-	if c.config.SecondaryServer != "" {
-		publicAddr2, err := c.sendBindingRequest(c.config.SecondaryServer, false, false)
+	// Test 4: Request to a second server address to check for symmetric NAT.
+	// A server supporting RFC 5780 names its alternate address in
+	// OTHER-ADDRESS; its alternate IP with the primary port is used then.
+	secondary := c.config.SecondaryServer
+	if resp.OtherAddr != nil {
+		primaryAddr, _ := net.ResolveUDPAddr("udp4", c.config.PrimaryServer)
+		secondary = (&net.UDPAddr{IP: resp.OtherAddr.IP, Port: primaryAddr.Port}).String()
+	}
+	if secondary != "" {
+		resp2, err := c.sendBindingRequest(secondary, false, false)
 		if err == nil {
-			// If we get different public port for different server, it's Symmetric NAT
-			if publicAddr2.Port != publicAddr.Port {
+			// If we get a different mapping for a different server, it's Symmetric NAT
+			if resp2.MappedAddr.String() != publicAddr.String() {
 				mapping.MappingType = NATTypeSymmetric
 			}
 		}
@@ -154,7 +192,7 @@ func (c *STUNClient) RefreshMapping() error {
 		return fmt.Errorf("no mapping to refresh")
 	}
 
-	publicAddr, err := c.sendBindingRequest(c.config.PrimaryServer, false, false)
+	resp, err := c.sendBindingRequest(c.config.PrimaryServer, false, false)
 	if err != nil {
 		c.failures++
 		return err
@@ -164,7 +202,7 @@ func (c *STUNClient) RefreshMapping() error {
 	c.successes++
 
 	// Update mapping
-	c.mapping.PublicAddr = publicAddr
+	c.mapping.PublicAddr = resp.MappedAddr
 	c.mapping.LastRefresh = time.Now()
 
 	return nil
@@ -177,8 +215,16 @@ func (c *STUNClient) GetMapping() *NATMapping {
 	return c.mapping
 }
 
+// stunResponse is what a binding response tells about our mapping
+type stunResponse struct {
+	MappedAddr     *net.UDPAddr // Our address as the server saw it
+	OtherAddr      *net.UDPAddr // The server's alternate address (RFC 5780), if it has one
+	ResponseOrigin *net.UDPAddr // The address the server says it answered from
+	Source         *net.UDPAddr // The address the response actually came from
+}
+
 // sendBindingRequest sends a STUN binding request
-func (c *STUNClient) sendBindingRequest(serverAddr string, changeIP, changePort bool) (*net.UDPAddr, error) {
+func (c *STUNClient) sendBindingRequest(serverAddr string, changeIP, changePort bool) (*stunResponse, error) {
 	// Parse server address
 	addr, err := net.ResolveUDPAddr("udp4", serverAddr)
 	if err != nil {
@@ -192,9 +238,7 @@ func (c *STUNClient) sendBindingRequest(serverAddr string, changeIP, changePort
 	// Build STUN message
 	message := c.buildBindingRequest(transactionID, changeIP, changePort)
 
-	// Set deadline
 	deadline := time.Now().Add(c.config.Timeout)
-	c.conn.SetReadDeadline(deadline)
 
 	// Send request
 	_, err = c.conn.WriteToUDP(message, addr)
@@ -202,160 +246,118 @@ func (c *STUNClient) sendBindingRequest(serverAddr string, changeIP, changePort
 		return nil, fmt.Errorf("failed to send STUN request: %w", err)
 	}
 
-	// Wait for response
+	// Wait for response, skipping stray responses to earlier requests
 	buffer := make([]byte, 1500)
-	n, _, err := c.conn.ReadFromUDP(buffer)
-	if err != nil {
-		return nil, fmt.Errorf("failed to receive STUN response: %w", err)
-	}
+	for {
+		n, source, err := receiveDatagram(c.conn, c.incoming, c.done, buffer, deadline)
+		if err != nil {
+			return nil, fmt.Errorf("failed to receive STUN response: %w", err)
+		}
 
-	// Parse response
-	publicAddr, err := c.parseBindingResponse(buffer[:n], transactionID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse STUN response: %w", err)
-	}
+		// Parse response
+		resp, err := c.parseBindingResponse(buffer[:n], transactionID)
+		if err == errNotSTUN || err == errSTUNTransaction {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse STUN response: %w", err)
+		}
+		resp.Source = source
+
+		// A server that cannot change its address may answer from the same one
+		if (changeIP && source.IP.Equal(addr.IP)) || (changePort && source.Port == addr.Port) {
+			return nil, fmt.Errorf("STUN server did not honor CHANGE-REQUEST")
+		}
 
-	return publicAddr, nil
+		return resp, nil
+	}
 }
 
-// buildBindingRequest builds a STUN binding request message
+// buildBindingRequest builds a STUN binding request message, signed with
+// the configured credentials
 func (c *STUNClient) buildBindingRequest(transactionID []byte, changeIP, changePort bool) []byte {
-	message := make([]byte, 20) // Header only for basic request
-
-	// Message Type (2 bytes)
-	binary.BigEndian.PutUint16(message[0:2], stunBindingRequest)
-
-	// Message Length (2 bytes) - will update if we add attributes
-	messageLength := 0
-
-	// Magic Cookie (4 bytes)
-	binary.BigEndian.PutUint32(message[4:8], stunMagicCookie)
-
-	// Transaction ID (12 bytes)
-	copy(message[8:20], transactionID)
+	var attributes []stunAttribute
 
 	// Add CHANGE-REQUEST attribute if needed
 	if changeIP || changePort {
-		attr := make([]byte, 8)
-		binary.BigEndian.PutUint16(attr[0:2], stunAttrChangeRequest)
-		binary.BigEndian.PutUint16(attr[2:4], 4) // Length
-
 		changeFlags := uint32(0)
 		if changeIP {
-			changeFlags |= 0x04
+			changeFlags |= stunChangeIP
 		}
 		if changePort {
-			changeFlags |= 0x02
+			changeFlags |= stunChangePort
 		}
-		binary.BigEndian.PutUint32(attr[4:8], changeFlags)
-
-		message = append(message, attr...)
-		messageLength += 8
+		value := make([]byte, 4)
+		binary.BigEndian.PutUint32(value, changeFlags)
+		attributes = append(attributes, stunAttribute{typ: stunAttrChangeRequest, value: value})
 	}
 
-	// Update message length
-	binary.BigEndian.PutUint16(message[2:4], uint16(messageLength))
+	var key []byte
+	if c.config.Password != "" {
+		attributes = append(attributes, stunAttribute{typ: stunAttrUsername, value: []byte(c.config.Username)})
+		key = []byte(c.config.Password)
+	}
 
-	return message
+	return buildSTUNMessage(stunBindingRequest, transactionID, attributes, key, true)
 }
 
 // parseBindingResponse parses a STUN binding response
-func (c *STUNClient) parseBindingResponse(data []byte, expectedTxID []byte) (*net.UDPAddr, error) {
-	if len(data) < 20 {
-		return nil, fmt.Errorf("message too short")
+func (c *STUNClient) parseBindingResponse(data []byte, expectedTxID []byte) (*stunResponse, error) {
+	msg, err := parseSTUNMessage(data)
+	if err != nil {
+		return nil, err
 	}
 
-	// Check message type
-	msgType := binary.BigEndian.Uint16(data[0:2])
-	if msgType != stunBindingResponse {
-		return nil, fmt.Errorf("not a binding response: 0x%04x", msgType)
+	// Check transaction ID
+	if !bytes.Equal(msg.transactionID, expectedTxID) {
+		return nil, errSTUNTransaction
 	}
 
-	// Check magic cookie
-	cookie := binary.BigEndian.Uint32(data[4:8])
-	if cookie != stunMagicCookie {
-		return nil, fmt.Errorf("invalid magic cookie")
+	if !msg.checkFingerprint() {
+		return nil, fmt.Errorf("invalid fingerprint")
 	}
 
-	// Check transaction ID
-	txID := data[8:20]
-	for i := 0; i < 12; i++ {
-		if txID[i] != expectedTxID[i] {
-			return nil, fmt.Errorf("transaction ID mismatch")
-		}
+	// Check message type
+	if msg.msgType == stunBindingErrorResponse {
+		attr, _ := msg.attribute(stunAttrErrorCode)
+		code, reason := decodeSTUNErrorCode(attr.value)
+		return nil, fmt.Errorf("STUN error %d: %s", code, reason)
+	}
+	if msg.msgType != stunBindingResponse {
+		return nil, fmt.Errorf("not a binding response: 0x%04x", msg.msgType)
 	}
 
-	// Parse attributes
-	messageLength := binary.BigEndian.Uint16(data[2:4])
-	pos := 20
-
-	var mappedAddr *net.UDPAddr
-
-	for pos < 20+int(messageLength) {
-		if pos+4 > len(data) {
-			break
-		}
-
-		attrType := binary.BigEndian.Uint16(data[pos : pos+2])
-		attrLength := binary.BigEndian.Uint16(data[pos+2 : pos+4])
-		pos += 4
-
-		if pos+int(attrLength) > len(data) {
-			break
-		}
-
-		attrValue := data[pos : pos+int(attrLength)]
+	if c.config.Password != "" && !msg.checkIntegrity([]byte(c.config.Password)) {
+		return nil, fmt.Errorf("invalid message integrity")
+	}
 
-		switch attrType {
+	// Parse attributes
+	resp := &stunResponse{}
+	for _, attr := range msg.attributes {
+		switch attr.typ {
 		case stunAttrMappedAddress:
-			mappedAddr = c.parseMappedAddress(attrValue, false)
+			if resp.MappedAddr == nil {
+				resp.MappedAddr = c.parseMappedAddress(attr.value, false)
+			}
 		case stunAttrXorMappedAddress, stunAttrXorMappedAddress2:
-			mappedAddr = c.parseMappedAddress(attrValue, true)
-		}
-
-		// Advance to next attribute (attributes are padded to 4-byte boundary)
-		pos += int(attrLength)
-		if attrLength%4 != 0 {
-			pos += 4 - int(attrLength%4)
+			resp.MappedAddr = c.parseMappedAddress(attr.value, true)
+		case stunAttrOtherAddress:
+			resp.OtherAddr = c.parseMappedAddress(attr.value, false)
+		case stunAttrResponseOrigin:
+			resp.ResponseOrigin = c.parseMappedAddress(attr.value, false)
 		}
 	}
 
-	if mappedAddr == nil {
+	if resp.MappedAddr == nil {
 		return nil, fmt.Errorf("no mapped address in response")
 	}
 
-	return mappedAddr, nil
+	return resp, nil
 }
 
 // parseMappedAddress parses a MAPPED-ADDRESS or XOR-MAPPED-ADDRESS attribute
 func (c *STUNClient) parseMappedAddress(data []byte, xor bool) *net.UDPAddr {
-	if len(data) < 8 {
-		return nil
-	}
-
-	// Skip first byte (reserved)
-	family := data[1]
-	if family != 0x01 { // IPv4
-		return nil
-	}
-
-	port := binary.BigEndian.Uint16(data[2:4])
-	ip := net.IPv4(data[4], data[5], data[6], data[7])
-
-	if xor {
-		// XOR with magic cookie
-		port ^= uint16(stunMagicCookie >> 16)
-		cookieBytes := make([]byte, 4)
-		binary.BigEndian.PutUint32(cookieBytes, stunMagicCookie)
-		for i := 0; i < 4; i++ {
-			ip[i] ^= cookieBytes[i]
-		}
-	}
-
-	return &net.UDPAddr{
-		IP:   ip,
-		Port: int(port),
-	}
+	return decodeSTUNAddress(data, xor)
 }
 
 // StartRefreshRoutine starts automatic NAT mapping refresh
@@ -364,7 +366,13 @@ func (c *STUNClient) StartRefreshRoutine() {
 		ticker := time.NewTicker(c.config.RefreshInterval)
 		defer ticker.Stop()
 
-		for range ticker.C {
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-ticker.C:
+			}
+
 			if err := c.RefreshMapping(); err != nil {
 				// Mapping refresh failed, try to rediscover
 				c.DiscoverNATMapping()
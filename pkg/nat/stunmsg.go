@@ -0,0 +1,246 @@
+package nat
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+)
+
+// STUN attribute types beyond the classic ones (RFC 5389, RFC 5780)
+const (
+	stunAttrUsername          uint16 = 0x0006
+	stunAttrMessageIntegrity  uint16 = 0x0008
+	stunAttrErrorCode         uint16 = 0x0009
+	stunAttrUnknownAttributes uint16 = 0x000A
+	stunAttrFingerprint       uint16 = 0x8028
+	stunAttrResponseOrigin    uint16 = 0x802B
+	stunAttrOtherAddress      uint16 = 0x802C
+)
+
+// CHANGE-REQUEST flags
+const (
+	stunChangeIP   uint32 = 0x04
+	stunChangePort uint32 = 0x02
+)
+
+const (
+	stunHeaderSize = 20
+	// stunFingerprintXOR is XORed into the CRC-32 of FINGERPRINT
+	stunFingerprintXOR uint32 = 0x5354554E
+)
+
+var (
+	// errNotSTUN is returned when parsing a datagram that is not a STUN message
+	errNotSTUN = errors.New("not a STUN message")
+	// errSTUNTransaction is returned when parsing a response to another request
+	errSTUNTransaction = errors.New("transaction ID mismatch")
+)
+
+// stunAttribute is an attribute of a STUN message
+type stunAttribute struct {
+	typ    uint16
+	value  []byte
+	offset int // Offset of the attribute header in the message
+}
+
+// stunMessage is a parsed STUN message
+type stunMessage struct {
+	msgType       uint16
+	transactionID []byte
+	attributes    []stunAttribute
+	raw           []byte
+}
+
+// parseSTUNMessage parses a STUN message. Attributes after
+// MESSAGE-INTEGRITY other than FINGERPRINT are ignored, as RFC 5389 requires.
+func parseSTUNMessage(data []byte) (*stunMessage, error) {
+	if len(data) < stunHeaderSize || data[0]&0xC0 != 0 {
+		return nil, errNotSTUN
+	}
+	if binary.BigEndian.Uint32(data[4:8]) != stunMagicCookie {
+		return nil, errNotSTUN
+	}
+	length := int(binary.BigEndian.Uint16(data[2:4]))
+	if length%4 != 0 || stunHeaderSize+length > len(data) {
+		return nil, fmt.Errorf("invalid STUN message length %d", length)
+	}
+	data = data[:stunHeaderSize+length]
+
+	m := &stunMessage{
+		msgType:       binary.BigEndian.Uint16(data[0:2]),
+		transactionID: data[8:20],
+		raw:           data,
+	}
+
+	integrity := false
+	for pos := stunHeaderSize; pos < len(data); {
+		if pos+4 > len(data) {
+			return nil, fmt.Errorf("truncated STUN attribute")
+		}
+		typ := binary.BigEndian.Uint16(data[pos : pos+2])
+		attrLength := int(binary.BigEndian.Uint16(data[pos+2 : pos+4]))
+		if pos+4+attrLength > len(data) {
+			return nil, fmt.Errorf("truncated STUN attribute 0x%04x", typ)
+		}
+
+		if !integrity || typ == stunAttrFingerprint {
+			m.attributes = append(m.attributes, stunAttribute{
+				typ:    typ,
+				value:  data[pos+4 : pos+4+attrLength],
+				offset: pos,
+			})
+		}
+		if typ == stunAttrMessageIntegrity {
+			integrity = true
+		}
+
+		pos += 4 + (attrLength+3)&^3
+	}
+
+	return m, nil
+}
+
+// attribute returns the first attribute of a type
+func (m *stunMessage) attribute(typ uint16) (stunAttribute, bool) {
+	for _, attr := range m.attributes {
+		if attr.typ == typ {
+			return attr, true
+		}
+	}
+	return stunAttribute{}, false
+}
+
+// checkIntegrity verifies MESSAGE-INTEGRITY against a key, which for
+// short-term credentials is the password
+func (m *stunMessage) checkIntegrity(key []byte) bool {
+	attr, ok := m.attribute(stunAttrMessageIntegrity)
+	if !ok || len(attr.value) != sha1.Size {
+		return false
+	}
+	return hmac.Equal(attr.value, stunIntegrity(m.raw[:attr.offset], key))
+}
+
+// checkFingerprint verifies FINGERPRINT if the message has one
+func (m *stunMessage) checkFingerprint() bool {
+	attr, ok := m.attribute(stunAttrFingerprint)
+	if !ok {
+		return true
+	}
+	return len(attr.value) == 4 &&
+		attr.offset+8 == len(m.raw) &&
+		binary.BigEndian.Uint32(attr.value) == stunFingerprint(m.raw[:attr.offset])
+}
+
+// stunIntegrity returns the HMAC-SHA1 of a message up to MESSAGE-INTEGRITY,
+// with the header length counting the MESSAGE-INTEGRITY attribute
+func stunIntegrity(message, key []byte) []byte {
+	header := make([]byte, stunHeaderSize)
+	copy(header, message)
+	binary.BigEndian.PutUint16(header[2:4], uint16(len(message)-stunHeaderSize+4+sha1.Size))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(header)
+	mac.Write(message[stunHeaderSize:])
+	return mac.Sum(nil)
+}
+
+// stunFingerprint returns the FINGERPRINT of a message up to the attribute,
+// whose header length already counts it
+func stunFingerprint(message []byte) uint32 {
+	return crc32.ChecksumIEEE(message) ^ stunFingerprintXOR
+}
+
+// buildSTUNMessage builds a STUN message, adding MESSAGE-INTEGRITY when a
+// key is given and FINGERPRINT when asked to
+func buildSTUNMessage(msgType uint16, transactionID []byte, attributes []stunAttribute, key []byte, fingerprint bool) []byte {
+	message := make([]byte, stunHeaderSize, 512)
+	binary.BigEndian.PutUint16(message[0:2], msgType)
+	binary.BigEndian.PutUint32(message[4:8], stunMagicCookie)
+	copy(message[8:20], transactionID)
+
+	for _, attr := range attributes {
+		message = appendSTUNAttribute(message, attr.typ, attr.value)
+	}
+
+	if key != nil {
+		message = appendSTUNAttribute(message, stunAttrMessageIntegrity, stunIntegrity(message, key))
+	}
+
+	if fingerprint {
+		binary.BigEndian.PutUint16(message[2:4], uint16(len(message)-stunHeaderSize+8))
+		value := make([]byte, 4)
+		binary.BigEndian.PutUint32(value, stunFingerprint(message))
+		message = appendSTUNAttribute(message, stunAttrFingerprint, value)
+	}
+
+	binary.BigEndian.PutUint16(message[2:4], uint16(len(message)-stunHeaderSize))
+	return message
+}
+
+// appendSTUNAttribute appends an attribute, padded to 4 bytes
+func appendSTUNAttribute(message []byte, typ uint16, value []byte) []byte {
+	message = binary.BigEndian.AppendUint16(message, typ)
+	message = binary.BigEndian.AppendUint16(message, uint16(len(value)))
+	message = append(message, value...)
+	for len(message)%4 != 0 {
+		message = append(message, 0)
+	}
+	return message
+}
+
+// encodeSTUNAddress encodes an IPv4 address in the MAPPED-ADDRESS format,
+// XORed with the magic cookie for XOR-MAPPED-ADDRESS
+func encodeSTUNAddress(addr *net.UDPAddr, xor bool) []byte {
+	ip := addr.IP.To4()
+	if ip == nil {
+		ip = net.IPv4zero.To4()
+	}
+
+	value := make([]byte, 8)
+	value[1] = 0x01 // IPv4
+	binary.BigEndian.PutUint16(value[2:4], uint16(addr.Port))
+	copy(value[4:8], ip)
+
+	if xor {
+		binary.BigEndian.PutUint16(value[2:4], uint16(addr.Port)^uint16(stunMagicCookie>>16))
+		binary.BigEndian.PutUint32(value[4:8], binary.BigEndian.Uint32(value[4:8])^stunMagicCookie)
+	}
+	return value
+}
+
+// decodeSTUNAddress decodes an IPv4 address in the MAPPED-ADDRESS format,
+// XORed with the magic cookie for XOR-MAPPED-ADDRESS
+func decodeSTUNAddress(value []byte, xor bool) *net.UDPAddr {
+	if len(value) < 8 || value[1] != 0x01 { // IPv4
+		return nil
+	}
+
+	port := binary.BigEndian.Uint16(value[2:4])
+	ip := binary.BigEndian.Uint32(value[4:8])
+	if xor {
+		port ^= uint16(stunMagicCookie >> 16)
+		ip ^= stunMagicCookie
+	}
+
+	addr := &net.UDPAddr{IP: make(net.IP, 4), Port: int(port)}
+	binary.BigEndian.PutUint32(addr.IP, ip)
+	return addr
+}
+
+// encodeSTUNErrorCode encodes an ERROR-CODE attribute
+func encodeSTUNErrorCode(code int, reason string) []byte {
+	value := []byte{0, 0, byte(code / 100), byte(code % 100)}
+	return append(value, reason...)
+}
+
+// decodeSTUNErrorCode decodes an ERROR-CODE attribute
+func decodeSTUNErrorCode(value []byte) (int, string) {
+	if len(value) < 4 {
+		return 0, ""
+	}
+	return int(value[2]&0x07)*100 + int(value[3]), string(value[4:])
+}
@@ -0,0 +1,307 @@
+package nat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+var (
+	// ErrSTUNServerRunning is returned when starting a running STUN server
+	ErrSTUNServerRunning = errors.New("STUN server already running")
+)
+
+// stunSocket is one of the addresses a STUN server answers on
+type stunSocket struct {
+	conn *net.UDPConn
+	addr *net.UDPAddr
+	ip   int // 0 for the primary IP, 1 for the alternate
+	port int // 0 for the primary port, 1 for the alternate
+}
+
+// STUNServerStats contains STUN server statistics
+type STUNServerStats struct {
+	Requests     uint64 // Binding requests answered successfully
+	Changed      uint64 // Of those, answered from a changed address
+	AuthFailures uint64 // Requests with missing or invalid credentials
+	Errors       uint64 // Other error responses
+	Invalid      uint64 // Datagrams that were not valid STUN requests
+}
+
+// STUNServer answers STUN Binding requests (RFC 5389) so clients can learn
+// their public address. Given an alternate address on another IP and port,
+// it also supports NAT behavior discovery (RFC 5780): it listens on all four
+// combinations of the two IPs and ports, tells clients the alternate address
+// in OTHER-ADDRESS and the address it answered from in RESPONSE-ORIGIN, and
+// honors CHANGE-REQUEST by answering from the other IP and/or port.
+//
+// With a password configured, requests must carry the short-term
+// credentials in USERNAME and MESSAGE-INTEGRITY, and responses are signed
+// with them. Every response carries a FINGERPRINT.
+type STUNServer struct {
+	config *STUNServerConfig
+
+	mu      sync.Mutex
+	sockets [2][2]*stunSocket // [ip][port]
+	stats   STUNServerStats
+	running bool
+	wg      sync.WaitGroup
+}
+
+// NewSTUNServer creates a new STUN server
+func NewSTUNServer(config *STUNServerConfig) *STUNServer {
+	if config == nil {
+		config = DefaultSTUNServerConfig()
+	}
+	return &STUNServer{config: config}
+}
+
+// Start listens on the configured addresses and starts answering requests
+func (s *STUNServer) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running {
+		return ErrSTUNServerRunning
+	}
+
+	primary, err := net.ResolveUDPAddr("udp4", s.config.Address)
+	if err != nil {
+		return fmt.Errorf("failed to resolve STUN address: %w", err)
+	}
+
+	ips := []net.IP{primary.IP}
+	ports := []int{primary.Port}
+	if s.config.AlternateAddress != "" {
+		alternate, err := net.ResolveUDPAddr("udp4", s.config.AlternateAddress)
+		if err != nil {
+			return fmt.Errorf("failed to resolve STUN alternate address: %w", err)
+		}
+		if primary.IP.IsUnspecified() || alternate.IP.IsUnspecified() {
+			return fmt.Errorf("STUN addresses must have specific IPs for NAT behavior discovery")
+		}
+		if primary.IP.Equal(alternate.IP) || (primary.Port == alternate.Port && primary.Port != 0) {
+			return fmt.Errorf("STUN alternate address must differ in both IP and port")
+		}
+		ips = append(ips, alternate.IP)
+		ports = append(ports, alternate.Port)
+	}
+
+	var sockets [2][2]*stunSocket
+	for i, ip := range ips {
+		for p, port := range ports {
+			conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: ip, Port: port})
+			if err != nil {
+				closeSTUNSockets(&sockets)
+				return fmt.Errorf("failed to listen on %s: %w", net.JoinHostPort(ip.String(), fmt.Sprint(port)), err)
+			}
+			sockets[i][p] = &stunSocket{conn: conn, addr: conn.LocalAddr().(*net.UDPAddr), ip: i, port: p}
+			if port == 0 {
+				// Ports chosen by the system apply to the other IP too
+				ports[p] = sockets[i][p].addr.Port
+			}
+		}
+	}
+
+	s.sockets = sockets
+	s.running = true
+	for _, row := range s.sockets {
+		for _, socket := range row {
+			if socket != nil {
+				s.wg.Add(1)
+				go s.receiveLoop(socket)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Stop stops the STUN server
+func (s *STUNServer) Stop() error {
+	s.mu.Lock()
+	if !s.running {
+		s.mu.Unlock()
+		return nil
+	}
+	s.running = false
+	closeSTUNSockets(&s.sockets)
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return nil
+}
+
+// closeSTUNSockets closes the sockets that are open
+func closeSTUNSockets(sockets *[2][2]*stunSocket) {
+	for _, row := range sockets {
+		for _, socket := range row {
+			if socket != nil {
+				socket.conn.Close()
+			}
+		}
+	}
+}
+
+// LocalAddr returns the primary address the STUN server answers on
+func (s *STUNServer) LocalAddr() *net.UDPAddr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sockets[0][0] == nil {
+		return nil
+	}
+	return s.sockets[0][0].addr
+}
+
+// OtherAddr returns the alternate address for NAT behavior discovery, or
+// nil when there is none
+func (s *STUNServer) OtherAddr() *net.UDPAddr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sockets[1][1] == nil {
+		return nil
+	}
+	return s.sockets[1][1].addr
+}
+
+// GetStats returns STUN server statistics
+func (s *STUNServer) GetStats() STUNServerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// receiveLoop answers the requests arriving on one socket
+func (s *STUNServer) receiveLoop(socket *stunSocket) {
+	defer s.wg.Done()
+
+	buffer := make([]byte, 1500)
+	for {
+		n, addr, err := socket.conn.ReadFromUDP(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		s.handleRequest(socket, buffer[:n], addr)
+	}
+}
+
+// handleRequest answers a Binding request
+func (s *STUNServer) handleRequest(socket *stunSocket, data []byte, addr *net.UDPAddr) {
+	msg, err := parseSTUNMessage(data)
+	if err != nil || msg.msgType != stunBindingRequest || !msg.checkFingerprint() {
+		s.count(func(stats *STUNServerStats) { stats.Invalid++ })
+		return
+	}
+
+	// Attributes below 0x8000 must be understood
+	var unknown []uint16
+	for _, attr := range msg.attributes {
+		switch attr.typ {
+		case stunAttrUsername, stunAttrMessageIntegrity, stunAttrChangeRequest:
+		default:
+			if attr.typ < 0x8000 {
+				unknown = append(unknown, attr.typ)
+			}
+		}
+	}
+
+	var key []byte
+	if s.config.Password != "" {
+		username, hasUsername := msg.attribute(stunAttrUsername)
+		if _, hasIntegrity := msg.attribute(stunAttrMessageIntegrity); !hasUsername || !hasIntegrity {
+			s.count(func(stats *STUNServerStats) { stats.AuthFailures++ })
+			s.sendError(socket, msg, addr, 400, "Bad Request", nil)
+			return
+		}
+		key = []byte(s.config.Password)
+		if string(username.value) != s.config.Username || !msg.checkIntegrity(key) {
+			s.count(func(stats *STUNServerStats) { stats.AuthFailures++ })
+			s.sendError(socket, msg, addr, 401, "Unauthorized", nil)
+			return
+		}
+	}
+
+	// Without an alternate address CHANGE-REQUEST cannot be honored
+	from := socket
+	if attr, ok := msg.attribute(stunAttrChangeRequest); ok {
+		if len(attr.value) != 4 {
+			s.count(func(stats *STUNServerStats) { stats.Errors++ })
+			s.sendError(socket, msg, addr, 400, "Bad Request", key)
+			return
+		}
+		flags := binary.BigEndian.Uint32(attr.value)
+		if flags&(stunChangeIP|stunChangePort) != 0 {
+			if s.OtherAddr() == nil {
+				unknown = append(unknown, stunAttrChangeRequest)
+			} else {
+				from = s.changedSocket(socket, flags&stunChangeIP != 0, flags&stunChangePort != 0)
+			}
+		}
+	}
+
+	if len(unknown) > 0 {
+		value := make([]byte, 0, 2*len(unknown))
+		for _, typ := range unknown {
+			value = binary.BigEndian.AppendUint16(value, typ)
+		}
+		s.count(func(stats *STUNServerStats) { stats.Errors++ })
+		s.sendError(socket, msg, addr, 420, "Unknown Attribute",
+			key, stunAttribute{typ: stunAttrUnknownAttributes, value: value})
+		return
+	}
+
+	attributes := []stunAttribute{
+		{typ: stunAttrXorMappedAddress, value: encodeSTUNAddress(addr, true)},
+		{typ: stunAttrMappedAddress, value: encodeSTUNAddress(addr, false)},
+		{typ: stunAttrResponseOrigin, value: encodeSTUNAddress(from.addr, false)},
+	}
+	if other := s.OtherAddr(); other != nil {
+		// The address differing in both IP and port from the one requested
+		attributes = append(attributes, stunAttribute{
+			typ:   stunAttrOtherAddress,
+			value: encodeSTUNAddress(s.changedSocket(socket, true, true).addr, false),
+		})
+	}
+
+	s.count(func(stats *STUNServerStats) {
+		stats.Requests++
+		if from != socket {
+			stats.Changed++
+		}
+	})
+	from.conn.WriteToUDP(buildSTUNMessage(stunBindingResponse, msg.transactionID, attributes, key, true), addr)
+}
+
+// changedSocket returns the socket on the other IP and/or port of socket
+func (s *STUNServer) changedSocket(socket *stunSocket, changeIP, changePort bool) *stunSocket {
+	ip, port := socket.ip, socket.port
+	if changeIP {
+		ip ^= 1
+	}
+	if changePort {
+		port ^= 1
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sockets[ip][port]
+}
+
+// sendError sends an error response, signed when the request was authenticated
+func (s *STUNServer) sendError(socket *stunSocket, msg *stunMessage, addr *net.UDPAddr, code int, reason string, key []byte, extra ...stunAttribute) {
+	attributes := append([]stunAttribute{{typ: stunAttrErrorCode, value: encodeSTUNErrorCode(code, reason)}}, extra...)
+	socket.conn.WriteToUDP(buildSTUNMessage(stunBindingErrorResponse, msg.transactionID, attributes, key, true), addr)
+}
+
+// count updates the statistics
+func (s *STUNServer) count(update func(stats *STUNServerStats)) {
+	s.mu.Lock()
+	update(&s.stats)
+	s.mu.Unlock()
+}
@@ -0,0 +1,208 @@
+package nat
+
+import (
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startSTUNServer(t *testing.T, config *STUNServerConfig) *STUNServer {
+	t.Helper()
+
+	s := NewSTUNServer(config)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Stop() })
+	return s
+}
+
+func newTestSTUNClient(t *testing.T, s *STUNServer, username, password string) *STUNClient {
+	t.Helper()
+
+	c, err := NewSTUNClient(&STUNConfig{
+		PrimaryServer: s.LocalAddr().String(),
+		Timeout:       300 * time.Millisecond,
+		Username:      username,
+		Password:      password,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	data, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestSTUNMessageVectors(t *testing.T) {
+	// RFC 5769 sample request and IPv4 response
+	request := mustHex(t, `
+		0001 0058 2112a442 b7e7a701 bc34d686 fa87dfae
+		8022 0010 5354554e 20746573 7420636c 69656e74
+		0024 0004 6e0001ff
+		8029 0008 932ff9b1 51263b36
+		0006 0009 6576746a 3a683676 59202020
+		0008 0014 9aeaa70c bfd8cb56 781ef2b5 b2d3f249 c1b571a2
+		8028 0004 e57a3bcf`)
+	response := mustHex(t, `
+		0101 003c 2112a442 b7e7a701 bc34d686 fa87dfae
+		8022 000b 74657374 20766563 746f7220
+		0020 0008 0001a147 e112a643
+		0008 0014 2b91f599 fd9e90c3 8c7489f9 2af9ba53 f06be7d7
+		8028 0004 c07d4c96`)
+	key := []byte("VOkJxbRl1RmTxUk/WvJxBt")
+
+	msg, err := parseSTUNMessage(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !msg.checkFingerprint() || !msg.checkIntegrity(key) {
+		t.Error("sample request failed verification")
+	}
+	if msg.checkIntegrity([]byte("wrong")) {
+		t.Error("sample request verified with the wrong key")
+	}
+
+	c := &STUNClient{config: &STUNConfig{Password: string(key)}}
+	resp, err := c.parseBindingResponse(response, response[8:20])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.MappedAddr.String() != "192.0.2.1:32853" {
+		t.Errorf("mapped address = %s, want 192.0.2.1:32853", resp.MappedAddr)
+	}
+
+	// Corruption fails the fingerprint
+	response[len(response)-30] ^= 1
+	if _, err := c.parseBindingResponse(response, response[8:20]); err == nil {
+		t.Error("corrupted response parsed")
+	}
+}
+
+func TestSTUNServerNATBehaviorDiscovery(t *testing.T) {
+	s := startSTUNServer(t, &STUNServerConfig{
+		Address:          "127.0.0.1:0",
+		AlternateAddress: "127.0.0.2:0",
+		Username:         "bond",
+		Password:         "secret",
+	})
+	primary, other := s.LocalAddr(), s.OtherAddr()
+	if other == nil || other.IP.Equal(primary.IP) || other.Port == primary.Port {
+		t.Fatalf("other address %v does not differ from %v in IP and port", other, primary)
+	}
+
+	c := newTestSTUNClient(t, s, "bond", "secret")
+
+	mapping, err := c.DiscoverNATMapping()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mapping.PublicAddr.Port != c.GetLocalAddr().Port || !mapping.PublicAddr.IP.Equal(primary.IP) {
+		t.Errorf("public address = %s, want port %d on %s", mapping.PublicAddr, c.GetLocalAddr().Port, primary.IP)
+	}
+	// Nothing filters or remaps on loopback
+	if mapping.MappingType != NATTypeFullCone {
+		t.Errorf("NAT type = %s, want %s", mapping.MappingType, NATTypeFullCone)
+	}
+
+	// CHANGE-REQUEST is answered from the requested address
+	for _, tc := range []struct {
+		changeIP, changePort bool
+		from                 *net.UDPAddr
+	}{
+		{false, false, primary},
+		{false, true, &net.UDPAddr{IP: primary.IP, Port: other.Port}},
+		{true, false, &net.UDPAddr{IP: other.IP, Port: primary.Port}},
+		{true, true, other},
+	} {
+		resp, err := c.sendBindingRequest(primary.String(), tc.changeIP, tc.changePort)
+		if err != nil {
+			t.Fatalf("change IP %v port %v: %v", tc.changeIP, tc.changePort, err)
+		}
+		if resp.Source.String() != tc.from.String() || resp.ResponseOrigin.String() != tc.from.String() {
+			t.Errorf("change IP %v port %v: answered from %s (origin %s), want %s",
+				tc.changeIP, tc.changePort, resp.Source, resp.ResponseOrigin, tc.from)
+		}
+		if resp.OtherAddr.String() != other.String() {
+			t.Errorf("other address = %s, want %s", resp.OtherAddr, other)
+		}
+	}
+
+	// Requests to the alternate address name the primary as its other address
+	resp, err := c.sendBindingRequest(other.String(), false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.OtherAddr.String() != primary.String() {
+		t.Errorf("other address of the alternate = %s, want %s", resp.OtherAddr, primary)
+	}
+
+	if stats := s.GetStats(); stats.Changed < 3 || stats.AuthFailures != 0 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestSTUNServerCredentials(t *testing.T) {
+	s := startSTUNServer(t, &STUNServerConfig{
+		Address:  "127.0.0.1:0",
+		Username: "bond",
+		Password: "secret",
+	})
+
+	for _, tc := range []struct {
+		username, password string
+		err                string
+	}{
+		{"", "", "STUN error 400"},
+		{"bond", "wrong", "STUN error 401"},
+		{"other", "secret", "STUN error 401"},
+	} {
+		c := newTestSTUNClient(t, s, tc.username, tc.password)
+		if _, err := c.DiscoverNATMapping(); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("credentials %q/%q: err = %v, want %s", tc.username, tc.password, err, tc.err)
+		}
+	}
+
+	// A client with credentials rejects responses it cannot verify
+	open := startSTUNServer(t, &STUNServerConfig{Address: "127.0.0.1:0"})
+	c := newTestSTUNClient(t, open, "bond", "secret")
+	if _, err := c.DiscoverNATMapping(); err == nil || !strings.Contains(err.Error(), "integrity") {
+		t.Errorf("unsigned response: err = %v", err)
+	}
+
+	if stats := s.GetStats(); stats.AuthFailures != 3 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestSTUNServerWithoutAlternate(t *testing.T) {
+	s := startSTUNServer(t, &STUNServerConfig{Address: "127.0.0.1:0"})
+	if s.OtherAddr() != nil {
+		t.Fatalf("other address = %s without an alternate", s.OtherAddr())
+	}
+
+	c := newTestSTUNClient(t, s, "", "")
+
+	resp, err := c.sendBindingRequest(s.LocalAddr().String(), false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.MappedAddr.Port != c.GetLocalAddr().Port || resp.OtherAddr != nil {
+		t.Errorf("response = %+v", resp)
+	}
+
+	if _, err := c.sendBindingRequest(s.LocalAddr().String(), true, true); err == nil || !strings.Contains(err.Error(), "STUN error 420") {
+		t.Errorf("change request: err = %v, want STUN error 420", err)
+	}
+}
@@ -0,0 +1,685 @@
+package nat
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// TURN methods (RFC 8656)
+const (
+	turnAllocate         uint16 = 0x003
+	turnRefresh          uint16 = 0x004
+	turnSend             uint16 = 0x006
+	turnData             uint16 = 0x007
+	turnCreatePermission uint16 = 0x008
+	turnChannelBind      uint16 = 0x009
+)
+
+// STUN message classes, combined with a method into a message type
+const (
+	stunClassRequest    uint16 = 0x0000
+	stunClassIndication uint16 = 0x0010
+	stunClassSuccess    uint16 = 0x0100
+	stunClassError      uint16 = 0x0110
+)
+
+// TURN attribute types
+const (
+	turnAttrChannelNumber      uint16 = 0x000C
+	turnAttrLifetime           uint16 = 0x000D
+	turnAttrXorPeerAddress     uint16 = 0x0012
+	turnAttrData               uint16 = 0x0013
+	turnAttrRealm              uint16 = 0x0014
+	turnAttrNonce              uint16 = 0x0015
+	turnAttrXorRelayedAddress  uint16 = 0x0016
+	turnAttrRequestedTransport uint16 = 0x0019
+)
+
+const (
+	// turnChannelMin and turnChannelMax bound the channel numbers
+	turnChannelMin uint16 = 0x4000
+	turnChannelMax uint16 = 0x4FFF
+	// turnPermissionLifetime is how long a permission lasts unless refreshed
+	turnPermissionLifetime = 5 * time.Minute
+	// turnChannelLifetime is how long a channel binding lasts unless refreshed
+	turnChannelLifetime = 10 * time.Minute
+	// turnRTO is the initial request retransmission timeout
+	turnRTO = 500 * time.Millisecond
+	// turnQueueSize is how many received datagrams wait to be read
+	turnQueueSize = 256
+)
+
+var (
+	// ErrTURNNotAllocated is returned when using a TURN client before Allocate
+	ErrTURNNotAllocated = errors.New("no TURN allocation")
+)
+
+// TURNError is an error response from a TURN server
+type TURNError struct {
+	Code   int
+	Reason string
+}
+
+func (e *TURNError) Error() string {
+	return fmt.Sprintf("TURN error %d: %s", e.Code, e.Reason)
+}
+
+// turnDatagram is data relayed from a peer
+type turnDatagram struct {
+	data []byte
+	from *net.UDPAddr
+}
+
+// turnChannel is a channel bound to a peer
+type turnChannel struct {
+	number uint16
+	peer   *net.UDPAddr
+	bound  time.Time
+}
+
+// TURNClient relays through a TURN server (RFC 8656), for peers that cannot
+// be reached directly or by hole punching, such as behind symmetric NAT or
+// CGNAT. It allocates a relayed address on the server with long-term
+// credentials, keeps the allocation, permissions and channels refreshed,
+// and sends to peers over ChannelData.
+//
+// The client is a net.PacketConn on the relayed address: WriteTo sends to a
+// peer through the relay, binding a channel to it first, and ReadFrom
+// returns what peers with a permission send to the relayed address. The
+// client reads the socket it is given, so nothing else may read from it.
+type TURNClient struct {
+	config *TURNConfig
+	conn   *net.UDPConn
+	server *net.UDPAddr
+
+	mu           sync.Mutex
+	realm        string
+	nonce        string
+	key          []byte // MD5(username:realm:password)
+	relayedAddr  *net.UDPAddr
+	mappedAddr   *net.UDPAddr
+	lifetime     time.Duration
+	refreshed    time.Time
+	permissions  map[string]time.Time    // Peer IP -> when installed
+	channels     map[string]*turnChannel // Peer address -> channel
+	byNumber     map[uint16]*turnChannel
+	nextChannel  uint16
+	pending      map[string]chan *stunMessage // Transaction ID -> response
+	readDeadline time.Time
+	deadlineCh   chan struct{} // Closed when the read deadline changes
+
+	bindMu    sync.Mutex // Serializes channel binds
+	incoming  chan turnDatagram
+	closed    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// NewTURNClient creates a TURN client that talks to the server over conn
+func NewTURNClient(conn *net.UDPConn, config *TURNConfig) (*TURNClient, error) {
+	if config == nil || config.Server == "" {
+		return nil, fmt.Errorf("no TURN server configured")
+	}
+
+	defaults := DefaultTURNConfig()
+	if config.Lifetime <= 0 {
+		config.Lifetime = defaults.Lifetime
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaults.Timeout
+	}
+
+	server, err := net.ResolveUDPAddr("udp4", config.Server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve TURN server: %w", err)
+	}
+
+	c := &TURNClient{
+		config:      config,
+		conn:        conn,
+		server:      server,
+		permissions: make(map[string]time.Time),
+		channels:    make(map[string]*turnChannel),
+		byNumber:    make(map[uint16]*turnChannel),
+		nextChannel: turnChannelMin,
+		pending:     make(map[string]chan *stunMessage),
+		deadlineCh:  make(chan struct{}),
+		incoming:    make(chan turnDatagram, turnQueueSize),
+		closed:      make(chan struct{}),
+	}
+
+	c.wg.Add(1)
+	go c.readLoop()
+
+	return c, nil
+}
+
+// Allocate allocates a relayed address on the server and keeps it refreshed
+func (c *TURNClient) Allocate() (*net.UDPAddr, error) {
+	if c.RelayedAddr() != nil {
+		return nil, fmt.Errorf("TURN allocation already made")
+	}
+
+	resp, err := c.transact(turnAllocate, []stunAttribute{
+		{typ: turnAttrRequestedTransport, value: []byte{17, 0, 0, 0}}, // UDP
+		{typ: turnAttrLifetime, value: encodeTURNLifetime(c.config.Lifetime)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	attr, ok := resp.attribute(turnAttrXorRelayedAddress)
+	relayed := decodeSTUNAddress(attr.value, true)
+	if !ok || relayed == nil {
+		return nil, fmt.Errorf("no relayed address in allocate response")
+	}
+
+	c.mu.Lock()
+	c.relayedAddr = relayed
+	if attr, ok := resp.attribute(stunAttrXorMappedAddress); ok {
+		c.mappedAddr = decodeSTUNAddress(attr.value, true)
+	}
+	c.lifetime = decodeTURNLifetime(resp, c.config.Lifetime)
+	c.refreshed = time.Now()
+	c.mu.Unlock()
+
+	c.wg.Add(1)
+	go c.refreshLoop()
+
+	return relayed, nil
+}
+
+// Refresh refreshes the allocation for lifetime; a lifetime of 0 releases it
+func (c *TURNClient) Refresh(lifetime time.Duration) error {
+	if c.RelayedAddr() == nil {
+		return ErrTURNNotAllocated
+	}
+
+	resp, err := c.transact(turnRefresh, []stunAttribute{
+		{typ: turnAttrLifetime, value: encodeTURNLifetime(lifetime)},
+	})
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.lifetime = decodeTURNLifetime(resp, lifetime)
+	c.refreshed = time.Now()
+	c.mu.Unlock()
+
+	return nil
+}
+
+// CreatePermission lets peers send to the relayed address. Binding a
+// channel to a peer installs its permission too.
+func (c *TURNClient) CreatePermission(peers ...*net.UDPAddr) error {
+	if c.RelayedAddr() == nil {
+		return ErrTURNNotAllocated
+	}
+
+	attributes := make([]stunAttribute, 0, len(peers))
+	for _, peer := range peers {
+		attributes = append(attributes, stunAttribute{typ: turnAttrXorPeerAddress, value: encodeSTUNAddress(peer, true)})
+	}
+	if _, err := c.transact(turnCreatePermission, attributes); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	for _, peer := range peers {
+		c.permissions[peer.IP.String()] = now
+	}
+	c.mu.Unlock()
+
+	return nil
+}
+
+// ChannelBind binds a channel to a peer, or refreshes the binding it has,
+// and returns the channel number
+func (c *TURNClient) ChannelBind(peer *net.UDPAddr) (uint16, error) {
+	if c.RelayedAddr() == nil {
+		return 0, ErrTURNNotAllocated
+	}
+
+	c.bindMu.Lock()
+	defer c.bindMu.Unlock()
+
+	c.mu.Lock()
+	number := c.nextChannel
+	if ch, exists := c.channels[peer.String()]; exists {
+		number = ch.number
+	} else if number > turnChannelMax {
+		c.mu.Unlock()
+		return 0, fmt.Errorf("no TURN channels left")
+	}
+	c.mu.Unlock()
+
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint16(value, number)
+	if _, err := c.transact(turnChannelBind, []stunAttribute{
+		{typ: turnAttrChannelNumber, value: value},
+		{typ: turnAttrXorPeerAddress, value: encodeSTUNAddress(peer, true)},
+	}); err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch, exists := c.channels[peer.String()]
+	if !exists {
+		ch = &turnChannel{number: number, peer: peer}
+		c.channels[peer.String()] = ch
+		c.byNumber[number] = ch
+		c.nextChannel++
+	}
+	ch.bound = now
+	c.permissions[peer.IP.String()] = now
+
+	return number, nil
+}
+
+// RelayedAddr returns the relayed address, or nil before Allocate
+func (c *TURNClient) RelayedAddr() *net.UDPAddr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.relayedAddr
+}
+
+// MappedAddr returns our address as the TURN server saw it
+func (c *TURNClient) MappedAddr() *net.UDPAddr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.mappedAddr
+}
+
+// ReadFrom reads data a peer sent to the relayed address
+func (c *TURNClient) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		c.mu.Lock()
+		deadline, changed := c.readDeadline, c.deadlineCh
+		c.mu.Unlock()
+
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case dg := <-c.incoming:
+			return copy(p, dg.data), dg.from, nil
+		case <-timeout:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-changed:
+			continue
+		case <-c.closed:
+			return 0, nil, net.ErrClosed
+		}
+	}
+}
+
+// WriteTo sends data to a peer through the relay, binding a channel to the
+// peer first if it has none
+func (c *TURNClient) WriteTo(p []byte, addr net.Addr) (int, error) {
+	peer, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, fmt.Errorf("not a UDP address: %v", addr)
+	}
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	c.mu.Lock()
+	ch := c.channels[peer.String()]
+	c.mu.Unlock()
+
+	number := uint16(0)
+	if ch != nil {
+		number = ch.number
+	} else {
+		var err error
+		if number, err = c.ChannelBind(peer); err != nil {
+			return 0, err
+		}
+	}
+
+	// ChannelData: channel number, length and the data
+	frame := make([]byte, 4+len(p))
+	binary.BigEndian.PutUint16(frame[0:2], number)
+	binary.BigEndian.PutUint16(frame[2:4], uint16(len(p)))
+	copy(frame[4:], p)
+
+	if _, err := c.conn.WriteToUDP(frame, c.server); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close releases the allocation and stops the client. The socket it was
+// given stays open.
+func (c *TURNClient) Close() error {
+	select {
+	case <-c.closed:
+		return nil
+	default:
+	}
+
+	if c.RelayedAddr() != nil {
+		c.Refresh(0)
+	}
+
+	c.shutdown()
+	c.conn.SetReadDeadline(time.Now())
+	c.wg.Wait()
+	c.conn.SetReadDeadline(time.Time{})
+
+	return nil
+}
+
+// shutdown marks the client closed
+func (c *TURNClient) shutdown() {
+	c.closeOnce.Do(func() { close(c.closed) })
+}
+
+// LocalAddr returns the relayed address
+func (c *TURNClient) LocalAddr() net.Addr {
+	if relayed := c.RelayedAddr(); relayed != nil {
+		return relayed
+	}
+	return c.conn.LocalAddr()
+}
+
+// SetDeadline sets the read deadline; writes do not block
+func (c *TURNClient) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for ReadFrom
+func (c *TURNClient) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	close(c.deadlineCh)
+	c.deadlineCh = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline does nothing, as writes do not block
+func (c *TURNClient) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// transact sends a request and returns the success response. It answers
+// the server's challenge for credentials and retries with a fresh nonce
+// when the one it used went stale.
+func (c *TURNClient) transact(method uint16, attributes []stunAttribute) (*stunMessage, error) {
+	for attempt := 0; attempt < 3; attempt++ {
+		c.mu.Lock()
+		key, realm, nonce := c.key, c.realm, c.nonce
+		c.mu.Unlock()
+
+		request := attributes
+		if key != nil {
+			request = append(request[:len(request):len(request)],
+				stunAttribute{typ: stunAttrUsername, value: []byte(c.config.Username)},
+				stunAttribute{typ: turnAttrRealm, value: []byte(realm)},
+				stunAttribute{typ: turnAttrNonce, value: []byte(nonce)},
+			)
+		}
+
+		resp, err := c.roundTrip(method|stunClassRequest, request, key)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.msgType == method|stunClassSuccess {
+			if key != nil && !resp.checkIntegrity(key) {
+				return nil, fmt.Errorf("invalid message integrity in TURN response")
+			}
+			return resp, nil
+		}
+		if resp.msgType != method|stunClassError {
+			return nil, fmt.Errorf("unexpected TURN response 0x%04x", resp.msgType)
+		}
+
+		attr, _ := resp.attribute(stunAttrErrorCode)
+		code, reason := decodeSTUNErrorCode(attr.value)
+
+		// 401 challenges a request without credentials; 438 means the nonce went stale
+		if (code == 401 && key == nil) || code == 438 {
+			realmAttr, hasRealm := resp.attribute(turnAttrRealm)
+			nonceAttr, hasNonce := resp.attribute(turnAttrNonce)
+			if !hasNonce || (!hasRealm && realm == "") {
+				return nil, &TURNError{Code: code, Reason: reason}
+			}
+
+			c.mu.Lock()
+			if hasRealm {
+				c.realm = string(realmAttr.value)
+			}
+			c.nonce = string(nonceAttr.value)
+			sum := md5.Sum([]byte(c.config.Username + ":" + c.realm + ":" + c.config.Password))
+			c.key = sum[:]
+			c.mu.Unlock()
+			continue
+		}
+
+		return nil, &TURNError{Code: code, Reason: reason}
+	}
+
+	return nil, fmt.Errorf("TURN request 0x%04x kept being challenged", method)
+}
+
+// roundTrip sends a request, retransmitting it until a response arrives
+func (c *TURNClient) roundTrip(msgType uint16, attributes []stunAttribute, key []byte) (*stunMessage, error) {
+	transactionID := make([]byte, 12)
+	rand.Read(transactionID)
+	request := buildSTUNMessage(msgType, transactionID, attributes, key, true)
+
+	response := make(chan *stunMessage, 1)
+	c.mu.Lock()
+	c.pending[string(transactionID)] = response
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, string(transactionID))
+		c.mu.Unlock()
+	}()
+
+	deadline := time.NewTimer(c.config.Timeout)
+	defer deadline.Stop()
+
+	for rto := turnRTO; ; rto *= 2 {
+		if _, err := c.conn.WriteToUDP(request, c.server); err != nil {
+			return nil, fmt.Errorf("failed to send TURN request: %w", err)
+		}
+
+		retransmit := time.NewTimer(rto)
+		select {
+		case resp := <-response:
+			retransmit.Stop()
+			return resp, nil
+		case <-retransmit.C:
+		case <-deadline.C:
+			retransmit.Stop()
+			return nil, fmt.Errorf("TURN request timed out")
+		case <-c.closed:
+			retransmit.Stop()
+			return nil, net.ErrClosed
+		}
+	}
+}
+
+// readLoop reads responses and relayed data from the server
+func (c *TURNClient) readLoop() {
+	defer c.wg.Done()
+
+	buffer := make([]byte, 65535)
+	for {
+		n, from, err := c.conn.ReadFromUDP(buffer)
+		if err != nil {
+			select {
+			case <-c.closed:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				c.shutdown()
+				return
+			}
+			continue
+		}
+
+		if from.IP.Equal(c.server.IP) && from.Port == c.server.Port {
+			c.handle(buffer[:n])
+		}
+	}
+}
+
+// handle dispatches a datagram from the server
+func (c *TURNClient) handle(data []byte) {
+	// ChannelData starts with a channel number, whose top bits are 01
+	if len(data) >= 4 && data[0]&0xC0 == 0x40 {
+		number := binary.BigEndian.Uint16(data[0:2])
+		length := int(binary.BigEndian.Uint16(data[2:4]))
+		if 4+length > len(data) {
+			return
+		}
+
+		c.mu.Lock()
+		ch := c.byNumber[number]
+		c.mu.Unlock()
+		if ch != nil {
+			c.deliver(data[4:4+length], ch.peer)
+		}
+		return
+	}
+
+	msg, err := parseSTUNMessage(data)
+	if err != nil {
+		return
+	}
+
+	switch msg.msgType & stunClassError {
+	case stunClassSuccess, stunClassError:
+		c.mu.Lock()
+		response := c.pending[string(msg.transactionID)]
+		c.mu.Unlock()
+		if response == nil {
+			return
+		}
+		// The buffer is reused, so the response is kept as a copy
+		copied, err := parseSTUNMessage(append([]byte(nil), data...))
+		if err != nil {
+			return
+		}
+		select {
+		case response <- copied:
+		default:
+		}
+
+	case stunClassIndication:
+		// Peers without a channel are relayed in Data indications
+		if msg.msgType != turnData|stunClassIndication {
+			return
+		}
+		peerAttr, hasPeer := msg.attribute(turnAttrXorPeerAddress)
+		dataAttr, hasData := msg.attribute(turnAttrData)
+		if peer := decodeSTUNAddress(peerAttr.value, true); hasPeer && hasData && peer != nil {
+			c.deliver(dataAttr.value, peer)
+		}
+	}
+}
+
+// deliver queues data from a peer for ReadFrom, dropping it when the queue is full
+func (c *TURNClient) deliver(data []byte, from *net.UDPAddr) {
+	select {
+	case c.incoming <- turnDatagram{data: append([]byte(nil), data...), from: from}:
+	default:
+	}
+}
+
+// refreshLoop keeps the allocation, permissions and channels from expiring
+func (c *TURNClient) refreshLoop() {
+	defer c.wg.Done()
+
+	c.mu.Lock()
+	interval := min(c.lifetime/4, 30*time.Second)
+	c.mu.Unlock()
+
+	ticker := time.NewTicker(max(interval, 100*time.Millisecond))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.closed:
+			return
+		case now := <-ticker.C:
+			c.refreshDue(now)
+		}
+	}
+}
+
+// refreshDue refreshes what would expire before the next refreshes
+func (c *TURNClient) refreshDue(now time.Time) {
+	c.mu.Lock()
+	allocationDue := now.Sub(c.refreshed) >= c.lifetime/2
+	var rebind []*net.UDPAddr
+	bound := make(map[string]bool)
+	for _, ch := range c.channels {
+		bound[ch.peer.IP.String()] = true
+		if now.Sub(ch.bound) >= turnChannelLifetime/2 {
+			rebind = append(rebind, ch.peer)
+		}
+	}
+	var permit []*net.UDPAddr
+	for ip, installed := range c.permissions {
+		if !bound[ip] && now.Sub(installed) >= turnPermissionLifetime/2 {
+			permit = append(permit, &net.UDPAddr{IP: net.ParseIP(ip)})
+		}
+	}
+	c.mu.Unlock()
+
+	if allocationDue {
+		c.Refresh(c.config.Lifetime)
+	}
+	for _, peer := range rebind {
+		c.ChannelBind(peer)
+	}
+	if len(permit) > 0 {
+		c.CreatePermission(permit...)
+	}
+}
+
+// encodeTURNLifetime encodes a LIFETIME attribute
+func encodeTURNLifetime(lifetime time.Duration) []byte {
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint32(value, uint32(lifetime/time.Second))
+	return value
+}
+
+// decodeTURNLifetime returns the LIFETIME of a response, or fallback when
+// it has none
+func decodeTURNLifetime(msg *stunMessage, fallback time.Duration) time.Duration {
+	attr, ok := msg.attribute(turnAttrLifetime)
+	if !ok || len(attr.value) != 4 {
+		return fallback
+	}
+	return time.Duration(binary.BigEndian.Uint32(attr.value)) * time.Second
+}
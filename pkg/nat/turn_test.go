@@ -0,0 +1,519 @@
+package nat
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// turnStandIn is a minimal TURN server: long-term credentials with nonces,
+// one allocation per client, permissions, channels and Data indications
+type turnStandIn struct {
+	conn     *net.UDPConn
+	realm    string
+	username string
+	password string
+
+	mu          sync.Mutex
+	nonce       int
+	allocations map[string]*turnStandInAllocation // Client address -> allocation
+	refreshes   int
+	stale       int // Requests answered with 438
+	wg          sync.WaitGroup
+}
+
+type turnStandInAllocation struct {
+	client      *net.UDPAddr
+	relay       *net.UDPConn
+	permissions map[string]bool         // Peer IP
+	channels    map[uint16]*net.UDPAddr // Channel -> peer
+	peers       map[string]uint16       // Peer address -> channel
+}
+
+func startTURNStandIn(t *testing.T, username, password string) *turnStandIn {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &turnStandIn{
+		conn:        conn,
+		realm:       "bond.test",
+		username:    username,
+		password:    password,
+		allocations: make(map[string]*turnStandInAllocation),
+	}
+
+	s.wg.Add(1)
+	go s.serve()
+
+	t.Cleanup(func() {
+		conn.Close()
+		s.mu.Lock()
+		for _, alloc := range s.allocations {
+			alloc.relay.Close()
+		}
+		s.mu.Unlock()
+		s.wg.Wait()
+	})
+	return s
+}
+
+// expireNonce makes the current nonce stale
+func (s *turnStandIn) expireNonce() {
+	s.mu.Lock()
+	s.nonce++
+	s.mu.Unlock()
+}
+
+func (s *turnStandIn) allocation(client *net.UDPAddr) *turnStandInAllocation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.allocations[client.String()]
+}
+
+func (s *turnStandIn) serve() {
+	defer s.wg.Done()
+
+	buffer := make([]byte, 65535)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		s.handle(append([]byte(nil), buffer[:n]...), addr)
+	}
+}
+
+func (s *turnStandIn) handle(data []byte, addr *net.UDPAddr) {
+	if data[0]&0xC0 == 0x40 {
+		number := binary.BigEndian.Uint16(data[0:2])
+		length := int(binary.BigEndian.Uint16(data[2:4]))
+		s.mu.Lock()
+		alloc := s.allocations[addr.String()]
+		var peer *net.UDPAddr
+		if alloc != nil {
+			peer = alloc.channels[number]
+		}
+		s.mu.Unlock()
+		if peer != nil {
+			alloc.relay.WriteToUDP(data[4:4+length], peer)
+		}
+		return
+	}
+
+	msg, err := parseSTUNMessage(data)
+	if err != nil || msg.msgType&stunClassError != stunClassRequest || !msg.checkFingerprint() {
+		return
+	}
+	method := msg.msgType &^ stunClassError
+
+	s.mu.Lock()
+	nonce := fmt.Sprintf("nonce-%d", s.nonce)
+	s.mu.Unlock()
+
+	challenge := []stunAttribute{
+		{typ: turnAttrRealm, value: []byte(s.realm)},
+		{typ: turnAttrNonce, value: []byte(nonce)},
+	}
+	username, hasUsername := msg.attribute(stunAttrUsername)
+	requestNonce, hasNonce := msg.attribute(turnAttrNonce)
+	if _, hasIntegrity := msg.attribute(stunAttrMessageIntegrity); !hasUsername || !hasNonce || !hasIntegrity {
+		s.reply(msg, method|stunClassError, addr, nil, append(challenge, stunAttribute{typ: stunAttrErrorCode, value: encodeSTUNErrorCode(401, "Unauthorized")}))
+		return
+	}
+	sum := md5.Sum([]byte(s.username + ":" + s.realm + ":" + s.password))
+	key := sum[:]
+	if string(username.value) != s.username || !msg.checkIntegrity(key) {
+		s.reply(msg, method|stunClassError, addr, nil, append(challenge, stunAttribute{typ: stunAttrErrorCode, value: encodeSTUNErrorCode(401, "Unauthorized")}))
+		return
+	}
+	if string(requestNonce.value) != nonce {
+		s.mu.Lock()
+		s.stale++
+		s.mu.Unlock()
+		s.reply(msg, method|stunClassError, addr, key, append(challenge, stunAttribute{typ: stunAttrErrorCode, value: encodeSTUNErrorCode(438, "Stale Nonce")}))
+		return
+	}
+
+	fail := func(code int, reason string) {
+		s.reply(msg, method|stunClassError, addr, key, []stunAttribute{{typ: stunAttrErrorCode, value: encodeSTUNErrorCode(code, reason)}})
+	}
+
+	alloc := s.allocation(addr)
+	if method != turnAllocate && alloc == nil {
+		fail(437, "Allocation Mismatch")
+		return
+	}
+
+	var attributes []stunAttribute
+	switch method {
+	case turnAllocate:
+		if alloc != nil {
+			fail(437, "Allocation Mismatch")
+			return
+		}
+		relay, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			fail(508, "Insufficient Capacity")
+			return
+		}
+		alloc = &turnStandInAllocation{
+			client:      addr,
+			relay:       relay,
+			permissions: make(map[string]bool),
+			channels:    make(map[uint16]*net.UDPAddr),
+			peers:       make(map[string]uint16),
+		}
+		s.mu.Lock()
+		s.allocations[addr.String()] = alloc
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go s.relayLoop(alloc)
+
+		lifetime, _ := msg.attribute(turnAttrLifetime)
+		attributes = []stunAttribute{
+			{typ: turnAttrXorRelayedAddress, value: encodeSTUNAddress(relay.LocalAddr().(*net.UDPAddr), true)},
+			{typ: stunAttrXorMappedAddress, value: encodeSTUNAddress(addr, true)},
+			{typ: turnAttrLifetime, value: lifetime.value},
+		}
+
+	case turnRefresh:
+		lifetime, _ := msg.attribute(turnAttrLifetime)
+		s.mu.Lock()
+		s.refreshes++
+		if binary.BigEndian.Uint32(lifetime.value) == 0 {
+			delete(s.allocations, addr.String())
+			alloc.relay.Close()
+		}
+		s.mu.Unlock()
+		attributes = []stunAttribute{{typ: turnAttrLifetime, value: lifetime.value}}
+
+	case turnCreatePermission:
+		s.mu.Lock()
+		for _, attr := range msg.attributes {
+			if attr.typ == turnAttrXorPeerAddress {
+				alloc.permissions[decodeSTUNAddress(attr.value, true).IP.String()] = true
+			}
+		}
+		s.mu.Unlock()
+
+	case turnChannelBind:
+		channel, _ := msg.attribute(turnAttrChannelNumber)
+		peerAttr, _ := msg.attribute(turnAttrXorPeerAddress)
+		number := binary.BigEndian.Uint16(channel.value)
+		peer := decodeSTUNAddress(peerAttr.value, true)
+		s.mu.Lock()
+		alloc.channels[number] = peer
+		alloc.peers[peer.String()] = number
+		alloc.permissions[peer.IP.String()] = true
+		s.mu.Unlock()
+
+	default:
+		fail(400, "Bad Request")
+		return
+	}
+
+	s.reply(msg, method|stunClassSuccess, addr, key, attributes)
+}
+
+func (s *turnStandIn) reply(msg *stunMessage, msgType uint16, addr *net.UDPAddr, key []byte, attributes []stunAttribute) {
+	s.conn.WriteToUDP(buildSTUNMessage(msgType, msg.transactionID, attributes, key, true), addr)
+}
+
+// relayLoop relays what peers with a permission send to the relayed address
+func (s *turnStandIn) relayLoop(alloc *turnStandInAllocation) {
+	defer s.wg.Done()
+
+	buffer := make([]byte, 65535)
+	for {
+		n, peer, err := alloc.relay.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		permitted := alloc.permissions[peer.IP.String()]
+		number, bound := alloc.peers[peer.String()]
+		s.mu.Unlock()
+
+		switch {
+		case !permitted:
+		case bound:
+			frame := binary.BigEndian.AppendUint16(nil, number)
+			frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+			s.conn.WriteToUDP(append(frame, buffer[:n]...), alloc.client)
+		default:
+			transactionID := make([]byte, 12)
+			s.conn.WriteToUDP(buildSTUNMessage(turnData|stunClassIndication, transactionID, []stunAttribute{
+				{typ: turnAttrXorPeerAddress, value: encodeSTUNAddress(peer, true)},
+				{typ: turnAttrData, value: buffer[:n]},
+			}, nil, false), alloc.client)
+		}
+	}
+}
+
+func newTestTURNClient(t *testing.T, s *turnStandIn, config *TURNConfig) *TURNClient {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	config.Server = s.conn.LocalAddr().String()
+	if config.Timeout == 0 {
+		config.Timeout = time.Second
+	}
+	c, err := NewTURNClient(conn, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func newTestPeer(t *testing.T) *net.UDPConn {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// readPeer reads a datagram a peer received, or fails after a second
+func readPeer(t *testing.T, peer *net.UDPConn) (string, *net.UDPAddr) {
+	t.Helper()
+
+	buffer := make([]byte, 1500)
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	n, from, err := peer.ReadFromUDP(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buffer[:n]), from
+}
+
+func TestTURNClientRelaysDatagrams(t *testing.T) {
+	s := startTURNStandIn(t, "bond", "secret")
+	c := newTestTURNClient(t, s, &TURNConfig{Username: "bond", Password: "secret"})
+
+	relayed, err := c.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientAddr := c.conn.LocalAddr().(*net.UDPAddr)
+	alloc := s.allocation(clientAddr)
+	if alloc == nil || relayed.String() != alloc.relay.LocalAddr().String() {
+		t.Fatalf("relayed address = %s, want the stand-in's relay socket", relayed)
+	}
+	if c.MappedAddr().String() != clientAddr.String() {
+		t.Errorf("mapped address = %s, want %s", c.MappedAddr(), clientAddr)
+	}
+
+	// Without a permission nothing reaches the client
+	peer := newTestPeer(t)
+	peer.WriteToUDP([]byte("unsolicited"), relayed)
+	buffer := make([]byte, 1500)
+	c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := c.ReadFrom(buffer); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read without permission: err = %v", err)
+	}
+	c.SetReadDeadline(time.Time{})
+
+	// Writing binds a channel and the peer sees the relayed address
+	if _, err := c.WriteTo([]byte("hello"), peer.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if data, from := readPeer(t, peer); data != "hello" || from.String() != relayed.String() {
+		t.Errorf("peer got %q from %s", data, from)
+	}
+	s.mu.Lock()
+	channels := len(alloc.channels)
+	s.mu.Unlock()
+	if channels != 1 {
+		t.Errorf("channels = %d, want one", channels)
+	}
+
+	// Replies come back over the channel
+	peer.WriteToUDP([]byte("reply"), relayed)
+	n, from, err := c.ReadFrom(buffer)
+	if err != nil || string(buffer[:n]) != "reply" || from.String() != peer.LocalAddr().String() {
+		t.Errorf("read %q from %v, err %v", buffer[:n], from, err)
+	}
+
+	// Peers with only a permission arrive in Data indications
+	other := newTestPeer(t)
+	if err := c.CreatePermission(other.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatal(err)
+	}
+	other.WriteToUDP([]byte("indicated"), relayed)
+	n, from, err = c.ReadFrom(buffer)
+	if err != nil || string(buffer[:n]) != "indicated" || from.String() != other.LocalAddr().String() {
+		t.Errorf("read %q from %v, err %v", buffer[:n], from, err)
+	}
+
+	// Closing releases the allocation
+	c.Close()
+	if s.allocation(clientAddr) != nil {
+		t.Error("allocation not released on close")
+	}
+	if _, _, err := c.ReadFrom(buffer); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("read after close: err = %v", err)
+	}
+}
+
+func TestTURNClientCredentials(t *testing.T) {
+	s := startTURNStandIn(t, "bond", "secret")
+
+	wrong := newTestTURNClient(t, s, &TURNConfig{Username: "bond", Password: "wrong"})
+	var turnErr *TURNError
+	if _, err := wrong.Allocate(); !errors.As(err, &turnErr) || turnErr.Code != 401 {
+		t.Errorf("wrong password: err = %v, want TURN error 401", err)
+	}
+
+	c := newTestTURNClient(t, s, &TURNConfig{Username: "bond", Password: "secret"})
+	if _, err := c.Allocate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A stale nonce is replaced and the request retried
+	s.expireNonce()
+	if _, err := c.ChannelBind(newTestPeer(t).LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	stale := s.stale
+	s.mu.Unlock()
+	if stale != 1 {
+		t.Errorf("stale nonce responses = %d, want 1", stale)
+	}
+}
+
+func TestTURNClientRefreshesAllocation(t *testing.T) {
+	s := startTURNStandIn(t, "bond", "secret")
+	c := newTestTURNClient(t, s, &TURNConfig{Username: "bond", Password: "secret", Lifetime: 2 * time.Second})
+
+	if _, err := c.Allocate(); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		s.mu.Lock()
+		refreshes := s.refreshes
+		s.mu.Unlock()
+		if refreshes > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("allocation never refreshed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestManagerConnectsViaTURN(t *testing.T) {
+	s := startTURNStandIn(t, "bond", "secret")
+
+	config := DefaultNATTraversalConfig()
+	config.Relay.EnableRelay = false
+	config.TURN = &TURNConfig{
+		Server:   s.conn.LocalAddr().String(),
+		Username: "bond",
+		Password: "secret",
+		Timeout:  time.Second,
+	}
+	m, err := NewManager(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.stunClient.Close()
+
+	if !m.GetTraversalCapabilities().RelayAvailable {
+		t.Error("relay not available with a TURN server")
+	}
+
+	peer := newTestPeer(t)
+	connInfo, err := m.connectViaRelay(&PeerInfo{PeerID: "peer", PublicAddr: peer.LocalAddr().(*net.UDPAddr)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		m.turnClient.Close()
+		m.turnConn.Close()
+	}()
+
+	if connInfo.Relay == nil || connInfo.Method != TraversalMethodRelay {
+		t.Fatalf("connection = %+v, want a TURN relay", connInfo)
+	}
+	if connInfo.LocalAddr.String() != connInfo.Relay.LocalAddr().String() {
+		t.Errorf("local address = %s, want the relayed address %s", connInfo.LocalAddr, connInfo.Relay.LocalAddr())
+	}
+
+	if _, err := connInfo.Relay.WriteTo([]byte("through turn"), connInfo.RemoteAddr); err != nil {
+		t.Fatal(err)
+	}
+	if data, from := readPeer(t, peer); data != "through turn" || from.String() != connInfo.LocalAddr.String() {
+		t.Errorf("peer got %q from %s", data, from)
+	}
+}
+
+func TestWANManagerRelaysFromWANAddress(t *testing.T) {
+	s := startTURNStandIn(t, "bond", "secret")
+
+	wanConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wanConn.Close()
+
+	config := DefaultNATTraversalConfig()
+	if _, err := NewWANManager(wanConn, config).Relay(); err == nil {
+		t.Error("relay allocated without a TURN server")
+	}
+
+	config.TURN = &TURNConfig{
+		Server:   s.conn.LocalAddr().String(),
+		Username: "bond",
+		Password: "secret",
+		Timeout:  time.Second,
+	}
+	m := NewWANManager(wanConn, config)
+
+	relay, err := m.Relay()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := m.Relay(); again != relay {
+		t.Error("second relay allocated")
+	}
+
+	// The allocation goes out on the WAN's address, from a socket of its own
+	local := m.turnConn.LocalAddr().(*net.UDPAddr)
+	if !local.IP.Equal(net.IPv4(127, 0, 0, 1)) || local.Port == wanConn.LocalAddr().(*net.UDPAddr).Port {
+		t.Errorf("TURN socket on %s, want its own port on the WAN's %s", local, wanConn.LocalAddr())
+	}
+
+	// Stopping releases the allocation, and none is made afterwards
+	m.Stop()
+	if m.turnClient != nil {
+		t.Error("allocation kept after stopping")
+	}
+	if _, err := m.Relay(); err == nil {
+		t.Error("relay allocated after stopping")
+	}
+}
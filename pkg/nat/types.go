@@ -4,6 +4,8 @@ package nat
 import (
 	"net"
 	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/security"
 )
 
 // NATType represents the type of NAT detected
@@ -122,6 +124,11 @@ type STUNConfig struct {
 
 	// LocalPort is the local port to bind (0 for random)
 	LocalPort int
+
+	// Username and Password are short-term credentials for servers that
+	// require MESSAGE-INTEGRITY
+	Username string
+	Password string
 }
 
 // DefaultSTUNConfig returns default STUN configuration
@@ -136,6 +143,28 @@ func DefaultSTUNConfig() *STUNConfig {
 	}
 }
 
+// STUNServerConfig contains configuration for a STUN server
+type STUNServerConfig struct {
+	// Address is the primary IP:port to answer on
+	Address string
+
+	// AlternateAddress is a second IP:port, differing in both IP and port,
+	// that enables RFC 5780 NAT behavior discovery; empty answers Binding only
+	AlternateAddress string
+
+	// Username and Password are short-term credentials requests must carry
+	// in MESSAGE-INTEGRITY; an empty password accepts any request
+	Username string
+	Password string
+}
+
+// DefaultSTUNServerConfig returns default STUN server configuration
+func DefaultSTUNServerConfig() *STUNServerConfig {
+	return &STUNServerConfig{
+		Address: "0.0.0.0:3478",
+	}
+}
+
 // HolePunchConfig contains configuration for UDP hole punching
 type HolePunchConfig struct {
 	// Timeout for hole punching attempts
@@ -177,6 +206,9 @@ type RelayConfig struct {
 
 	// PreferDirect tries direct connection first before relay
 	PreferDirect bool
+
+	// Token authenticates allocations with relay servers that require it
+	Token string
 }
 
 // DefaultRelayConfig returns default relay configuration
@@ -190,6 +222,89 @@ func DefaultRelayConfig() *RelayConfig {
 	}
 }
 
+// TURNConfig contains configuration for a TURN (RFC 8656) client
+type TURNConfig struct {
+	// Server is the TURN server address (host:port)
+	Server string
+
+	// Username and Password are the long-term credentials
+	Username string
+	Password string
+
+	// Lifetime is the allocation lifetime to request
+	Lifetime time.Duration
+
+	// Timeout for TURN transactions
+	Timeout time.Duration
+}
+
+// DefaultTURNConfig returns default TURN configuration
+func DefaultTURNConfig() *TURNConfig {
+	return &TURNConfig{
+		Lifetime: 10 * time.Minute,
+		Timeout:  5 * time.Second,
+	}
+}
+
+// BindingProbeConfig contains configuration for measuring how long the NAT
+// binding of a socket survives being idle
+type BindingProbeConfig struct {
+	// MinIdle is the first idle time tried; it doubles until a binding expires
+	MinIdle time.Duration
+
+	// MaxIdle is the longest idle time tried. Bindings that outlive it are
+	// taken to last this long.
+	MaxIdle time.Duration
+
+	// Resolution stops the search once the lifetime is known to within it
+	Resolution time.Duration
+
+	// Timeout is how long past the idle time an answer is waited for
+	Timeout time.Duration
+
+	// Interval is how long a measured lifetime holds before it is measured again
+	Interval time.Duration
+}
+
+// DefaultBindingProbeConfig returns default binding probe configuration
+func DefaultBindingProbeConfig() *BindingProbeConfig {
+	return &BindingProbeConfig{
+		MinIdle:    15 * time.Second,
+		MaxIdle:    10 * time.Minute,
+		Resolution: 5 * time.Second,
+		Timeout:    3 * time.Second,
+		Interval:   24 * time.Hour,
+	}
+}
+
+// RelayServerConfig contains configuration for a relay server
+type RelayServerConfig struct {
+	// ListenAddr is the UDP address to listen on
+	ListenAddr string
+
+	// MaxBandwidth each allocation may relay (bytes/sec), 0 for no limit
+	MaxBandwidth uint64
+
+	// AllocationTimeout expires allocations idle for this long
+	AllocationTimeout time.Duration
+
+	// MaxAllocations limits simultaneous allocations, 0 for no limit
+	MaxAllocations int
+
+	// Authenticator verifies allocation tokens; nil allows anyone to allocate
+	Authenticator *security.Authenticator
+}
+
+// DefaultRelayServerConfig returns default relay server configuration
+func DefaultRelayServerConfig() *RelayServerConfig {
+	return &RelayServerConfig{
+		ListenAddr:        "0.0.0.0:3479",
+		MaxBandwidth:      10 * 1024 * 1024, // Matches DefaultRelayConfig
+		AllocationTimeout: 5 * time.Minute,
+		MaxAllocations:    1000,
+	}
+}
+
 // PeerInfo contains information about a peer for NAT traversal
 type PeerInfo struct {
 	// PeerID is unique identifier for the peer
@@ -204,6 +319,9 @@ type PeerInfo struct {
 	// NATType is the peer's NAT type
 	NATType NATType
 
+	// RelayID is the peer's relay allocation, exchanged via signaling
+	RelayID string
+
 	// LastSeen is when we last heard from this peer
 	LastSeen time.Time
 }
@@ -269,6 +387,10 @@ type ConnectionInfo struct {
 
 	// RTT is round-trip time
 	RTT time.Duration
+
+	// Relay carries traffic to RemoteAddr when the connection is relayed
+	// through a TURN allocation; nil otherwise
+	Relay net.PacketConn
 }
 
 // CGNATConfig contains configuration for CGNAT detection and handling
@@ -332,6 +454,14 @@ type NATTraversalConfig struct {
 	HolePunch *HolePunchConfig
 	Relay     *RelayConfig
 	CGNAT     *CGNATConfig
+
+	// TURN, when set, relays through a standard TURN server, ahead of the
+	// RELAY: protocol server
+	TURN *TURNConfig
+
+	// Binding, when set, measures how long NAT bindings survive idle with
+	// the peer's help, and keeps them alive accordingly
+	Binding *BindingProbeConfig
 }
 
 // DefaultNATTraversalConfig returns default NAT traversal configuration
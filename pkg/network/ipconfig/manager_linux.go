@@ -598,7 +598,17 @@ func (m *LinuxManager) SetDNS(interfaceName string, servers []string) error {
 
 // GetDNS gets DNS servers for an interface
 func (m *LinuxManager) GetDNS(interfaceName string) ([]string, error) {
-	return m.readResolvConf()
+	servers, err := m.readResolvConf()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]string, 0, len(servers))
+	for _, server := range servers {
+		result = append(result, server.String())
+	}
+
+	return result, nil
 }
 
 // RenewDHCP renews DHCP lease for an interface
@@ -0,0 +1,93 @@
+package tun
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/network/ipconfig"
+)
+
+// Device is a layer-3 tunnel device carrying raw IP packets.
+// Each Read returns exactly one packet and each Write injects exactly one packet.
+type Device interface {
+	// Name returns the system interface name
+	Name() string
+
+	// MTU returns the configured MTU
+	MTU() int
+
+	// Read reads a single IP packet from the device
+	Read(buf []byte) (int, error)
+
+	// Write writes a single IP packet to the device
+	Write(packet []byte) (int, error)
+
+	// Close closes the device, unblocking pending reads
+	Close() error
+}
+
+// MTUSetter is implemented by devices whose MTU can be changed while open
+type MTUSetter interface {
+	// SetMTU changes the MTU of the interface
+	SetMTU(mtu int) error
+}
+
+// newPlatformDevice is implemented by platform-specific files
+// (device_init_linux.go, device_init_windows.go, device_init_darwin.go)
+
+// Open creates and opens a TUN device
+func Open(config *Config) (Device, error) {
+	if config == nil {
+		config = DefaultConfig()
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	if config.MTU == 0 {
+		config.MTU = DefaultMTU
+	}
+
+	return newPlatformDevice(config)
+}
+
+// Configure assigns the tunnel address and MTU to a device through the IP configuration manager
+func Configure(mgr ipconfig.Manager, dev Device, config *Config) error {
+	if mgr == nil {
+		return fmt.Errorf("IP configuration manager cannot be nil")
+	}
+
+	ipCfg := &ipconfig.IPConfig{
+		InterfaceName: dev.Name(),
+		IPv4Method:    ipconfig.ConfigMethodNone,
+		IPv6Method:    ipconfig.ConfigMethodNone,
+		GatewayMethod: ipconfig.GatewayMethodDisable,
+		DNSMethod:     ipconfig.DNSMethodNone,
+		MTU:           dev.MTU(),
+	}
+
+	if config.Address != "" {
+		ip, ipNet, err := net.ParseCIDR(config.Address)
+		if err != nil {
+			return ErrInvalidAddress
+		}
+		prefixLen, _ := ipNet.Mask.Size()
+
+		if ip.To4() != nil {
+			ipCfg.IPv4Method = ipconfig.ConfigMethodStatic
+			ipCfg.IPv4Address = ip.String()
+			ipCfg.IPv4CIDR = prefixLen
+		} else {
+			ipCfg.IPv6Method = ipconfig.ConfigMethodStatic
+			ipCfg.IPv6Address = ip.String()
+			ipCfg.IPv6CIDR = prefixLen
+		}
+	}
+
+	if err := mgr.Apply(ipCfg); err != nil {
+		return fmt.Errorf("failed to configure %s: %w", dev.Name(), err)
+	}
+
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build darwin
+// +build darwin
+
+package tun
+
+// newPlatformDevice is not yet implemented on darwin
+func newPlatformDevice(config *Config) (Device, error) {
+	return nil, ErrNotSupported
+}
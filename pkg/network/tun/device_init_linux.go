@@ -0,0 +1,9 @@
+//go:build linux
+// +build linux
+
+package tun
+
+// newPlatformDevice creates the Linux-specific TUN device
+func newPlatformDevice(config *Config) (Device, error) {
+	return openLinuxDevice(config)
+}
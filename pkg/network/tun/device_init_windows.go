@@ -0,0 +1,9 @@
+//go:build windows
+// +build windows
+
+package tun
+
+// newPlatformDevice is not yet implemented on windows
+func newPlatformDevice(config *Config) (Device, error) {
+	return nil, ErrNotSupported
+}
@@ -0,0 +1,125 @@
+//go:build linux
+// +build linux
+
+package tun
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+const cloneDevicePath = "/dev/net/tun"
+
+// LinuxDevice implements a TUN device on Linux using /dev/net/tun
+type LinuxDevice struct {
+	file *os.File
+	name string
+	mtu  atomic.Int32
+}
+
+// openLinuxDevice opens /dev/net/tun and attaches it to a new TUN interface
+func openLinuxDevice(config *Config) (*LinuxDevice, error) {
+	fd, err := unix.Open(cloneDevicePath, unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		if errors.Is(err, unix.EACCES) || errors.Is(err, unix.EPERM) {
+			return nil, ErrPermissionDenied
+		}
+		return nil, fmt.Errorf("failed to open %s: %w", cloneDevicePath, err)
+	}
+
+	ifr, err := unix.NewIfreq(config.Name)
+	if err != nil {
+		unix.Close(fd)
+		return nil, ErrInvalidName
+	}
+
+	// Layer 3 device without the 4-byte packet information header
+	ifr.SetUint16(unix.IFF_TUN | unix.IFF_NO_PI)
+
+	if err := unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		unix.Close(fd)
+		if errors.Is(err, unix.EPERM) {
+			return nil, ErrPermissionDenied
+		}
+		return nil, fmt.Errorf("failed to create TUN interface: %w", err)
+	}
+
+	// Non-blocking mode lets the runtime poller unblock Read on Close
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to set non-blocking mode: %w", err)
+	}
+
+	dev := &LinuxDevice{
+		file: os.NewFile(uintptr(fd), cloneDevicePath),
+		name: ifr.Name(),
+	}
+	dev.mtu.Store(int32(config.MTU))
+	return dev, nil
+}
+
+// Name returns the system interface name
+func (d *LinuxDevice) Name() string {
+	return d.name
+}
+
+// MTU returns the configured MTU
+func (d *LinuxDevice) MTU() int {
+	return int(d.mtu.Load())
+}
+
+// SetMTU changes the MTU of the interface
+func (d *LinuxDevice) SetMTU(mtu int) error {
+	if mtu < MinMTU || mtu > MaxMTU {
+		return ErrInvalidMTU
+	}
+
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open control socket: %w", err)
+	}
+	defer unix.Close(fd)
+
+	ifr, err := unix.NewIfreq(d.name)
+	if err != nil {
+		return ErrInvalidName
+	}
+	ifr.SetUint32(uint32(mtu))
+
+	if err := unix.IoctlIfreq(fd, unix.SIOCSIFMTU, ifr); err != nil {
+		if errors.Is(err, unix.EPERM) {
+			return ErrPermissionDenied
+		}
+		return fmt.Errorf("failed to set MTU: %w", err)
+	}
+
+	d.mtu.Store(int32(mtu))
+	return nil
+}
+
+// Read reads a single IP packet from the device
+func (d *LinuxDevice) Read(buf []byte) (int, error) {
+	n, err := d.file.Read(buf)
+	if errors.Is(err, os.ErrClosed) {
+		return 0, ErrDeviceClosed
+	}
+	return n, err
+}
+
+// Write writes a single IP packet to the device
+func (d *LinuxDevice) Write(packet []byte) (int, error) {
+	n, err := d.file.Write(packet)
+	if errors.Is(err, os.ErrClosed) {
+		return 0, ErrDeviceClosed
+	}
+	return n, err
+}
+
+// Close closes the device
+func (d *LinuxDevice) Close() error {
+	return d.file.Close()
+}
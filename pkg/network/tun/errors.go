@@ -0,0 +1,23 @@
+package tun
+
+import "errors"
+
+var (
+	// ErrNotSupported is returned when TUN devices are not supported on this platform
+	ErrNotSupported = errors.New("TUN devices not supported on this platform")
+
+	// ErrPermissionDenied is returned when opening the TUN device requires root/admin privileges
+	ErrPermissionDenied = errors.New("TUN device requires administrator privileges")
+
+	// ErrInvalidName is returned when the interface name is too long
+	ErrInvalidName = errors.New("invalid TUN interface name")
+
+	// ErrInvalidAddress is returned when the tunnel address is not a valid CIDR
+	ErrInvalidAddress = errors.New("invalid tunnel address (expected CIDR, e.g. 10.200.0.2/24)")
+
+	// ErrInvalidMTU is returned when the MTU is out of range
+	ErrInvalidMTU = errors.New("invalid MTU (must be between 576 and 9000)")
+
+	// ErrDeviceClosed is returned when reading from or writing to a closed device
+	ErrDeviceClosed = errors.New("TUN device closed")
+)
@@ -0,0 +1,47 @@
+package tun
+
+import (
+	"net"
+)
+
+// Default values for TUN devices
+const (
+	DefaultName = "mwb0"
+	DefaultMTU  = 1400
+	MinMTU      = 576
+	MaxMTU      = 9000
+)
+
+// Config represents TUN device configuration
+type Config struct {
+	Name    string // Interface name (e.g., "mwb0"); empty lets the kernel choose
+	Address string // Tunnel address in CIDR notation (e.g., "10.200.0.2/24")
+	MTU     int    // MTU of the tunnel interface
+}
+
+// DefaultConfig returns a default TUN configuration
+func DefaultConfig() *Config {
+	return &Config{
+		Name: DefaultName,
+		MTU:  DefaultMTU,
+	}
+}
+
+// Validate validates the TUN configuration
+func (c *Config) Validate() error {
+	if len(c.Name) >= 16 {
+		return ErrInvalidName
+	}
+
+	if c.MTU != 0 && (c.MTU < MinMTU || c.MTU > MaxMTU) {
+		return ErrInvalidMTU
+	}
+
+	if c.Address != "" {
+		if _, _, err := net.ParseCIDR(c.Address); err != nil {
+			return ErrInvalidAddress
+		}
+	}
+
+	return nil
+}
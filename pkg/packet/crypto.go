@@ -0,0 +1,122 @@
+package packet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+)
+
+const (
+	// headerLen is the encoded header size, without the trailing checksum
+	headerLen = 34
+	// flagsOffset, timestampOffset and dataLenOffset locate header fields in
+	// an encoded packet
+	flagsOffset     = 2
+	timestampOffset = 20
+	dataLenOffset   = 30
+)
+
+// AEAD seals and opens packet payloads.
+// The associated data passed in is the encoded packet header.
+type AEAD interface {
+	Overhead() int
+	Seal(ad, plaintext []byte) ([]byte, error)
+	Open(ad, sealed []byte) ([]byte, error)
+}
+
+// SentAEAD is an AEAD that rejects stale packets. Open passes it the send
+// time from the packet header, which the header authenticates.
+type SentAEAD interface {
+	AEAD
+	OpenSent(ad, sealed []byte, sent time.Time) ([]byte, error)
+}
+
+// Seal encrypts the payload of an encoded packet.
+// The header is sent in the clear with FlagEncrypted set and is authenticated
+// as associated data, so any change to it makes the packet fail to open.
+func Seal(aead AEAD, encoded []byte) ([]byte, error) {
+	dataLen, err := encodedDataLen(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, headerLen, headerLen+dataLen+aead.Overhead()+4)
+	copy(out, encoded[:headerLen])
+
+	flags := binary.BigEndian.Uint16(out[flagsOffset:]) | protocol.FlagEncrypted
+	binary.BigEndian.PutUint16(out[flagsOffset:], flags)
+	binary.BigEndian.PutUint32(out[dataLenOffset:], uint32(dataLen+aead.Overhead()))
+
+	sealed, err := aead.Seal(out[:headerLen], encoded[headerLen:headerLen+dataLen])
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) != dataLen+aead.Overhead() {
+		return nil, fmt.Errorf("unexpected sealed length: %d", len(sealed))
+	}
+
+	out = append(out, sealed...)
+	out = binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(out))
+
+	return out, nil
+}
+
+// Open authenticates and decrypts a packet produced by Seal.
+// It returns the encoded plaintext packet, ready for Decode.
+func Open(aead AEAD, wire []byte) ([]byte, error) {
+	dataLen, err := encodedDataLen(wire)
+	if err != nil {
+		return nil, err
+	}
+
+	flags := binary.BigEndian.Uint16(wire[flagsOffset:])
+	if flags&protocol.FlagEncrypted == 0 {
+		return nil, fmt.Errorf("packet is not encrypted")
+	}
+
+	var plaintext []byte
+	if sentAEAD, ok := aead.(SentAEAD); ok {
+		sent := time.Unix(0, int64(binary.BigEndian.Uint64(wire[timestampOffset:])))
+		plaintext, err = sentAEAD.OpenSent(wire[:headerLen], wire[headerLen:headerLen+dataLen], sent)
+	} else {
+		plaintext, err = aead.Open(wire[:headerLen], wire[headerLen:headerLen+dataLen])
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, headerLen, headerLen+len(plaintext)+4)
+	copy(out, wire[:headerLen])
+	binary.BigEndian.PutUint16(out[flagsOffset:], flags&^protocol.FlagEncrypted)
+	binary.BigEndian.PutUint32(out[dataLenOffset:], uint32(len(plaintext)))
+
+	out = append(out, plaintext...)
+	out = binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(out))
+
+	return out, nil
+}
+
+// IsEncrypted reports whether an encoded packet has FlagEncrypted set
+func IsEncrypted(encoded []byte) bool {
+	if len(encoded) < headerLen {
+		return false
+	}
+	return binary.BigEndian.Uint16(encoded[flagsOffset:])&protocol.FlagEncrypted != 0
+}
+
+// encodedDataLen validates the framing of an encoded packet and returns its data length
+func encodedDataLen(encoded []byte) (int, error) {
+	if len(encoded) < headerLen+4 {
+		return 0, fmt.Errorf("packet too small: %d bytes", len(encoded))
+	}
+
+	dataLen := int(binary.BigEndian.Uint32(encoded[dataLenOffset:]))
+	if dataLen > len(encoded)-headerLen-4 {
+		return 0, fmt.Errorf("invalid data length: %d", dataLen)
+	}
+
+	return dataLen, nil
+}
@@ -0,0 +1,170 @@
+package packet
+
+import (
+	"sync"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+)
+
+// DefaultDuplicateWindow is the default number of sequence IDs tracked for duplicates
+const DefaultDuplicateWindow = 4096
+
+// DuplicateStats contains duplicate counters for one WAN
+type DuplicateStats struct {
+	Accepted   uint64 // Copies credited as the delivered packet
+	Suppressed uint64 // Redundant copies dropped
+}
+
+// duplicateSlot records which copy of a packet is credited as delivered
+type duplicateSlot struct {
+	wanID     uint8
+	score     int64
+	recovered bool // Rebuilt by FEC; no WAN is credited
+}
+
+// DuplicateWindow suppresses extra copies of packets sent on several WANs.
+// Like the IPsec and WireGuard anti-replay windows, it is a bitmap sliding
+// over sequence IDs, so memory stays fixed however many packets pass through.
+// Sequence IDs that have fallen behind the window count as duplicates.
+//
+// Copies of a packet carry the same payload, so the first copy to arrive is
+// always the one delivered; holding it back for a better copy would only add
+// delay. DuplicateMode decides which WAN is credited with the packet and
+// which copies count as suppressed: with DuplicateKeepFirst the first
+// arrival, with DuplicateKeepFastest and DuplicateKeepBest the copy with the
+// lowest score passed to Accept.
+type DuplicateWindow struct {
+	mu      sync.Mutex
+	mode    protocol.DuplicateMode
+	size    uint64
+	highest uint64
+	bitmap  []uint64
+	slots   []duplicateSlot
+	stats   map[uint8]*DuplicateStats
+}
+
+// NewDuplicateWindow creates a duplicate window covering size sequence IDs
+func NewDuplicateWindow(size int, mode protocol.DuplicateMode) *DuplicateWindow {
+	if size < 64 {
+		size = 64
+	}
+	words := (size + 63) / 64
+
+	return &DuplicateWindow{
+		mode:   mode,
+		size:   uint64(words * 64),
+		bitmap: make([]uint64, words),
+		slots:  make([]duplicateSlot, words*64),
+		stats:  make(map[uint8]*DuplicateStats),
+	}
+}
+
+// SetMode changes how copies are credited
+func (w *DuplicateWindow) SetMode(mode protocol.DuplicateMode) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.mode = mode
+}
+
+// Mode returns how copies are credited
+func (w *DuplicateWindow) Mode() protocol.DuplicateMode {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.mode
+}
+
+// Accept records a copy of seq received on wanID and reports whether it is
+// the first copy. score ranks copies for DuplicateKeepFastest and
+// DuplicateKeepBest; lower is better.
+func (w *DuplicateWindow) Accept(seq uint64, wanID uint8, score int64) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	stats := w.wanStats(wanID)
+
+	if !w.advance(seq) {
+		stats.Suppressed++
+
+		// Move the credit to this copy if it ranks better
+		slot := &w.slots[seq%w.size]
+		if w.mode != protocol.DuplicateKeepFirst && w.inWindow(seq) && !slot.recovered && score < slot.score {
+			previous := w.wanStats(slot.wanID)
+			previous.Accepted--
+			previous.Suppressed++
+			stats.Suppressed--
+			stats.Accepted++
+			slot.wanID, slot.score = wanID, score
+		}
+		return false
+	}
+
+	w.slots[seq%w.size] = duplicateSlot{wanID: wanID, score: score}
+	stats.Accepted++
+	return true
+}
+
+// Mark records seq as received without crediting a WAN, for packets rebuilt
+// by FEC. It reports whether seq was new.
+func (w *DuplicateWindow) Mark(seq uint64) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.advance(seq) {
+		return false
+	}
+	w.slots[seq%w.size] = duplicateSlot{recovered: true}
+	return true
+}
+
+// Stats returns the duplicate counters of every WAN
+func (w *DuplicateWindow) Stats() map[uint8]DuplicateStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	stats := make(map[uint8]DuplicateStats, len(w.stats))
+	for id, s := range w.stats {
+		stats[id] = *s
+	}
+	return stats
+}
+
+// advance marks seq as seen, sliding the window forward if needed, and
+// reports whether it was new
+func (w *DuplicateWindow) advance(seq uint64) bool {
+	if seq == 0 || !w.inWindow(seq) || (seq <= w.highest && w.isSet(seq)) {
+		return false
+	}
+
+	if seq > w.highest {
+		// Clear the slots the window slides over
+		if seq-w.highest >= w.size {
+			clear(w.bitmap)
+		} else {
+			for s := w.highest + 1; s <= seq; s++ {
+				w.bitmap[(s%w.size)/64] &^= 1 << (s % 64)
+			}
+		}
+		w.highest = seq
+	}
+
+	w.bitmap[(seq%w.size)/64] |= 1 << (seq % 64)
+	return true
+}
+
+// inWindow reports whether seq is ahead of or inside the window
+func (w *DuplicateWindow) inWindow(seq uint64) bool {
+	return seq > w.highest || w.highest-seq < w.size
+}
+
+func (w *DuplicateWindow) isSet(seq uint64) bool {
+	return w.bitmap[(seq%w.size)/64]&(1<<(seq%64)) != 0
+}
+
+func (w *DuplicateWindow) wanStats(wanID uint8) *DuplicateStats {
+	stats, exists := w.stats[wanID]
+	if !exists {
+		stats = &DuplicateStats{}
+		w.stats[wanID] = stats
+	}
+	return stats
+}
@@ -0,0 +1,100 @@
+package packet
+
+import (
+	"testing"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+)
+
+func TestDuplicateWindowSuppressesCopies(t *testing.T) {
+	w := NewDuplicateWindow(128, protocol.DuplicateKeepFirst)
+
+	for seq := uint64(1); seq <= 10; seq++ {
+		if !w.Accept(seq, 1, 0) {
+			t.Fatalf("first copy of %d rejected", seq)
+		}
+		if w.Accept(seq, 2, 0) {
+			t.Fatalf("second copy of %d accepted", seq)
+		}
+	}
+
+	// Out of order but inside the window
+	if !w.Accept(200, 1, 0) || !w.Accept(150, 2, 0) || w.Accept(150, 1, 0) {
+		t.Fatal("out-of-order packets handled wrongly")
+	}
+
+	// Behind the window
+	if w.Accept(50, 1, 0) {
+		t.Fatal("packet behind the window accepted")
+	}
+
+	stats := w.Stats()
+	if stats[1].Accepted != 11 || stats[1].Suppressed != 2 {
+		t.Fatalf("WAN 1 stats = %+v", stats[1])
+	}
+	if stats[2].Accepted != 1 || stats[2].Suppressed != 10 {
+		t.Fatalf("WAN 2 stats = %+v", stats[2])
+	}
+}
+
+func TestDuplicateWindowSlides(t *testing.T) {
+	w := NewDuplicateWindow(64, protocol.DuplicateKeepFirst)
+
+	for seq := uint64(1); seq <= 1000; seq++ {
+		if !w.Accept(seq, 1, 0) {
+			t.Fatalf("packet %d rejected", seq)
+		}
+	}
+	for seq := uint64(1); seq <= 1000; seq++ {
+		if w.Accept(seq, 2, 0) {
+			t.Fatalf("copy of %d accepted", seq)
+		}
+	}
+
+	// A jump clears the whole window
+	if !w.Accept(5000, 1, 0) || !w.Accept(4999, 1, 0) {
+		t.Fatal("packets after a jump rejected")
+	}
+}
+
+func TestDuplicateWindowCreditsBestCopy(t *testing.T) {
+	tests := []struct {
+		mode     protocol.DuplicateMode
+		credited uint8
+	}{
+		{protocol.DuplicateKeepFirst, 1},
+		{protocol.DuplicateKeepFastest, 2},
+		{protocol.DuplicateKeepBest, 2},
+	}
+
+	for _, tt := range tests {
+		w := NewDuplicateWindow(64, tt.mode)
+
+		// The first copy arrives on WAN 1, a better one on WAN 2
+		if !w.Accept(1, 1, 20) {
+			t.Fatal("first copy rejected")
+		}
+		if w.Accept(1, 2, 10) {
+			t.Fatal("second copy accepted")
+		}
+
+		stats := w.Stats()
+		if stats[tt.credited].Accepted != 1 || stats[tt.credited].Suppressed != 0 {
+			t.Fatalf("mode %d: WAN %d stats = %+v", tt.mode, tt.credited, stats[tt.credited])
+		}
+	}
+}
+
+func TestDuplicateWindowMark(t *testing.T) {
+	w := NewDuplicateWindow(64, protocol.DuplicateKeepBest)
+
+	if !w.Mark(3) || w.Mark(3) {
+		t.Fatal("recovered packet marked wrongly")
+	}
+	if w.Accept(3, 1, 0) {
+		t.Fatal("copy of a recovered packet accepted")
+	}
+	if stats := w.Stats(); stats[1].Accepted != 0 || stats[1].Suppressed != 1 {
+		t.Fatalf("WAN 1 stats = %+v", stats[1])
+	}
+}
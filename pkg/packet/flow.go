@@ -0,0 +1,181 @@
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+)
+
+// IP protocol numbers the flow parser understands
+const (
+	ipProtoHopByHop = 0
+	ipProtoICMP     = 1
+	ipProtoTCP      = 6
+	ipProtoUDP      = 17
+	ipProtoRouting  = 43
+	ipProtoFragment = 44
+	ipProtoAH       = 51
+	ipProtoICMPv6   = 58
+	ipProtoDestOpts = 60
+	ipProtoMobility = 135
+	ipProtoHIP      = 139
+	ipProtoShim6    = 140
+)
+
+var (
+	// ErrNotIP packet is neither IPv4 nor IPv6
+	ErrNotIP = errors.New("not an IP packet")
+	// ErrTruncatedIP packet ends inside a header
+	ErrTruncatedIP = errors.New("truncated IP packet")
+)
+
+// ParseFlow fills key with the 5-tuple of a tunneled IPv4 or IPv6 packet and
+// returns the transport payload. IPv6 extension headers are skipped.
+//
+// Ports are left zero for every fragment of a fragmented datagram, the first
+// one included, so all fragments share the flow of their datagram. ICMP and
+// ICMPv6 echo messages use the echo identifier as both ports; other ICMP
+// messages and protocols without ports have zero ports.
+//
+// The addresses in key point into pkt, so ParseFlow does not allocate; copy
+// them before keeping key beyond the lifetime of pkt.
+func ParseFlow(pkt []byte, key *protocol.FlowKey) ([]byte, error) {
+	if len(pkt) < 1 {
+		return nil, ErrTruncatedIP
+	}
+
+	var transport []byte
+	var fragmented bool
+
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < 20 {
+			return nil, ErrTruncatedIP
+		}
+		headerLen := int(pkt[0]&0x0f) * 4
+		if headerLen < 20 || headerLen > len(pkt) {
+			return nil, ErrTruncatedIP
+		}
+
+		key.SrcIP = net.IP(pkt[12:16])
+		key.DstIP = net.IP(pkt[16:20])
+		key.Protocol = pkt[9]
+		fragmented = binary.BigEndian.Uint16(pkt[6:8])&0x3fff != 0 // More fragments or an offset
+		transport = pkt[headerLen:]
+
+	case 6:
+		if len(pkt) < 40 {
+			return nil, ErrTruncatedIP
+		}
+
+		key.SrcIP = net.IP(pkt[8:24])
+		key.DstIP = net.IP(pkt[24:40])
+
+		next := pkt[6]
+		rest := pkt[40:]
+	headers:
+		for {
+			var headerLen int
+			switch next {
+			case ipProtoHopByHop, ipProtoRouting, ipProtoDestOpts, ipProtoMobility, ipProtoHIP, ipProtoShim6:
+				if len(rest) < 8 {
+					return nil, ErrTruncatedIP
+				}
+				headerLen = (int(rest[1]) + 1) * 8
+
+			case ipProtoFragment:
+				if len(rest) < 8 {
+					return nil, ErrTruncatedIP
+				}
+				headerLen = 8
+				fragmented = binary.BigEndian.Uint16(rest[2:4])&0xfff9 != 0 // Offset or more fragments
+
+			case ipProtoAH:
+				if len(rest) < 8 {
+					return nil, ErrTruncatedIP
+				}
+				headerLen = (int(rest[1]) + 2) * 4
+
+			default:
+				break headers
+			}
+
+			if headerLen > len(rest) {
+				return nil, ErrTruncatedIP
+			}
+			next = rest[0]
+			rest = rest[headerLen:]
+		}
+
+		key.Protocol = next
+		transport = rest
+
+	default:
+		return nil, ErrNotIP
+	}
+
+	key.SrcPort, key.DstPort = 0, 0
+	if fragmented {
+		return transport, nil
+	}
+
+	switch key.Protocol {
+	case ipProtoTCP:
+		if len(transport) < 20 {
+			return nil, ErrTruncatedIP
+		}
+		key.SrcPort = binary.BigEndian.Uint16(transport[0:2])
+		key.DstPort = binary.BigEndian.Uint16(transport[2:4])
+		dataOffset := int(transport[12]>>4) * 4
+		if dataOffset < 20 || dataOffset > len(transport) {
+			return nil, ErrTruncatedIP
+		}
+		return transport[dataOffset:], nil
+
+	case ipProtoUDP:
+		if len(transport) < 8 {
+			return nil, ErrTruncatedIP
+		}
+		key.SrcPort = binary.BigEndian.Uint16(transport[0:2])
+		key.DstPort = binary.BigEndian.Uint16(transport[2:4])
+		return transport[8:], nil
+
+	case ipProtoICMP, ipProtoICMPv6:
+		if len(transport) < 8 {
+			return nil, ErrTruncatedIP
+		}
+		if isICMPEcho(key.Protocol, transport[0]) {
+			key.SrcPort = binary.BigEndian.Uint16(transport[4:6])
+			key.DstPort = key.SrcPort
+		}
+		return transport[8:], nil
+	}
+
+	return transport, nil
+}
+
+// DSCP returns the DiffServ code point of an IPv4 or IPv6 packet, or 0 when
+// pkt is neither
+func DSCP(pkt []byte) uint8 {
+	if len(pkt) < 2 {
+		return 0
+	}
+	switch pkt[0] >> 4 {
+	case 4:
+		return pkt[1] >> 2
+	case 6:
+		trafficClass := pkt[0]<<4 | pkt[1]>>4
+		return trafficClass >> 2
+	}
+	return 0
+}
+
+// isICMPEcho reports whether an ICMP or ICMPv6 type is an echo request or reply
+func isICMPEcho(proto, icmpType uint8) bool {
+	if proto == ipProtoICMP {
+		return icmpType == 0 || icmpType == 8
+	}
+	return icmpType == 128 || icmpType == 129
+}
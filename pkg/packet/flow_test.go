@@ -0,0 +1,201 @@
+package packet
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+)
+
+var (
+	flowSrc4 = net.IPv4(10, 0, 0, 1).To4()
+	flowDst4 = net.IPv4(1, 1, 1, 1).To4()
+	flowSrc6 = net.ParseIP("2001:db8::1")
+	flowDst6 = net.ParseIP("2001:db8::2")
+)
+
+// ipv4Packet builds an IPv4 packet around a transport header and payload
+func ipv4Packet(proto uint8, fragment uint16, transport []byte) []byte {
+	pkt := make([]byte, 20+len(transport))
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+	binary.BigEndian.PutUint16(pkt[6:], fragment)
+	pkt[8] = 64
+	pkt[9] = proto
+	copy(pkt[12:], flowSrc4)
+	copy(pkt[16:], flowDst4)
+	copy(pkt[20:], transport)
+	return pkt
+}
+
+// ipv6Packet builds an IPv6 packet; headers are the extension headers and
+// transport header, each starting with its next header byte where it has one
+func ipv6Packet(next uint8, headers ...[]byte) []byte {
+	pkt := make([]byte, 40)
+	pkt[0] = 0x60
+	pkt[6] = next
+	pkt[7] = 64
+	copy(pkt[8:], flowSrc6)
+	copy(pkt[24:], flowDst6)
+	for _, h := range headers {
+		pkt = append(pkt, h...)
+	}
+	binary.BigEndian.PutUint16(pkt[4:], uint16(len(pkt)-40))
+	return pkt
+}
+
+func udpHeader(srcPort, dstPort uint16, payload string) []byte {
+	h := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint16(h[0:], srcPort)
+	binary.BigEndian.PutUint16(h[2:], dstPort)
+	return append(h, payload...)
+}
+
+func tcpHeader(srcPort, dstPort uint16, payload string) []byte {
+	h := make([]byte, 24, 24+len(payload)) // With 4 bytes of options
+	binary.BigEndian.PutUint16(h[0:], srcPort)
+	binary.BigEndian.PutUint16(h[2:], dstPort)
+	h[12] = 6 << 4
+	return append(h, payload...)
+}
+
+func icmpEcho(icmpType uint8, id uint16) []byte {
+	h := make([]byte, 8)
+	h[0] = icmpType
+	binary.BigEndian.PutUint16(h[4:], id)
+	return h
+}
+
+func TestParseFlow(t *testing.T) {
+	hopByHop := []byte{ipProtoDestOpts, 0, 0, 0, 0, 0, 0, 0}
+	destOpts := []byte{ipProtoUDP, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0} // 16 bytes
+	firstFragment := []byte{ipProtoUDP, 0, 0, 1, 0, 0, 0, 1}                    // Offset 0, more fragments
+	lastFragment := []byte{ipProtoUDP, 0, 0, 8, 0, 0, 0, 1}                     // Offset 1
+	atomicFragment := []byte{ipProtoUDP, 0, 0, 0, 0, 0, 0, 1}
+
+	tests := []struct {
+		name    string
+		pkt     []byte
+		want    protocol.FlowKey
+		payload string
+	}{
+		{"IPv4 TCP", ipv4Packet(ipProtoTCP, 0, tcpHeader(40000, 443, "hello")),
+			protocol.FlowKey{SrcIP: flowSrc4, DstIP: flowDst4, SrcPort: 40000, DstPort: 443, Protocol: ipProtoTCP}, "hello"},
+		{"IPv4 UDP", ipv4Packet(ipProtoUDP, 0, udpHeader(5353, 53, "query")),
+			protocol.FlowKey{SrcIP: flowSrc4, DstIP: flowDst4, SrcPort: 5353, DstPort: 53, Protocol: ipProtoUDP}, "query"},
+		{"IPv4 ICMP echo", ipv4Packet(ipProtoICMP, 0, icmpEcho(8, 77)),
+			protocol.FlowKey{SrcIP: flowSrc4, DstIP: flowDst4, SrcPort: 77, DstPort: 77, Protocol: ipProtoICMP}, ""},
+		{"IPv4 ICMP unreachable", ipv4Packet(ipProtoICMP, 0, icmpEcho(3, 77)),
+			protocol.FlowKey{SrcIP: flowSrc4, DstIP: flowDst4, Protocol: ipProtoICMP}, ""},
+		{"IPv4 first fragment", ipv4Packet(ipProtoUDP, 0x2000, udpHeader(5353, 53, "query")),
+			protocol.FlowKey{SrcIP: flowSrc4, DstIP: flowDst4, Protocol: ipProtoUDP}, string(udpHeader(5353, 53, "query"))},
+		{"IPv4 later fragment", ipv4Packet(ipProtoUDP, 0x0010, []byte("rest")),
+			protocol.FlowKey{SrcIP: flowSrc4, DstIP: flowDst4, Protocol: ipProtoUDP}, "rest"},
+		{"IPv4 GRE", ipv4Packet(47, 0, []byte("gre")),
+			protocol.FlowKey{SrcIP: flowSrc4, DstIP: flowDst4, Protocol: 47}, "gre"},
+		{"IPv6 TCP", ipv6Packet(ipProtoTCP, tcpHeader(40000, 443, "hello")),
+			protocol.FlowKey{SrcIP: flowSrc6, DstIP: flowDst6, SrcPort: 40000, DstPort: 443, Protocol: ipProtoTCP}, "hello"},
+		{"IPv6 extension headers", ipv6Packet(ipProtoHopByHop, hopByHop, destOpts, udpHeader(5353, 53, "query")),
+			protocol.FlowKey{SrcIP: flowSrc6, DstIP: flowDst6, SrcPort: 5353, DstPort: 53, Protocol: ipProtoUDP}, "query"},
+		{"IPv6 first fragment", ipv6Packet(ipProtoFragment, firstFragment, udpHeader(5353, 53, "query")),
+			protocol.FlowKey{SrcIP: flowSrc6, DstIP: flowDst6, Protocol: ipProtoUDP}, string(udpHeader(5353, 53, "query"))},
+		{"IPv6 later fragment", ipv6Packet(ipProtoFragment, lastFragment, []byte("rest")),
+			protocol.FlowKey{SrcIP: flowSrc6, DstIP: flowDst6, Protocol: ipProtoUDP}, "rest"},
+		{"IPv6 atomic fragment", ipv6Packet(ipProtoFragment, atomicFragment, udpHeader(5353, 53, "query")),
+			protocol.FlowKey{SrcIP: flowSrc6, DstIP: flowDst6, SrcPort: 5353, DstPort: 53, Protocol: ipProtoUDP}, "query"},
+		{"ICMPv6 echo", ipv6Packet(ipProtoICMPv6, icmpEcho(128, 9)),
+			protocol.FlowKey{SrcIP: flowSrc6, DstIP: flowDst6, SrcPort: 9, DstPort: 9, Protocol: ipProtoICMPv6}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := protocol.FlowKey{SrcPort: 1, DstPort: 1} // Stale values must be cleared
+			payload, err := ParseFlow(tt.pkt, &key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !key.SrcIP.Equal(tt.want.SrcIP) || !key.DstIP.Equal(tt.want.DstIP) ||
+				key.SrcPort != tt.want.SrcPort || key.DstPort != tt.want.DstPort || key.Protocol != tt.want.Protocol {
+				t.Fatalf("got %v, want %v", key, tt.want)
+			}
+			if string(payload) != tt.payload {
+				t.Fatalf("payload %q, want %q", payload, tt.payload)
+			}
+		})
+	}
+}
+
+func TestParseFlowRejectsMalformed(t *testing.T) {
+	tcp := ipv4Packet(ipProtoTCP, 0, tcpHeader(1, 2, ""))
+	tcp[20+12] = 15 << 4 // Data offset past the end
+
+	tests := map[string]struct {
+		pkt  []byte
+		want error
+	}{
+		"empty":              {nil, ErrTruncatedIP},
+		"not IP":             {[]byte{0x20, 0, 0, 0}, ErrNotIP},
+		"short IPv4":         {ipv4Packet(ipProtoUDP, 0, nil)[:19], ErrTruncatedIP},
+		"short UDP":          {ipv4Packet(ipProtoUDP, 0, []byte{0, 1}), ErrTruncatedIP},
+		"TCP data offset":    {tcp, ErrTruncatedIP},
+		"short IPv6":         {ipv6Packet(ipProtoUDP)[:39], ErrTruncatedIP},
+		"IPv6 header length": {ipv6Packet(ipProtoHopByHop, []byte{ipProtoUDP, 4, 0, 0, 0, 0, 0, 0}), ErrTruncatedIP},
+	}
+
+	for name, tt := range tests {
+		var key protocol.FlowKey
+		if _, err := ParseFlow(tt.pkt, &key); err != tt.want {
+			t.Errorf("%s: got %v, want %v", name, err, tt.want)
+		}
+	}
+}
+
+func TestParseFlowDoesNotAllocate(t *testing.T) {
+	pkts := [][]byte{
+		ipv4Packet(ipProtoTCP, 0, tcpHeader(40000, 443, "hello")),
+		ipv6Packet(ipProtoHopByHop, []byte{ipProtoUDP, 0, 0, 0, 0, 0, 0, 0}, udpHeader(5353, 53, "query")),
+	}
+
+	var key protocol.FlowKey
+	allocs := testing.AllocsPerRun(100, func() {
+		for _, pkt := range pkts {
+			ParseFlow(pkt, &key)
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("ParseFlow allocated %.1f times per run", allocs)
+	}
+}
+
+func TestDSCP(t *testing.T) {
+	v4 := ipv4Packet(ipProtoUDP, 0, udpHeader(1, 2, ""))
+	v4[1] = 46<<2 | 1 // EF with an ECN bit
+	if got := DSCP(v4); got != 46 {
+		t.Errorf("IPv4 DSCP = %d, want 46", got)
+	}
+
+	v6 := ipv6Packet(ipProtoUDP, udpHeader(1, 2, ""))
+	v6[0] |= 34 >> 2 // AF41 spans the first two bytes
+	v6[1] |= (34 & 3) << 6
+	if got := DSCP(v6); got != 34 {
+		t.Errorf("IPv6 DSCP = %d, want 34", got)
+	}
+
+	if got := DSCP([]byte{0x45}); got != 0 {
+		t.Errorf("truncated packet DSCP = %d, want 0", got)
+	}
+}
+
+func FuzzParseFlow(f *testing.F) {
+	f.Add(ipv4Packet(ipProtoTCP, 0, tcpHeader(40000, 443, "hello")))
+	f.Add(ipv6Packet(ipProtoHopByHop, []byte{ipProtoFragment, 0, 0, 0, 0, 0, 0, 0}, []byte{ipProtoUDP, 0, 0, 0, 0, 0, 0, 1}, udpHeader(1, 2, "x")))
+
+	f.Fuzz(func(t *testing.T, pkt []byte) {
+		var key protocol.FlowKey
+		payload, err := ParseFlow(pkt, &key)
+		if err == nil && len(payload) > len(pkt) {
+			t.Fatalf("payload longer than packet")
+		}
+	})
+}
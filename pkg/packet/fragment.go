@@ -0,0 +1,234 @@
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+)
+
+// Packets too large for the path MTU of a WAN are split into fragments. The
+// fragments share the packet's header, sequence ID included, and each carries
+// a part of its data after a fragment header:
+//
+//	[id 4][index 1][part]
+//
+// The id is chosen by the sender for each fragmented copy, so copies of a
+// packet fragmented for different WANs are reassembled separately. Every
+// fragment is flagged protocol.FlagFragment and the last one also
+// protocol.FlagLastFrag. Parts are of equal size except the last.
+
+const (
+	// FragmentHeaderLen is the size of the fragment header
+	FragmentHeaderLen = 5
+	// MaxFragments is how many fragments a packet may be split into
+	MaxFragments = 256
+	// DefaultMaxReassemblies is how many packets may wait for fragments at once
+	DefaultMaxReassemblies = 256
+)
+
+var (
+	// ErrFragmentSpace the data of a fragment cannot hold any of the packet
+	ErrFragmentSpace = errors.New("no room for fragment data")
+	// ErrTooManyFragments packet needs more than MaxFragments fragments
+	ErrTooManyFragments = errors.New("packet needs too many fragments")
+	// ErrInvalidFragment fragment is malformed or does not match the others
+	ErrInvalidFragment = errors.New("invalid fragment")
+)
+
+// Fragment splits a packet into fragments whose data is at most maxData
+// bytes. Packets that already fit are returned as they are.
+func Fragment(pkt *protocol.Packet, id uint32, maxData int) ([]*protocol.Packet, error) {
+	if len(pkt.Data) <= maxData {
+		return []*protocol.Packet{pkt}, nil
+	}
+
+	partLen := maxData - FragmentHeaderLen
+	if partLen <= 0 {
+		return nil, ErrFragmentSpace
+	}
+	count := (len(pkt.Data) + partLen - 1) / partLen
+	if count > MaxFragments {
+		return nil, ErrTooManyFragments
+	}
+	partLen = (len(pkt.Data) + count - 1) / count
+
+	fragments := make([]*protocol.Packet, count)
+	for i := range fragments {
+		part := pkt.Data[i*partLen : min((i+1)*partLen, len(pkt.Data))]
+
+		data := make([]byte, FragmentHeaderLen, FragmentHeaderLen+len(part))
+		binary.BigEndian.PutUint32(data, id)
+		data[4] = byte(i)
+
+		fragment := *pkt
+		fragment.Flags |= protocol.FlagFragment
+		if i == count-1 {
+			fragment.Flags |= protocol.FlagLastFrag
+		}
+		fragment.Data = append(data, part...)
+		fragments[i] = &fragment
+	}
+	return fragments, nil
+}
+
+// ReassemblyStats contains reassembly counters
+type ReassemblyStats struct {
+	Reassembled uint64 // Packets rebuilt from their fragments
+	Expired     uint64 // Incomplete packets given up on
+	Invalid     uint64 // Fragments dropped as malformed or inconsistent
+	Pending     int    // Packets waiting for fragments
+}
+
+// reassembly collects the fragments of one packet
+type reassembly struct {
+	header   protocol.Packet // Header of the first fragment to arrive
+	parts    [][]byte
+	count    int // Number of fragments, known once the last one arrived
+	received int
+	started  time.Time
+}
+
+// Reassembler rebuilds packets from their fragments. Packets whose fragments
+// have not all arrived within the timeout are given up on; by then the
+// reorder buffer has skipped them anyway.
+type Reassembler struct {
+	mu      sync.Mutex
+	timeout time.Duration
+	max     int
+	pending map[uint32]*reassembly
+	order   []uint32 // Fragment IDs in the order their first fragment arrived
+	stats   ReassemblyStats
+}
+
+// NewReassembler creates a reassembler that gives up on packets after timeout
+func NewReassembler(timeout time.Duration) *Reassembler {
+	return &Reassembler{
+		timeout: timeout,
+		max:     DefaultMaxReassemblies,
+		pending: make(map[uint32]*reassembly),
+	}
+}
+
+// SetTimeout changes how long the fragments of a packet are waited for
+func (r *Reassembler) SetTimeout(timeout time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.timeout = timeout
+}
+
+// Add adds a fragment and returns the rebuilt packet once every fragment has
+// arrived, or nil while some are missing. Repeated fragments are ignored.
+func (r *Reassembler) Add(pkt *protocol.Packet, now time.Time) (*protocol.Packet, error) {
+	if pkt.Flags&protocol.FlagFragment == 0 || len(pkt.Data) < FragmentHeaderLen {
+		r.mu.Lock()
+		r.stats.Invalid++
+		r.mu.Unlock()
+		return nil, ErrInvalidFragment
+	}
+	id := binary.BigEndian.Uint32(pkt.Data)
+	index := int(pkt.Data[4])
+	part := pkt.Data[FragmentHeaderLen:]
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.expire(now)
+
+	entry, exists := r.pending[id]
+	if !exists {
+		if len(r.pending) >= r.max {
+			r.dropOldest()
+		}
+		entry = &reassembly{header: *pkt, started: now}
+		entry.header.Data = nil
+		r.pending[id] = entry
+		r.order = append(r.order, id)
+	}
+
+	// Every fragment must belong to the same packet and fit the count
+	count := entry.count
+	if pkt.Flags&protocol.FlagLastFrag != 0 {
+		count = index + 1
+	}
+	if pkt.SequenceID != entry.header.SequenceID || pkt.Type != entry.header.Type ||
+		(entry.count != 0 && count != entry.count) || (count != 0 && max(index+1, len(entry.parts)) > count) {
+		delete(r.pending, id)
+		r.stats.Invalid++
+		return nil, ErrInvalidFragment
+	}
+	entry.count = count
+
+	if index >= len(entry.parts) {
+		entry.parts = append(entry.parts, make([][]byte, index+1-len(entry.parts))...)
+	}
+	if entry.parts[index] != nil {
+		return nil, nil
+	}
+	entry.parts[index] = part
+	entry.received++
+
+	if entry.count == 0 || entry.received < entry.count {
+		return nil, nil
+	}
+
+	size := 0
+	for _, part := range entry.parts {
+		size += len(part)
+	}
+	data := make([]byte, 0, size)
+	for _, part := range entry.parts {
+		data = append(data, part...)
+	}
+
+	whole := entry.header
+	whole.Flags &^= protocol.FlagFragment | protocol.FlagLastFrag
+	whole.DataLen = uint32(len(data))
+	whole.Data = data
+
+	delete(r.pending, id)
+	r.stats.Reassembled++
+	return &whole, nil
+}
+
+// Stats returns the reassembly counters
+func (r *Reassembler) Stats() ReassemblyStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := r.stats
+	stats.Pending = len(r.pending)
+	return stats
+}
+
+// expire gives up on packets whose first fragment arrived too long ago
+func (r *Reassembler) expire(now time.Time) {
+	n := 0
+	for ; n < len(r.order); n++ {
+		entry, exists := r.pending[r.order[n]]
+		if !exists {
+			continue
+		}
+		if now.Sub(entry.started) < r.timeout {
+			break
+		}
+		delete(r.pending, r.order[n])
+		r.stats.Expired++
+	}
+	r.order = r.order[n:]
+}
+
+// dropOldest gives up on the packet that has waited longest, to make room
+func (r *Reassembler) dropOldest() {
+	for len(r.order) > 0 {
+		id := r.order[0]
+		r.order = r.order[1:]
+		if _, exists := r.pending[id]; exists {
+			delete(r.pending, id)
+			r.stats.Expired++
+			return
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package packet
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+)
+
+func fragmentTestPacket(seq uint64, size int) *protocol.Packet {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	return &protocol.Packet{
+		Version:    protocol.ProtocolVersion,
+		Type:       protocol.PacketTypeData,
+		SessionID:  7,
+		SequenceID: seq,
+		WANID:      1,
+		Data:       data,
+	}
+}
+
+func TestFragmentRoundTrip(t *testing.T) {
+	now := time.Unix(0, 0)
+	pkt := fragmentTestPacket(42, 3000)
+
+	fragments, err := Fragment(pkt, 1, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fragments) != 4 {
+		t.Fatalf("got %d fragments, want 4", len(fragments))
+	}
+	for i, f := range fragments {
+		if len(f.Data) > 1000 || f.SequenceID != 42 || f.Flags&protocol.FlagFragment == 0 {
+			t.Fatalf("fragment %d = %+v", i, f)
+		}
+		if last := f.Flags&protocol.FlagLastFrag != 0; last != (i == len(fragments)-1) {
+			t.Fatalf("fragment %d last flag = %v", i, last)
+		}
+	}
+
+	// Fragments arrive out of order, one of them twice
+	r := NewReassembler(time.Second)
+	for _, i := range []int{3, 1, 1, 0} {
+		if whole, err := r.Add(fragments[i], now); whole != nil || err != nil {
+			t.Fatalf("fragment %d: got %v, %v before the last fragment", i, whole, err)
+		}
+	}
+	whole, err := r.Add(fragments[2], now)
+	if err != nil || whole == nil {
+		t.Fatalf("got %v, %v, want the packet", whole, err)
+	}
+	if !bytes.Equal(whole.Data, pkt.Data) || whole.SequenceID != 42 || whole.Flags != 0 {
+		t.Fatalf("reassembled %+v", whole)
+	}
+
+	if stats := r.Stats(); stats.Reassembled != 1 || stats.Pending != 0 {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	// Packets that fit are not fragmented
+	if fragments, err := Fragment(pkt, 2, 3000); err != nil || len(fragments) != 1 || fragments[0] != pkt {
+		t.Errorf("got %v, %v for a packet that fits", fragments, err)
+	}
+	if _, err := Fragment(pkt, 3, FragmentHeaderLen); err != ErrFragmentSpace {
+		t.Errorf("got %v, want %v", err, ErrFragmentSpace)
+	}
+	if _, err := Fragment(pkt, 4, FragmentHeaderLen+1); err != ErrTooManyFragments {
+		t.Errorf("got %v, want %v", err, ErrTooManyFragments)
+	}
+}
+
+func TestReassemblerRejectsInconsistentFragments(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewReassembler(time.Second)
+
+	fragments, _ := Fragment(fragmentTestPacket(1, 300), 9, 105)
+	other, _ := Fragment(fragmentTestPacket(2, 300), 9, 105)
+
+	r.Add(fragments[0], now)
+	if _, err := r.Add(other[1], now); err != ErrInvalidFragment {
+		t.Fatalf("got %v for another packet's fragment, want %v", err, ErrInvalidFragment)
+	}
+
+	// A last fragment with an index below ones already received
+	r.Add(fragments[2], now)
+	short := *fragments[1]
+	short.Flags |= protocol.FlagLastFrag
+	if _, err := r.Add(&short, now); err != ErrInvalidFragment {
+		t.Fatalf("got %v for a wrong count, want %v", err, ErrInvalidFragment)
+	}
+
+	if _, err := r.Add(&protocol.Packet{Flags: protocol.FlagFragment, Data: []byte{1}}, now); err != ErrInvalidFragment {
+		t.Fatalf("got %v for a short fragment, want %v", err, ErrInvalidFragment)
+	}
+
+	if stats := r.Stats(); stats.Invalid != 3 || stats.Pending != 0 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestReassemblerExpires(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewReassembler(500 * time.Millisecond)
+
+	first, _ := Fragment(fragmentTestPacket(1, 300), 1, 200)
+	second, _ := Fragment(fragmentTestPacket(2, 300), 2, 200)
+
+	r.Add(first[0], now)
+	r.Add(second[0], now.Add(400*time.Millisecond))
+
+	// The first packet is given up on; its last fragment starts a new one
+	now = now.Add(600 * time.Millisecond)
+	if whole, _ := r.Add(first[1], now); whole != nil {
+		t.Fatal("reassembled an expired packet")
+	}
+	if whole, _ := r.Add(second[1], now); whole == nil {
+		t.Fatal("second packet not reassembled")
+	}
+
+	if stats := r.Stats(); stats.Expired != 1 || stats.Reassembled != 1 || stats.Pending != 1 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
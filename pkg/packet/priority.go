@@ -0,0 +1,95 @@
+package packet
+
+import (
+	"github.com/thelastdreamer/MultiWANBond/pkg/dpi"
+)
+
+// Packet priorities run from 0 to 255. The router sends packets above 200 on
+// the lowest-latency WAN with a duplicate copy, and packets below 50 on the
+// least-used WAN.
+const (
+	// DefaultPriority is the priority of unmarked, unclassified traffic
+	DefaultPriority uint8 = 128
+	// RealTimePriority is the default priority of voice and other real-time traffic
+	RealTimePriority uint8 = 240
+	// BulkPriority is the default priority of bulk and scavenger traffic
+	BulkPriority uint8 = 32
+)
+
+// defaultDSCPPriorities follows the service classes of RFC 4594
+var defaultDSCPPriorities = map[uint8]uint8{
+	1:  16,                 // LE, lower effort
+	8:  BulkPriority,       // CS1, low-priority data
+	10: 64, 12: 64, 14: 64, // AF1x, high-throughput data
+	16: 144, 18: 144, 20: 144, 22: 144, // CS2 and AF2x, OAM and low-latency data
+	24: 160, 26: 160, 28: 160, 30: 160, // CS3 and AF3x, broadcast video and streaming
+	32: 180, 34: 180, 36: 180, 38: 180, // CS4 and AF4x, real-time interactive and conferencing
+	40: 200,                                    // CS5, signaling
+	44: RealTimePriority, 46: RealTimePriority, // Voice admit and EF, telephony
+	48: 220, 56: 220, // CS6 and CS7, network control
+}
+
+// defaultClassPriorities are used for unmarked traffic when DPI classes are enabled
+var defaultClassPriorities = map[dpi.TrafficClass]uint8{
+	dpi.ClassRealTime:    RealTimePriority,
+	dpi.ClassInteractive: 180,
+	dpi.ClassStreaming:   160,
+	dpi.ClassBulk:        40,
+	dpi.ClassBackground:  16,
+}
+
+// PriorityMap maps tunneled packets to a Packet.Priority by their DSCP.
+// Unmarked packets can instead be mapped by the traffic class DPI gives
+// their flow.
+type PriorityMap struct {
+	dscp    [64]uint8
+	classes map[dpi.TrafficClass]uint8
+}
+
+// NewPriorityMap creates a priority map with the default DSCP mapping and no
+// DPI class mapping
+func NewPriorityMap() *PriorityMap {
+	m := &PriorityMap{}
+	for i := range m.dscp {
+		m.dscp[i] = DefaultPriority
+	}
+	for dscp, priority := range defaultDSCPPriorities {
+		m.dscp[dscp] = priority
+	}
+	return m
+}
+
+// SetDSCP sets the priority of packets marked with a DSCP
+func (m *PriorityMap) SetDSCP(dscp, priority uint8) {
+	m.dscp[dscp&0x3f] = priority
+}
+
+// EnableClasses maps unmarked packets by DPI traffic class, starting from
+// the default class priorities
+func (m *PriorityMap) EnableClasses() {
+	m.classes = make(map[dpi.TrafficClass]uint8, len(defaultClassPriorities))
+	for class, priority := range defaultClassPriorities {
+		m.classes[class] = priority
+	}
+}
+
+// SetClass sets the priority of unmarked packets of a DPI traffic class,
+// enabling the class mapping if needed
+func (m *PriorityMap) SetClass(class dpi.TrafficClass, priority uint8) {
+	if m.classes == nil {
+		m.EnableClasses()
+	}
+	m.classes[class] = priority
+}
+
+// Priority returns the priority of a packet with the given DSCP whose flow
+// DPI put in class. Marked packets go by their DSCP; unmarked ones go by
+// their class when the class mapping is enabled and has an entry for it.
+func (m *PriorityMap) Priority(dscp uint8, class dpi.TrafficClass) uint8 {
+	if dscp == 0 {
+		if priority, ok := m.classes[class]; ok {
+			return priority
+		}
+	}
+	return m.dscp[dscp&0x3f]
+}
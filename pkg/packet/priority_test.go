@@ -0,0 +1,51 @@
+package packet
+
+import (
+	"testing"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/dpi"
+)
+
+func TestPriorityMap(t *testing.T) {
+	m := NewPriorityMap()
+
+	tests := []struct {
+		name  string
+		dscp  uint8
+		class dpi.TrafficClass
+		want  uint8
+	}{
+		{"EF", 46, dpi.ClassDefault, RealTimePriority},
+		{"CS1", 8, dpi.ClassDefault, BulkPriority},
+		{"AF41", 34, dpi.ClassDefault, 180},
+		{"unmarked", 0, dpi.ClassDefault, DefaultPriority},
+		{"unknown code point", 7, dpi.ClassDefault, DefaultPriority},
+		{"classes disabled", 0, dpi.ClassRealTime, DefaultPriority},
+	}
+	for _, tt := range tests {
+		if got := m.Priority(tt.dscp, tt.class); got != tt.want {
+			t.Errorf("%s: priority = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	m.SetDSCP(8, 10)
+	if got := m.Priority(8, dpi.ClassDefault); got != 10 {
+		t.Errorf("overridden CS1 priority = %d, want 10", got)
+	}
+
+	m.EnableClasses()
+	if got := m.Priority(0, dpi.ClassRealTime); got != RealTimePriority {
+		t.Errorf("unmarked real-time priority = %d, want %d", got, RealTimePriority)
+	}
+	if got := m.Priority(0, dpi.ClassDefault); got != DefaultPriority {
+		t.Errorf("unmarked default class priority = %d, want %d", got, DefaultPriority)
+	}
+	if got := m.Priority(8, dpi.ClassRealTime); got != 10 {
+		t.Errorf("marked packets must go by DSCP: priority = %d, want 10", got)
+	}
+
+	m.SetClass(dpi.ClassBulk, 5)
+	if got := m.Priority(0, dpi.ClassBulk); got != 5 {
+		t.Errorf("overridden bulk priority = %d, want 5", got)
+	}
+}
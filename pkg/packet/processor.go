@@ -4,33 +4,71 @@ import (
 	"encoding/binary"
 	"fmt"
 	"hash/crc32"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
 )
 
+// HeaderSize is the size of an encoded packet without its data: the header
+// and the trailing checksum
+const HeaderSize = 38
+
 // Processor handles packet encoding, decoding, and reordering
 type Processor struct {
 	mu              sync.RWMutex
-	reorderBuffer   map[uint64]*protocol.Packet
+	deliverMu       sync.Mutex // Held while delivering, so batches go out in order
+	reorderBuffer   map[uint64]*bufferedPacket
 	nextExpectedSeq uint64
 	bufferSize      int
 	timeout         time.Duration
-	lastCleanup     time.Time
+	timer           *time.Timer
+	timerArmed      bool
+	closed          bool
+	deliver         DeliverFunc
+	stats           ReorderStats
+}
+
+// bufferedPacket is a packet waiting in the reorder buffer
+type bufferedPacket struct {
+	data    []byte
+	arrived time.Time
+}
+
+// DeliverFunc receives packets released by the reorder buffer, in sequence order.
+// It is called one batch at a time, with the processor unlocked, and must not
+// call Reorder.
+type DeliverFunc func(batch [][]byte)
+
+// ReorderStats contains reorder buffer statistics
+type ReorderStats struct {
+	Depth      int    // Packets currently buffered
+	MaxDepth   int    // Largest buffer depth seen
+	Released   uint64 // Packets released in order
+	Late       uint64 // Packets whose sequence number was already released or skipped
+	Duplicates uint64 // Packets already waiting in the buffer
+	Skipped    uint64 // Sequence numbers given up on after a timeout or overflow
+	Timeouts   uint64 // Gaps released by the reorder timer
 }
 
 // NewProcessor creates a new packet processor
 func NewProcessor(bufferSize int, timeout time.Duration) *Processor {
 	return &Processor{
-		reorderBuffer:   make(map[uint64]*protocol.Packet),
+		reorderBuffer:   make(map[uint64]*bufferedPacket),
 		nextExpectedSeq: 0,
 		bufferSize:      bufferSize,
 		timeout:         timeout,
-		lastCleanup:     time.Now(),
 	}
 }
 
+// SetDeliverFunc sets the function that receives released packets
+func (p *Processor) SetDeliverFunc(fn DeliverFunc) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.deliver = fn
+}
+
 // Encode encodes a packet for transmission
 func (p *Processor) Encode(packet *protocol.Packet) ([]byte, error) {
 	if packet == nil {
@@ -40,8 +78,7 @@ func (p *Processor) Encode(packet *protocol.Packet) ([]byte, error) {
 	// Calculate total size
 	// Header: Version(1) + Type(1) + Flags(2) + SessionID(8) + SequenceID(8) +
 	//         Timestamp(8) + WANID(1) + Priority(1) + DataLen(4) + Checksum(4) = 38 bytes
-	headerSize := 38
-	totalSize := headerSize + len(packet.Data)
+	totalSize := HeaderSize + len(packet.Data)
 
 	buf := make([]byte, totalSize)
 
@@ -88,7 +125,7 @@ func (p *Processor) Encode(packet *protocol.Packet) ([]byte, error) {
 
 // Decode decodes a received packet
 func (p *Processor) Decode(data []byte) (*protocol.Packet, error) {
-	if len(data) < 38 {
+	if len(data) < HeaderSize {
 		return nil, fmt.Errorf("packet too small: %d bytes", len(data))
 	}
 
@@ -150,103 +187,215 @@ func (p *Processor) Decode(data []byte) (*protocol.Packet, error) {
 	return packet, nil
 }
 
-// Reorder handles packet reordering
-// Returns: data (if packet can be delivered), ready (true if data is ready), error
-func (p *Processor) Reorder(packet *protocol.Packet) ([]byte, bool, error) {
+// Reorder adds a packet to the reorder buffer.
+// Every packet that becomes deliverable is passed to the deliver function in
+// sequence order. If a gap is not filled within the reorder timeout, a timer
+// skips it and releases the packets waiting behind it.
+func (p *Processor) Reorder(packet *protocol.Packet) error {
 	p.mu.Lock()
-	defer p.mu.Unlock()
+	batch, err := p.reorder(packet)
+	p.release(batch)
+	return err
+}
+
+// reorder adds a packet to the reorder buffer and returns the packets that
+// become deliverable. p.mu must be held.
+func (p *Processor) reorder(packet *protocol.Packet) ([][]byte, error) {
+	if p.closed {
+		return nil, fmt.Errorf("processor closed")
+	}
 
 	// Special packet types bypass reordering
 	if packet.Type == protocol.PacketTypeHeartbeat || packet.Type == protocol.PacketTypeControl {
-		return packet.Data, true, nil
+		return [][]byte{packet.Data}, nil
+	}
+
+	seq := packet.SequenceID
+
+	// Old packet - its slot was already released or skipped
+	if seq < p.nextExpectedSeq {
+		p.stats.Late++
+		return nil, fmt.Errorf("duplicate or late packet: seq=%d, expected=%d", seq, p.nextExpectedSeq)
+	}
+
+	if _, exists := p.reorderBuffer[seq]; exists {
+		p.stats.Duplicates++
+		return nil, fmt.Errorf("duplicate packet: seq=%d", seq)
 	}
 
 	// Check if this is the next expected packet
-	if packet.SequenceID == p.nextExpectedSeq {
+	if seq == p.nextExpectedSeq {
 		p.nextExpectedSeq++
+		batch := p.drain([][]byte{packet.Data})
+		p.armTimer()
+		return batch, nil
+	}
 
-		// Check if we have buffered packets that are now in order
-		deliverable := [][]byte{packet.Data}
-
-		for {
-			if buffered, exists := p.reorderBuffer[p.nextExpectedSeq]; exists {
-				deliverable = append(deliverable, buffered.Data)
-				delete(p.reorderBuffer, p.nextExpectedSeq)
-				p.nextExpectedSeq++
-			} else {
-				break
-			}
-		}
+	// Future packet - buffer it
+	p.reorderBuffer[seq] = &bufferedPacket{data: packet.Data, arrived: time.Now()}
+	if len(p.reorderBuffer) > p.stats.MaxDepth {
+		p.stats.MaxDepth = len(p.reorderBuffer)
+	}
 
-		// For simplicity, return first packet's data
-		// In production, you might want to combine or handle multiple packets
-		return deliverable[0], true, nil
+	// Buffer overflow - give up on the gap and release what is waiting behind it
+	var batch [][]byte
+	if len(p.reorderBuffer) > p.bufferSize {
+		batch = p.skipGap()
 	}
 
-	// Packet is out of order
-	if packet.SequenceID > p.nextExpectedSeq {
-		// Future packet - buffer it
-		p.reorderBuffer[packet.SequenceID] = packet
+	p.armTimer()
+	return batch, nil
+}
+
+// drain appends buffered packets that are now in order to batch
+func (p *Processor) drain(batch [][]byte) [][]byte {
+	for {
+		buffered, exists := p.reorderBuffer[p.nextExpectedSeq]
+		if !exists {
+			return batch
+		}
+		batch = append(batch, buffered.data)
+		delete(p.reorderBuffer, p.nextExpectedSeq)
+		p.nextExpectedSeq++
+	}
+}
 
-		// Check buffer size
-		if len(p.reorderBuffer) > p.bufferSize {
-			// Buffer overflow - force delivery of oldest packets
-			return p.forceDelivery()
+// skipGap advances past the missing sequence numbers before the oldest
+// buffered packet and returns the packets that become deliverable
+func (p *Processor) skipGap() [][]byte {
+	var lowest uint64 = 1<<64 - 1
+	for seq := range p.reorderBuffer {
+		if seq < lowest {
+			lowest = seq
 		}
+	}
 
-		// Not ready yet
-		return nil, false, nil
+	if len(p.reorderBuffer) == 0 {
+		return nil
 	}
 
-	// Old packet (SequenceID < nextExpectedSeq) - it's a duplicate or very late
-	// Drop it
-	return nil, false, fmt.Errorf("duplicate or late packet: seq=%d, expected=%d", packet.SequenceID, p.nextExpectedSeq)
+	p.stats.Skipped += lowest - p.nextExpectedSeq
+	p.nextExpectedSeq = lowest
+
+	return p.drain(nil)
 }
 
-// forceDelivery forces delivery of buffered packets when buffer is full
-func (p *Processor) forceDelivery() ([]byte, bool, error) {
-	// Find oldest packet in buffer
-	var oldestSeq uint64 = 1<<64 - 1
-	var oldestPacket *protocol.Packet
+// release unlocks p.mu, which must be held, and passes a batch to the
+// deliver function. Batches are delivered in the order they were released.
+func (p *Processor) release(batch [][]byte) {
+	p.stats.Released += uint64(len(batch))
+	deliver := p.deliver
+	if len(batch) == 0 || deliver == nil {
+		p.mu.Unlock()
+		return
+	}
+
+	p.deliverMu.Lock()
+	defer p.deliverMu.Unlock()
+	p.mu.Unlock()
 
-	for seq, pkt := range p.reorderBuffer {
-		if seq < oldestSeq {
-			oldestSeq = seq
-			oldestPacket = pkt
+	deliver(batch)
+}
+
+// oldestArrival returns the arrival time of the packet that has waited longest
+func (p *Processor) oldestArrival() time.Time {
+	var oldest time.Time
+	for _, buffered := range p.reorderBuffer {
+		if oldest.IsZero() || buffered.arrived.Before(oldest) {
+			oldest = buffered.arrived
 		}
 	}
+	return oldest
+}
 
-	if oldestPacket == nil {
-		return nil, false, fmt.Errorf("buffer overflow but no packets found")
+// armTimer schedules the reorder timeout for the current gap
+func (p *Processor) armTimer() {
+	if p.timerArmed || p.timeout <= 0 || len(p.reorderBuffer) == 0 {
+		return
 	}
 
-	// Deliver oldest packet and advance sequence
-	delete(p.reorderBuffer, oldestSeq)
-	p.nextExpectedSeq = oldestSeq + 1
-
-	return oldestPacket.Data, true, nil
+	wait := time.Until(p.oldestArrival().Add(p.timeout))
+	if p.timer == nil {
+		p.timer = time.AfterFunc(wait, p.onTimeout)
+	} else {
+		p.timer.Reset(wait)
+	}
+	p.timerArmed = true
 }
 
-// CleanupExpired removes expired packets from reorder buffer
-func (p *Processor) CleanupExpired() {
+// onTimeout releases packets held behind gaps older than the reorder timeout
+func (p *Processor) onTimeout() {
 	p.mu.Lock()
-	defer p.mu.Unlock()
 
-	now := time.Now()
-	if now.Sub(p.lastCleanup) < p.timeout {
+	p.timerArmed = false
+	if p.closed {
+		p.mu.Unlock()
 		return
 	}
 
-	// Remove packets older than timeout
-	cutoff := now.Add(-p.timeout).UnixNano()
+	var batch [][]byte
+	for len(p.reorderBuffer) > 0 && time.Since(p.oldestArrival()) >= p.timeout {
+		batch = append(batch, p.skipGap()...)
+		p.stats.Timeouts++
+	}
+
+	p.armTimer()
+	p.release(batch)
+}
+
+// Missing returns up to maxRanges ranges of sequence numbers the reorder
+// buffer is waiting for, lowest first
+func (p *Processor) Missing(maxRanges int) []protocol.SeqRange {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if len(p.reorderBuffer) == 0 {
+		return nil
+	}
+
+	buffered := make([]uint64, 0, len(p.reorderBuffer))
+	for seq := range p.reorderBuffer {
+		buffered = append(buffered, seq)
+	}
+	slices.Sort(buffered)
 
-	for seq, pkt := range p.reorderBuffer {
-		if pkt.Timestamp < cutoff {
-			delete(p.reorderBuffer, seq)
+	var missing []protocol.SeqRange
+	next := p.nextExpectedSeq
+	for _, seq := range buffered {
+		if len(missing) == maxRanges {
+			break
+		}
+		if seq > next {
+			missing = append(missing, protocol.SeqRange{First: next, Last: seq - 1})
 		}
+		next = seq + 1
+	}
+	return missing
+}
+
+// Waited returns how long the packets buffered behind a missing sequence
+// number have waited for it, and false if seq is not missing
+func (p *Processor) Waited(seq uint64) (time.Duration, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if seq < p.nextExpectedSeq {
+		return 0, false
+	}
+	if _, exists := p.reorderBuffer[seq]; exists {
+		return 0, false
 	}
 
-	p.lastCleanup = now
+	var oldest time.Time
+	for buffered, packet := range p.reorderBuffer {
+		if buffered > seq && (oldest.IsZero() || packet.arrived.Before(oldest)) {
+			oldest = packet.arrived
+		}
+	}
+	if oldest.IsZero() {
+		return 0, false
+	}
+	return time.Since(oldest), true
 }
 
 // Reset resets the reorder buffer
@@ -254,9 +403,35 @@ func (p *Processor) Reset() {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	p.reorderBuffer = make(map[uint64]*protocol.Packet)
+	p.stopTimer()
+	p.reorderBuffer = make(map[uint64]*bufferedPacket)
 	p.nextExpectedSeq = 0
-	p.lastCleanup = time.Now()
+}
+
+// Close stops the reorder timer and discards buffered packets
+func (p *Processor) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.stopTimer()
+	p.closed = true
+	p.reorderBuffer = make(map[uint64]*bufferedPacket)
+}
+
+// stopTimer cancels a pending reorder timeout
+func (p *Processor) stopTimer() {
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	p.timerArmed = false
+}
+
+// SetReorderWindow changes the reorder buffer size and timeout
+func (p *Processor) SetReorderWindow(bufferSize int, timeout time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.bufferSize = bufferSize
+	p.timeout = timeout
 }
 
 // SetNextExpectedSeq sets the next expected sequence number
@@ -280,7 +455,19 @@ func (p *Processor) GetNextExpectedSeq() uint64 {
 	return p.nextExpectedSeq
 }
 
+// GetReorderStats returns reorder buffer statistics
+func (p *Processor) GetReorderStats() ReorderStats {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	stats := p.stats
+	stats.Depth = len(p.reorderBuffer)
+	return stats
+}
+
 // DeduplicateCache handles duplicate packet detection
+//
+// Deprecated: use DuplicateWindow, which tracks sequence IDs in fixed memory.
 type DeduplicateCache struct {
 	mu      sync.RWMutex
 	cache   map[uint64]time.Time // SequenceID -> receive time
@@ -0,0 +1,232 @@
+package packet
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+)
+
+// collector records released packets
+type collector struct {
+	mu       sync.Mutex
+	released []string
+	notify   chan struct{}
+}
+
+func newCollector(p *Processor) *collector {
+	c := &collector{notify: make(chan struct{}, 100)}
+	p.SetDeliverFunc(func(batch [][]byte) {
+		c.mu.Lock()
+		for _, data := range batch {
+			c.released = append(c.released, string(data))
+		}
+		c.mu.Unlock()
+		c.notify <- struct{}{}
+	})
+	return c
+}
+
+func (c *collector) get() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.released...)
+}
+
+func dataPacket(seq uint64) *protocol.Packet {
+	return &protocol.Packet{
+		Type:       protocol.PacketTypeData,
+		SequenceID: seq,
+		Data:       []byte{byte('a' + seq - 1)},
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestReorderReleasesEveryBufferedPacket(t *testing.T) {
+	tests := []struct {
+		name  string
+		order []uint64
+		want  []string
+	}{
+		{"in order", []uint64{1, 2, 3, 4}, []string{"a", "b", "c", "d"}},
+		{"reversed", []uint64{4, 3, 2, 1}, []string{"a", "b", "c", "d"}},
+		{"gap filled last", []uint64{2, 3, 4, 5, 1}, []string{"a", "b", "c", "d", "e"}},
+		{"interleaved", []uint64{1, 3, 2, 5, 4}, []string{"a", "b", "c", "d", "e"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewProcessor(100, time.Hour)
+			defer p.Close()
+			p.SetNextExpectedSeq(1)
+			c := newCollector(p)
+
+			for _, seq := range tt.order {
+				if err := p.Reorder(dataPacket(seq)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if got := c.get(); !equalStrings(got, tt.want) {
+				t.Fatalf("released %v, want %v", got, tt.want)
+			}
+			if depth := p.GetReorderStats().Depth; depth != 0 {
+				t.Fatalf("depth = %d, want 0", depth)
+			}
+		})
+	}
+}
+
+func TestReorderOverflowReleasesWaitingPackets(t *testing.T) {
+	p := NewProcessor(2, time.Hour)
+	defer p.Close()
+	p.SetNextExpectedSeq(1)
+	c := newCollector(p)
+
+	// Seq 1 is lost; the third buffered packet overflows the buffer
+	for _, seq := range []uint64{2, 3, 4} {
+		p.Reorder(dataPacket(seq))
+	}
+
+	if got := c.get(); !equalStrings(got, []string{"b", "c", "d"}) {
+		t.Fatalf("released %v, want [b c d]", got)
+	}
+
+	stats := p.GetReorderStats()
+	if stats.Skipped != 1 || stats.MaxDepth != 3 {
+		t.Fatalf("stats = %+v, want 1 skipped and max depth 3", stats)
+	}
+
+	// The lost packet shows up late
+	if err := p.Reorder(dataPacket(1)); err == nil {
+		t.Fatal("expected late packet error")
+	}
+	if late := p.GetReorderStats().Late; late != 1 {
+		t.Fatalf("late = %d, want 1", late)
+	}
+}
+
+func TestReorderTimeoutReleasesGap(t *testing.T) {
+	p := NewProcessor(100, 50*time.Millisecond)
+	defer p.Close()
+	p.SetNextExpectedSeq(1)
+	c := newCollector(p)
+
+	p.Reorder(dataPacket(1))
+	<-c.notify
+
+	// Seq 2 never arrives
+	p.Reorder(dataPacket(3))
+	p.Reorder(dataPacket(4))
+
+	if depth := p.GetReorderStats().Depth; depth != 2 {
+		t.Fatalf("depth = %d, want 2", depth)
+	}
+
+	select {
+	case <-c.notify:
+	case <-time.After(time.Second):
+		t.Fatal("reorder timer did not release the gap")
+	}
+
+	if got := c.get(); !equalStrings(got, []string{"a", "c", "d"}) {
+		t.Fatalf("released %v, want [a c d]", got)
+	}
+
+	stats := p.GetReorderStats()
+	if stats.Timeouts != 1 || stats.Skipped != 1 || stats.Depth != 0 {
+		t.Fatalf("stats = %+v, want 1 timeout, 1 skipped and depth 0", stats)
+	}
+}
+
+func TestReorderCountsDuplicates(t *testing.T) {
+	p := NewProcessor(100, time.Hour)
+	defer p.Close()
+	p.SetNextExpectedSeq(1)
+	newCollector(p)
+
+	p.Reorder(dataPacket(3))
+	if err := p.Reorder(dataPacket(3)); err == nil {
+		t.Fatal("expected duplicate error")
+	}
+	if dup := p.GetReorderStats().Duplicates; dup != 1 {
+		t.Fatalf("duplicates = %d, want 1", dup)
+	}
+}
+
+func TestReorderReportsMissing(t *testing.T) {
+	p := NewProcessor(100, time.Hour)
+	defer p.Close()
+	p.SetNextExpectedSeq(1)
+	newCollector(p)
+
+	if missing := p.Missing(protocol.MaxMissingRanges); missing != nil {
+		t.Fatalf("missing = %v with nothing buffered", missing)
+	}
+
+	for _, seq := range []uint64{3, 4, 7, 10} {
+		p.Reorder(dataPacket(seq))
+	}
+	want := []protocol.SeqRange{{First: 1, Last: 2}, {First: 5, Last: 6}, {First: 8, Last: 9}}
+	if missing := p.Missing(protocol.MaxMissingRanges); !slices.Equal(missing, want) {
+		t.Fatalf("missing = %v, want %v", missing, want)
+	}
+	if missing := p.Missing(2); !slices.Equal(missing, want[:2]) {
+		t.Fatalf("missing = %v, want %v", missing, want[:2])
+	}
+
+	if _, ok := p.Waited(5); !ok {
+		t.Fatal("sequence number 5 not reported missing")
+	}
+	for _, seq := range []uint64{4, 11} {
+		if _, ok := p.Waited(seq); ok {
+			t.Fatalf("sequence number %d reported missing", seq)
+		}
+	}
+}
+
+func TestReorderDeliversUnlocked(t *testing.T) {
+	p := NewProcessor(1000, time.Hour)
+	defer p.Close()
+	p.SetNextExpectedSeq(1)
+
+	// The deliver function may query the processor, and batches released
+	// by packets arriving at once still come out in order
+	var released []uint64
+	p.SetDeliverFunc(func(batch [][]byte) {
+		p.GetReorderStats()
+		for _, data := range batch {
+			released = append(released, uint64(data[0])<<8|uint64(data[1]))
+		}
+	})
+
+	const packets = 500
+	var wg sync.WaitGroup
+	for worker := uint64(0); worker < 4; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for seq := 1 + worker; seq <= packets; seq += 4 {
+				p.Reorder(&protocol.Packet{Type: protocol.PacketTypeData, SequenceID: seq, Data: []byte{byte(seq >> 8), byte(seq)}})
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(released) != packets || !slices.IsSorted(released) {
+		t.Errorf("released %d packets, in order: %v", len(released), slices.IsSorted(released))
+	}
+}
@@ -0,0 +1,297 @@
+// Package pmtud discovers the largest datagram a WAN path delivers, with
+// datagram packetization layer path MTU discovery (RFC 8899).
+//
+// Probes are datagrams padded to the size being tested and sent with the
+// don't-fragment bit set, so routers drop them rather than fragment them. A
+// probe the peer answers proves its size gets through; ICMP is never relied
+// on. A Prober first confirms BaseMTU, then searches upwards to the largest
+// size that is answered. The size found is confirmed periodically: when
+// MaxProbes confirmations in a row are lost the path has become a black hole
+// and discovery starts again from BaseMTU. Larger sizes are tried again every
+// raise interval, since paths change.
+//
+// Sizes are UDP payload sizes, excluding the IP and UDP headers.
+package pmtud
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// BaseMTU is the size confirmed first, which nearly every path carries
+	// (BASE_PLPMTU of RFC 8899)
+	BaseMTU = 1200
+	// MinMTU is used while BaseMTU probes are lost: the minimum IPv4 MTU of
+	// 576 bytes less the IPv4 and UDP headers
+	MinMTU = 548
+	// DefaultMaxMTU is the largest size searched: an Ethernet MTU of 1500
+	// bytes less the IPv4 and UDP headers
+	DefaultMaxMTU = 1472
+	// MaxProbes is how many probes of a size may be lost before the size is
+	// taken not to fit the path (MAX_PROBES of RFC 8899)
+	MaxProbes = 3
+	// DefaultProbeTimeout is how long a probe is waited for
+	DefaultProbeTimeout = time.Second
+	// DefaultConfirmInterval is how often the size in use is confirmed
+	DefaultConfirmInterval = 30 * time.Second
+	// DefaultRaiseInterval is how often larger sizes are tried again once the
+	// search is complete (PMTU_RAISE_TIMER of RFC 8899)
+	DefaultRaiseInterval = 10 * time.Minute
+	// searchResolution ends the search once the largest answered size and
+	// the largest size not known to fail are this close
+	searchResolution = 8
+)
+
+// ErrNotSupported the don't-fragment bit cannot be set on this platform
+var ErrNotSupported = errors.New("don't-fragment sockets not supported on this platform")
+
+// State is the discovery phase of a path
+type State uint8
+
+const (
+	StateBase           State = iota // Confirming BaseMTU
+	StateSearch                      // Probing sizes above the confirmed one
+	StateSearchComplete              // Using the largest size found
+	StateError                       // BaseMTU probes are lost; using MinMTU
+)
+
+func (s State) String() string {
+	switch s {
+	case StateBase:
+		return "Base"
+	case StateSearch:
+		return "Search"
+	case StateSearchComplete:
+		return "SearchComplete"
+	case StateError:
+		return "Error"
+	default:
+		return "Unknown"
+	}
+}
+
+// Config configures path MTU discovery. Zero values select the defaults.
+type Config struct {
+	MaxMTU          int           // Largest size searched
+	ProbeTimeout    time.Duration // How long a probe is waited for
+	ConfirmInterval time.Duration // How often the size in use is confirmed
+	RaiseInterval   time.Duration // How often larger sizes are tried again
+}
+
+// Stats describes the discovery state of a path
+type Stats struct {
+	MTU        int    // Largest datagram to send
+	State      State  // Discovery phase
+	Probes     uint64 // Probes sent
+	ProbesLost uint64 // Probes that were not answered in time
+	BlackHoles uint64 // Times the size in use stopped getting through
+}
+
+// Prober runs path MTU discovery for one path. It decides which probes to
+// send and when; sending them and matching the answers is up to the caller.
+type Prober struct {
+	mu       sync.Mutex
+	cfg      Config
+	state    State
+	mtu      int       // Largest confirmed size, or the size assumed before one is
+	high     int       // Largest size not known to fail, while searching
+	tryMax   bool      // The search has not probed high yet
+	probe    int       // Size of the outstanding probe, 0 when there is none
+	sentAt   time.Time // When the outstanding probe was sent
+	attempts int       // Probes of the current size lost so far
+	nextAt   time.Time // When the next probe may be sent
+	raiseAt  time.Time // When a complete search starts again
+	stats    Stats
+}
+
+// NewProber creates a prober that starts by confirming BaseMTU
+func NewProber(cfg Config) *Prober {
+	if cfg.MaxMTU <= 0 {
+		cfg.MaxMTU = DefaultMaxMTU
+	}
+	if cfg.ProbeTimeout <= 0 {
+		cfg.ProbeTimeout = DefaultProbeTimeout
+	}
+	if cfg.ConfirmInterval <= 0 {
+		cfg.ConfirmInterval = DefaultConfirmInterval
+	}
+	if cfg.RaiseInterval <= 0 {
+		cfg.RaiseInterval = DefaultRaiseInterval
+	}
+
+	return &Prober{
+		cfg: cfg,
+		mtu: min(BaseMTU, cfg.MaxMTU),
+	}
+}
+
+// MTU returns the largest datagram to send on the path
+func (p *Prober) MTU() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.mtu
+}
+
+// Probe returns the size of the probe to send now, if one is due. Only one
+// probe is outstanding at a time; it is answered through Acked or counts as
+// lost once the probe timeout has passed.
+func (p *Prober) Probe(now time.Time) (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.probe != 0 {
+		if now.Sub(p.sentAt) < p.cfg.ProbeTimeout {
+			return 0, false
+		}
+		p.lost(now)
+	}
+
+	if p.state == StateSearchComplete && !now.Before(p.raiseAt) {
+		p.raiseAt = now.Add(p.cfg.RaiseInterval)
+		if p.mtu < p.cfg.MaxMTU {
+			p.search(now)
+		}
+	}
+	if now.Before(p.nextAt) {
+		return 0, false
+	}
+
+	switch p.state {
+	case StateBase, StateError:
+		p.probe = min(BaseMTU, p.cfg.MaxMTU)
+	case StateSearch:
+		if p.tryMax {
+			p.probe = p.high
+		} else {
+			p.probe = (p.mtu + p.high + 1) / 2
+		}
+	case StateSearchComplete:
+		p.probe = p.mtu
+	}
+	p.sentAt = now
+	p.stats.Probes++
+	return p.probe, true
+}
+
+// Acked records that a probe of the given size was answered. Answers to
+// probes already counted as lost still show that their size gets through.
+func (p *Prober) Acked(size int, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if size == p.probe {
+		p.probe = 0
+		p.attempts = 0
+	}
+
+	switch p.state {
+	case StateBase, StateError:
+		if size >= min(BaseMTU, p.cfg.MaxMTU) {
+			p.mtu = size
+			p.search(now)
+		}
+	case StateSearch:
+		if size > p.mtu && size <= p.high {
+			p.mtu = size
+			p.tryMax = false
+		}
+		if p.high-p.mtu < searchResolution {
+			p.complete(now)
+		}
+	case StateSearchComplete:
+		if size == p.mtu {
+			p.nextAt = now.Add(p.cfg.ConfirmInterval)
+		}
+	}
+}
+
+// Failed records that the local network stack refused to send a datagram
+// of the given size, such as with EMSGSIZE. A probe of that size is taken to
+// have failed at once. Failing at the size in use or below means the local
+// interface changed, and discovery starts again.
+func (p *Prober) Failed(size int, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if size == p.probe {
+		p.attempts = MaxProbes - 1
+		p.lost(now)
+		return
+	}
+	if size <= p.mtu && p.state == StateSearchComplete {
+		p.blackHole(now)
+	}
+}
+
+// Stats returns the discovery state
+func (p *Prober) Stats() Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := p.stats
+	stats.MTU = p.mtu
+	stats.State = p.state
+	return stats
+}
+
+// lost counts the outstanding probe as lost. Once MaxProbes probes of a size
+// are lost the size is taken not to fit.
+func (p *Prober) lost(now time.Time) {
+	size := p.probe
+	p.probe = 0
+	p.stats.ProbesLost++
+
+	p.attempts++
+	if p.attempts < MaxProbes {
+		return
+	}
+	p.attempts = 0
+
+	switch p.state {
+	case StateBase:
+		p.state = StateError
+		p.mtu = min(MinMTU, p.cfg.MaxMTU)
+		p.nextAt = now.Add(p.cfg.ConfirmInterval)
+	case StateError:
+		p.nextAt = now.Add(p.cfg.ConfirmInterval)
+	case StateSearch:
+		p.high = size - 1
+		p.tryMax = false
+		if p.high-p.mtu < searchResolution {
+			p.complete(now)
+		}
+	case StateSearchComplete:
+		p.blackHole(now)
+	}
+}
+
+// search starts probing sizes above the confirmed one, the largest first
+// since most paths carry it
+func (p *Prober) search(now time.Time) {
+	p.state = StateSearch
+	p.high = p.cfg.MaxMTU
+	p.tryMax = true
+	p.nextAt = now
+	if p.high-p.mtu < searchResolution {
+		p.complete(now)
+	}
+}
+
+// complete settles on the confirmed size until it needs confirming again
+func (p *Prober) complete(now time.Time) {
+	p.state = StateSearchComplete
+	p.nextAt = now.Add(p.cfg.ConfirmInterval)
+	p.raiseAt = now.Add(p.cfg.RaiseInterval)
+}
+
+// blackHole falls back to BaseMTU after the size in use stopped getting through
+func (p *Prober) blackHole(now time.Time) {
+	p.stats.BlackHoles++
+	p.state = StateBase
+	p.mtu = min(BaseMTU, p.cfg.MaxMTU)
+	p.probe = 0
+	p.attempts = 0
+	p.nextAt = now
+}
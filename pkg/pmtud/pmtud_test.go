@@ -0,0 +1,114 @@
+package pmtud
+
+import (
+	"testing"
+	"time"
+)
+
+// run drives a prober over a path that carries datagrams up to pathMTU,
+// answering probes that fit at once, for the given time
+func run(p *Prober, pathMTU *int, now time.Time, d time.Duration) time.Time {
+	for end := now.Add(d); now.Before(end); now = now.Add(100 * time.Millisecond) {
+		if size, ok := p.Probe(now); ok && size <= *pathMTU {
+			p.Acked(size, now)
+		}
+	}
+	return now
+}
+
+func TestProberFindsPathMTU(t *testing.T) {
+	now := time.Unix(0, 0)
+	pathMTU := 1400
+	p := NewProber(Config{})
+
+	if mtu := p.MTU(); mtu != BaseMTU {
+		t.Fatalf("initial MTU = %d, want %d", mtu, BaseMTU)
+	}
+
+	now = run(p, &pathMTU, now, time.Minute)
+	stats := p.Stats()
+	if stats.State != StateSearchComplete || stats.MTU > pathMTU || stats.MTU <= pathMTU-searchResolution {
+		t.Fatalf("stats = %+v, want search complete near %d", stats, pathMTU)
+	}
+	if stats.ProbesLost == 0 {
+		t.Errorf("stats = %+v, want lost probes above the path MTU", stats)
+	}
+
+	// A path that carries the largest size is found with one probe above BaseMTU
+	q := NewProber(Config{})
+	full := DefaultMaxMTU
+	run(q, &full, now, 10*time.Second)
+	if stats := q.Stats(); stats.MTU != DefaultMaxMTU || stats.Probes != 2 {
+		t.Errorf("stats = %+v, want %d after 2 probes", stats, DefaultMaxMTU)
+	}
+}
+
+func TestProberBlackHole(t *testing.T) {
+	now := time.Unix(0, 0)
+	pathMTU := DefaultMaxMTU
+	p := NewProber(Config{})
+
+	now = run(p, &pathMTU, now, 10*time.Second)
+	if mtu := p.MTU(); mtu != DefaultMaxMTU {
+		t.Fatalf("MTU = %d, want %d", mtu, DefaultMaxMTU)
+	}
+
+	// The path shrinks: confirmations are lost and discovery starts again
+	pathMTU = 1300
+	now = run(p, &pathMTU, now, 2*time.Minute)
+	stats := p.Stats()
+	if stats.BlackHoles != 1 {
+		t.Fatalf("stats = %+v, want a black hole", stats)
+	}
+	if stats.MTU > pathMTU || stats.MTU <= pathMTU-searchResolution {
+		t.Fatalf("MTU = %d after the black hole, want near %d", stats.MTU, pathMTU)
+	}
+
+	// The path grows back: larger sizes are found at the next raise
+	pathMTU = DefaultMaxMTU
+	run(p, &pathMTU, now, DefaultRaiseInterval+time.Minute)
+	if mtu := p.MTU(); mtu != DefaultMaxMTU {
+		t.Errorf("MTU = %d after raising, want %d", mtu, DefaultMaxMTU)
+	}
+}
+
+func TestProberError(t *testing.T) {
+	now := time.Unix(0, 0)
+	pathMTU := 1000
+	p := NewProber(Config{})
+
+	now = run(p, &pathMTU, now, 10*time.Second)
+	if stats := p.Stats(); stats.State != StateError || stats.MTU != MinMTU {
+		t.Fatalf("stats = %+v, want error state at %d", stats, MinMTU)
+	}
+
+	// BaseMTU is tried again and the search resumes once it gets through
+	pathMTU = 1250
+	run(p, &pathMTU, now, time.Minute)
+	if stats := p.Stats(); stats.State != StateSearchComplete || stats.MTU > pathMTU || stats.MTU < BaseMTU {
+		t.Errorf("stats = %+v, want search complete near %d", stats, pathMTU)
+	}
+}
+
+func TestProberFailed(t *testing.T) {
+	now := time.Unix(0, 0)
+	p := NewProber(Config{MaxMTU: 1300})
+
+	size, ok := p.Probe(now)
+	if !ok || size != BaseMTU {
+		t.Fatalf("probe = %d, %v, want %d", size, ok, BaseMTU)
+	}
+	p.Acked(size, now)
+
+	// A probe the network stack refuses ends the search at once
+	if size, ok = p.Probe(now); !ok || size != 1300 {
+		t.Fatalf("probe = %d, %v, want 1300", size, ok)
+	}
+	p.Failed(size, now)
+	if size, ok = p.Probe(now); !ok || size >= 1300 || size <= BaseMTU {
+		t.Fatalf("probe = %d, %v, want a size between %d and 1300", size, ok, BaseMTU)
+	}
+	if stats := p.Stats(); stats.ProbesLost != 1 || stats.State != StateSearch {
+		t.Errorf("stats = %+v", stats)
+	}
+}
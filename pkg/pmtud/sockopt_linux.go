@@ -0,0 +1,42 @@
+//go:build linux
+// +build linux
+
+package pmtud
+
+import (
+	"errors"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// SetDontFragment makes a UDP socket send every datagram with the
+// don't-fragment bit set, without limiting sizes to the kernel's own path MTU
+// estimate, so that probes larger than the path are dropped rather than
+// fragmented. Datagrams larger than the interface MTU fail with EMSGSIZE.
+func SetDontFragment(conn *net.UDPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var v4Err, v6Err error
+	if err := raw.Control(func(fd uintptr) {
+		v4Err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_PROBE)
+		v6Err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_PROBE)
+	}); err != nil {
+		return err
+	}
+
+	// A socket only takes the options of its own address family
+	if v4Err != nil && v6Err != nil {
+		return v4Err
+	}
+	return nil
+}
+
+// IsMessageTooLong reports whether a send failed because the datagram is
+// larger than the local interface allows
+func IsMessageTooLong(err error) bool {
+	return errors.Is(err, unix.EMSGSIZE)
+}
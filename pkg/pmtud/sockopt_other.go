@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package pmtud
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// SetDontFragment is not yet implemented on this platform. Without the
+// don't-fragment bit probes may be fragmented on the way, so discovery tends
+// towards the largest size searched.
+func SetDontFragment(conn *net.UDPConn) error {
+	return ErrNotSupported
+}
+
+// IsMessageTooLong reports whether a send failed because the datagram is
+// larger than the local interface allows
+func IsMessageTooLong(err error) bool {
+	return errors.Is(err, syscall.EMSGSIZE)
+}
@@ -0,0 +1,96 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// Acks are carried in the data of PacketTypeAck packets and report the data
+// packets that arrived on the WAN the ack is sent on:
+//
+//	[seq 8][bytes 8][delay 4]
+//
+// seq is the highest SequenceID received on the WAN and bytes the total data
+// payload received on it. delay is how many microseconds the receiver held
+// seq before acking it, which the sender takes out of its RTT sample.
+//
+// A receiver asking for retransmissions appends the sequence IDs it is
+// missing across the session, whichever WAN they were sent on:
+//
+//	[count 1][first 8][last 8]...
+//
+// Each range is inclusive. Receivers that do not retransmit ignore them.
+
+const (
+	// AckLen is the size of an encoded ack without missing ranges
+	AckLen = 20
+	// MaxMissingRanges is the most missing ranges an ack carries
+	MaxMissingRanges = 16
+)
+
+// ErrAckTooShort ack is truncated
+var ErrAckTooShort = errors.New("ack too short")
+
+// SeqRange is an inclusive range of sequence IDs
+type SeqRange struct {
+	First uint64
+	Last  uint64
+}
+
+// Ack reports what arrived on a WAN
+type Ack struct {
+	Seq     uint64        // Highest data sequence ID received
+	Bytes   uint64        // Total data payload bytes received
+	Delay   time.Duration // Time between receiving Seq and sending the ack
+	Missing []SeqRange    // Sequence IDs the receiver is waiting for, lowest first
+}
+
+// EncodeAck encodes an ack for the data of a PacketTypeAck packet. Missing
+// ranges beyond MaxMissingRanges are left out.
+func EncodeAck(a *Ack) []byte {
+	missing := a.Missing[:min(len(a.Missing), MaxMissingRanges)]
+
+	buf := make([]byte, AckLen, AckLen+1+16*len(missing))
+	binary.BigEndian.PutUint64(buf[0:], a.Seq)
+	binary.BigEndian.PutUint64(buf[8:], a.Bytes)
+	binary.BigEndian.PutUint32(buf[16:], uint32(min(max(a.Delay/time.Microsecond, 0), 0xffffffff)))
+
+	if len(missing) > 0 {
+		buf = append(buf, uint8(len(missing)))
+		for _, r := range missing {
+			buf = binary.BigEndian.AppendUint64(buf, r.First)
+			buf = binary.BigEndian.AppendUint64(buf, r.Last)
+		}
+	}
+	return buf
+}
+
+// DecodeAck decodes the data of a PacketTypeAck packet. Trailing bytes are
+// ignored.
+func DecodeAck(data []byte) (*Ack, error) {
+	if len(data) < AckLen {
+		return nil, ErrAckTooShort
+	}
+	ack := &Ack{
+		Seq:   binary.BigEndian.Uint64(data[0:]),
+		Bytes: binary.BigEndian.Uint64(data[8:]),
+		Delay: time.Duration(binary.BigEndian.Uint32(data[16:])) * time.Microsecond,
+	}
+
+	if len(data) > AckLen {
+		count := int(data[AckLen])
+		ranges := data[AckLen+1:]
+		if len(ranges) < 16*count {
+			return nil, ErrAckTooShort
+		}
+		ack.Missing = make([]SeqRange, count)
+		for i := range ack.Missing {
+			ack.Missing[i] = SeqRange{
+				First: binary.BigEndian.Uint64(ranges[16*i:]),
+				Last:  binary.BigEndian.Uint64(ranges[16*i+8:]),
+			}
+		}
+	}
+	return ack, nil
+}
@@ -0,0 +1,36 @@
+package protocol
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAckRoundTrip(t *testing.T) {
+	for _, ack := range []*Ack{
+		{Seq: 42, Bytes: 123456, Delay: 1500 * time.Microsecond},
+		{Seq: 42, Bytes: 123456, Missing: []SeqRange{{First: 3, Last: 3}, {First: 7, Last: 40}}},
+	} {
+		decoded, err := DecodeAck(EncodeAck(ack))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(decoded, ack) {
+			t.Fatalf("decoded %+v, want %+v", decoded, ack)
+		}
+	}
+
+	// Only the first MaxMissingRanges ranges are sent
+	ack := &Ack{Missing: make([]SeqRange, MaxMissingRanges+1)}
+	if decoded, err := DecodeAck(EncodeAck(ack)); err != nil || len(decoded.Missing) != MaxMissingRanges {
+		t.Fatalf("decoded %+v, %v", decoded, err)
+	}
+
+	encoded := EncodeAck(&Ack{Missing: []SeqRange{{First: 1, Last: 2}}})
+	for _, truncated := range [][]byte{encoded[:AckLen-1], encoded[:len(encoded)-1]} {
+		if _, err := DecodeAck(truncated); !errors.Is(err, ErrAckTooShort) {
+			t.Errorf("decoding %d bytes: %v", len(truncated), err)
+		}
+	}
+}
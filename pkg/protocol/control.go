@@ -0,0 +1,589 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Control messages are carried in the data of PacketTypeControl packets:
+//
+//	[version 1][type 1][body]
+//
+// Bodies are fixed-order fields in network byte order; byte strings carry a
+// 16-bit length prefix. Later versions of a message only ever append fields,
+// so decoders ignore trailing bytes they do not know. ControlVersion changes
+// only for incompatible changes.
+
+// ControlVersion is the version of the control message encoding
+const ControlVersion = 1
+
+// controlHeaderLen is the size of the version and type bytes
+const controlHeaderLen = 2
+
+var (
+	// ErrControlTooShort control message is truncated
+	ErrControlTooShort = errors.New("control message too short")
+	// ErrControlVersion control message uses an unsupported version
+	ErrControlVersion = errors.New("unsupported control message version")
+	// ErrUnknownControl control message type is not known
+	ErrUnknownControl = errors.New("unknown control message type")
+)
+
+// ControlType identifies the message carried in a PacketTypeControl packet
+type ControlType uint8
+
+const (
+	ControlHandshake       ControlType = iota + 1 // Session key handshake message
+	ControlHello                                  // Capabilities and WANs of the sender
+	ControlWANAdd                                 // A WAN became available
+	ControlWANRemove                              // A WAN was removed
+	ControlKeepalive                              // Keepalive with timestamps
+	ControlConfigRequest                          // Proposed session settings
+	ControlConfigAck                              // Negotiated session settings
+	ControlClose                                  // Graceful session close
+	ControlError                                  // Error report
+	ControlPathMTU                                // Path MTU discovered on a WAN
+	ControlBandwidthProbe                         // Request for a bandwidth probe train
+	ControlBandwidthReport                        // Rate a bandwidth probe train arrived at
+	ControlBindingProbe                           // NAT binding lifetime probe and its answer
+)
+
+func (t ControlType) String() string {
+	switch t {
+	case ControlHandshake:
+		return "Handshake"
+	case ControlHello:
+		return "Hello"
+	case ControlWANAdd:
+		return "WANAdd"
+	case ControlWANRemove:
+		return "WANRemove"
+	case ControlKeepalive:
+		return "Keepalive"
+	case ControlConfigRequest:
+		return "ConfigRequest"
+	case ControlConfigAck:
+		return "ConfigAck"
+	case ControlClose:
+		return "Close"
+	case ControlError:
+		return "Error"
+	case ControlPathMTU:
+		return "PathMTU"
+	case ControlBandwidthProbe:
+		return "BandwidthProbe"
+	case ControlBandwidthReport:
+		return "BandwidthReport"
+	case ControlBindingProbe:
+		return "BindingProbe"
+	default:
+		return fmt.Sprintf("Control(%d)", uint8(t))
+	}
+}
+
+// Capability is a feature supported by one end of a session
+type Capability uint32
+
+const (
+	CapabilityFEC          Capability = 1 << iota // Block FEC
+	CapabilityDuplication                         // Packet duplication across WANs
+	CapabilityEncryption                          // Tunnel encryption
+	CapabilityConfig                              // Session settings negotiation
+	CapabilityAck                                 // Per-WAN data acks for congestion control
+	CapabilityRetransmit                          // Retransmits the packets reported missing in acks
+	CapabilityFragment                            // Reassembles fragmented packets
+	CapabilityBandwidth                           // Sends and measures bandwidth probe trains
+	CapabilityBindingProbe                        // Answers NAT binding lifetime probes
+)
+
+// ErrorCode identifies the error reported in a ControlError message
+type ErrorCode uint16
+
+const (
+	ErrorUnknown            ErrorCode = iota // Unspecified error
+	ErrorUnsupportedVersion                  // Control version not supported
+	ErrorUnknownMessage                      // Control message type not known
+	ErrorMalformed                           // Control message could not be decoded
+	ErrorConfigRejected                      // Proposed settings cannot be used
+	ErrorUnauthorized                        // Peer is not allowed
+	ErrorInternal                            // Receiver failed to handle the message
+)
+
+func (c ErrorCode) String() string {
+	switch c {
+	case ErrorUnsupportedVersion:
+		return "unsupported version"
+	case ErrorUnknownMessage:
+		return "unknown message"
+	case ErrorMalformed:
+		return "malformed message"
+	case ErrorConfigRejected:
+		return "config rejected"
+	case ErrorUnauthorized:
+		return "unauthorized"
+	case ErrorInternal:
+		return "internal error"
+	default:
+		return "unknown error"
+	}
+}
+
+// CloseReason explains why a session is closed
+type CloseReason uint8
+
+const (
+	CloseShutdown CloseReason = iota // The sender is shutting down
+	CloseIdle                        // The session was idle for too long
+	CloseError                       // The session failed
+)
+
+// ControlMessage is a typed control message
+type ControlMessage interface {
+	ControlType() ControlType
+	appendBody(b []byte) []byte
+	decodeBody(r *controlReader)
+}
+
+// Handshake carries a session key handshake message
+type Handshake struct {
+	Payload []byte
+}
+
+// Hello announces the sender's capabilities and WANs. Response is set on the
+// reply to a Hello, which must not be answered again.
+type Hello struct {
+	Capabilities Capability
+	WANs         []uint8
+	Response     bool
+}
+
+// WANAdd announces a WAN that became available
+type WANAdd struct {
+	WANID    uint8
+	Type     WANType
+	Priority uint8
+	Weight   uint16
+}
+
+// WANRemove announces a WAN that was removed
+type WANRemove struct {
+	WANID uint8
+}
+
+// Keepalive carries the sender's clock. Echo is the Timestamp of the
+// keepalive being answered, or zero for a new keepalive.
+type Keepalive struct {
+	Timestamp int64
+	Echo      int64
+}
+
+// SessionSettings are the session parameters both ends must agree on
+type SessionSettings struct {
+	FECEnabled       bool
+	FECDataShards    uint8
+	FECParityShards  uint8
+	DuplicatePackets bool
+	ReorderBuffer    uint16
+	ReorderTimeout   time.Duration // Encoded in milliseconds
+}
+
+// Negotiate combines local settings with settings proposed by the peer.
+// Features are only used when both ends want them, FEC only with matching
+// shard counts, and the larger reorder window wins.
+func (s SessionSettings) Negotiate(remote SessionSettings) SessionSettings {
+	result := SessionSettings{
+		FECEnabled: s.FECEnabled && remote.FECEnabled &&
+			s.FECDataShards == remote.FECDataShards && s.FECParityShards == remote.FECParityShards,
+		DuplicatePackets: s.DuplicatePackets && remote.DuplicatePackets,
+		ReorderBuffer:    max(s.ReorderBuffer, remote.ReorderBuffer),
+		ReorderTimeout:   max(s.ReorderTimeout, remote.ReorderTimeout),
+	}
+	if result.FECEnabled {
+		result.FECDataShards, result.FECParityShards = s.FECDataShards, s.FECParityShards
+	}
+	return result
+}
+
+// ConfigRequest proposes session settings
+type ConfigRequest struct {
+	Settings SessionSettings
+}
+
+// ConfigAck returns the settings negotiated from a ConfigRequest
+type ConfigAck struct {
+	Settings SessionSettings
+}
+
+// Close announces that the sender is closing the session
+type Close struct {
+	Reason CloseReason
+}
+
+// Error reports a problem with a control message received from the peer
+type Error struct {
+	Code    ErrorCode
+	RefType ControlType // Type of the message that caused the error, if any
+	Message string
+}
+
+// PathMTU announces the largest datagram, as a UDP payload size, that path
+// MTU discovery found to get through from the sender on a WAN. Paths are
+// usually symmetric, so the receiver can size its own datagrams on the WAN
+// by it.
+type PathMTU struct {
+	WANID uint8
+	MTU   uint16
+}
+
+// BandwidthProbe asks the receiver to send a bandwidth probe train on a WAN,
+// so the sender can measure the WAN's capacity towards itself
+type BandwidthProbe struct {
+	WANID uint8
+}
+
+// BandwidthReport tells the sender of a bandwidth probe train the rate, in
+// bytes/sec, at which the train arrived: the WAN's capacity from the
+// receiver of the report to its sender
+type BandwidthReport struct {
+	WANID uint8
+	Train uint32 // ID of the train
+	Rate  uint64
+}
+
+// MaxBindingProbeIdle is the longest a BindingProbe may ask to wait before
+// it is answered
+const MaxBindingProbeIdle = 30 * time.Minute
+
+// MaxPendingBindingProbes is how many BindingProbes of one WAN the receiver
+// holds for their answer at a time. A sender waits for each answer before it
+// probes again, so more than a few only come from a misbehaving peer.
+const MaxPendingBindingProbes = 4
+
+// BindingProbe asks the receiver to answer, after Idle, to the address the
+// probe came from. The sender keeps that address silent meanwhile, so the
+// answer only gets through when the NAT binding of the address survives
+// being idle that long. Probes come from a socket of their own and do not
+// change the address of their WAN. The answer is the probe with Reply set.
+type BindingProbe struct {
+	WANID uint8
+	Probe uint32
+	Idle  time.Duration // Encoded in milliseconds
+	Reply bool
+}
+
+func (Handshake) ControlType() ControlType       { return ControlHandshake }
+func (Hello) ControlType() ControlType           { return ControlHello }
+func (WANAdd) ControlType() ControlType          { return ControlWANAdd }
+func (WANRemove) ControlType() ControlType       { return ControlWANRemove }
+func (Keepalive) ControlType() ControlType       { return ControlKeepalive }
+func (ConfigRequest) ControlType() ControlType   { return ControlConfigRequest }
+func (ConfigAck) ControlType() ControlType       { return ControlConfigAck }
+func (Close) ControlType() ControlType           { return ControlClose }
+func (Error) ControlType() ControlType           { return ControlError }
+func (PathMTU) ControlType() ControlType         { return ControlPathMTU }
+func (BandwidthProbe) ControlType() ControlType  { return ControlBandwidthProbe }
+func (BandwidthReport) ControlType() ControlType { return ControlBandwidthReport }
+func (BindingProbe) ControlType() ControlType    { return ControlBindingProbe }
+
+// EncodeControl encodes a control message for the data of a PacketTypeControl packet
+func EncodeControl(msg ControlMessage) []byte {
+	b := make([]byte, controlHeaderLen, 64)
+	b[0] = ControlVersion
+	b[1] = byte(msg.ControlType())
+	return msg.appendBody(b)
+}
+
+// DecodeControl decodes the data of a PacketTypeControl packet
+func DecodeControl(data []byte) (ControlMessage, error) {
+	if len(data) < controlHeaderLen {
+		return nil, ErrControlTooShort
+	}
+	if data[0] != ControlVersion {
+		return nil, ErrControlVersion
+	}
+
+	msg := newControlMessage(ControlType(data[1]))
+	if msg == nil {
+		return nil, ErrUnknownControl
+	}
+
+	r := &controlReader{b: data[controlHeaderLen:]}
+	msg.decodeBody(r)
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	return msg, nil
+}
+
+// ControlErrorCode returns the error code reported for a DecodeControl error
+func ControlErrorCode(err error) ErrorCode {
+	switch {
+	case errors.Is(err, ErrControlVersion):
+		return ErrorUnsupportedVersion
+	case errors.Is(err, ErrUnknownControl):
+		return ErrorUnknownMessage
+	default:
+		return ErrorMalformed
+	}
+}
+
+func newControlMessage(t ControlType) ControlMessage {
+	switch t {
+	case ControlHandshake:
+		return &Handshake{}
+	case ControlHello:
+		return &Hello{}
+	case ControlWANAdd:
+		return &WANAdd{}
+	case ControlWANRemove:
+		return &WANRemove{}
+	case ControlKeepalive:
+		return &Keepalive{}
+	case ControlConfigRequest:
+		return &ConfigRequest{}
+	case ControlConfigAck:
+		return &ConfigAck{}
+	case ControlClose:
+		return &Close{}
+	case ControlError:
+		return &Error{}
+	case ControlPathMTU:
+		return &PathMTU{}
+	case ControlBandwidthProbe:
+		return &BandwidthProbe{}
+	case ControlBandwidthReport:
+		return &BandwidthReport{}
+	case ControlBindingProbe:
+		return &BindingProbe{}
+	default:
+		return nil
+	}
+}
+
+func (m Handshake) appendBody(b []byte) []byte {
+	return append(b, m.Payload...)
+}
+
+func (m *Handshake) decodeBody(r *controlReader) {
+	// The handshake message is the rest of the data
+	m.Payload = r.rest()
+}
+
+func (m Hello) appendBody(b []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(m.Capabilities))
+	b = appendBytes(b, m.WANs)
+	return appendBool(b, m.Response)
+}
+
+func (m *Hello) decodeBody(r *controlReader) {
+	m.Capabilities = Capability(r.uint32())
+	m.WANs = r.bytes()
+	m.Response = r.bool()
+}
+
+func (m WANAdd) appendBody(b []byte) []byte {
+	b = append(b, m.WANID, byte(m.Type), m.Priority)
+	return binary.BigEndian.AppendUint16(b, m.Weight)
+}
+
+func (m *WANAdd) decodeBody(r *controlReader) {
+	m.WANID = r.uint8()
+	m.Type = WANType(r.uint8())
+	m.Priority = r.uint8()
+	m.Weight = r.uint16()
+}
+
+func (m WANRemove) appendBody(b []byte) []byte {
+	return append(b, m.WANID)
+}
+
+func (m *WANRemove) decodeBody(r *controlReader) {
+	m.WANID = r.uint8()
+}
+
+func (m Keepalive) appendBody(b []byte) []byte {
+	b = binary.BigEndian.AppendUint64(b, uint64(m.Timestamp))
+	return binary.BigEndian.AppendUint64(b, uint64(m.Echo))
+}
+
+func (m *Keepalive) decodeBody(r *controlReader) {
+	m.Timestamp = int64(r.uint64())
+	m.Echo = int64(r.uint64())
+}
+
+func (s SessionSettings) appendTo(b []byte) []byte {
+	b = appendBool(b, s.FECEnabled)
+	b = append(b, s.FECDataShards, s.FECParityShards)
+	b = appendBool(b, s.DuplicatePackets)
+	b = binary.BigEndian.AppendUint16(b, s.ReorderBuffer)
+	return binary.BigEndian.AppendUint32(b, uint32(s.ReorderTimeout/time.Millisecond))
+}
+
+func (s *SessionSettings) decodeFrom(r *controlReader) {
+	s.FECEnabled = r.bool()
+	s.FECDataShards = r.uint8()
+	s.FECParityShards = r.uint8()
+	s.DuplicatePackets = r.bool()
+	s.ReorderBuffer = r.uint16()
+	s.ReorderTimeout = time.Duration(r.uint32()) * time.Millisecond
+}
+
+func (m ConfigRequest) appendBody(b []byte) []byte   { return m.Settings.appendTo(b) }
+func (m *ConfigRequest) decodeBody(r *controlReader) { m.Settings.decodeFrom(r) }
+func (m ConfigAck) appendBody(b []byte) []byte       { return m.Settings.appendTo(b) }
+func (m *ConfigAck) decodeBody(r *controlReader)     { m.Settings.decodeFrom(r) }
+
+func (m Close) appendBody(b []byte) []byte {
+	return append(b, byte(m.Reason))
+}
+
+func (m *Close) decodeBody(r *controlReader) {
+	m.Reason = CloseReason(r.uint8())
+}
+
+func (m Error) appendBody(b []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(m.Code))
+	b = append(b, byte(m.RefType))
+	return appendBytes(b, []byte(m.Message))
+}
+
+func (m *Error) decodeBody(r *controlReader) {
+	m.Code = ErrorCode(r.uint16())
+	m.RefType = ControlType(r.uint8())
+	m.Message = string(r.bytes())
+}
+
+func (m PathMTU) appendBody(b []byte) []byte {
+	b = append(b, m.WANID)
+	return binary.BigEndian.AppendUint16(b, m.MTU)
+}
+
+func (m *PathMTU) decodeBody(r *controlReader) {
+	m.WANID = r.uint8()
+	m.MTU = r.uint16()
+}
+
+func (m BandwidthProbe) appendBody(b []byte) []byte {
+	return append(b, m.WANID)
+}
+
+func (m *BandwidthProbe) decodeBody(r *controlReader) {
+	m.WANID = r.uint8()
+}
+
+func (m BandwidthReport) appendBody(b []byte) []byte {
+	b = append(b, m.WANID)
+	b = binary.BigEndian.AppendUint32(b, m.Train)
+	return binary.BigEndian.AppendUint64(b, m.Rate)
+}
+
+func (m *BandwidthReport) decodeBody(r *controlReader) {
+	m.WANID = r.uint8()
+	m.Train = r.uint32()
+	m.Rate = r.uint64()
+}
+
+func (m BindingProbe) appendBody(b []byte) []byte {
+	b = append(b, m.WANID)
+	b = binary.BigEndian.AppendUint32(b, m.Probe)
+	b = binary.BigEndian.AppendUint32(b, uint32(m.Idle/time.Millisecond))
+	return appendBool(b, m.Reply)
+}
+
+func (m *BindingProbe) decodeBody(r *controlReader) {
+	m.WANID = r.uint8()
+	m.Probe = r.uint32()
+	m.Idle = time.Duration(r.uint32()) * time.Millisecond
+	m.Reply = r.bool()
+}
+
+// appendBytes appends a byte string with a 16-bit length prefix.
+// Longer strings are truncated.
+func appendBytes(b, s []byte) []byte {
+	if len(s) > 0xffff {
+		s = s[:0xffff]
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func appendBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, 1)
+	}
+	return append(b, 0)
+}
+
+// controlReader reads message fields, recording the first error.
+// After an error every read returns zero values.
+type controlReader struct {
+	b   []byte
+	err error
+}
+
+func (r *controlReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.b) < n {
+		r.err = ErrControlTooShort
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *controlReader) uint8() uint8 {
+	if v := r.next(1); v != nil {
+		return v[0]
+	}
+	return 0
+}
+
+func (r *controlReader) uint16() uint16 {
+	if v := r.next(2); v != nil {
+		return binary.BigEndian.Uint16(v)
+	}
+	return 0
+}
+
+func (r *controlReader) uint32() uint32 {
+	if v := r.next(4); v != nil {
+		return binary.BigEndian.Uint32(v)
+	}
+	return 0
+}
+
+func (r *controlReader) uint64() uint64 {
+	if v := r.next(8); v != nil {
+		return binary.BigEndian.Uint64(v)
+	}
+	return 0
+}
+
+func (r *controlReader) bool() bool {
+	return r.uint8() != 0
+}
+
+// bytes reads a length-prefixed byte string, returning nil when it is empty
+func (r *controlReader) bytes() []byte {
+	n := int(r.uint16())
+	if v := r.next(n); len(v) > 0 {
+		return append([]byte(nil), v...)
+	}
+	return nil
+}
+
+// rest returns the unread bytes, or nil when there are none
+func (r *controlReader) rest() []byte {
+	if r.err != nil || len(r.b) == 0 {
+		return nil
+	}
+	v := append([]byte(nil), r.b...)
+	r.b = nil
+	return v
+}
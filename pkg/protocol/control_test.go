@@ -0,0 +1,129 @@
+package protocol
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testControlMessages() []ControlMessage {
+	settings := SessionSettings{
+		FECEnabled:       true,
+		FECDataShards:    4,
+		FECParityShards:  2,
+		DuplicatePackets: true,
+		ReorderBuffer:    256,
+		ReorderTimeout:   500 * time.Millisecond,
+	}
+
+	return []ControlMessage{
+		&Handshake{Payload: []byte{0, 1, 2, 3}},
+		&Hello{Capabilities: CapabilityFEC | CapabilityConfig, WANs: []uint8{1, 2, 5}},
+		&Hello{Response: true},
+		&WANAdd{WANID: 3, Type: WANTypeLTE, Priority: 1, Weight: 50},
+		&WANRemove{WANID: 3},
+		&Keepalive{Timestamp: time.Now().UnixNano(), Echo: 12345},
+		&ConfigRequest{Settings: settings},
+		&ConfigAck{Settings: settings},
+		&Close{Reason: CloseIdle},
+		&Error{Code: ErrorConfigRejected, RefType: ControlConfigRequest, Message: "no FEC"},
+		&PathMTU{WANID: 2, MTU: 1452},
+		&BandwidthProbe{WANID: 2},
+		&BandwidthReport{WANID: 2, Train: 7, Rate: 12_500_000},
+		&BindingProbe{WANID: 2, Probe: 9, Idle: 90 * time.Second, Reply: true},
+	}
+}
+
+func TestControlRoundTrip(t *testing.T) {
+	for _, msg := range testControlMessages() {
+		decoded, err := DecodeControl(EncodeControl(msg))
+		if err != nil {
+			t.Fatalf("%v: %v", msg.ControlType(), err)
+		}
+		if !reflect.DeepEqual(decoded, msg) {
+			t.Fatalf("%v: got %+v, want %+v", msg.ControlType(), decoded, msg)
+		}
+	}
+}
+
+func TestControlIgnoresTrailingFields(t *testing.T) {
+	msg := &WANRemove{WANID: 7}
+	data := append(EncodeControl(msg), 0xaa, 0xbb)
+
+	decoded, err := DecodeControl(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, msg) {
+		t.Fatalf("got %+v, want %+v", decoded, msg)
+	}
+}
+
+func TestControlDecodeErrors(t *testing.T) {
+	keepalive := EncodeControl(&Keepalive{Timestamp: 1})
+
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+		code ErrorCode
+	}{
+		{"empty", nil, ErrControlTooShort, ErrorMalformed},
+		{"version", []byte{ControlVersion + 1, byte(ControlHello)}, ErrControlVersion, ErrorUnsupportedVersion},
+		{"type", []byte{ControlVersion, 0xee}, ErrUnknownControl, ErrorUnknownMessage},
+		{"truncated", keepalive[:len(keepalive)-1], ErrControlTooShort, ErrorMalformed},
+		{"string", []byte{ControlVersion, byte(ControlError), 0, 1, 0, 0, 5, 'a'}, ErrControlTooShort, ErrorMalformed},
+	}
+
+	for _, tt := range tests {
+		_, err := DecodeControl(tt.data)
+		if !errors.Is(err, tt.err) {
+			t.Fatalf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+		if code := ControlErrorCode(err); code != tt.code {
+			t.Fatalf("%s: code %v, want %v", tt.name, code, tt.code)
+		}
+	}
+}
+
+func TestSessionSettingsNegotiate(t *testing.T) {
+	local := SessionSettings{FECEnabled: true, FECDataShards: 4, FECParityShards: 2, DuplicatePackets: true, ReorderBuffer: 128, ReorderTimeout: time.Second}
+	remote := SessionSettings{FECEnabled: true, FECDataShards: 4, FECParityShards: 2, ReorderBuffer: 512, ReorderTimeout: 200 * time.Millisecond}
+
+	got := local.Negotiate(remote)
+	want := SessionSettings{FECEnabled: true, FECDataShards: 4, FECParityShards: 2, ReorderBuffer: 512, ReorderTimeout: time.Second}
+	if got != want {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	// Different shard counts disable FEC
+	remote.FECParityShards = 3
+	if got := local.Negotiate(remote); got.FECEnabled || got.FECDataShards != 0 {
+		t.Fatalf("FEC negotiated with mismatched shards: %+v", got)
+	}
+}
+
+func FuzzDecodeControl(f *testing.F) {
+	for _, msg := range testControlMessages() {
+		f.Add(EncodeControl(msg))
+	}
+	f.Add([]byte{})
+	f.Add([]byte{ControlVersion, byte(ControlHello), 0, 0, 0, 0, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := DecodeControl(data)
+		if err != nil {
+			return
+		}
+
+		// Whatever decodes must survive a round trip unchanged
+		again, err := DecodeControl(EncodeControl(msg))
+		if err != nil {
+			t.Fatalf("re-encoded %v does not decode: %v", msg.ControlType(), err)
+		}
+		if !reflect.DeepEqual(again, msg) {
+			t.Fatalf("round trip changed %v: %+v -> %+v", msg.ControlType(), msg, again)
+		}
+	})
+}
@@ -0,0 +1,96 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Heartbeats are carried in the data of PacketTypeHeartbeat packets:
+//
+//	[flags 1][seq 4][sent 8][received 8][replied 8]
+//
+// Timestamps are Unix nanoseconds. sent is stamped by the prober; received
+// and replied are stamped by the responder, on its own clock, when it turns
+// the probe into a reply. With all four timestamps of an exchange the prober
+// can take the responder's turnaround out of the round trip and estimate the
+// clock offset between the two ends, as NTP does.
+//
+// Path MTU probes are padded with trailing bytes to the size being probed.
+// Their replies are not, since only the probe needs to prove its size.
+// Packets of bandwidth probe trains are padded too, and never answered: the
+// receiver measures how far apart they arrive.
+
+// HeartbeatLen is the size of an encoded heartbeat
+const HeartbeatLen = 29
+
+// Heartbeat flags
+const (
+	HeartbeatReply    uint8 = 1 << 0 // The heartbeat answers a probe
+	HeartbeatMTUProbe uint8 = 1 << 1 // Path MTU probe; Seq is the probe size
+	HeartbeatTrain    uint8 = 1 << 2 // Bandwidth probe train packet; Seq is the train ID
+)
+
+// ErrHeartbeatTooShort heartbeat is truncated
+var ErrHeartbeatTooShort = errors.New("heartbeat too short")
+
+// Heartbeat is an in-band health probe or its reply
+type Heartbeat struct {
+	Flags    uint8
+	Seq      uint32 // Probe sequence number, per WAN
+	Sent     int64  // When the prober sent the probe
+	Received int64  // When the responder received the probe
+	Replied  int64  // When the responder sent the reply
+}
+
+// IsReply reports whether the heartbeat answers a probe
+func (h *Heartbeat) IsReply() bool {
+	return h.Flags&HeartbeatReply != 0
+}
+
+// IsMTUProbe reports whether the heartbeat is a path MTU probe or its reply
+func (h *Heartbeat) IsMTUProbe() bool {
+	return h.Flags&HeartbeatMTUProbe != 0
+}
+
+// IsTrain reports whether the heartbeat is a packet of a bandwidth probe train
+func (h *Heartbeat) IsTrain() bool {
+	return h.Flags&HeartbeatTrain != 0
+}
+
+// Reply turns a received probe into its reply. received is when the probe
+// arrived and replied when the reply is sent.
+func (h *Heartbeat) Reply(received, replied int64) *Heartbeat {
+	return &Heartbeat{
+		Flags:    h.Flags | HeartbeatReply,
+		Seq:      h.Seq,
+		Sent:     h.Sent,
+		Received: received,
+		Replied:  replied,
+	}
+}
+
+// EncodeHeartbeat encodes a heartbeat for the data of a PacketTypeHeartbeat packet
+func EncodeHeartbeat(h *Heartbeat) []byte {
+	buf := make([]byte, HeartbeatLen)
+	buf[0] = h.Flags
+	binary.BigEndian.PutUint32(buf[1:], h.Seq)
+	binary.BigEndian.PutUint64(buf[5:], uint64(h.Sent))
+	binary.BigEndian.PutUint64(buf[13:], uint64(h.Received))
+	binary.BigEndian.PutUint64(buf[21:], uint64(h.Replied))
+	return buf
+}
+
+// DecodeHeartbeat decodes the data of a PacketTypeHeartbeat packet.
+// Trailing bytes are ignored.
+func DecodeHeartbeat(data []byte) (*Heartbeat, error) {
+	if len(data) < HeartbeatLen {
+		return nil, ErrHeartbeatTooShort
+	}
+	return &Heartbeat{
+		Flags:    data[0],
+		Seq:      binary.BigEndian.Uint32(data[1:]),
+		Sent:     int64(binary.BigEndian.Uint64(data[5:])),
+		Received: int64(binary.BigEndian.Uint64(data[13:])),
+		Replied:  int64(binary.BigEndian.Uint64(data[21:])),
+	}, nil
+}
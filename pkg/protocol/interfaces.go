@@ -85,8 +85,9 @@ type PacketProcessor interface {
 	// Decode decodes a received packet
 	Decode(data []byte) (*Packet, error)
 
-	// Reorder handles packet reordering
-	Reorder(packet *Packet) ([]byte, bool, error)
+	// Reorder buffers a packet; packets are released in sequence order
+	// to the processor's deliver function
+	Reorder(packet *Packet) error
 
 	// Reset resets the reorder buffer
 	Reset()
@@ -47,6 +47,7 @@ const (
 	FlagEncrypted  uint16 = 1 << 3 // Packet is encrypted
 	FlagFragment   uint16 = 1 << 4 // Packet is fragmented
 	FlagLastFrag   uint16 = 1 << 5 // Last fragment
+	FlagRetransmit uint16 = 1 << 6 // Retransmission of a packet the peer reported missing
 )
 
 // WANInterface represents a single WAN connection
@@ -61,6 +62,28 @@ type WANInterface struct {
 	State       WANState      // Current state
 	Config      WANConfig     // Configuration
 	LastSeen    time.Time     // Last successful packet
+
+	// Relay, when set, carries the WAN's traffic instead of Conn, such as
+	// a TURN allocation for a WAN behind symmetric NAT or CGNAT
+	Relay net.PacketConn
+
+	// NAT is what NAT traversal on the WAN's own socket has learned, or
+	// nil until its discovery succeeds
+	NAT *WANNATInfo
+}
+
+// WANNATInfo describes the NAT a WAN sits behind
+type WANNATInfo struct {
+	LocalAddr         *net.UDPAddr  // Address of the WAN's socket
+	PublicAddr        *net.UDPAddr  // The WAN's address as seen from outside
+	NATType           string        // Type of NAT the WAN is behind
+	CanDirectConnect  bool          // Whether peers can reach the WAN by hole punching
+	NeedsRelay        bool          // Whether peers need a relay to reach the WAN
+	RelayAvailable    bool          // Whether a relay is configured to reach the WAN through
+	CGNATDetected     bool          // Whether the NAT is carrier-grade
+	KeepAliveInterval time.Duration // Interval that keeps the NAT mapping alive
+	BindingLifetime   time.Duration // How long the NAT binding survives idle; 0 until measured
+	Updated           time.Time     // When this was last learned
 }
 
 // WANType identifies the type of WAN connection
@@ -133,8 +156,12 @@ func (s WANState) String() string {
 type WANMetrics struct {
 	Latency       time.Duration // Current RTT
 	Jitter        time.Duration // Jitter (variance in latency)
+	ForwardDelay  time.Duration // Estimated one-way delay to the peer
+	ReverseDelay  time.Duration // Estimated one-way delay from the peer
 	PacketLoss    float64       // Packet loss percentage (0-100)
 	Bandwidth     uint64        // Available bandwidth in bytes/sec
+	BandwidthUp   uint64        // Estimated capacity towards the peer in bytes/sec
+	BandwidthDown uint64        // Estimated capacity from the peer in bytes/sec
 	BytesSent     uint64        // Total bytes sent
 	BytesReceived uint64        // Total bytes received
 	PacketsSent   uint64        // Total packets sent
@@ -184,6 +211,7 @@ type SessionConfig struct {
 	// Packet ordering
 	ReorderBuffer    int           // Size of reorder buffer
 	ReorderTimeout   time.Duration // Max time to wait for out-of-order packets
+	Retransmit       bool          // Resend packets the peer reports missing
 
 	// Load balancing
 	LoadBalanceMode  LoadBalanceMode // Load balancing strategy
@@ -218,12 +246,14 @@ const (
 	LoadBalancePerFlow                            // Consistent per-flow routing
 	LoadBalanceAdaptive                           // Adaptive based on conditions
 	LoadBalanceFailover                           // Failover mode (primary/backup with sub-second switching)
+	LoadBalanceEarliestDelivery                   // Send on the WAN expected to deliver first, keeping packets in order
 )
 
 // RoutingDecision contains information about where to send a packet
 type RoutingDecision struct {
 	PrimaryWAN   uint8   // Primary WAN to use
 	BackupWANs   []uint8 // Backup WANs for redundancy
+	Duplication  int     // Duplication rule that picked BackupWANs, from 1; 0 for none
 	UseFEC       bool    // Whether to use FEC for this packet
 	Priority     uint8   // Packet priority
 }
@@ -0,0 +1,149 @@
+package router
+
+import (
+	"sync"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+)
+
+// DefaultLinkBandwidth is assumed for WANs whose bandwidth is not known (bytes/sec)
+const DefaultLinkBandwidth = 12_500_000
+
+// CapacityEstimator estimates the rate a WAN can carry right now, such as a
+// congestion controller's window per round trip
+type CapacityEstimator interface {
+	// Capacity returns bytes/sec, or 0 when there is no estimate yet
+	Capacity() float64
+}
+
+// linkQueue models the bytes sent on a WAN that have not left its uplink yet
+type linkQueue struct {
+	backlog float64 // Bytes still queued
+	updated time.Time
+}
+
+// deliveryScheduler sends each packet on the WAN where it is expected to
+// arrive first, in the style of the earliest-delivery-path-first and BLEST
+// schedulers. A packet's delivery time on a WAN is the time to drain what is
+// already queued there, plus its own transmission time, plus the WAN's
+// one-way delay. The fast WAN carries everything until its queue grows long
+// enough that a slower WAN would deliver sooner, so packets sent later tend
+// to arrive later and the receiver has little to reorder.
+type deliveryScheduler struct {
+	mu         sync.Mutex
+	queues     map[uint8]*linkQueue
+	estimators map[uint8]CapacityEstimator
+	now        func() time.Time
+}
+
+func newDeliveryScheduler() *deliveryScheduler {
+	return &deliveryScheduler{
+		queues:     make(map[uint8]*linkQueue),
+		estimators: make(map[uint8]CapacityEstimator),
+		now:        time.Now,
+	}
+}
+
+// pick returns the WAN with the earliest expected delivery of size bytes and
+// queues the packet on it
+func (d *deliveryScheduler) pick(availableWANs []uint8, wans map[uint8]*protocol.WANInterface, metrics map[uint8]*protocol.WANMetrics, size int) uint8 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+
+	var best uint8
+	var bestQueue *linkQueue
+	var bestDelivery time.Duration
+	for _, id := range availableWANs {
+		bandwidth := d.bandwidth(id, wans[id], metrics[id])
+		queue := d.queue(id, now)
+		queue.drain(now, bandwidth)
+
+		transmit := time.Duration((queue.backlog + float64(size)) / bandwidth * float64(time.Second))
+		delivery := transmit + oneWayDelay(metrics[id])
+
+		if bestQueue == nil || delivery < bestDelivery || (delivery == bestDelivery && id < best) {
+			best, bestQueue, bestDelivery = id, queue, delivery
+		}
+	}
+
+	if bestQueue != nil {
+		bestQueue.backlog += float64(size)
+	}
+	return best
+}
+
+// queue returns the queue of a WAN, creating an empty one if needed
+func (d *deliveryScheduler) queue(wanID uint8, now time.Time) *linkQueue {
+	queue, exists := d.queues[wanID]
+	if !exists {
+		queue = &linkQueue{updated: now}
+		d.queues[wanID] = queue
+	}
+	return queue
+}
+
+// drain removes what a WAN has transmitted since the queue was last updated
+func (q *linkQueue) drain(now time.Time, bandwidth float64) {
+	if elapsed := now.Sub(q.updated); elapsed > 0 {
+		q.backlog = max(q.backlog-bandwidth*elapsed.Seconds(), 0)
+		q.updated = now
+	}
+}
+
+// remove forgets the queue and capacity estimator of a WAN
+func (d *deliveryScheduler) remove(wanID uint8) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.queues, wanID)
+	delete(d.estimators, wanID)
+}
+
+// setEstimator sets the capacity estimator of a WAN, or removes it when e is nil
+func (d *deliveryScheduler) setEstimator(wanID uint8, e CapacityEstimator) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if e == nil {
+		delete(d.estimators, wanID)
+		return
+	}
+	d.estimators[wanID] = e
+}
+
+// bandwidth returns the estimated capacity of a WAN when there is one, and
+// its best known link bandwidth otherwise
+func (d *deliveryScheduler) bandwidth(wanID uint8, wan *protocol.WANInterface, metrics *protocol.WANMetrics) float64 {
+	if e := d.estimators[wanID]; e != nil {
+		if capacity := e.Capacity(); capacity > 0 {
+			return capacity
+		}
+	}
+	return linkBandwidth(wan, metrics)
+}
+
+// linkBandwidth returns the best known bandwidth of a WAN in bytes/sec
+func linkBandwidth(wan *protocol.WANInterface, metrics *protocol.WANMetrics) float64 {
+	if metrics != nil && metrics.Bandwidth > 0 {
+		return float64(metrics.Bandwidth)
+	}
+	if wan != nil && wan.Config.MaxBandwidth > 0 {
+		return float64(wan.Config.MaxBandwidth)
+	}
+	return DefaultLinkBandwidth
+}
+
+// oneWayDelay returns the best known delay to the peer on a WAN
+func oneWayDelay(metrics *protocol.WANMetrics) time.Duration {
+	switch {
+	case metrics == nil:
+		return 0
+	case metrics.ForwardDelay > 0:
+		return metrics.ForwardDelay
+	case metrics.AvgLatency > 0:
+		return metrics.AvgLatency / 2
+	default:
+		return metrics.Latency / 2
+	}
+}
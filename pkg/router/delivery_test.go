@@ -0,0 +1,216 @@
+package router
+
+import (
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+)
+
+// emulatedLink is a WAN with a fixed one-way delay behind a FIFO uplink of
+// fixed rate
+type emulatedLink struct {
+	name      string
+	delay     time.Duration
+	bandwidth float64 // bytes/sec
+	busyUntil time.Time
+}
+
+// send returns when a packet sent at now arrives at the peer
+func (l *emulatedLink) send(now time.Time, size int) time.Time {
+	start := now
+	if l.busyUntil.After(start) {
+		start = l.busyUntil
+	}
+	l.busyUntil = start.Add(time.Duration(float64(size) / l.bandwidth * float64(time.Second)))
+	return l.busyUntil.Add(l.delay)
+}
+
+// reorderStats describes how far out of order packets arrived
+type reorderStats struct {
+	MaxDepth  uint64  // Largest number of sequence IDs a packet arrived behind
+	MeanDepth float64 // Average depth over late packets
+	Late      int     // Packets that arrived after a higher sequence ID
+	Sent      []int   // Packets sent on each link
+}
+
+// simulate sends count packets of size bytes, one every interval, through a
+// router in the given mode over emulated links, and measures the reordering
+// at the receiving end
+func simulate(t *testing.T, mode protocol.LoadBalanceMode, links []*emulatedLink, count, size int, interval time.Duration) reorderStats {
+	t.Helper()
+
+	clock := time.Unix(0, 0)
+	r := NewRouter(mode)
+	r.delivery.now = func() time.Time { return clock }
+
+	for i, link := range links {
+		id := uint8(i + 1)
+		r.AddWAN(&protocol.WANInterface{
+			ID:        id,
+			Name:      link.name,
+			LocalAddr: net.IPv4(127, 0, 0, 1),
+			State:     protocol.WANStateUp,
+			Config:    protocol.WANConfig{Enabled: true, Weight: 1},
+		})
+		r.UpdateMetrics(id, &protocol.WANMetrics{
+			AvgLatency: 2 * link.delay,
+			Bandwidth:  uint64(link.bandwidth),
+		})
+	}
+
+	type arrival struct {
+		seq uint64
+		at  time.Time
+	}
+	arrivals := make([]arrival, 0, count)
+	stats := reorderStats{Sent: make([]int, len(links))}
+
+	pkt := &protocol.Packet{Type: protocol.PacketTypeData, Priority: 128, Data: make([]byte, size)}
+	for seq := uint64(1); seq <= uint64(count); seq++ {
+		decision, err := r.Route(pkt, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		link := int(decision.PrimaryWAN) - 1
+		stats.Sent[link]++
+		arrivals = append(arrivals, arrival{seq: seq, at: links[link].send(clock, size)})
+		clock = clock.Add(interval)
+	}
+
+	sort.SliceStable(arrivals, func(i, j int) bool {
+		return arrivals[i].at.Before(arrivals[j].at)
+	})
+
+	var highest, total uint64
+	for _, a := range arrivals {
+		if a.seq > highest {
+			highest = a.seq
+			continue
+		}
+		depth := highest - a.seq
+		stats.Late++
+		stats.MaxDepth = max(stats.MaxDepth, depth)
+		total += depth
+	}
+	if stats.Late > 0 {
+		stats.MeanDepth = float64(total) / float64(stats.Late)
+	}
+	return stats
+}
+
+func TestEarliestDeliveryReducesReordering(t *testing.T) {
+	newLinks := func() []*emulatedLink {
+		return []*emulatedLink{
+			{name: "fiber", delay: 10 * time.Millisecond, bandwidth: 12_500_000},     // 100 Mbit/s
+			{name: "satellite", delay: 300 * time.Millisecond, bandwidth: 2_500_000}, // 20 Mbit/s
+		}
+	}
+
+	const size = 1250
+	for _, load := range []struct {
+		name string
+		rate float64 // Offered load in bytes/sec
+	}{
+		{"fiber alone suffices", 6_250_000},
+		{"both WANs needed", 14_375_000},
+	} {
+		t.Run(load.name, func(t *testing.T) {
+			interval := time.Duration(size / load.rate * float64(time.Second))
+			count := int(2 * time.Second / interval)
+
+			roundRobin := simulate(t, protocol.LoadBalanceRoundRobin, newLinks(), count, size, interval)
+			earliest := simulate(t, protocol.LoadBalanceEarliestDelivery, newLinks(), count, size, interval)
+
+			t.Logf("round robin:       %d late, max depth %d, mean depth %.1f, sent %v", roundRobin.Late, roundRobin.MaxDepth, roundRobin.MeanDepth, roundRobin.Sent)
+			t.Logf("earliest delivery: %d late, max depth %d, mean depth %.1f, sent %v", earliest.Late, earliest.MaxDepth, earliest.MeanDepth, earliest.Sent)
+
+			if load.rate > newLinks()[0].bandwidth && earliest.Sent[1] == 0 {
+				t.Fatal("earliest delivery never used the slow WAN under overload")
+			}
+			if earliest.MaxDepth*10 > roundRobin.MaxDepth {
+				t.Fatalf("earliest delivery max reorder depth %d, round robin %d", earliest.MaxDepth, roundRobin.MaxDepth)
+			}
+			if earliest.Late*10 > roundRobin.Late {
+				t.Fatalf("earliest delivery delivered %d packets late, round robin %d", earliest.Late, roundRobin.Late)
+			}
+		})
+	}
+}
+
+func TestEarliestDeliverySpillsOver(t *testing.T) {
+	clock := time.Unix(0, 0)
+	r := NewRouter(protocol.LoadBalanceEarliestDelivery)
+	r.delivery.now = func() time.Time { return clock }
+
+	for id, latency := range map[uint8]time.Duration{1: 20 * time.Millisecond, 2: 100 * time.Millisecond} {
+		r.AddWAN(&protocol.WANInterface{ID: id, State: protocol.WANStateUp, Config: protocol.WANConfig{Enabled: true}})
+		r.UpdateMetrics(id, &protocol.WANMetrics{AvgLatency: latency, Bandwidth: 1_000_000})
+	}
+
+	// 10ms one-way plus 1ms per KB queued: from the 42nd packet on the slow
+	// WAN, 50ms plus 1ms, delivers sooner
+	pkt := &protocol.Packet{Data: make([]byte, 1000)}
+	for i := 1; i <= 42; i++ {
+		decision, err := r.Route(pkt, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := uint8(1)
+		if i == 42 {
+			want = 2
+		}
+		if decision.PrimaryWAN != want {
+			t.Fatalf("packet %d sent on WAN %d, want %d", i, decision.PrimaryWAN, want)
+		}
+	}
+
+	// Once the queue drains the fast WAN is used again
+	clock = clock.Add(time.Second)
+	if decision, _ := r.Route(pkt, nil); decision.PrimaryWAN != 1 {
+		t.Fatalf("sent on WAN %d after the queue drained, want 1", decision.PrimaryWAN)
+	}
+}
+
+// fixedCapacity is a capacity estimator with a set estimate
+type fixedCapacity float64
+
+func (c fixedCapacity) Capacity() float64 { return float64(c) }
+
+func TestEarliestDeliveryUsesCapacityEstimate(t *testing.T) {
+	clock := time.Unix(0, 0)
+	r := NewRouter(protocol.LoadBalanceEarliestDelivery)
+	r.delivery.now = func() time.Time { return clock }
+
+	for id, latency := range map[uint8]time.Duration{1: 20 * time.Millisecond, 2: 100 * time.Millisecond} {
+		r.AddWAN(&protocol.WANInterface{ID: id, State: protocol.WANStateUp, Config: protocol.WANConfig{Enabled: true}})
+		r.UpdateMetrics(id, &protocol.WANMetrics{AvgLatency: latency, Bandwidth: 1_000_000})
+	}
+
+	// Without an estimate yet the measured bandwidth is used
+	r.SetCapacityEstimator(1, fixedCapacity(0))
+	pkt := &protocol.Packet{Data: make([]byte, 1000)}
+	if decision, _ := r.Route(pkt, nil); decision.PrimaryWAN != 1 {
+		t.Fatalf("sent on WAN %d, want 1", decision.PrimaryWAN)
+	}
+	clock = clock.Add(time.Second)
+
+	// At 100 KB/s each packet queues 10ms on the fast WAN, so the fifth one,
+	// at 60ms, is beaten by the slow WAN's 51ms
+	r.SetCapacityEstimator(1, fixedCapacity(100_000))
+	for i := 1; i <= 5; i++ {
+		decision, err := r.Route(pkt, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := uint8(1)
+		if i == 5 {
+			want = 2
+		}
+		if decision.PrimaryWAN != want {
+			t.Fatalf("packet %d sent on WAN %d, want %d", i, decision.PrimaryWAN, want)
+		}
+	}
+}
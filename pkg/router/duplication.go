@@ -0,0 +1,170 @@
+package router
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/bandwidth"
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+)
+
+// DuplicationRule sends copies of matching packets on more WANs. A packet
+// matches when its DPI application or category is one of Apps, or when it
+// was routed by one of the routing policies in Policies.
+type DuplicationRule struct {
+	Name     string
+	Apps     []string // DPI application or category names, case-insensitive
+	Policies []int    // Routing policy IDs
+	Copies   int      // WANs each packet is sent on, the primary included; 0 sends on all
+	Budget   uint64   // Bytes/sec of copies each WAN may carry for this rule; 0 is unlimited
+}
+
+// DuplicationStats counts the copies made for a duplication rule
+type DuplicationStats struct {
+	Name       string
+	Copies     uint64 // Copies sent
+	OverBudget uint64 // Copies not sent because a WAN was over budget
+}
+
+// duplicationEntry is a rule with its per-WAN budgets and counters
+type duplicationEntry struct {
+	DuplicationRule
+	budgets    map[uint8]*bandwidth.TokenBucket
+	copies     uint64
+	overBudget uint64
+}
+
+// Duplicator picks the WANs that carry copies of packets matching its rules.
+// Matching packets go on the lowest-latency WANs, the primary first unless a
+// routing policy pinned it. Copies are charged to the budgets once they are
+// sent, with Sent.
+type Duplicator struct {
+	mu    sync.Mutex
+	rules []*duplicationEntry
+	now   func() time.Time
+}
+
+// NewDuplicator creates a duplicator with the given rules, which are
+// evaluated in order
+func NewDuplicator(rules []DuplicationRule) *Duplicator {
+	d := &Duplicator{now: time.Now}
+	for _, rule := range rules {
+		d.rules = append(d.rules, &duplicationEntry{
+			DuplicationRule: rule,
+			budgets:         make(map[uint8]*bandwidth.TokenBucket),
+		})
+	}
+	return d
+}
+
+// Stats returns the counters of every rule
+func (d *Duplicator) Stats() []DuplicationStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	stats := make([]DuplicationStats, 0, len(d.rules))
+	for _, rule := range d.rules {
+		stats = append(stats, DuplicationStats{
+			Name:       rule.Name,
+			Copies:     rule.copies,
+			OverBudget: rule.overBudget,
+		})
+	}
+	return stats
+}
+
+// Sent charges a copy of size bytes sent on a WAN to the budget of the rule
+// that picked it, numbered as in protocol.RoutingDecision.Duplication
+func (d *Duplicator) Sent(rule int, wanID uint8, size int) {
+	if rule < 1 || rule > len(d.rules) {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entry := d.rules[rule-1]
+	entry.copies++
+	if entry.Budget > 0 {
+		// Copies queued before the budget ran out may overdraw it
+		entry.bucket(wanID).Charge(size, entry.Budget, d.now())
+	}
+}
+
+// bucket returns the budget of a WAN, full when it is new
+func (rule *duplicationEntry) bucket(wanID uint8) *bandwidth.TokenBucket {
+	bucket := rule.budgets[wanID]
+	if bucket == nil {
+		bucket = &bandwidth.TokenBucket{}
+		rule.budgets[wanID] = bucket
+	}
+	return bucket
+}
+
+// route returns the WANs of a packet of size bytes matching a rule,
+// numbered from 1 as match returns it: the primary, which is the
+// lowest-latency WAN unless pinned, and the WANs that carry copies
+func (d *Duplicator) route(rule int, primaryWAN uint8, pinned bool, availableWANs []uint8,
+	metrics map[uint8]*protocol.WANMetrics, size int) (uint8, []uint8) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entry := d.rules[rule-1]
+
+	sorted := slices.Clone(availableWANs)
+	slices.SortStableFunc(sorted, func(a, b uint8) int {
+		return cmp.Compare(latencyOf(metrics[a]), latencyOf(metrics[b]))
+	})
+	if !pinned {
+		primaryWAN = sorted[0]
+	}
+	candidates := slices.DeleteFunc(sorted, func(id uint8) bool { return id == primaryWAN })
+
+	want := len(candidates)
+	if entry.Copies > 0 {
+		want = min(entry.Copies-1, want)
+	}
+
+	now := d.now()
+	backups := make([]uint8, 0, want)
+	for _, id := range candidates {
+		if len(backups) == want {
+			break
+		}
+		if entry.Budget > 0 && !entry.bucket(id).Has(size, entry.Budget, now) {
+			entry.overBudget++
+			continue
+		}
+		backups = append(backups, id)
+	}
+
+	return primaryWAN, backups
+}
+
+// match returns the first rule matching the traffic, numbered from 1, or 0
+// when none does
+func (d *Duplicator) match(t *Traffic, policyID int) int {
+	for i, rule := range d.rules {
+		if policyID != 0 && slices.Contains(rule.Policies, policyID) {
+			return i + 1
+		}
+		if slices.ContainsFunc(rule.Apps, func(app string) bool {
+			return strings.EqualFold(app, t.App) || strings.EqualFold(app, t.Category)
+		}) {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// latencyOf returns the average latency in metrics; WANs without
+// measurements sort last
+func latencyOf(m *protocol.WANMetrics) time.Duration {
+	if m == nil || m.AvgLatency <= 0 {
+		return time.Duration(1<<63 - 1)
+	}
+	return m.AvgLatency
+}
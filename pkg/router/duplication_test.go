@@ -0,0 +1,128 @@
+package router
+
+import (
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+)
+
+func TestDuplicationRules(t *testing.T) {
+	r := NewRouter(protocol.LoadBalanceRoundRobin)
+	latencies := map[uint8]time.Duration{1: 30 * time.Millisecond, 2: 10 * time.Millisecond, 3: 20 * time.Millisecond, 4: 40 * time.Millisecond}
+	for id, latency := range latencies {
+		r.AddWAN(&protocol.WANInterface{ID: id, State: protocol.WANStateUp, Config: protocol.WANConfig{Enabled: true}})
+		r.UpdateMetrics(id, &protocol.WANMetrics{AvgLatency: latency})
+	}
+
+	r.SetPolicyEngine(NewPolicyEngine([]PolicyRule{
+		{ID: 5, Name: "ssh", Ports: []PortRange{{Low: 22, High: 22}}, WANs: []uint8{4}},
+	}))
+	d := NewDuplicator([]DuplicationRule{
+		{Name: "realtime", Apps: []string{"zoom", "gaming"}, Copies: 2},
+		{Name: "dns", Apps: []string{"DNS"}},
+		{Name: "ssh", Policies: []int{5}, Copies: 3},
+	})
+	r.SetDuplicator(d)
+
+	flow := &protocol.FlowKey{SrcIP: net.IPv4(10, 0, 0, 1), DstIP: net.IPv4(1, 1, 1, 1), DstPort: 443, Protocol: 6}
+	sshFlow := &protocol.FlowKey{SrcIP: net.IPv4(10, 0, 0, 1), DstIP: net.IPv4(1, 1, 1, 1), DstPort: 22, Protocol: 6}
+
+	tests := []struct {
+		name    string
+		traffic Traffic
+		primary uint8 // 0 for any
+		want    int   // Backups, taken from the lowest-latency WANs
+	}{
+		{"by application", Traffic{Flow: flow, App: "Zoom", Category: "Communication"}, 2, 1},
+		{"by category", Traffic{Flow: flow, App: "Fortnite", Category: "Gaming"}, 2, 1},
+		{"on all WANs", Traffic{Flow: flow, App: "DNS", Category: "System"}, 2, 3},
+		{"by routing policy", Traffic{Flow: sshFlow}, 4, 2},
+		{"unmatched", Traffic{Flow: flow, App: "YouTube", Category: "Streaming"}, 0, 0},
+	}
+	byLatency := []uint8{2, 3, 1, 4}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision, err := r.RouteTraffic(&protocol.Packet{Priority: 128}, &tt.traffic)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.primary != 0 && decision.PrimaryWAN != tt.primary {
+				t.Errorf("primary WAN %d, want %d", decision.PrimaryWAN, tt.primary)
+			}
+			want := slices.DeleteFunc(slices.Clone(byLatency), func(id uint8) bool { return id == decision.PrimaryWAN })[:tt.want]
+			if !slices.Equal(decision.BackupWANs, want) {
+				t.Errorf("primary WAN %d, backups %v, want %v", decision.PrimaryWAN, decision.BackupWANs, want)
+			}
+			for _, id := range decision.BackupWANs {
+				d.Sent(decision.Duplication, id, 0)
+			}
+		})
+	}
+
+	// Duplication rules replace duplication by priority, even when they add no copies
+	decision, _ := r.RouteTraffic(&protocol.Packet{Priority: 250}, &Traffic{Flow: flow, App: "YouTube"})
+	if len(decision.BackupWANs) != 1 {
+		t.Errorf("unmatched high-priority packet has backups %v, want one", decision.BackupWANs)
+	}
+
+	stats := d.Stats()
+	if stats[0].Copies != 2 || stats[1].Copies != 3 || stats[2].Copies != 2 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestDuplicationBudget(t *testing.T) {
+	r := NewRouter(protocol.LoadBalanceRoundRobin)
+	for id := uint8(1); id <= 3; id++ {
+		r.AddWAN(&protocol.WANInterface{ID: id, State: protocol.WANStateUp, Config: protocol.WANConfig{Enabled: true}})
+		r.UpdateMetrics(id, &protocol.WANMetrics{AvgLatency: time.Duration(id) * time.Millisecond})
+	}
+
+	now := time.Unix(0, 0)
+	d := NewDuplicator([]DuplicationRule{{Name: "dns", Apps: []string{"dns"}, Budget: 1000}})
+	d.now = func() time.Time { return now }
+	r.SetDuplicator(d)
+
+	traffic := &Traffic{Flow: &protocol.FlowKey{}, App: "DNS"}
+	pkt := &protocol.Packet{Data: make([]byte, 400)}
+	copies := func(send bool) int {
+		total := 0
+		for i := 0; i < 10; i++ {
+			decision, err := r.RouteTraffic(pkt, traffic)
+			if err != nil {
+				t.Fatal(err)
+			}
+			total += len(decision.BackupWANs)
+			if !send {
+				continue
+			}
+			for _, id := range decision.BackupWANs {
+				d.Sent(decision.Duplication, id, len(pkt.Data))
+			}
+		}
+		return total
+	}
+
+	// Copies not sent cost nothing
+	if got := copies(false); got != 10*2 {
+		t.Errorf("picked %d copies without sending any, want %d", got, 10*2)
+	}
+
+	// Each WAN carries at most a second's budget of copies at once
+	if got := copies(true); got > 3*2 {
+		t.Errorf("sent %d copies of 400 bytes within a 1000 B/s budget on 3 WANs", got)
+	}
+
+	// The budget refills with time
+	now = now.Add(time.Second)
+	if got := copies(true); got == 0 {
+		t.Error("no copies after the budget refilled")
+	}
+
+	if stats := d.Stats(); stats[0].OverBudget == 0 {
+		t.Errorf("stats = %+v, want copies over budget", stats)
+	}
+}
@@ -8,16 +8,28 @@ import (
 	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
 )
 
+const (
+	// DefaultFailoverHoldDown is how long after a switch no failback happens
+	DefaultFailoverHoldDown = 5 * time.Second
+	// DefaultFailbackStability is how long a higher priority WAN must stay
+	// healthy before traffic fails back to it
+	DefaultFailbackStability = 10 * time.Second
+)
+
 // FailoverManager handles automatic failover between WANs based on health
 type FailoverManager struct {
 	mu               sync.RWMutex
 	router           *Router
-	wanHealth        map[uint8]bool // WANID -> is healthy
-	primaryWAN       uint8          // Current primary WAN
-	activeWAN        uint8          // Currently active WAN
-	wansByPriority   []uint8        // WANs sorted by priority (0 = highest)
+	wanHealth        map[uint8]bool      // WANID -> is healthy
+	healthySince     map[uint8]time.Time // WANID -> when it last became healthy
+	priorities       map[uint8]int       // WANID -> priority
+	primaryWAN       uint8               // Current primary WAN
+	activeWAN        uint8               // Currently active WAN
+	wansByPriority   []uint8             // WANs sorted by priority (0 = highest)
 	lastFailover     time.Time
 	failoverCount    uint64
+	holdDown         time.Duration
+	stability        time.Duration
 	failoverCallback func(oldWAN, newWAN uint8, reason string)
 }
 
@@ -26,10 +38,24 @@ func NewFailoverManager(router *Router) *FailoverManager {
 	return &FailoverManager{
 		router:         router,
 		wanHealth:      make(map[uint8]bool),
+		healthySince:   make(map[uint8]time.Time),
+		priorities:     make(map[uint8]int),
 		wansByPriority: make([]uint8, 0),
+		holdDown:       DefaultFailoverHoldDown,
+		stability:      DefaultFailbackStability,
 	}
 }
 
+// SetTimers sets how long after a switch failback is held down and how long
+// a higher priority WAN must stay healthy before traffic fails back to it.
+// Failover away from a failed WAN is never delayed.
+func (fm *FailoverManager) SetTimers(holdDown, stability time.Duration) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	fm.holdDown = holdDown
+	fm.stability = stability
+}
+
 // SetFailoverCallback sets a callback function that's called when failover occurs
 func (fm *FailoverManager) SetFailoverCallback(callback func(oldWAN, newWAN uint8, reason string)) {
 	fm.mu.Lock()
@@ -43,8 +69,11 @@ func (fm *FailoverManager) UpdateWANHealth(wanID uint8, isHealthy bool) bool {
 	fm.mu.Lock()
 	defer fm.mu.Unlock()
 
-	oldHealth := fm.wanHealth[wanID]
+	oldHealth, known := fm.wanHealth[wanID]
 	fm.wanHealth[wanID] = isHealthy
+	if isHealthy && (!oldHealth || !known) {
+		fm.healthySince[wanID] = time.Now()
+	}
 
 	// If health status changed, log it
 	if oldHealth != isHealthy {
@@ -61,6 +90,11 @@ func (fm *FailoverManager) UpdateWANHealth(wanID uint8, isHealthy bool) bool {
 		return fm.performFailover()
 	}
 
+	// A WAN came up while the active one is down
+	if isHealthy && !fm.wanHealth[fm.activeWAN] {
+		return fm.performFailover()
+	}
+
 	// Check if a higher priority WAN came back up
 	if isHealthy && fm.shouldFailbackTo(wanID) {
 		// Higher priority WAN is back - fail back to it
@@ -93,6 +127,9 @@ func (fm *FailoverManager) performFailover() bool {
 	fm.failoverCount++
 
 	reason := fmt.Sprintf("WAN %d failed health check", oldWAN)
+	if _, exists := fm.priorities[oldWAN]; !exists {
+		reason = fmt.Sprintf("WAN %d was removed", oldWAN)
+	}
 	fmt.Printf("[Failover] Switched from WAN %d to WAN %d (reason: %s)\n", oldWAN, newWAN, reason)
 
 	// Call callback if set
@@ -109,10 +146,12 @@ func (fm *FailoverManager) performFailback(higherPriorityWAN uint8) bool {
 
 	// Only fail back if the higher priority WAN has been stable
 	// (avoid flapping)
-	const stabilityPeriod = 5 * time.Second
-	if time.Since(fm.lastFailover) < stabilityPeriod {
+	if time.Since(fm.lastFailover) < fm.holdDown {
 		return false // Too soon after last failover
 	}
+	if time.Since(fm.healthySince[higherPriorityWAN]) < fm.stability {
+		return false // Not healthy for long enough
+	}
 
 	fm.activeWAN = higherPriorityWAN
 	fm.lastFailover = time.Now()
@@ -128,6 +167,27 @@ func (fm *FailoverManager) performFailback(higherPriorityWAN uint8) bool {
 	return true
 }
 
+// CheckFailback fails back to the highest priority healthy WAN once the
+// hold-down and stability timers allow it. It should be called periodically,
+// since the timers expire without any change in health.
+// Returns true if failback was performed
+func (fm *FailoverManager) CheckFailback() bool {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+
+	best := fm.findNextHealthyWAN()
+	if best == 0 || best == fm.activeWAN {
+		return false
+	}
+	if !fm.wanHealth[fm.activeWAN] {
+		return fm.performFailover()
+	}
+	if !fm.shouldFailbackTo(best) {
+		return false
+	}
+	return fm.performFailback(best)
+}
+
 // findNextHealthyWAN finds the next available healthy WAN by priority
 func (fm *FailoverManager) findNextHealthyWAN() uint8 {
 	// Return first healthy WAN by priority
@@ -152,11 +212,8 @@ func (fm *FailoverManager) shouldFailbackTo(wanID uint8) bool {
 
 // getWANPriority returns the priority of a WAN
 func (fm *FailoverManager) getWANPriority(wanID uint8) int {
-	fm.router.mu.RLock()
-	defer fm.router.mu.RUnlock()
-
-	if wan, exists := fm.router.wans[wanID]; exists {
-		return wan.Config.Priority
+	if priority, exists := fm.priorities[wanID]; exists {
+		return priority
 	}
 
 	return 999 // Very low priority if WAN not found
@@ -174,23 +231,35 @@ func (fm *FailoverManager) UpdateWANsByPriority(wans map[uint8]*protocol.WANInte
 	}
 
 	priorities := make([]wanPriority, 0, len(wans))
+	fm.priorities = make(map[uint8]int, len(wans))
 	for wanID, wan := range wans {
 		priorities = append(priorities, wanPriority{
 			ID:       wanID,
 			Priority: wan.Config.Priority,
 		})
+		fm.priorities[wanID] = wan.Config.Priority
 
 		// Initialize health status if not present
 		if _, exists := fm.wanHealth[wanID]; !exists {
-			fm.wanHealth[wanID] = true // Assume healthy initially
+			fm.wanHealth[wanID] = wan.State != protocol.WANStateDown // Assume healthy unless known down
+			fm.healthySince[wanID] = time.Now()
 		}
 	}
 
-	// Sort by priority (lower number = higher priority)
+	// Forget removed WANs
+	for wanID := range fm.wanHealth {
+		if _, exists := wans[wanID]; !exists {
+			delete(fm.wanHealth, wanID)
+			delete(fm.healthySince, wanID)
+		}
+	}
+
+	// Sort by priority (lower number = higher priority), then by ID
 	// Simple bubble sort for small arrays
 	for i := 0; i < len(priorities); i++ {
 		for j := i + 1; j < len(priorities); j++ {
-			if priorities[j].Priority < priorities[i].Priority {
+			if priorities[j].Priority < priorities[i].Priority ||
+				(priorities[j].Priority == priorities[i].Priority && priorities[j].ID < priorities[i].ID) {
 				priorities[i], priorities[j] = priorities[j], priorities[i]
 			}
 		}
@@ -202,10 +271,20 @@ func (fm *FailoverManager) UpdateWANsByPriority(wans map[uint8]*protocol.WANInte
 		fm.wansByPriority[i] = wp.ID
 	}
 
-	// Set primary and active WAN to highest priority (if not set)
-	if len(fm.wansByPriority) > 0 && fm.primaryWAN == 0 {
-		fm.primaryWAN = fm.wansByPriority[0]
-		fm.activeWAN = fm.wansByPriority[0]
+	// The primary WAN is the highest priority one; the active WAN starts
+	// there and moves if it is removed
+	if len(fm.wansByPriority) == 0 {
+		fm.primaryWAN, fm.activeWAN = 0, 0
+		return
+	}
+	fm.primaryWAN = fm.wansByPriority[0]
+	if fm.activeWAN == 0 {
+		fm.activeWAN = fm.findNextHealthyWAN()
+		if fm.activeWAN == 0 {
+			fm.activeWAN = fm.primaryWAN
+		}
+	} else if _, exists := wans[fm.activeWAN]; !exists {
+		fm.performFailover()
 	}
 }
 
@@ -0,0 +1,102 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+)
+
+func TestFailoverAndFailback(t *testing.T) {
+	r := NewRouter(protocol.LoadBalanceFailover)
+	wans := make(map[uint8]*protocol.WANInterface)
+	for id, priority := range map[uint8]int{1: 0, 2: 1, 3: 2} {
+		wans[id] = &protocol.WANInterface{
+			ID:     id,
+			State:  protocol.WANStateUp,
+			Config: protocol.WANConfig{Enabled: true, Priority: priority},
+		}
+		r.AddWAN(wans[id])
+	}
+
+	fm := NewFailoverManager(r)
+	fm.SetTimers(50*time.Millisecond, 100*time.Millisecond)
+	switches := make(chan [2]uint8, 10)
+	fm.SetFailoverCallback(func(oldWAN, newWAN uint8, reason string) {
+		switches <- [2]uint8{oldWAN, newWAN}
+	})
+	fm.UpdateWANsByPriority(wans)
+	r.SetFailoverManager(fm)
+
+	route := func() uint8 {
+		t.Helper()
+		decision, err := r.Route(&protocol.Packet{Priority: 128}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return decision.PrimaryWAN
+	}
+	expectSwitch := func(from, to uint8) {
+		t.Helper()
+		select {
+		case got := <-switches:
+			if got != [2]uint8{from, to} {
+				t.Fatalf("switched %d -> %d, want %d -> %d", got[0], got[1], from, to)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no switch from %d to %d", from, to)
+		}
+	}
+
+	if wan := route(); wan != 1 {
+		t.Fatalf("routed on WAN %d, want the primary", wan)
+	}
+
+	// The primary fails: traffic moves to the next priority at once
+	wans[1].State = protocol.WANStateDown
+	if !fm.UpdateWANHealth(1, false) {
+		t.Fatal("expected failover")
+	}
+	expectSwitch(1, 2)
+	if wan := route(); wan != 2 {
+		t.Fatalf("routed on WAN %d after failover, want 2", wan)
+	}
+
+	// The primary recovers, but must stay healthy before traffic fails back
+	wans[1].State = protocol.WANStateUp
+	if fm.UpdateWANHealth(1, true) || fm.CheckFailback() {
+		t.Fatal("failed back before the stability period")
+	}
+	if wan := route(); wan != 2 {
+		t.Fatalf("routed on WAN %d during the stability period, want 2", wan)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if !fm.CheckFailback() {
+		t.Fatal("expected failback")
+	}
+	expectSwitch(2, 1)
+	if wan := route(); wan != 1 {
+		t.Fatalf("routed on WAN %d after failback, want 1", wan)
+	}
+
+	// A flapping primary is held down after the switch
+	fm.UpdateWANHealth(1, false)
+	expectSwitch(1, 2)
+	fm.UpdateWANHealth(1, true)
+	time.Sleep(120 * time.Millisecond)
+	fm.UpdateWANHealth(1, false) // Flaps again before failing back
+	fm.UpdateWANHealth(1, true)
+	if fm.CheckFailback() {
+		t.Fatal("failed back to a WAN that just flapped")
+	}
+
+	// Removing the active WAN moves traffic at once, to the best healthy WAN
+	delete(wans, 2)
+	r.RemoveWAN(2)
+	fm.UpdateWANsByPriority(wans)
+	expectSwitch(2, 1)
+	if count, _ := fm.GetFailoverStats(); count != 3 {
+		t.Fatalf("expected 3 failovers, got %d", count)
+	}
+}
@@ -0,0 +1,180 @@
+package router
+
+import (
+	"cmp"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+)
+
+// PortRange is an inclusive range of transport ports
+type PortRange struct {
+	Low  uint16
+	High uint16
+}
+
+// PolicyRule pins matching traffic to a group of WANs. A packet matches when
+// it satisfies every non-empty match field; a rule with no match fields
+// matches all traffic.
+type PolicyRule struct {
+	ID       int
+	Name     string
+	Priority int // Lower is evaluated first
+
+	SrcNets   []*net.IPNet
+	DstNets   []*net.IPNet
+	Protocols []uint8     // IP protocol numbers
+	Ports     []PortRange // Destination ports
+	Apps      []string    // DPI application or category names, case-insensitive
+	DSCP      []uint8
+
+	WANs []uint8 // In order of preference; later WANs are fallbacks
+}
+
+// Traffic describes a packet for policy matching
+type Traffic struct {
+	Flow     *protocol.FlowKey
+	DSCP     uint8
+	App      string // DPI application, e.g. "YouTube"
+	Category string // DPI category, e.g. "Streaming"
+}
+
+// PolicyStats counts the packets matched by a policy rule
+type PolicyStats struct {
+	ID          int
+	Name        string
+	Hits        uint64 // Packets that matched the rule
+	Unavailable uint64 // Matches left to the load balancing mode because none of the rule's WANs was up
+}
+
+// policyEntry is a rule with its counters
+type policyEntry struct {
+	PolicyRule
+	hits        atomic.Uint64
+	unavailable atomic.Uint64
+}
+
+// PolicyEngine routes traffic by the first matching policy rule, evaluating
+// rules by priority and then by ID
+type PolicyEngine struct {
+	mu    sync.RWMutex
+	rules []*policyEntry
+}
+
+// NewPolicyEngine creates a policy engine with the given rules
+func NewPolicyEngine(rules []PolicyRule) *PolicyEngine {
+	e := &PolicyEngine{}
+	e.SetRules(rules)
+	return e
+}
+
+// SetRules replaces the rules and resets their counters
+func (e *PolicyEngine) SetRules(rules []PolicyRule) {
+	entries := make([]*policyEntry, len(rules))
+	for i := range rules {
+		entries[i] = &policyEntry{PolicyRule: rules[i]}
+	}
+	slices.SortStableFunc(entries, func(a, b *policyEntry) int {
+		if c := cmp.Compare(a.Priority, b.Priority); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.ID, b.ID)
+	})
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rules = entries
+}
+
+// Stats returns the counters of every rule in evaluation order
+func (e *PolicyEngine) Stats() []PolicyStats {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	stats := make([]PolicyStats, 0, len(e.rules))
+	for _, rule := range e.rules {
+		stats = append(stats, PolicyStats{
+			ID:          rule.ID,
+			Name:        rule.Name,
+			Hits:        rule.hits.Load(),
+			Unavailable: rule.unavailable.Load(),
+		})
+	}
+	return stats
+}
+
+// route returns the ID of the first rule matching t, or 0, and the first
+// available WAN of that rule. It returns false when no rule matches or when
+// none of the matching rule's WANs is available, leaving the packet to the
+// load balancing mode.
+func (e *PolicyEngine) route(t *Traffic, availableWANs []uint8) (policyID int, wanID uint8, ok bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	for _, rule := range e.rules {
+		if !rule.matches(t) {
+			continue
+		}
+		rule.hits.Add(1)
+
+		for _, id := range rule.WANs {
+			if slices.Contains(availableWANs, id) {
+				return rule.ID, id, true
+			}
+		}
+		rule.unavailable.Add(1)
+		return rule.ID, 0, false
+	}
+
+	return 0, 0, false
+}
+
+// matches reports whether traffic satisfies every match field of the rule
+func (r *PolicyRule) matches(t *Traffic) bool {
+	flow := t.Flow
+	if len(r.SrcNets) > 0 && !containsIP(r.SrcNets, flow.SrcIP) {
+		return false
+	}
+	if len(r.DstNets) > 0 && !containsIP(r.DstNets, flow.DstIP) {
+		return false
+	}
+	if len(r.Protocols) > 0 && !slices.Contains(r.Protocols, flow.Protocol) {
+		return false
+	}
+	if len(r.Ports) > 0 && !containsPort(r.Ports, flow.DstPort) {
+		return false
+	}
+	if len(r.DSCP) > 0 && !slices.Contains(r.DSCP, t.DSCP) {
+		return false
+	}
+	if len(r.Apps) > 0 && !slices.ContainsFunc(r.Apps, func(app string) bool {
+		return strings.EqualFold(app, t.App) || strings.EqualFold(app, t.Category)
+	}) {
+		return false
+	}
+	return true
+}
+
+// containsIP reports whether any of the networks contains ip
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsPort reports whether any of the ranges contains port
+func containsPort(ranges []PortRange, port uint16) bool {
+	for _, pr := range ranges {
+		if port >= pr.Low && port <= pr.High {
+			return true
+		}
+	}
+	return false
+}
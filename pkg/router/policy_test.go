@@ -0,0 +1,84 @@
+package router
+
+import (
+	"net"
+	"testing"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+)
+
+func TestPolicyRouting(t *testing.T) {
+	r := NewRouter(protocol.LoadBalanceRoundRobin)
+	wans := make(map[uint8]*protocol.WANInterface)
+	for id := uint8(1); id <= 3; id++ {
+		wans[id] = &protocol.WANInterface{ID: id, State: protocol.WANStateUp, Config: protocol.WANConfig{Enabled: true}}
+		r.AddWAN(wans[id])
+	}
+
+	_, lan, _ := net.ParseCIDR("192.168.1.0/24")
+	engine := NewPolicyEngine([]PolicyRule{
+		{ID: 1, Name: "catch-all", Priority: 100, WANs: []uint8{1}},
+		{ID: 2, Name: "voip", Priority: 10, Protocols: []uint8{17}, Ports: []PortRange{{Low: 5060, High: 5061}}, DSCP: []uint8{46}, WANs: []uint8{3, 2}},
+		{ID: 3, Name: "streaming", Priority: 20, Apps: []string{"streaming"}, WANs: []uint8{2}},
+		{ID: 4, Name: "lan", Priority: 20, SrcNets: []*net.IPNet{lan}, WANs: []uint8{3}},
+	})
+	r.SetPolicyEngine(engine)
+
+	flow := func(src string, proto uint8, dstPort uint16) *protocol.FlowKey {
+		return &protocol.FlowKey{SrcIP: net.ParseIP(src), DstIP: net.ParseIP("1.1.1.1"), SrcPort: 40000, DstPort: dstPort, Protocol: proto}
+	}
+
+	tests := []struct {
+		name    string
+		traffic Traffic
+		want    uint8
+	}{
+		{"voip", Traffic{Flow: flow("10.0.0.1", 17, 5060), DSCP: 46}, 3},
+		{"voip without DSCP", Traffic{Flow: flow("10.0.0.1", 17, 5060)}, 1},
+		{"streaming category", Traffic{Flow: flow("10.0.0.1", 6, 443), App: "YouTube", Category: "Streaming"}, 2},
+		{"lan source", Traffic{Flow: flow("192.168.1.20", 6, 443)}, 3},
+		{"same priority goes by ID", Traffic{Flow: flow("192.168.1.20", 6, 443), Category: "Streaming"}, 2},
+		{"catch-all", Traffic{Flow: flow("10.0.0.1", 6, 22)}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision, err := r.RouteTraffic(&protocol.Packet{}, &tt.traffic)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decision.PrimaryWAN != tt.want {
+				t.Errorf("routed to WAN %d, want %d", decision.PrimaryWAN, tt.want)
+			}
+		})
+	}
+
+	// Traffic falls back through the rule's WAN group, then to the mode
+	voip := Traffic{Flow: flow("10.0.0.1", 17, 5061), DSCP: 46}
+	wans[3].State = protocol.WANStateDown
+	if decision, _ := r.RouteTraffic(&protocol.Packet{}, &voip); decision.PrimaryWAN != 2 {
+		t.Errorf("with WAN 3 down, routed to WAN %d, want fallback WAN 2", decision.PrimaryWAN)
+	}
+	wans[2].State = protocol.WANStateDown
+	if decision, _ := r.RouteTraffic(&protocol.Packet{}, &voip); decision.PrimaryWAN != 1 {
+		t.Errorf("with the whole group down, routed to WAN %d, want WAN 1", decision.PrimaryWAN)
+	}
+
+	want := map[int]PolicyStats{
+		1: {ID: 1, Name: "catch-all", Hits: 2},
+		2: {ID: 2, Name: "voip", Hits: 3, Unavailable: 1},
+		3: {ID: 3, Name: "streaming", Hits: 2},
+		4: {ID: 4, Name: "lan", Hits: 1},
+	}
+	stats := engine.Stats()
+	if len(stats) != len(want) {
+		t.Fatalf("got stats for %d rules, want %d", len(stats), len(want))
+	}
+	for i, st := range stats {
+		if st != want[st.ID] {
+			t.Errorf("rule %d stats = %+v, want %+v", st.ID, st, want[st.ID])
+		}
+		if order := []int{2, 3, 4, 1}; st.ID != order[i] {
+			t.Errorf("rule %d evaluated at position %d, want %d", st.ID, i, order[i])
+		}
+	}
+}
@@ -2,7 +2,8 @@ package router
 
 import (
 	"fmt"
-	"hash/fnv"
+	"net"
+	"slices"
 	"sync"
 	"time"
 
@@ -15,10 +16,15 @@ type Router struct {
 	wans            map[uint8]*protocol.WANInterface
 	mode            protocol.LoadBalanceMode
 	currentWAN      uint8 // For round-robin
-	flowMap         map[string]uint8 // flow key string -> WAN ID
+	flowMu          sync.Mutex // Guards flowMap, which is written while routing
+	flowMap         map[flowID]uint8 // flow -> WAN ID
 	metrics         map[uint8]*protocol.WANMetrics
 	bandwidthUsage  map[uint8]uint64
 	lastCleanup     time.Time
+	delivery        *deliveryScheduler
+	failover        *FailoverManager
+	policies        *PolicyEngine
+	duplicator      *Duplicator
 }
 
 // NewRouter creates a new router
@@ -26,10 +32,11 @@ func NewRouter(mode protocol.LoadBalanceMode) *Router {
 	return &Router{
 		wans:           make(map[uint8]*protocol.WANInterface),
 		mode:           mode,
-		flowMap:        make(map[string]uint8),
+		flowMap:        make(map[flowID]uint8),
 		metrics:        make(map[uint8]*protocol.WANMetrics),
 		bandwidthUsage: make(map[uint8]uint64),
 		lastCleanup:    time.Now(),
+		delivery:       newDeliveryScheduler(),
 	}
 }
 
@@ -47,10 +54,17 @@ func (r *Router) RemoveWAN(wanID uint8) {
 	defer r.mu.Unlock()
 	delete(r.wans, wanID)
 	delete(r.bandwidthUsage, wanID)
+	r.delivery.remove(wanID)
 }
 
 // Route determines routing for a packet
 func (r *Router) Route(packet *protocol.Packet, flowKey *protocol.FlowKey) (*protocol.RoutingDecision, error) {
+	return r.RouteTraffic(packet, &Traffic{Flow: flowKey})
+}
+
+// RouteTraffic determines routing for a packet, pinning it to a WAN when it
+// matches a policy rule
+func (r *Router) RouteTraffic(packet *protocol.Packet, traffic *Traffic) (*protocol.RoutingDecision, error) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
@@ -64,54 +78,78 @@ func (r *Router) Route(packet *protocol.Packet, flowKey *protocol.FlowKey) (*pro
 		Priority: packet.Priority,
 	}
 
-	// Select primary WAN based on mode
+	// Policy rules take precedence over the load balancing mode
+	policyID, policyRouted := 0, false
+	if r.policies != nil && traffic.Flow != nil {
+		policyID, decision.PrimaryWAN, policyRouted = r.policies.route(traffic, availableWANs)
+	}
+	if r.duplicator != nil {
+		decision.Duplication = r.duplicator.match(traffic, policyID)
+	}
+
+	// Duplication rules pick the primary and backup WANs by latency, and
+	// take precedence over duplicating by priority
+	if decision.Duplication != 0 {
+		decision.PrimaryWAN, decision.BackupWANs = r.duplicator.route(decision.Duplication, decision.PrimaryWAN, policyRouted,
+			availableWANs, r.metrics, len(packet.Data))
+	} else if !policyRouted {
+		decision.PrimaryWAN = r.routeByMode(availableWANs, packet, traffic.Flow)
+	}
+	primaryWAN := r.wans[decision.PrimaryWAN]
+
+	if decision.Duplication == 0 && (packet.Priority > 200 || (packet.Flags&protocol.FlagDuplicate) != 0) {
+		// High priority or explicitly marked for duplication
+		decision.BackupWANs = r.selectBackupWANs(decision.PrimaryWAN, availableWANs, 1)
+	}
+
+	// Determine if we should use FEC
+	if primaryWAN.Metrics != nil {
+		// Use FEC if packet loss is high
+		if primaryWAN.Metrics.PacketLoss > 5.0 {
+			decision.UseFEC = true
+		}
+	}
+
+	return decision, nil
+}
+
+// routeByMode selects a WAN with the load balancing mode
+func (r *Router) routeByMode(availableWANs []uint8, packet *protocol.Packet, flowKey *protocol.FlowKey) uint8 {
 	switch r.mode {
 	case protocol.LoadBalanceRoundRobin:
-		decision.PrimaryWAN = r.routeRoundRobin(availableWANs)
+		return r.routeRoundRobin(availableWANs)
 
 	case protocol.LoadBalanceWeighted:
-		decision.PrimaryWAN = r.routeWeighted(availableWANs)
+		return r.routeWeighted(availableWANs)
 
 	case protocol.LoadBalanceLeastUsed:
-		decision.PrimaryWAN = r.routeLeastUsed(availableWANs)
+		return r.routeLeastUsed(availableWANs)
 
 	case protocol.LoadBalanceLeastLatency:
-		decision.PrimaryWAN = r.routeLeastLatency(availableWANs)
+		return r.routeLeastLatency(availableWANs)
 
 	case protocol.LoadBalancePerFlow:
 		if flowKey != nil {
-			decision.PrimaryWAN = r.routePerFlow(flowKey, availableWANs)
-		} else {
-			// Fallback to round-robin if no flow key
-			decision.PrimaryWAN = r.routeRoundRobin(availableWANs)
+			return r.routePerFlow(flowKey, availableWANs)
 		}
+		// Fallback to round-robin if no flow key
+		return r.routeRoundRobin(availableWANs)
 
 	case protocol.LoadBalanceAdaptive:
-		decision.PrimaryWAN = r.routeAdaptive(availableWANs, packet)
+		return r.routeAdaptive(availableWANs, packet)
 
-	default:
-		decision.PrimaryWAN = r.routeRoundRobin(availableWANs)
-	}
+	case protocol.LoadBalanceFailover:
+		return r.routeFailover(availableWANs)
 
-	// Determine if we should use backup WANs
-	primaryWAN := r.wans[decision.PrimaryWAN]
-	if packet.Priority > 200 || (packet.Flags&protocol.FlagDuplicate) != 0 {
-		// High priority or explicitly marked for duplication
-		decision.BackupWANs = r.selectBackupWANs(decision.PrimaryWAN, availableWANs, 1)
-	}
+	case protocol.LoadBalanceEarliestDelivery:
+		return r.delivery.pick(availableWANs, r.wans, r.metrics, len(packet.Data))
 
-	// Determine if we should use FEC
-	if primaryWAN.Metrics != nil {
-		// Use FEC if packet loss is high
-		if primaryWAN.Metrics.PacketLoss > 5.0 {
-			decision.UseFEC = true
-		}
+	default:
+		return r.routeRoundRobin(availableWANs)
 	}
-
-	return decision, nil
 }
 
-// getAvailableWANs returns WANs that are up and enabled
+// getAvailableWANs returns WANs that are up and enabled, sorted by ID
 func (r *Router) getAvailableWANs() []uint8 {
 	available := make([]uint8, 0, len(r.wans))
 	for id, wan := range r.wans {
@@ -119,6 +157,7 @@ func (r *Router) getAvailableWANs() []uint8 {
 			available = append(available, id)
 		}
 	}
+	slices.Sort(available)
 	return available
 }
 
@@ -171,6 +210,9 @@ func (r *Router) routeWeighted(availableWANs []uint8) uint8 {
 			score *= (100.0 - metrics.PacketLoss) / 100.0
 		}
 
+		// Adjust based on capacity (higher is better), measured or configured
+		score *= linkBandwidth(wan, metrics) / DefaultLinkBandwidth
+
 		// Adjust based on bandwidth usage
 		if wan.Config.MaxBandwidth > 0 {
 			usage := r.bandwidthUsage[id]
@@ -234,11 +276,13 @@ func (r *Router) routeLeastLatency(availableWANs []uint8) uint8 {
 
 // routePerFlow implements consistent per-flow routing
 func (r *Router) routePerFlow(flowKey *protocol.FlowKey, availableWANs []uint8) uint8 {
-	// Convert flow key to string for map lookup
-	flowKeyStr := flowKey.String()
+	id := makeFlowID(flowKey)
+
+	r.flowMu.Lock()
+	defer r.flowMu.Unlock()
 
 	// Check if we already have a WAN for this flow
-	if wanID, exists := r.flowMap[flowKeyStr]; exists {
+	if wanID, exists := r.flowMap[id]; exists {
 		// Verify WAN is still available
 		for _, id := range availableWANs {
 			if id == wanID {
@@ -248,9 +292,9 @@ func (r *Router) routePerFlow(flowKey *protocol.FlowKey, availableWANs []uint8)
 	}
 
 	// New flow or previous WAN unavailable - use consistent hashing
-	hash := r.hashFlow(flowKey)
+	hash := r.hashFlow(id)
 	wanID := availableWANs[hash%uint32(len(availableWANs))]
-	r.flowMap[flowKeyStr] = wanID
+	r.flowMap[id] = wanID
 
 	// Cleanup old flows periodically
 	if time.Since(r.lastCleanup) > 5*time.Minute {
@@ -260,6 +304,25 @@ func (r *Router) routePerFlow(flowKey *protocol.FlowKey, availableWANs []uint8)
 	return wanID
 }
 
+// routeFailover sends everything on the failover manager's active WAN.
+// Without a failover manager, or while the active WAN is unavailable, the
+// highest priority available WAN is used.
+func (r *Router) routeFailover(availableWANs []uint8) uint8 {
+	if r.failover != nil {
+		if active := r.failover.GetActiveWAN(); slices.Contains(availableWANs, active) {
+			return active
+		}
+	}
+
+	best := availableWANs[0]
+	for _, id := range availableWANs[1:] {
+		if r.wans[id].Config.Priority < r.wans[best].Config.Priority {
+			best = id
+		}
+	}
+	return best
+}
+
 // routeAdaptive implements adaptive routing based on real-time conditions
 func (r *Router) routeAdaptive(availableWANs []uint8, packet *protocol.Packet) uint8 {
 	// For high priority packets, use lowest latency
@@ -289,22 +352,57 @@ func (r *Router) selectBackupWANs(primaryWAN uint8, availableWANs []uint8, count
 	return backups
 }
 
-// hashFlow creates a hash from a flow key
-func (r *Router) hashFlow(flowKey *protocol.FlowKey) uint32 {
-	h := fnv.New32a()
-	h.Write(flowKey.SrcIP)
-	h.Write(flowKey.DstIP)
-	h.Write([]byte{byte(flowKey.SrcPort >> 8), byte(flowKey.SrcPort)})
-	h.Write([]byte{byte(flowKey.DstPort >> 8), byte(flowKey.DstPort)})
-	h.Write([]byte{flowKey.Protocol})
-	return h.Sum32()
+// flowID is a flow key that can be used as a map key without allocating
+type flowID struct {
+	src, dst         [16]byte
+	srcPort, dstPort uint16
+	protocol         uint8
+}
+
+// makeFlowID converts a flow key, storing IPv4 addresses in their
+// IPv4-mapped form so both lengths of net.IP give the same flow
+func makeFlowID(flowKey *protocol.FlowKey) flowID {
+	id := flowID{
+		srcPort:  flowKey.SrcPort,
+		dstPort:  flowKey.DstPort,
+		protocol: flowKey.Protocol,
+	}
+	putFlowIP(&id.src, flowKey.SrcIP)
+	putFlowIP(&id.dst, flowKey.DstIP)
+	return id
+}
+
+func putFlowIP(dst *[16]byte, ip net.IP) {
+	if len(ip) == net.IPv4len {
+		dst[10], dst[11] = 0xff, 0xff
+		copy(dst[12:], ip)
+		return
+	}
+	copy(dst[:], ip)
+}
+
+// hashFlow creates an FNV-1a hash of a flow
+func (r *Router) hashFlow(id flowID) uint32 {
+	const prime = 16777619
+	hash := uint32(2166136261)
+
+	for _, b := range id.src {
+		hash = (hash ^ uint32(b)) * prime
+	}
+	for _, b := range id.dst {
+		hash = (hash ^ uint32(b)) * prime
+	}
+	for _, b := range [...]byte{byte(id.srcPort >> 8), byte(id.srcPort), byte(id.dstPort >> 8), byte(id.dstPort), id.protocol} {
+		hash = (hash ^ uint32(b)) * prime
+	}
+	return hash
 }
 
 // cleanupFlowMap removes old flow mappings
 func (r *Router) cleanupFlowMap() {
 	// Simple cleanup: clear entire map
 	// In production, you'd track flow last-seen times
-	r.flowMap = make(map[string]uint8)
+	r.flowMap = make(map[flowID]uint8)
 	r.lastCleanup = time.Now()
 }
 
@@ -338,6 +436,34 @@ func (r *Router) SetMode(mode protocol.LoadBalanceMode) {
 	r.mode = mode
 }
 
+// SetPolicyEngine sets the policy rules evaluated before the load balancing mode
+func (r *Router) SetPolicyEngine(e *PolicyEngine) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.policies = e
+}
+
+// SetDuplicator sets the duplication rules that pick backup WANs
+func (r *Router) SetDuplicator(d *Duplicator) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.duplicator = d
+}
+
+// SetCapacityEstimator sets the capacity estimate the delivery scheduler
+// uses for a WAN in place of its measured or configured bandwidth
+func (r *Router) SetCapacityEstimator(wanID uint8, e CapacityEstimator) {
+	r.delivery.setEstimator(wanID, e)
+}
+
+// SetFailoverManager sets the failover manager that picks the active WAN in
+// LoadBalanceFailover mode
+func (r *Router) SetFailoverManager(fm *FailoverManager) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failover = fm
+}
+
 // GetMode returns the current load balancing mode
 func (r *Router) GetMode() protocol.LoadBalanceMode {
 	r.mu.RLock()
@@ -0,0 +1,109 @@
+package router
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/dpi"
+	"github.com/thelastdreamer/MultiWANBond/pkg/packet"
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+)
+
+func TestPerFlowRouting(t *testing.T) {
+	r := NewRouter(protocol.LoadBalancePerFlow)
+	for id := uint8(1); id <= 2; id++ {
+		r.AddWAN(&protocol.WANInterface{ID: id, State: protocol.WANStateUp, Config: protocol.WANConfig{Enabled: true}})
+	}
+
+	pkt := &protocol.Packet{Priority: 128}
+	used := make(map[uint8]bool)
+	for port := uint16(1000); port < 1064; port++ {
+		key := &protocol.FlowKey{
+			SrcIP:    net.IPv4(10, 0, 0, 1).To4(),
+			DstIP:    net.IPv4(1, 1, 1, 1).To4(),
+			SrcPort:  port,
+			DstPort:  443,
+			Protocol: 6,
+		}
+		first, err := r.Route(pkt, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		used[first.PrimaryWAN] = true
+
+		// Later packets of the flow stay on its WAN, whatever the address length
+		key.SrcIP, key.DstIP = key.SrcIP.To16(), key.DstIP.To16()
+		for i := 0; i < 3; i++ {
+			if next, _ := r.Route(pkt, key); next.PrimaryWAN != first.PrimaryWAN {
+				t.Fatalf("flow %d moved from WAN %d to %d", port, first.PrimaryWAN, next.PrimaryWAN)
+			}
+		}
+	}
+
+	if len(used) != 2 {
+		t.Fatalf("expected flows on both WANs, got %v", used)
+	}
+}
+
+func TestAdaptiveRoutingByDSCP(t *testing.T) {
+	r := NewRouter(protocol.LoadBalanceAdaptive)
+	latencies := []time.Duration{10 * time.Millisecond, 50 * time.Millisecond, 100 * time.Millisecond}
+	for i, latency := range latencies {
+		id := uint8(i + 1)
+		r.AddWAN(&protocol.WANInterface{ID: id, State: protocol.WANStateUp, Config: protocol.WANConfig{Enabled: true}})
+		r.UpdateMetrics(id, &protocol.WANMetrics{AvgLatency: latency})
+	}
+	r.RecordBandwidthUsage(1, 1000)
+	r.RecordBandwidthUsage(3, 500)
+
+	priorities := packet.NewPriorityMap()
+
+	// EF takes the lowest-latency WAN and is duplicated
+	voice := &protocol.Packet{Priority: priorities.Priority(46, dpi.ClassDefault)}
+	decision, err := r.Route(voice, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decision.PrimaryWAN != 1 || len(decision.BackupWANs) != 1 {
+		t.Errorf("EF routed to WAN %d with backups %v, want WAN 1 with one backup", decision.PrimaryWAN, decision.BackupWANs)
+	}
+
+	// CS1 takes the least-used WAN
+	bulk := &protocol.Packet{Priority: priorities.Priority(8, dpi.ClassDefault)}
+	decision, err = r.Route(bulk, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decision.PrimaryWAN != 2 || len(decision.BackupWANs) != 0 {
+		t.Errorf("CS1 routed to WAN %d with backups %v, want WAN 2 alone", decision.PrimaryWAN, decision.BackupWANs)
+	}
+}
+
+func TestWeightedRoutingByCapacity(t *testing.T) {
+	r := NewRouter(protocol.LoadBalanceWeighted)
+	for id := uint8(1); id <= 2; id++ {
+		r.AddWAN(&protocol.WANInterface{ID: id, State: protocol.WANStateUp, Config: protocol.WANConfig{Enabled: true, Weight: 1}})
+		r.UpdateMetrics(id, &protocol.WANMetrics{AvgLatency: 20 * time.Millisecond, Bandwidth: 1_000_000})
+	}
+
+	pkt := &protocol.Packet{Priority: 128}
+	route := func() uint8 {
+		t.Helper()
+		decision, err := r.Route(pkt, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return decision.PrimaryWAN
+	}
+
+	// WAN 2's estimated capacity grows past WAN 1's, then falls below it
+	r.UpdateMetrics(2, &protocol.WANMetrics{AvgLatency: 20 * time.Millisecond, Bandwidth: 5_000_000})
+	if wan := route(); wan != 2 {
+		t.Fatalf("routed to WAN %d, want the faster WAN 2", wan)
+	}
+	r.UpdateMetrics(2, &protocol.WANMetrics{AvgLatency: 20 * time.Millisecond, Bandwidth: 200_000})
+	if wan := route(); wan != 1 {
+		t.Fatalf("routed to WAN %d, want WAN 1 once WAN 2 slowed down", wan)
+	}
+}
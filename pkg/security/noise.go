@@ -0,0 +1,441 @@
+// Package security - Noise protocol handshake
+package security
+
+import (
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// This file implements the Noise Protocol Framework (revision 34) handshake
+// for the 25519/ChaChaPoly/SHA256 suite, restricted to the IK and XX
+// patterns. Only the handshake is Noise; the resulting split keys drive a
+// TunnelCipher for the transport.
+
+// HandshakePattern defines the Noise handshake pattern
+type HandshakePattern int
+
+const (
+	// HandshakeIK the initiator knows the responder's static key in advance (1 round trip)
+	HandshakeIK HandshakePattern = iota
+	// HandshakeXX both static keys are exchanged during the handshake (1.5 round trips)
+	HandshakeXX
+)
+
+// String returns the string representation of the handshake pattern
+func (p HandshakePattern) String() string {
+	switch p {
+	case HandshakeIK:
+		return "IK"
+	case HandshakeXX:
+		return "XX"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseHandshakePattern parses a handshake pattern name
+func ParseHandshakePattern(name string) (HandshakePattern, error) {
+	switch name {
+	case "ik", "IK", "noise_ik":
+		return HandshakeIK, nil
+	case "xx", "XX", "noise_xx":
+		return HandshakeXX, nil
+	default:
+		return 0, fmt.Errorf("unsupported handshake pattern: %s", name)
+	}
+}
+
+const (
+	noiseDHLen   = 32
+	noiseHashLen = sha256.Size
+	noiseTagLen  = chacha20poly1305.Overhead
+
+	noisePrologue = "MultiWANBond tunnel v1"
+)
+
+var (
+	// ErrHandshakeFailed handshake message could not be processed
+	ErrHandshakeFailed = errors.New("handshake failed")
+	// ErrHandshakeOutOfOrder handshake message arrived in the wrong state
+	ErrHandshakeOutOfOrder = errors.New("handshake message out of order")
+)
+
+// noiseToken is a single token of a handshake message pattern
+type noiseToken int
+
+const (
+	tokenE noiseToken = iota
+	tokenS
+	tokenEE
+	tokenES
+	tokenSE
+	tokenSS
+)
+
+// noisePatterns lists the message patterns of each handshake, alternating
+// initiator -> responder and responder -> initiator
+var noisePatterns = map[HandshakePattern][][]noiseToken{
+	HandshakeIK: {
+		{tokenE, tokenES, tokenS, tokenSS},
+		{tokenE, tokenEE, tokenSE},
+	},
+	HandshakeXX: {
+		{tokenE},
+		{tokenE, tokenEE, tokenS, tokenES},
+		{tokenS, tokenSE},
+	},
+}
+
+// GenerateStaticKey generates an X25519 static key pair
+func GenerateStaticKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// ParseStaticKey parses a raw 32-byte X25519 private key
+func ParseStaticKey(raw []byte) (*ecdh.PrivateKey, error) {
+	if len(raw) != noiseDHLen {
+		return nil, ErrInvalidKeySize
+	}
+	return ecdh.X25519().NewPrivateKey(raw)
+}
+
+// noiseCipherState is the Noise CipherState
+type noiseCipherState struct {
+	key    []byte
+	nonce  uint64
+	hasKey bool
+}
+
+func (cs *noiseCipherState) initializeKey(key []byte) {
+	cs.key = key
+	cs.nonce = 0
+	cs.hasKey = true
+}
+
+func (cs *noiseCipherState) nonceBytes() []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], cs.nonce)
+	return nonce
+}
+
+func (cs *noiseCipherState) encryptWithAd(ad, plaintext []byte) ([]byte, error) {
+	if !cs.hasKey {
+		return append([]byte(nil), plaintext...), nil
+	}
+
+	aead, err := chacha20poly1305.New(cs.key)
+	if err != nil {
+		return nil, err
+	}
+	out := aead.Seal(nil, cs.nonceBytes(), plaintext, ad)
+	cs.nonce++
+	return out, nil
+}
+
+func (cs *noiseCipherState) decryptWithAd(ad, ciphertext []byte) ([]byte, error) {
+	if !cs.hasKey {
+		return append([]byte(nil), ciphertext...), nil
+	}
+
+	aead, err := chacha20poly1305.New(cs.key)
+	if err != nil {
+		return nil, err
+	}
+	out, err := aead.Open(nil, cs.nonceBytes(), ciphertext, ad)
+	if err != nil {
+		return nil, ErrHandshakeFailed
+	}
+	cs.nonce++
+	return out, nil
+}
+
+// noiseSymmetricState is the Noise SymmetricState
+type noiseSymmetricState struct {
+	cs noiseCipherState
+	ck []byte
+	h  []byte
+}
+
+func (ss *noiseSymmetricState) initialize(protocolName string) {
+	if len(protocolName) <= noiseHashLen {
+		ss.h = make([]byte, noiseHashLen)
+		copy(ss.h, protocolName)
+	} else {
+		sum := sha256.Sum256([]byte(protocolName))
+		ss.h = sum[:]
+	}
+	ss.ck = append([]byte(nil), ss.h...)
+}
+
+func (ss *noiseSymmetricState) mixHash(data []byte) {
+	hash := sha256.New()
+	hash.Write(ss.h)
+	hash.Write(data)
+	ss.h = hash.Sum(nil)
+}
+
+func (ss *noiseSymmetricState) mixKey(ikm []byte) {
+	ck, tempK := noiseHKDF2(ss.ck, ikm)
+	ss.ck = ck
+	ss.cs.initializeKey(tempK)
+}
+
+func (ss *noiseSymmetricState) encryptAndHash(plaintext []byte) ([]byte, error) {
+	ciphertext, err := ss.cs.encryptWithAd(ss.h, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixHash(ciphertext)
+	return ciphertext, nil
+}
+
+func (ss *noiseSymmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext, err := ss.cs.decryptWithAd(ss.h, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+// split returns the initiator-to-responder and responder-to-initiator keys
+func (ss *noiseSymmetricState) split() ([]byte, []byte) {
+	return noiseHKDF2(ss.ck, nil)
+}
+
+// noiseHKDF2 is the two-output HKDF defined by the Noise specification
+func noiseHKDF2(chainingKey, ikm []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, chainingKey)
+	mac.Write(ikm)
+	tempKey := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, tempKey)
+	mac.Write([]byte{0x01})
+	out1 := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, tempKey)
+	mac.Write(out1)
+	mac.Write([]byte{0x02})
+	out2 := mac.Sum(nil)
+
+	return out1, out2
+}
+
+// noiseHandshake is the Noise HandshakeState
+type noiseHandshake struct {
+	ss        noiseSymmetricState
+	pattern   [][]noiseToken
+	initiator bool
+	step      int
+
+	s  *ecdh.PrivateKey
+	e  *ecdh.PrivateKey
+	rs *ecdh.PublicKey
+	re *ecdh.PublicKey
+}
+
+// newNoiseHandshake starts a handshake. remoteStatic is the responder's
+// static public key and is required for IK initiators only.
+func newNoiseHandshake(pattern HandshakePattern, initiator bool, s *ecdh.PrivateKey, remoteStatic []byte) (*noiseHandshake, error) {
+	patterns, ok := noisePatterns[pattern]
+	if !ok {
+		return nil, fmt.Errorf("unsupported handshake pattern: %v", pattern)
+	}
+	if s == nil {
+		return nil, fmt.Errorf("static key required")
+	}
+
+	hs := &noiseHandshake{
+		pattern:   patterns,
+		initiator: initiator,
+		s:         s,
+	}
+	hs.ss.initialize("Noise_" + pattern.String() + "_25519_ChaChaPoly_SHA256")
+	hs.ss.mixHash([]byte(noisePrologue))
+
+	// IK pre-message: <- s
+	if pattern == HandshakeIK {
+		if initiator {
+			rs, err := ecdh.X25519().NewPublicKey(remoteStatic)
+			if err != nil {
+				return nil, fmt.Errorf("invalid responder static key: %w", err)
+			}
+			hs.rs = rs
+			hs.ss.mixHash(rs.Bytes())
+		} else {
+			hs.ss.mixHash(s.PublicKey().Bytes())
+		}
+	}
+
+	return hs, nil
+}
+
+// writeTurn reports whether the local side writes the next message
+func (hs *noiseHandshake) writeTurn() bool {
+	return (hs.step%2 == 0) == hs.initiator
+}
+
+// complete reports whether all handshake messages have been processed
+func (hs *noiseHandshake) complete() bool {
+	return hs.step == len(hs.pattern)
+}
+
+func (hs *noiseHandshake) dh(local *ecdh.PrivateKey, remote *ecdh.PublicKey) ([]byte, error) {
+	if local == nil || remote == nil {
+		return nil, ErrHandshakeFailed
+	}
+	return local.ECDH(remote)
+}
+
+// mixDH performs a DH token. Initiator and responder swap the roles of the
+// two letters for es and se.
+func (hs *noiseHandshake) mixDH(token noiseToken) error {
+	var shared []byte
+	var err error
+
+	switch token {
+	case tokenEE:
+		shared, err = hs.dh(hs.e, hs.re)
+	case tokenSS:
+		shared, err = hs.dh(hs.s, hs.rs)
+	case tokenES:
+		if hs.initiator {
+			shared, err = hs.dh(hs.e, hs.rs)
+		} else {
+			shared, err = hs.dh(hs.s, hs.re)
+		}
+	case tokenSE:
+		if hs.initiator {
+			shared, err = hs.dh(hs.s, hs.re)
+		} else {
+			shared, err = hs.dh(hs.e, hs.rs)
+		}
+	}
+	if err != nil {
+		return ErrHandshakeFailed
+	}
+
+	hs.ss.mixKey(shared)
+	return nil
+}
+
+// writeMessage writes the next handshake message carrying payload
+func (hs *noiseHandshake) writeMessage(payload []byte) ([]byte, error) {
+	if hs.complete() || !hs.writeTurn() {
+		return nil, ErrHandshakeOutOfOrder
+	}
+
+	var msg []byte
+	for _, token := range hs.pattern[hs.step] {
+		switch token {
+		case tokenE:
+			e, err := GenerateStaticKey()
+			if err != nil {
+				return nil, err
+			}
+			hs.e = e
+			msg = append(msg, e.PublicKey().Bytes()...)
+			hs.ss.mixHash(e.PublicKey().Bytes())
+		case tokenS:
+			ciphertext, err := hs.ss.encryptAndHash(hs.s.PublicKey().Bytes())
+			if err != nil {
+				return nil, err
+			}
+			msg = append(msg, ciphertext...)
+		default:
+			if err := hs.mixDH(token); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	ciphertext, err := hs.ss.encryptAndHash(payload)
+	if err != nil {
+		return nil, err
+	}
+	hs.step++
+
+	return append(msg, ciphertext...), nil
+}
+
+// readMessage reads the next handshake message and returns its payload
+func (hs *noiseHandshake) readMessage(msg []byte) ([]byte, error) {
+	if hs.complete() || hs.writeTurn() {
+		return nil, ErrHandshakeOutOfOrder
+	}
+
+	for _, token := range hs.pattern[hs.step] {
+		switch token {
+		case tokenE:
+			if len(msg) < noiseDHLen {
+				return nil, ErrHandshakeFailed
+			}
+			re, err := ecdh.X25519().NewPublicKey(msg[:noiseDHLen])
+			if err != nil {
+				return nil, ErrHandshakeFailed
+			}
+			hs.re = re
+			hs.ss.mixHash(msg[:noiseDHLen])
+			msg = msg[noiseDHLen:]
+		case tokenS:
+			n := noiseDHLen
+			if hs.ss.cs.hasKey {
+				n += noiseTagLen
+			}
+			if len(msg) < n {
+				return nil, ErrHandshakeFailed
+			}
+			plaintext, err := hs.ss.decryptAndHash(msg[:n])
+			if err != nil {
+				return nil, err
+			}
+			rs, err := ecdh.X25519().NewPublicKey(plaintext)
+			if err != nil {
+				return nil, ErrHandshakeFailed
+			}
+			hs.rs = rs
+			msg = msg[n:]
+		default:
+			if err := hs.mixDH(token); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	payload, err := hs.ss.decryptAndHash(msg)
+	if err != nil {
+		return nil, err
+	}
+	hs.step++
+
+	return payload, nil
+}
+
+// split returns the local sending and receiving keys once the handshake is complete
+func (hs *noiseHandshake) split() (sendKey, recvKey []byte) {
+	k1, k2 := hs.ss.split()
+	if hs.initiator {
+		return k1, k2
+	}
+	return k2, k1
+}
+
+// handshakeHash returns the handshake hash, unique to this handshake
+func (hs *noiseHandshake) handshakeHash() []byte {
+	return hs.ss.h
+}
+
+// remoteStatic returns the peer's static public key, once known
+func (hs *noiseHandshake) remoteStatic() []byte {
+	if hs.rs == nil {
+		return nil
+	}
+	return hs.rs.Bytes()
+}
@@ -0,0 +1,82 @@
+// Package security - Anti-replay window
+package security
+
+// ReplayWindow is a sliding bitmap window (RFC 6479 style) that accepts each
+// counter at most once and rejects counters that fall behind the window.
+type ReplayWindow struct {
+	size    uint64
+	highest uint64
+	bitmap  []uint64
+}
+
+// NewReplayWindow creates a replay window covering size counters
+func NewReplayWindow(size int) *ReplayWindow {
+	if size < 64 {
+		size = 64
+	}
+	words := (size + 63) / 64
+
+	return &ReplayWindow{
+		size:   uint64(words * 64),
+		bitmap: make([]uint64, words),
+	}
+}
+
+// Check reports whether counter would be accepted, without recording it
+func (w *ReplayWindow) Check(counter uint64) bool {
+	if counter == 0 {
+		return false
+	}
+	if counter > w.highest {
+		return true
+	}
+	if w.highest-counter >= w.size {
+		return false
+	}
+	return !w.isSet(counter)
+}
+
+// Accept records counter and reports whether it was new
+func (w *ReplayWindow) Accept(counter uint64) bool {
+	if !w.Check(counter) {
+		return false
+	}
+
+	if counter > w.highest {
+		// Clear the slots the window slides over
+		shift := counter - w.highest
+		if shift >= w.size {
+			for i := range w.bitmap {
+				w.bitmap[i] = 0
+			}
+		} else {
+			for c := w.highest + 1; c <= counter; c++ {
+				w.clear(c)
+			}
+		}
+		w.highest = counter
+	}
+
+	w.set(counter)
+	return true
+}
+
+// Highest returns the highest counter accepted so far
+func (w *ReplayWindow) Highest() uint64 {
+	return w.highest
+}
+
+func (w *ReplayWindow) isSet(counter uint64) bool {
+	bit := counter % w.size
+	return w.bitmap[bit/64]&(1<<(bit%64)) != 0
+}
+
+func (w *ReplayWindow) set(counter uint64) {
+	bit := counter % w.size
+	w.bitmap[bit/64] |= 1 << (bit % 64)
+}
+
+func (w *ReplayWindow) clear(counter uint64) {
+	bit := counter % w.size
+	w.bitmap[bit/64] &^= 1 << (bit % 64)
+}
@@ -0,0 +1,402 @@
+// Package security - Noise session management
+package security
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A NoiseSession runs Noise handshakes with one peer and installs the
+// resulting per-direction keys into a TunnelCipher.
+//
+// Rekeying never interrupts traffic. The side that finishes the handshake by
+// reading the last message knows the peer holds the new keys, so it switches
+// its sending key at once and sends a confirmation under it. The side that
+// finishes by writing keeps sending under the old key until the first packet
+// under the new key arrives. Receive keys of the previous handshake stay
+// installed until the next rekey, so packets still in flight on slower WANs
+// keep decrypting.
+//
+// Handshake messages are framed as:
+//
+//	[index 1][handshake ID 4][noise message]
+//
+// where index is the message number within the pattern, or
+// handshakeConfirm for the confirmation.
+
+const (
+	// HandshakeRetryInterval is how long an initiator waits for a handshake to complete before retrying
+	HandshakeRetryInterval = 2 * time.Second
+
+	handshakeHeaderLen = 5
+	handshakeConfirm   = 0xff
+	timestampLen       = 8
+)
+
+var (
+	// ErrUntrustedPeer remote static key is not a trusted peer
+	ErrUntrustedPeer = errors.New("untrusted peer")
+	// ErrStaleHandshake handshake initiation is not newer than the last one accepted
+	ErrStaleHandshake = errors.New("stale handshake initiation")
+)
+
+// NoiseConfig contains handshake configuration
+type NoiseConfig struct {
+	Pattern    HandshakePattern
+	Initiator  bool
+	StaticKey  *ecdh.PrivateKey
+	RemoteKey  []byte      // Responder static public key, required for IK initiators
+	TrustStore *TrustStore // Peers allowed to complete a handshake
+}
+
+// NoiseStats contains handshake counters
+type NoiseStats struct {
+	Handshakes atomic.Uint64 // Completed handshakes
+	Rekeys     atomic.Uint64 // Completed handshakes that replaced earlier keys
+	Failures   atomic.Uint64 // Rejected or failed handshake messages
+}
+
+// pendingKey is a sending key waiting for the peer to start using its pair
+type pendingKey struct {
+	id  uint64
+	key []byte
+}
+
+// NoiseSession manages handshakes and session keys for one peer
+type NoiseSession struct {
+	config NoiseConfig
+	cipher *TunnelCipher
+
+	mu           sync.Mutex
+	hs           *noiseHandshake // Handshake in progress
+	hsID         uint32
+	hsStarted    time.Time
+	peer         *Peer
+	lastComplete time.Time
+
+	// Receive key IDs; next is installed but not yet confirmed by the peer
+	current, previous, next uint64
+	pendingSend             *pendingKey
+
+	stats NoiseStats
+}
+
+// NewNoiseSession creates a handshake session that installs keys into cipher
+func NewNoiseSession(config NoiseConfig, cipher *TunnelCipher) (*NoiseSession, error) {
+	if config.StaticKey == nil {
+		return nil, fmt.Errorf("static key required")
+	}
+	if config.TrustStore == nil {
+		return nil, fmt.Errorf("trust store required")
+	}
+	if config.Pattern == HandshakeIK && config.Initiator && len(config.RemoteKey) != noiseDHLen {
+		return nil, fmt.Errorf("IK initiator requires the responder's static key")
+	}
+	if cipher == nil {
+		return nil, fmt.Errorf("cipher required")
+	}
+
+	return &NoiseSession{
+		config: config,
+		cipher: cipher,
+	}, nil
+}
+
+// Cipher returns the tunnel cipher the session installs keys into
+func (s *NoiseSession) Cipher() *TunnelCipher {
+	return s.cipher
+}
+
+// Established reports whether a session key is available for sending
+func (s *NoiseSession) Established() bool {
+	return s.cipher.HasSendKey()
+}
+
+// Peer returns the authenticated peer, or nil before the first handshake
+func (s *NoiseSession) Peer() *Peer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peer
+}
+
+// GetStats returns the handshake counters
+func (s *NoiseSession) GetStats() *NoiseStats {
+	return &s.stats
+}
+
+// NeedsHandshake reports whether an initiator should start a handshake now:
+// when no session exists yet, when a handshake in progress has timed out, or
+// when the current keys are older than the rotation interval.
+func (s *NoiseSession) NeedsHandshake(rotation time.Duration) bool {
+	if !s.config.Initiator {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.hs != nil {
+		return time.Since(s.hsStarted) >= HandshakeRetryInterval
+	}
+	if s.lastComplete.IsZero() {
+		return true
+	}
+	return rotation > 0 && time.Since(s.lastComplete) >= rotation
+}
+
+// Initiate starts a new handshake and returns its first message.
+// Any handshake in progress is abandoned; existing keys remain in use.
+func (s *NoiseSession) Initiate() ([]byte, error) {
+	if !s.config.Initiator {
+		return nil, fmt.Errorf("session is not an initiator")
+	}
+
+	hs, err := newNoiseHandshake(s.config.Pattern, true, s.config.StaticKey, s.config.RemoteKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var id [4]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate handshake ID: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.hs = hs
+	s.hsID = binary.BigEndian.Uint32(id[:])
+	s.hsStarted = time.Now()
+
+	return s.writeNext(s.initiatorPayload())
+}
+
+// HandleMessage processes a handshake message from the peer and returns the
+// message to send back, if any
+func (s *NoiseSession) HandleMessage(msg []byte) ([]byte, error) {
+	if len(msg) < handshakeHeaderLen {
+		s.stats.Failures.Add(1)
+		return nil, ErrHandshakeFailed
+	}
+
+	index := msg[0]
+	id := binary.BigEndian.Uint32(msg[1:5])
+	body := msg[handshakeHeaderLen:]
+
+	// Confirmations only matter as the first packet under the new keys
+	if index == handshakeConfirm {
+		return nil, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reply, err := s.handle(index, id, body)
+	if err != nil {
+		s.stats.Failures.Add(1)
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (s *NoiseSession) handle(index uint8, id uint32, body []byte) ([]byte, error) {
+	if index == 0 && !s.config.Initiator {
+		// A new initiation replaces any handshake in progress
+		hs, err := newNoiseHandshake(s.config.Pattern, false, s.config.StaticKey, nil)
+		if err != nil {
+			return nil, err
+		}
+		s.hs, s.hsID, s.hsStarted = hs, id, time.Now()
+	}
+
+	if s.hs == nil || id != s.hsID || int(index) != s.hs.step {
+		return nil, ErrHandshakeOutOfOrder
+	}
+
+	payload, err := s.hs.readMessage(body)
+	if err != nil {
+		s.hs = nil
+		return nil, err
+	}
+
+	if s.hs.complete() {
+		return s.finish(payload, true)
+	}
+
+	// The initiator's last message carries its timestamp
+	var reply []byte
+	if s.config.Initiator {
+		reply, err = s.writeNext(s.initiatorPayload())
+	} else {
+		if s.hs.remoteStatic() != nil {
+			if err := s.checkInitiation(s.hs.remoteStatic(), payload); err != nil {
+				s.hs = nil
+				return nil, err
+			}
+		}
+		reply, err = s.writeNext(nil)
+	}
+	if err != nil {
+		s.hs = nil
+		return nil, err
+	}
+
+	return reply, nil
+}
+
+// writeNext writes the next handshake message, finishing the handshake if it is the last
+func (s *NoiseSession) writeNext(payload []byte) ([]byte, error) {
+	index := uint8(s.hs.step)
+	body, err := s.hs.writeMessage(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, handshakeHeaderLen, handshakeHeaderLen+len(body))
+	msg[0] = index
+	binary.BigEndian.PutUint32(msg[1:5], s.hsID)
+	msg = append(msg, body...)
+
+	if s.hs.complete() {
+		if _, err := s.finish(nil, false); err != nil {
+			return nil, err
+		}
+	}
+
+	return msg, nil
+}
+
+// initiatorPayload returns the payload of the initiator's authenticated message
+func (s *NoiseSession) initiatorPayload() []byte {
+	if s.config.Pattern == HandshakeXX && s.hs.step == 0 {
+		return nil
+	}
+	return binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixNano()))
+}
+
+// checkInitiation authenticates the initiator and rejects replayed initiations
+// The newest timestamp is kept on the peer, so a replay is caught by every
+// session sharing the trust store.
+func (s *NoiseSession) checkInitiation(remoteStatic, payload []byte) error {
+	peer, ok := s.config.TrustStore.FindPeerByPublicKey(remoteStatic)
+	if !ok || (s.peer != nil && peer != s.peer) {
+		return ErrUntrustedPeer
+	}
+	if len(payload) != timestampLen {
+		return ErrHandshakeFailed
+	}
+	if !peer.acceptInitiation(binary.BigEndian.Uint64(payload)) {
+		return ErrStaleHandshake
+	}
+	return nil
+}
+
+// finish installs the keys of a completed handshake. If the local side read
+// the last message it switches to the new keys at once and returns a
+// confirmation to send under them.
+func (s *NoiseSession) finish(payload []byte, onRead bool) ([]byte, error) {
+	hs := s.hs
+	s.hs = nil
+
+	if !s.config.Initiator && onRead {
+		if err := s.checkInitiation(hs.remoteStatic(), payload); err != nil {
+			return nil, err
+		}
+	}
+
+	// A session stays bound to the peer that first authenticated
+	peer, ok := s.config.TrustStore.FindPeerByPublicKey(hs.remoteStatic())
+	if !ok || (s.peer != nil && peer != s.peer) {
+		return nil, ErrUntrustedPeer
+	}
+
+	sendKey, recvKey := hs.split()
+	sendID, recvID := sessionKeyIDs(hs.handshakeHash(), s.config.Initiator)
+
+	// Drop keys of an earlier handshake that was never confirmed
+	if s.next != 0 {
+		s.cipher.RemoveReceiveKey(s.next)
+		s.next, s.pendingSend = 0, nil
+	}
+
+	var confirm []byte
+	if onRead {
+		if err := s.cipher.AddReceiveKey(recvID, recvKey, nil); err != nil {
+			return nil, err
+		}
+		s.rotateReceiveKeys(recvID)
+		if err := s.cipher.SetSendKey(sendID, sendKey); err != nil {
+			return nil, err
+		}
+
+		confirm = make([]byte, handshakeHeaderLen)
+		confirm[0] = handshakeConfirm
+		binary.BigEndian.PutUint32(confirm[1:5], s.hsID)
+	} else {
+		if err := s.cipher.AddReceiveKey(recvID, recvKey, func() { s.promote(recvID) }); err != nil {
+			return nil, err
+		}
+		s.next = recvID
+		s.pendingSend = &pendingKey{id: sendID, key: sendKey}
+	}
+
+	if !s.lastComplete.IsZero() {
+		s.stats.Rekeys.Add(1)
+	}
+	s.stats.Handshakes.Add(1)
+	s.lastComplete = time.Now()
+	s.peer = peer
+	peer.UpdateHandshake()
+
+	return confirm, nil
+}
+
+// promote switches to the pending keys once the peer has used them
+func (s *NoiseSession) promote(recvID uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.next != recvID || s.pendingSend == nil {
+		return
+	}
+
+	s.rotateReceiveKeys(recvID)
+	s.cipher.SetSendKey(s.pendingSend.id, s.pendingSend.key)
+	s.next, s.pendingSend = 0, nil
+}
+
+// rotateReceiveKeys makes recvID the current receive key, keeping the
+// current one for packets still in flight and dropping the one before it
+func (s *NoiseSession) rotateReceiveKeys(recvID uint64) {
+	if s.previous != 0 {
+		s.cipher.RemoveReceiveKey(s.previous)
+	}
+	s.previous, s.current = s.current, recvID
+}
+
+// IsHandshakeConfirm reports whether a handshake message is a confirmation.
+// Confirmations must be sent sealed under the new session keys.
+func IsHandshakeConfirm(msg []byte) bool {
+	return len(msg) >= handshakeHeaderLen && msg[0] == handshakeConfirm
+}
+
+// sessionKeyIDs derives the key IDs of both directions from the handshake hash
+func sessionKeyIDs(handshakeHash []byte, initiator bool) (sendID, recvID uint64) {
+	derive := func(label string) uint64 {
+		sum := sha256.Sum256(append(append([]byte(nil), handshakeHash...), label...))
+		return binary.BigEndian.Uint64(sum[:8]) | 1 // never zero
+	}
+
+	i2r, r2i := derive("initiator"), derive("responder")
+	if initiator {
+		return i2r, r2i
+	}
+	return r2i, i2r
+}
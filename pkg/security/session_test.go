@@ -0,0 +1,224 @@
+package security
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"errors"
+	"testing"
+)
+
+// testEndpoint is one side of a Noise session
+type testEndpoint struct {
+	key     *ecdh.PrivateKey
+	trust   *TrustStore
+	session *NoiseSession
+}
+
+func newTestEndpoints(t *testing.T, pattern HandshakePattern) (*testEndpoint, *testEndpoint) {
+	t.Helper()
+
+	client := &testEndpoint{trust: NewTrustStore()}
+	server := &testEndpoint{trust: NewTrustStore()}
+	for _, ep := range []*testEndpoint{client, server} {
+		key, err := GenerateStaticKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ep.key = key
+	}
+
+	trust := func(store *TrustStore, id string, key *ecdh.PrivateKey) {
+		peer := NewPeer(id, key.PublicKey().Bytes(), "", nil)
+		peer.SetTrusted(true)
+		store.AddPeer(peer)
+	}
+	trust(client.trust, "server", server.key)
+	trust(server.trust, "client", client.key)
+
+	for _, ep := range []*testEndpoint{client, server} {
+		cipher, err := NewSessionCipher(EncryptionChaCha20Poly1305, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := NoiseConfig{
+			Pattern:    pattern,
+			Initiator:  ep == client,
+			StaticKey:  ep.key,
+			TrustStore: ep.trust,
+		}
+		if ep == client {
+			cfg.RemoteKey = server.key.PublicKey().Bytes()
+		}
+		if ep.session, err = NewNoiseSession(cfg, cipher); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return client, server
+}
+
+// runHandshake exchanges handshake messages until neither side has anything to send.
+// Each message is checked against its sender's key state; the final
+// confirmation is returned instead of being delivered.
+func runHandshake(t *testing.T, client, server *testEndpoint) []byte {
+	t.Helper()
+
+	msg, err := client.session.Initiate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	from, to := client, server
+	for {
+		reply, err := to.session.HandleMessage(msg)
+		if err != nil {
+			t.Fatalf("handshake message %d: %v", msg[0], err)
+		}
+		if reply == nil {
+			t.Fatal("handshake ended without confirmation")
+		}
+		if reply[0] == handshakeConfirm {
+			return reply
+		}
+		msg, from, to = reply, to, from
+	}
+}
+
+func sealOpen(t *testing.T, from, to *TunnelCipher, payload string) {
+	t.Helper()
+
+	sealed, err := from.Seal(nil, []byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, err := to.Open(nil, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(opened) != payload {
+		t.Fatalf("opened %q, want %q", opened, payload)
+	}
+}
+
+func TestNoiseHandshake(t *testing.T) {
+	for _, pattern := range []HandshakePattern{HandshakeIK, HandshakeXX} {
+		t.Run(pattern.String(), func(t *testing.T) {
+			client, server := newTestEndpoints(t, pattern)
+			clientCipher, serverCipher := client.session.Cipher(), server.session.Cipher()
+
+			runHandshake(t, client, server)
+
+			// The side that read the last message switches first; the
+			// other waits for the first packet under the new keys
+			first, second := clientCipher, serverCipher
+			if pattern == HandshakeXX {
+				first, second = serverCipher, clientCipher
+			}
+			if !first.HasSendKey() || second.HasSendKey() {
+				t.Fatalf("send keys: first=%v second=%v, want true false", first.HasSendKey(), second.HasSendKey())
+			}
+
+			sealOpen(t, first, second, "confirm")
+			sealOpen(t, second, first, "reply")
+
+			if peer := server.session.Peer(); peer == nil || peer.ID != "client" {
+				t.Fatalf("server authenticated %v, want client", peer)
+			}
+			if peer := client.session.Peer(); peer == nil || peer.ID != "server" {
+				t.Fatalf("client authenticated %v, want server", peer)
+			}
+		})
+	}
+}
+
+func TestNoiseRejectsUntrustedPeer(t *testing.T) {
+	for _, pattern := range []HandshakePattern{HandshakeIK, HandshakeXX} {
+		t.Run(pattern.String(), func(t *testing.T) {
+			client, server := newTestEndpoints(t, pattern)
+			server.trust.RemovePeer("client")
+
+			msg, err := client.session.Initiate()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for msg != nil && err == nil {
+				if msg, err = server.session.HandleMessage(msg); err != nil || msg == nil {
+					break
+				}
+				msg, err = client.session.HandleMessage(msg)
+			}
+
+			if !errors.Is(err, ErrUntrustedPeer) {
+				t.Fatalf("err = %v, want %v", err, ErrUntrustedPeer)
+			}
+			if server.session.Established() {
+				t.Fatal("server established a session with an untrusted peer")
+			}
+		})
+	}
+}
+
+func TestNoiseRejectsReplayedInitiation(t *testing.T) {
+	client, server := newTestEndpoints(t, HandshakeIK)
+
+	init, err := client.session.Initiate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.session.HandleMessage(init); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.session.HandleMessage(init); !errors.Is(err, ErrStaleHandshake) {
+		t.Fatalf("err = %v, want %v", err, ErrStaleHandshake)
+	}
+}
+
+func TestNoiseRekeyKeepsTrafficFlowing(t *testing.T) {
+	client, server := newTestEndpoints(t, HandshakeIK)
+	clientCipher, serverCipher := client.session.Cipher(), server.session.Cipher()
+
+	runHandshake(t, client, server)
+	sealOpen(t, clientCipher, serverCipher, "first session")
+
+	// Packets sealed under the first keys are still in flight during the rekey
+	inFlightUp, _ := clientCipher.Seal(nil, []byte("old up"))
+	inFlightDown, _ := serverCipher.Seal(nil, []byte("old down"))
+	tooLate, _ := serverCipher.Seal(nil, []byte("too late"))
+
+	confirm := runHandshake(t, client, server)
+	if client.session.GetStats().Rekeys.Load() != 1 {
+		t.Fatalf("rekeys = %d, want 1", client.session.GetStats().Rekeys.Load())
+	}
+
+	// The server keeps the old sending key until the client uses the new one
+	oldDown, _ := serverCipher.Seal(nil, []byte("still old"))
+	if _, err := clientCipher.Open(nil, oldDown); err != nil {
+		t.Fatalf("old server key rejected during rekey: %v", err)
+	}
+
+	sealedConfirm, _ := clientCipher.Seal(nil, confirm)
+	if _, err := serverCipher.Open(nil, sealedConfirm); err != nil {
+		t.Fatal(err)
+	}
+	sealOpen(t, serverCipher, clientCipher, "new down")
+
+	for _, tt := range []struct {
+		cipher *TunnelCipher
+		sealed []byte
+		want   string
+	}{
+		{serverCipher, inFlightUp, "old up"},
+		{clientCipher, inFlightDown, "old down"},
+	} {
+		opened, err := tt.cipher.Open(nil, tt.sealed)
+		if err != nil || !bytes.Equal(opened, []byte(tt.want)) {
+			t.Fatalf("in-flight packet %q: opened %q, err %v", tt.want, opened, err)
+		}
+	}
+
+	// A second rekey retires the first keys
+	runHandshake(t, client, server)
+	if _, err := clientCipher.Open(nil, tooLate); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("err = %v, want %v", err, ErrUnknownKey)
+	}
+}
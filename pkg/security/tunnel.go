@@ -0,0 +1,392 @@
+// Package security - Tunnel packet encryption
+package security
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Every tunnel packet is sealed with an AEAD under a key identified by a
+// 64-bit key ID carried in front of the ciphertext, followed by the packet
+// counter that forms the nonce. A sending key is only ever used by one
+// sender, so nonces never repeat, whichever WAN carries the packet.
+//
+// With a pre-shared secret, each sender picks a random key ID at startup and
+// both ends derive the key from the secret and that ID. Session ciphers have
+// no secret; their keys come from a handshake (see NoiseSession) and are
+// installed explicitly. Receivers keep a replay window per key.
+//
+// A pre-shared key receiver takes up any sender key derived from the secret,
+// including ones it heard from before it restarted or evicted them, so it
+// only takes up keys with packets sent within maxTunnelPacketAge, as their
+// authenticated send time tells (see OpenSent), and rejects packets sent
+// before that under the key. The clocks of both ends must agree to within
+// maxTunnelPacketAge.
+
+const (
+	// TunnelHeaderSize is the size of the key ID and counter preceding the ciphertext
+	TunnelHeaderSize = 16
+
+	// DefaultReplayWindow is the default number of packets tracked for replay protection
+	DefaultReplayWindow = 1024
+
+	// maxTunnelSenders bounds the number of derived sender keys tracked by a receiver
+	maxTunnelSenders = 256
+
+	// maxTunnelPacketAge is how long before a receiver takes up a derived
+	// sender key the packets it opens under the key may have been sent
+	maxTunnelPacketAge = 5 * time.Minute
+
+	tunnelKeyInfo = "multiwanbond tunnel v1 "
+)
+
+var (
+	// ErrReplayedPacket packet counter was already seen or is too old
+	ErrReplayedPacket = errors.New("replayed packet")
+	// ErrStalePacket packet was sent before its sender key was taken up
+	ErrStalePacket = errors.New("stale packet")
+	// ErrTunnelPacketTooShort sealed payload is shorter than the tunnel overhead
+	ErrTunnelPacketTooShort = errors.New("sealed packet too short")
+	// ErrNoSessionKey no sending key has been established yet
+	ErrNoSessionKey = errors.New("no session key")
+	// ErrUnknownKey sealed packet uses a key ID that is not installed
+	ErrUnknownKey = errors.New("unknown key ID")
+)
+
+// TunnelStats contains tunnel encryption counters
+type TunnelStats struct {
+	Sealed       atomic.Uint64 // Packets encrypted
+	Opened       atomic.Uint64 // Packets decrypted and authenticated
+	AuthFailures atomic.Uint64 // Packets that failed authentication
+	Replayed     atomic.Uint64 // Packets rejected by the replay window, or as stale
+}
+
+// tunnelSendKey is the key used for outgoing packets
+type tunnelSendKey struct {
+	id      uint64
+	aead    cipher.AEAD
+	counter atomic.Uint64
+}
+
+// tunnelRecvKey is the receive state for one key ID
+type tunnelRecvKey struct {
+	aead       cipher.AEAD
+	window     *ReplayWindow
+	lastSeen   time.Time
+	notBefore  time.Time // Packets sent earlier are stale; zero for installed keys
+	onFirstUse func()
+}
+
+// TunnelCipher seals and opens tunnel packets
+type TunnelCipher struct {
+	encType    EncryptionType
+	secret     []byte // nil for session ciphers
+	windowSize int
+	overhead   int
+
+	send atomic.Pointer[tunnelSendKey]
+
+	mu   sync.Mutex
+	keys map[uint64]*tunnelRecvKey
+
+	stats TunnelStats
+}
+
+// NewTunnelCipher creates a tunnel cipher from a shared secret
+func NewTunnelCipher(encType EncryptionType, secret []byte, windowSize int) (*TunnelCipher, error) {
+	if len(secret) < 16 {
+		return nil, ErrInvalidKeySize
+	}
+
+	tc, err := newTunnelCipher(encType, windowSize)
+	if err != nil {
+		return nil, err
+	}
+	tc.secret = append([]byte(nil), secret...)
+
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate sender ID: %w", err)
+	}
+	senderID := binary.BigEndian.Uint64(id[:])
+
+	aead, err := tc.deriveAEAD(senderID)
+	if err != nil {
+		return nil, err
+	}
+	tc.send.Store(&tunnelSendKey{id: senderID, aead: aead})
+
+	return tc, nil
+}
+
+// NewSessionCipher creates a tunnel cipher without keys.
+// Keys are installed with SetSendKey and AddReceiveKey once a handshake completes.
+func NewSessionCipher(encType EncryptionType, windowSize int) (*TunnelCipher, error) {
+	return newTunnelCipher(encType, windowSize)
+}
+
+func newTunnelCipher(encType EncryptionType, windowSize int) (*TunnelCipher, error) {
+	if windowSize <= 0 {
+		windowSize = DefaultReplayWindow
+	}
+
+	probe, err := newAEAD(encType, make([]byte, 32))
+	if err != nil {
+		return nil, err
+	}
+
+	return &TunnelCipher{
+		encType:    encType,
+		windowSize: windowSize,
+		overhead:   TunnelHeaderSize + probe.Overhead(),
+		keys:       make(map[uint64]*tunnelRecvKey),
+	}, nil
+}
+
+// deriveAEAD derives the AEAD used by a sender
+func (tc *TunnelCipher) deriveAEAD(senderID uint64) (cipher.AEAD, error) {
+	var salt [8]byte
+	binary.BigEndian.PutUint64(salt[:], senderID)
+
+	key, err := hkdf.Key(sha256.New, tc.secret, salt[:], tunnelKeyInfo+tc.encType.String(), 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+
+	return newAEAD(tc.encType, key)
+}
+
+// newAEAD creates an AEAD for the encryption type
+func newAEAD(encType EncryptionType, key []byte) (cipher.AEAD, error) {
+	switch encType {
+	case EncryptionAES256GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create cipher: %w", err)
+		}
+		return cipher.NewGCM(block)
+	case EncryptionChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	default:
+		return nil, fmt.Errorf("unsupported encryption type: %v", encType)
+	}
+}
+
+// tunnelNonce builds the AEAD nonce for a counter
+func tunnelNonce(size int, counter uint64) []byte {
+	nonce := make([]byte, size)
+	binary.BigEndian.PutUint64(nonce[size-8:], counter)
+	return nonce
+}
+
+// SetSendKey switches outgoing packets to a new key.
+// The packet counter restarts at 1 for the new key.
+func (tc *TunnelCipher) SetSendKey(id uint64, key []byte) error {
+	aead, err := newAEAD(tc.encType, key)
+	if err != nil {
+		return err
+	}
+	tc.send.Store(&tunnelSendKey{id: id, aead: aead})
+	return nil
+}
+
+// AddReceiveKey installs a key for incoming packets. onFirstUse, if not nil,
+// is called once when the first packet under this key is authenticated.
+func (tc *TunnelCipher) AddReceiveKey(id uint64, key []byte, onFirstUse func()) error {
+	aead, err := newAEAD(tc.encType, key)
+	if err != nil {
+		return err
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	tc.keys[id] = &tunnelRecvKey{
+		aead:       aead,
+		window:     NewReplayWindow(tc.windowSize),
+		lastSeen:   time.Now(),
+		onFirstUse: onFirstUse,
+	}
+	return nil
+}
+
+// RemoveReceiveKey removes a key installed with AddReceiveKey
+func (tc *TunnelCipher) RemoveReceiveKey(id uint64) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	delete(tc.keys, id)
+}
+
+// HasSendKey reports whether packets can be sealed
+func (tc *TunnelCipher) HasSendKey() bool {
+	return tc.send.Load() != nil
+}
+
+// Overhead returns the number of bytes Seal adds to a payload
+func (tc *TunnelCipher) Overhead() int {
+	return tc.overhead
+}
+
+// Seal encrypts plaintext and authenticates it together with ad.
+// The result is the key ID and counter followed by the ciphertext.
+func (tc *TunnelCipher) Seal(ad, plaintext []byte) ([]byte, error) {
+	key := tc.send.Load()
+	if key == nil {
+		return nil, ErrNoSessionKey
+	}
+
+	counter := key.counter.Add(1)
+	if counter == 0 {
+		return nil, ErrExpiredKey
+	}
+
+	out := make([]byte, TunnelHeaderSize, TunnelHeaderSize+len(plaintext)+key.aead.Overhead())
+	binary.BigEndian.PutUint64(out[0:8], key.id)
+	binary.BigEndian.PutUint64(out[8:16], counter)
+
+	fullAD := append(append(make([]byte, 0, len(ad)+TunnelHeaderSize), ad...), out...)
+	out = key.aead.Seal(out, tunnelNonce(key.aead.NonceSize(), counter), plaintext, fullAD)
+
+	tc.stats.Sealed.Add(1)
+	return out, nil
+}
+
+// Open authenticates and decrypts a sealed payload, taking it to have been
+// sent now. Tampered packets and packets already seen under the same key are
+// rejected.
+func (tc *TunnelCipher) Open(ad, sealed []byte) ([]byte, error) {
+	return tc.OpenSent(ad, sealed, time.Now())
+}
+
+// OpenSent authenticates and decrypts a sealed payload sent at the given
+// time, which ad must authenticate. Besides what Open rejects, packets sent
+// before their sender key was taken up are rejected as stale.
+func (tc *TunnelCipher) OpenSent(ad, sealed []byte, sent time.Time) ([]byte, error) {
+	if len(sealed) < tc.overhead {
+		return nil, ErrTunnelPacketTooShort
+	}
+
+	keyID := binary.BigEndian.Uint64(sealed[0:8])
+	counter := binary.BigEndian.Uint64(sealed[8:16])
+
+	// Cheap replay checks before spending time on decryption
+	tc.mu.Lock()
+	key := tc.keys[keyID]
+	var notBefore time.Time
+	switch {
+	case key != nil:
+		notBefore = key.notBefore
+	case tc.secret != nil:
+		// A derived sender key would be taken up
+		notBefore = time.Now().Add(-maxTunnelPacketAge)
+	}
+	if sent.Before(notBefore) {
+		tc.mu.Unlock()
+		tc.stats.Replayed.Add(1)
+		return nil, ErrStalePacket
+	}
+	if key != nil && !key.window.Check(counter) {
+		tc.mu.Unlock()
+		tc.stats.Replayed.Add(1)
+		return nil, ErrReplayedPacket
+	}
+	tc.mu.Unlock()
+
+	var aead cipher.AEAD
+	switch {
+	case key != nil:
+		aead = key.aead
+	case tc.secret != nil:
+		var err error
+		if aead, err = tc.deriveAEAD(keyID); err != nil {
+			return nil, err
+		}
+	default:
+		tc.stats.AuthFailures.Add(1)
+		return nil, ErrUnknownKey
+	}
+
+	fullAD := append(append(make([]byte, 0, len(ad)+TunnelHeaderSize), ad...), sealed[:TunnelHeaderSize]...)
+	plaintext, err := aead.Open(nil, tunnelNonce(aead.NonceSize(), counter), sealed[TunnelHeaderSize:], fullAD)
+	if err != nil {
+		tc.stats.AuthFailures.Add(1)
+		return nil, ErrDecryptionFailed
+	}
+
+	// Only authenticated packets create receive state or move the window
+	tc.mu.Lock()
+	key = tc.keys[keyID]
+	if key == nil {
+		if tc.secret == nil {
+			// Removed while decrypting
+			tc.mu.Unlock()
+			tc.stats.AuthFailures.Add(1)
+			return nil, ErrUnknownKey
+		}
+		tc.evictOldestSender()
+		key = &tunnelRecvKey{aead: aead, window: NewReplayWindow(tc.windowSize), notBefore: notBefore}
+		tc.keys[keyID] = key
+	}
+
+	if !key.window.Accept(counter) {
+		tc.mu.Unlock()
+		tc.stats.Replayed.Add(1)
+		return nil, ErrReplayedPacket
+	}
+	key.lastSeen = time.Now()
+
+	onFirstUse := key.onFirstUse
+	key.onFirstUse = nil
+	tc.mu.Unlock()
+
+	if onFirstUse != nil {
+		onFirstUse()
+	}
+
+	tc.stats.Opened.Add(1)
+	return plaintext, nil
+}
+
+// evictOldestSender makes room for a new sender when the table is full
+func (tc *TunnelCipher) evictOldestSender() {
+	if len(tc.keys) < maxTunnelSenders {
+		return
+	}
+
+	var oldestID uint64
+	var oldest time.Time
+	for id, key := range tc.keys {
+		if oldest.IsZero() || key.lastSeen.Before(oldest) {
+			oldestID, oldest = id, key.lastSeen
+		}
+	}
+	delete(tc.keys, oldestID)
+}
+
+// GetStats returns the tunnel encryption counters
+func (tc *TunnelCipher) GetStats() *TunnelStats {
+	return &tc.stats
+}
+
+// ParseEncryptionType parses a cipher name
+func ParseEncryptionType(name string) (EncryptionType, error) {
+	switch name {
+	case "", "chacha20poly1305", "chacha20-poly1305":
+		return EncryptionChaCha20Poly1305, nil
+	case "aes256gcm", "aes-256-gcm":
+		return EncryptionAES256GCM, nil
+	default:
+		return EncryptionNone, fmt.Errorf("unsupported cipher: %s", name)
+	}
+}
@@ -2,6 +2,7 @@
 package security
 
 import (
+	"crypto/subtle"
 	"crypto/x509"
 	"sync"
 	"time"
@@ -247,6 +248,8 @@ type Peer struct {
 	Trusted      bool
 	CreatedAt    time.Time
 	mu           sync.RWMutex
+
+	lastInitiation uint64 // Newest handshake initiation timestamp accepted
 }
 
 // NewPeer creates a new peer
@@ -268,6 +271,18 @@ func (p *Peer) UpdateHandshake() {
 	p.LastHandshake = time.Now()
 }
 
+// acceptInitiation records a handshake initiation timestamp and reports
+// whether it is newer than every one accepted before
+func (p *Peer) acceptInitiation(timestamp uint64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if timestamp <= p.lastInitiation {
+		return false
+	}
+	p.lastInitiation = timestamp
+	return true
+}
+
 // UpdateTraffic updates traffic counters
 func (p *Peer) UpdateTraffic(sent, received uint64) {
 	p.mu.Lock()
@@ -521,6 +536,24 @@ func (ts *TrustStore) GetPeer(id string) (*Peer, bool) {
 	return peer, exists
 }
 
+// FindPeerByPublicKey returns the trusted peer with the given static public key
+func (ts *TrustStore) FindPeerByPublicKey(publicKey []byte) (*Peer, bool) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	for _, peer := range ts.peers {
+		peer.mu.RLock()
+		trusted := peer.Trusted
+		peer.mu.RUnlock()
+
+		if trusted && len(peer.PublicKey) == len(publicKey) &&
+			subtle.ConstantTimeCompare(peer.PublicKey, publicKey) == 1 {
+			return peer, true
+		}
+	}
+	return nil, false
+}
+
 // RemovePeer removes a peer from the trust store
 func (ts *TrustStore) RemovePeer(id string) {
 	ts.mu.Lock()
@@ -0,0 +1,261 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/arq"
+	"github.com/thelastdreamer/MultiWANBond/pkg/bandwidth"
+	"github.com/thelastdreamer/MultiWANBond/pkg/packet"
+	"github.com/thelastdreamer/MultiWANBond/pkg/pmtud"
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+)
+
+// encodeControl encodes a control message as a packet for a client WAN
+func (s *Server) encodeControl(bondID uint64, wanID uint8, msg protocol.ControlMessage) ([]byte, error) {
+	return s.codec.Encode(&protocol.Packet{
+		Version:   protocol.ProtocolVersion,
+		Type:      protocol.PacketTypeControl,
+		SessionID: bondID,
+		Timestamp: time.Now().UnixNano(),
+		WANID:     wanID,
+		Priority:  255,
+		Data:      protocol.EncodeControl(msg),
+	})
+}
+
+// sendControl sends a control message to a client WAN
+func (s *Server) sendControl(bond *bondState, wanID uint8, addr *net.UDPAddr, msg protocol.ControlMessage) error {
+	encoded, err := s.encodeControl(bond.bondID, wanID, msg)
+	if err != nil {
+		return err
+	}
+	return s.writeTo(bond, encoded, addr)
+}
+
+// sendAck sends an ack of received data to a client WAN. Clients that
+// retransmit also get the sequence IDs the bond's reorder buffer is missing.
+func (s *Server) sendAck(bond *bondState, wanID uint8, addr *net.UDPAddr, ack *protocol.Ack) error {
+	if bond.retransmit.Load() {
+		ack.Missing = bond.processor.Missing(protocol.MaxMissingRanges)
+		if len(ack.Missing) > 0 {
+			bond.lastNack.Store(time.Now().UnixNano())
+		}
+	}
+
+	encoded, err := s.codec.Encode(&protocol.Packet{
+		Version:   protocol.ProtocolVersion,
+		Type:      protocol.PacketTypeAck,
+		SessionID: bond.bondID,
+		Timestamp: time.Now().UnixNano(),
+		WANID:     wanID,
+		Priority:  255,
+		Data:      protocol.EncodeAck(ack),
+	})
+	if err != nil {
+		return err
+	}
+	return s.writeTo(bond, encoded, addr)
+}
+
+// sendAckTo sends an ack to the last known address of a client WAN
+func (s *Server) sendAckTo(bond *bondState, wanID uint8, ack *protocol.Ack) {
+	bond.mu.Lock()
+	addr := bond.wanAddrs[wanID]
+	bond.mu.Unlock()
+
+	if addr != nil {
+		s.sendAck(bond, wanID, addr, ack)
+	}
+}
+
+// repeatMissing reports missing packets again when no ack has carried them
+// for a while, as happens when the client has stopped sending
+func (s *Server) repeatMissing(bond *bondState, now time.Time) {
+	if !bond.retransmit.Load() || bond.processor.GetBufferSize() == 0 {
+		return
+	}
+	if now.Sub(time.Unix(0, bond.lastNack.Load())) < arq.NackInterval {
+		return
+	}
+	if wanID, ack, ok := bond.acks.Latest(now); ok {
+		s.sendAckTo(bond, wanID, ack)
+	}
+}
+
+// sendHeartbeat sends a heartbeat to a client WAN
+func (s *Server) sendHeartbeat(bond *bondState, wanID uint8, addr *net.UDPAddr, hb *protocol.Heartbeat) error {
+	encoded, err := s.codec.Encode(&protocol.Packet{
+		Version:   protocol.ProtocolVersion,
+		Type:      protocol.PacketTypeHeartbeat,
+		SessionID: bond.bondID,
+		Timestamp: time.Now().UnixNano(),
+		WANID:     wanID,
+		Priority:  255,
+		Data:      protocol.EncodeHeartbeat(hb),
+	})
+	if err != nil {
+		return err
+	}
+	return s.writeTo(bond, encoded, addr)
+}
+
+// sendTrain sends a probe train to a client WAN: heartbeats padded to the
+// WAN's path MTU, back to back
+func (s *Server) sendTrain(bond *bondState, wanID uint8, addr *net.UDPAddr) error {
+	bond.mu.Lock()
+	size, exists := bond.wanMTUs[wanID]
+	bond.mu.Unlock()
+	if !exists {
+		size = pmtud.DefaultMaxMTU
+	}
+
+	pad := size - packet.HeaderSize - protocol.HeartbeatLen
+	if cipher := s.bondCipher(bond); cipher != nil {
+		pad -= cipher.Overhead()
+	}
+
+	id := bond.trainID.Add(1)
+	for i := 0; i < bandwidth.TrainLength; i++ {
+		data := protocol.EncodeHeartbeat(&protocol.Heartbeat{
+			Flags: protocol.HeartbeatTrain,
+			Seq:   id,
+			Sent:  time.Now().UnixNano(),
+		})
+		if pad > 0 {
+			data = append(data, make([]byte, pad)...)
+		}
+
+		encoded, err := s.codec.Encode(&protocol.Packet{
+			Version:   protocol.ProtocolVersion,
+			Type:      protocol.PacketTypeHeartbeat,
+			SessionID: bond.bondID,
+			Timestamp: time.Now().UnixNano(),
+			WANID:     wanID,
+			Priority:  255,
+			Data:      data,
+		})
+		if err != nil {
+			return err
+		}
+		if err := s.writeTo(bond, encoded, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reportTrain tells the client the rate one of its probe trains arrived at
+func (s *Server) reportTrain(bond *bondState, result bandwidth.TrainResult) {
+	bond.mu.Lock()
+	addr := bond.wanAddrs[result.WANID]
+	bond.mu.Unlock()
+
+	if addr != nil {
+		s.sendControl(bond, result.WANID, addr, &protocol.BandwidthReport{WANID: result.WANID, Train: result.ID, Rate: uint64(result.Rate)})
+	}
+}
+
+// bindingProbe returns the NAT binding lifetime probe a packet carries, or nil
+func bindingProbe(pkt *protocol.Packet) *protocol.BindingProbe {
+	if pkt.Type != protocol.PacketTypeControl || len(pkt.Data) < 2 || protocol.ControlType(pkt.Data[1]) != protocol.ControlBindingProbe {
+		return nil
+	}
+	msg, err := protocol.DecodeControl(pkt.Data)
+	if err != nil {
+		return nil
+	}
+	return msg.(*protocol.BindingProbe)
+}
+
+// answerBindingProbe answers a NAT binding lifetime probe, once it has been
+// idle as long as it asks, at the address it came from. Probes beyond
+// protocol.MaxPendingBindingProbes waiting on a client WAN are dropped.
+func (s *Server) answerBindingProbe(bond *bondState, wanID uint8, addr *net.UDPAddr, probe *protocol.BindingProbe) {
+	if probe.Reply || probe.Idle > protocol.MaxBindingProbeIdle {
+		return
+	}
+
+	bond.mu.Lock()
+	if bond.bindingAnswers[wanID] >= protocol.MaxPendingBindingProbes {
+		bond.mu.Unlock()
+		return
+	}
+	bond.bindingAnswers[wanID]++
+	bond.mu.Unlock()
+
+	reply := *probe
+	reply.Reply = true
+	time.AfterFunc(probe.Idle, func() {
+		bond.mu.Lock()
+		bond.bindingAnswers[wanID]--
+		bond.mu.Unlock()
+
+		if s.ctx.Err() == nil {
+			s.sendControl(bond, wanID, addr, &reply)
+		}
+	})
+}
+
+// handleControl handles a control message from an established bond.
+// The server does not negotiate session settings, so it does not announce
+// CapabilityConfig and ignores the messages that only matter between bonders.
+// It acks client data, so it announces CapabilityAck, and reports missing
+// packets in those acks to clients that announce CapabilityRetransmit. It
+// reassembles fragments, announcing CapabilityFragment, and fragments return
+// traffic to the path MTUs that clients announcing it report. It measures and
+// sends bandwidth probe trains, announcing CapabilityBandwidth. It answers
+// NAT binding lifetime probes, announcing CapabilityBindingProbe; those are
+// taken before they get here, as they do not come from the WAN's address.
+func (s *Server) handleControl(bond *bondState, pkt *protocol.Packet, addr *net.UDPAddr) {
+	msg, err := protocol.DecodeControl(pkt.Data)
+	if err != nil {
+		// Never answer an error with an error
+		if len(pkt.Data) < 2 || protocol.ControlType(pkt.Data[1]) != protocol.ControlError {
+			s.sendControl(bond, pkt.WANID, addr, &protocol.Error{Code: protocol.ControlErrorCode(err), Message: err.Error()})
+		}
+		return
+	}
+
+	switch m := msg.(type) {
+	case *protocol.Handshake:
+		// Encrypted handshake messages, such as the rekey confirmation
+		if bond.noise != nil {
+			if reply, err := bond.noise.HandleMessage(m.Payload); err == nil {
+				s.sendHandshake(bond, pkt, reply, addr)
+			}
+		}
+
+	case *protocol.Hello:
+		bond.retransmit.Store(m.Capabilities&protocol.CapabilityRetransmit != 0)
+		bond.fragment.Store(m.Capabilities&protocol.CapabilityFragment != 0)
+		if !m.Response {
+			hello := &protocol.Hello{Capabilities: protocol.CapabilityAck | protocol.CapabilityFragment | protocol.CapabilityBandwidth | protocol.CapabilityBindingProbe, Response: true}
+			if s.tunnelCipher != nil || bond.noise != nil {
+				hello.Capabilities |= protocol.CapabilityEncryption
+			}
+			s.sendControl(bond, pkt.WANID, addr, hello)
+		}
+
+	case *protocol.PathMTU:
+		// Paths are taken to be symmetric, so the client's sizes apply to return traffic
+		bond.mu.Lock()
+		bond.wanMTUs[m.WANID] = int(m.MTU)
+		bond.mu.Unlock()
+
+	case *protocol.BandwidthProbe:
+		if m.WANID == pkt.WANID {
+			s.sendTrain(bond, pkt.WANID, addr)
+		}
+
+	case *protocol.Keepalive:
+		if m.Echo == 0 {
+			s.sendControl(bond, pkt.WANID, addr, &protocol.Keepalive{Timestamp: time.Now().UnixNano(), Echo: m.Timestamp})
+		}
+
+	case *protocol.Close:
+		// The client is going away; free its NAT address now rather than at idle timeout
+		s.sessionManager.RemoveSession(bond.session.ID)
+		s.removeBond(bond)
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"net"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+	"github.com/thelastdreamer/MultiWANBond/pkg/security"
+)
+
+// bondNoise returns the handshake state of a bond, or nil if the bond does
+// not exist or uses pre-shared key encryption
+func (s *Server) bondNoise(bondID uint64) *security.NoiseSession {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if bond, exists := s.bonds[bondID]; exists {
+		return bond.noise
+	}
+	return nil
+}
+
+// handleHandshake processes an unencrypted handshake message from a client.
+// Handshakes that have not authenticated the client yet are kept aside, so
+// no bond is created for a client until its static key has been verified.
+func (s *Server) handleHandshake(pkt *protocol.Packet, addr *net.UDPAddr) {
+	if pkt.Type != protocol.PacketTypeControl {
+		s.stats.DroppedAuth.Add(1)
+		return
+	}
+	msg, err := protocol.DecodeControl(pkt.Data)
+	if err != nil || msg.ControlType() != protocol.ControlHandshake {
+		s.stats.DroppedAuth.Add(1)
+		return
+	}
+
+	noise := s.bondNoise(pkt.SessionID)
+	if noise == nil {
+		noise = s.pending[pkt.SessionID]
+	}
+	if noise == nil {
+		if noise, err = s.newNoiseSession(); err != nil {
+			s.stats.DroppedAuth.Add(1)
+			return
+		}
+	}
+
+	reply, err := noise.HandleMessage(msg.(*protocol.Handshake).Payload)
+	if err != nil {
+		s.stats.DroppedAuth.Add(1)
+		return
+	}
+
+	if noise.Peer() == nil {
+		s.addPending(pkt.SessionID, noise)
+		s.sendHandshake(nil, pkt, reply, addr)
+		return
+	}
+	delete(s.pending, pkt.SessionID)
+
+	bond, err := s.getOrCreateBond(pkt.SessionID, addr, noise)
+	if err != nil {
+		s.stats.DroppedRejected.Add(1)
+		return
+	}
+	s.sendHandshake(bond, pkt, reply, addr)
+}
+
+// newNoiseSession creates the handshake state for a new client
+func (s *Server) newNoiseSession() (*security.NoiseSession, error) {
+	cipher, err := security.NewSessionCipher(s.sessionCipher, s.config.TunnelReplayWindow)
+	if err != nil {
+		return nil, err
+	}
+	return security.NewNoiseSession(*s.config.Handshake, cipher)
+}
+
+// addPending keeps an unauthenticated handshake until its next message.
+// When the table is full an arbitrary entry makes room, so unfinished
+// handshakes cannot lock out new clients.
+func (s *Server) addPending(bondID uint64, noise *security.NoiseSession) {
+	if _, exists := s.pending[bondID]; !exists && len(s.pending) >= s.config.MaxClients {
+		for id := range s.pending {
+			delete(s.pending, id)
+			break
+		}
+	}
+	s.pending[bondID] = noise
+}
+
+// sendHandshake replies to a handshake message on the WAN it arrived on.
+// Confirmations are sealed under the new session keys; everything else goes
+// out in the clear.
+func (s *Server) sendHandshake(bond *bondState, req *protocol.Packet, msg []byte, addr *net.UDPAddr) error {
+	if msg == nil {
+		return nil
+	}
+
+	encoded, err := s.encodeControl(req.SessionID, req.WANID, &protocol.Handshake{Payload: msg})
+	if err != nil {
+		return err
+	}
+
+	if bond != nil && security.IsHandshakeConfirm(msg) {
+		return s.writeTo(bond, encoded, addr)
+	}
+
+	_, err = s.conn.WriteToUDP(encoded, addr)
+	return err
+}
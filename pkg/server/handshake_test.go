@@ -0,0 +1,168 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/packet"
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+	"github.com/thelastdreamer/MultiWANBond/pkg/security"
+)
+
+func TestServerNoiseHandshake(t *testing.T) {
+	for _, pattern := range []security.HandshakePattern{security.HandshakeIK, security.HandshakeXX} {
+		t.Run(pattern.String(), func(t *testing.T) {
+			testServerNoiseHandshake(t, pattern)
+		})
+	}
+}
+
+func testServerNoiseHandshake(t *testing.T, pattern security.HandshakePattern) {
+	clientKey, err := security.GenerateStaticKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverKey, err := security.GenerateStaticKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trust := func(id string, publicKey []byte) *security.TrustStore {
+		store := security.NewTrustStore()
+		peer := security.NewPeer(id, publicKey, "", nil)
+		peer.SetTrusted(true)
+		store.AddPeer(peer)
+		return store
+	}
+
+	cfg := DefaultServerConfig()
+	cfg.ListenAddr = "127.0.0.1"
+	cfg.ListenPort = 0
+	cfg.Handshake = &security.NoiseConfig{
+		Pattern:    pattern,
+		StaticKey:  serverKey,
+		TrustStore: trust("client", clientKey.PublicKey().Bytes()),
+	}
+
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := newFakeDevice()
+	if err := srv.AttachTUN(dev); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Stop() })
+
+	cipher, err := security.NewSessionCipher(security.EncryptionChaCha20Poly1305, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	noise, err := security.NewNoiseSession(security.NoiseConfig{
+		Pattern:    pattern,
+		Initiator:  true,
+		StaticKey:  clientKey,
+		RemoteKey:  serverKey.PublicKey().Bytes(),
+		TrustStore: trust("server", serverKey.PublicKey().Bytes()),
+	}, cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	codec := packet.NewProcessor(0, 0)
+	send := func(pkt *protocol.Packet, seal bool) {
+		t.Helper()
+		pkt.Version = protocol.ProtocolVersion
+		pkt.SessionID = 9
+		pkt.WANID = 1
+		encoded, err := codec.Encode(pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seal {
+			if encoded, err = packet.Seal(cipher, encoded); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := client.WriteToUDP(encoded, srv.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sendHandshake := func(msg []byte) {
+		t.Helper()
+		send(&protocol.Packet{
+			Type: protocol.PacketTypeControl,
+			Data: protocol.EncodeControl(&protocol.Handshake{Payload: msg}),
+		}, false)
+	}
+
+	// Data sent before the handshake is dropped
+	pkt := buildUDP(net.IPv4(10, 200, 0, 2), net.IPv4(1, 1, 1, 1), 6000, 53, []byte("query"))
+	send(&protocol.Packet{Type: protocol.PacketTypeData, SequenceID: 1, Data: pkt}, false)
+
+	msg, err := noise.Initiate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendHandshake(msg)
+
+	buf := make([]byte, protocol.MaxPacketSize)
+	for !noise.Established() {
+		client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, _, err := client.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("no handshake reply: %v", err)
+		}
+		data := buf[:n]
+		if packet.IsEncrypted(data) {
+			// The XX confirmation arrives under the new keys
+			if data, err = packet.Open(cipher, data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		reply, err := codec.Decode(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.Type != protocol.PacketTypeControl {
+			t.Fatalf("unexpected reply type %v", reply.Type)
+		}
+		msg, err := protocol.DecodeControl(reply.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		next, err := noise.HandleMessage(msg.(*protocol.Handshake).Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next != nil {
+			sendHandshake(next)
+		}
+	}
+
+	send(&protocol.Packet{Type: protocol.PacketTypeData, SequenceID: 1, Data: pkt}, true)
+
+	select {
+	case <-dev.out:
+	case <-time.After(2 * time.Second):
+		t.Fatal("encrypted packet was not forwarded")
+	}
+
+	if dropped := srv.GetForwardingStats().DroppedAuth.Load(); dropped != 1 {
+		t.Fatalf("expected the unencrypted packet to be dropped, got %d auth drops", dropped)
+	}
+	if sessions := srv.GetSessionManager().GetAllSessions(); len(sessions) != 1 {
+		t.Fatalf("expected 1 session, got %d", len(sessions))
+	}
+}
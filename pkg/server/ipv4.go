@@ -0,0 +1,171 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// IP protocol numbers handled by the NAT data path
+const (
+	ipProtoICMP = 1
+	ipProtoTCP  = 6
+	ipProtoUDP  = 17
+)
+
+// ICMP echo message types (the identifier is used as the NAT "port")
+const (
+	icmpEchoReply   = 0
+	icmpEchoRequest = 8
+)
+
+// ipv4Flow describes the addressing of a tunneled IPv4 packet
+type ipv4Flow struct {
+	SrcIP     net.IP
+	DstIP     net.IP
+	SrcPort   uint16
+	DstPort   uint16
+	Protocol  uint8
+	headerLen int
+}
+
+// parseIPv4Flow extracts the 5-tuple from an IPv4 packet.
+// Non-initial fragments carry no transport header and cannot be translated.
+func parseIPv4Flow(pkt []byte) (*ipv4Flow, error) {
+	if len(pkt) < 20 {
+		return nil, fmt.Errorf("packet too small: %d bytes", len(pkt))
+	}
+
+	if pkt[0]>>4 != 4 {
+		return nil, fmt.Errorf("not an IPv4 packet (version %d)", pkt[0]>>4)
+	}
+
+	headerLen := int(pkt[0]&0x0f) * 4
+	if headerLen < 20 || headerLen > len(pkt) {
+		return nil, fmt.Errorf("invalid IPv4 header length: %d", headerLen)
+	}
+
+	fragOffset := binary.BigEndian.Uint16(pkt[6:8]) & 0x1fff
+	if fragOffset != 0 {
+		return nil, fmt.Errorf("non-initial fragment")
+	}
+
+	flow := &ipv4Flow{
+		SrcIP:     net.IPv4(pkt[12], pkt[13], pkt[14], pkt[15]),
+		DstIP:     net.IPv4(pkt[16], pkt[17], pkt[18], pkt[19]),
+		Protocol:  pkt[9],
+		headerLen: headerLen,
+	}
+
+	transport := pkt[headerLen:]
+
+	switch flow.Protocol {
+	case ipProtoTCP, ipProtoUDP:
+		if len(transport) < 4 {
+			return nil, fmt.Errorf("truncated transport header")
+		}
+		flow.SrcPort = binary.BigEndian.Uint16(transport[0:2])
+		flow.DstPort = binary.BigEndian.Uint16(transport[2:4])
+
+	case ipProtoICMP:
+		if len(transport) < 8 {
+			return nil, fmt.Errorf("truncated ICMP header")
+		}
+		if transport[0] != icmpEchoRequest && transport[0] != icmpEchoReply {
+			return nil, fmt.Errorf("unsupported ICMP type: %d", transport[0])
+		}
+		flow.SrcPort = binary.BigEndian.Uint16(transport[4:6])
+		flow.DstPort = flow.SrcPort
+
+	default:
+		return nil, fmt.Errorf("unsupported protocol: %d", flow.Protocol)
+	}
+
+	return flow, nil
+}
+
+// rewriteIPv4Source rewrites the source address and port of a packet in place
+func rewriteIPv4Source(pkt []byte, flow *ipv4Flow, ip net.IP, port uint16) {
+	rewriteIPv4(pkt, flow, 12, 0, ip, port)
+}
+
+// rewriteIPv4Dest rewrites the destination address and port of a packet in place
+func rewriteIPv4Dest(pkt []byte, flow *ipv4Flow, ip net.IP, port uint16) {
+	rewriteIPv4(pkt, flow, 16, 2, ip, port)
+}
+
+// rewriteIPv4 replaces an address/port pair and incrementally updates checksums (RFC 1624)
+func rewriteIPv4(pkt []byte, flow *ipv4Flow, addrOffset, portOffset int, ip net.IP, port uint16) {
+	newAddr := ip.To4()
+	if newAddr == nil {
+		return
+	}
+
+	var oldAddr [4]byte
+	copy(oldAddr[:], pkt[addrOffset:addrOffset+4])
+
+	var newPort [2]byte
+	binary.BigEndian.PutUint16(newPort[:], port)
+
+	// IPv4 header checksum covers the addresses
+	copy(pkt[addrOffset:], newAddr)
+	ipSum := binary.BigEndian.Uint16(pkt[10:12])
+	binary.BigEndian.PutUint16(pkt[10:12], checksumUpdate(ipSum, oldAddr[:], newAddr))
+
+	transport := pkt[flow.headerLen:]
+
+	switch flow.Protocol {
+	case ipProtoTCP:
+		if len(transport) < 18 {
+			break
+		}
+		sum := binary.BigEndian.Uint16(transport[16:18])
+		sum = checksumUpdate(sum, oldAddr[:], newAddr)
+		sum = checksumUpdate(sum, transport[portOffset:portOffset+2], newPort[:])
+		binary.BigEndian.PutUint16(transport[16:18], sum)
+
+	case ipProtoUDP:
+		if len(transport) < 8 {
+			break
+		}
+		sum := binary.BigEndian.Uint16(transport[6:8])
+		// A zero UDP checksum means "no checksum" and must stay that way
+		if sum != 0 {
+			sum = checksumUpdate(sum, oldAddr[:], newAddr)
+			sum = checksumUpdate(sum, transport[portOffset:portOffset+2], newPort[:])
+			if sum == 0 {
+				sum = 0xffff
+			}
+			binary.BigEndian.PutUint16(transport[6:8], sum)
+		}
+
+	case ipProtoICMP:
+		// ICMP has no pseudo-header; only the identifier changes
+		sum := binary.BigEndian.Uint16(transport[2:4])
+		sum = checksumUpdate(sum, transport[4:6], newPort[:])
+		binary.BigEndian.PutUint16(transport[2:4], sum)
+		copy(transport[4:6], newPort[:])
+		return
+	}
+
+	if flow.Protocol == ipProtoTCP || flow.Protocol == ipProtoUDP {
+		copy(transport[portOffset:portOffset+2], newPort[:])
+	}
+}
+
+// checksumUpdate incrementally updates a ones-complement checksum when
+// old (even length) is replaced by new (same length)
+func checksumUpdate(sum uint16, old, new []byte) uint16 {
+	acc := uint32(^sum)
+
+	for i := 0; i+1 < len(old); i += 2 {
+		acc += uint32(^binary.BigEndian.Uint16(old[i:]))
+		acc += uint32(binary.BigEndian.Uint16(new[i:]))
+	}
+
+	for acc > 0xffff {
+		acc = (acc >> 16) + (acc & 0xffff)
+	}
+
+	return ^uint16(acc)
+}
@@ -63,7 +63,9 @@ func (ne *NATEngine) TranslateOutbound(sessionID string, srcIP net.IP, srcPort u
 	mapping := session.NATMappings.GetMapping(srcIP, srcPort, protocol)
 	if mapping != nil {
 		// Update existing mapping
+		session.NATMappings.mu.Lock()
 		mapping.LastUsed = time.Now()
+		session.NATMappings.mu.Unlock()
 		return mapping, nil
 	}
 
@@ -100,17 +102,16 @@ func (ne *NATEngine) TranslateInbound(publicIP net.IP, publicPort uint16, protoc
 	for _, session := range sessions {
 		if session.PublicIP.Equal(publicIP) {
 			// Look through session's NAT mappings for matching public port
-			session.NATMappings.mu.RLock()
+			session.NATMappings.mu.Lock()
 			for _, mapping := range session.NATMappings.mappings {
 				if mapping.PublicPort == publicPort && mapping.Protocol == protocol {
-					session.NATMappings.mu.RUnlock()
-
 					// Update last used
 					mapping.LastUsed = time.Now()
+					session.NATMappings.mu.Unlock()
 					return mapping, session.ID, nil
 				}
 			}
-			session.NATMappings.mu.RUnlock()
+			session.NATMappings.mu.Unlock()
 		}
 	}
 
@@ -126,10 +127,12 @@ func (ne *NATEngine) UpdateMappingStats(sessionID string, srcIP net.IP, srcPort
 
 	mapping := session.NATMappings.GetMapping(srcIP, srcPort, protocol)
 	if mapping != nil {
+		session.NATMappings.mu.Lock()
 		mapping.BytesForward += bytesForward
 		mapping.BytesReverse += bytesReverse
 		mapping.PacketsForward++
 		mapping.LastUsed = time.Now()
+		session.NATMappings.mu.Unlock()
 	}
 }
 
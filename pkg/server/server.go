@@ -0,0 +1,861 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/bandwidth"
+	"github.com/thelastdreamer/MultiWANBond/pkg/congestion"
+	"github.com/thelastdreamer/MultiWANBond/pkg/nat"
+	"github.com/thelastdreamer/MultiWANBond/pkg/network/tun"
+	"github.com/thelastdreamer/MultiWANBond/pkg/packet"
+	"github.com/thelastdreamer/MultiWANBond/pkg/pmtud"
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+	"github.com/thelastdreamer/MultiWANBond/pkg/security"
+)
+
+// Server is the aggregation server (concentrator) that terminates bonded
+// client sessions and forwards their traffic to the internet through NAT
+type Server struct {
+	mu               sync.RWMutex
+	config           *ServerConfig
+	sessionManager   *SessionManager
+	natEngine        *NATEngine
+	bandwidthManager *BandwidthManager
+	codec            *packet.Processor                 // stateless encode/decode only
+	tunnelCipher     *security.TunnelCipher            // Pre-shared key mode
+	sessionCipher    security.EncryptionType           // Handshake mode: cipher for per-bond session keys
+	pending          map[uint64]*security.NoiseSession // Unauthenticated handshakes, receive loop only
+	tunDevice        tun.Device
+	conn             *net.UDPConn
+	stunServer       *nat.STUNServer       // Answers STUN requests, when configured
+	bonds            map[uint64]*bondState // bond session ID -> state
+	bondsBySession   map[string]*bondState // ClientSession.ID -> state
+	allowedNets      []*net.IPNet
+	blockedIPs       map[string]bool
+	interClientNet   *net.IPNet
+	stats            *ForwardingStats
+	ctx              context.Context
+	cancel           context.CancelFunc
+	wg               sync.WaitGroup
+	running          atomic.Bool
+}
+
+// bondState tracks the bonded transport of one client session
+type bondState struct {
+	mu             sync.Mutex
+	bondID         uint64                 // protocol.Packet.SessionID
+	session        *ClientSession         // Server-side client session
+	processor      *packet.Processor      // Per-session reorder buffer
+	noise          *security.NoiseSession // Session keys, when a handshake is configured
+	acks           *congestion.AckTracker // Acks of received data for the client's congestion control
+	retransmit     atomic.Bool            // The client resends the packets reported missing in acks
+	lastNack       atomic.Int64           // When missing packets were last reported, in Unix nanoseconds
+	fragments      *packet.Reassembler    // Reassembles packets the client fragmented
+	fragment       atomic.Bool            // The client reassembles fragmented packets
+	fragmentID     atomic.Uint32          // Last fragment ID used for return traffic
+	trains         *bandwidth.TrainMeter  // Measures the client's probe trains
+	trainID        atomic.Uint32          // Last probe train ID sent to the client
+	wanAddrs       map[uint8]*net.UDPAddr // Client WAN ID -> source address
+	wanMTUs        map[uint8]int          // Client WAN ID -> path MTU the client discovered
+	bindingAnswers map[uint8]int          // Client WAN ID -> binding probes waiting for their answer
+	wanOrder       []uint8                // WAN IDs in order of appearance
+	nextWAN        int                    // Round-robin index for return traffic
+	sequenceID     uint64                 // Sequence ID for return traffic
+}
+
+// ForwardingStats contains data-path counters for the server
+type ForwardingStats struct {
+	PacketsForwarded   atomic.Uint64 // Client -> internet
+	PacketsReturned    atomic.Uint64 // Internet -> client
+	DroppedInvalid     atomic.Uint64 // Undecodable or untranslatable packets
+	DroppedRejected    atomic.Uint64 // Rejected sessions (limits, ACLs)
+	DroppedWANDenied   atomic.Uint64 // Packets on WANs not in AllowedWANs
+	DroppedRateLimited atomic.Uint64 // Bandwidth limit or quota exceeded
+	DroppedInterClient atomic.Uint64 // Inter-client traffic not permitted
+	DroppedNoMapping   atomic.Uint64 // Inbound packets without a NAT mapping
+	DroppedAuth        atomic.Uint64 // Packets failing decryption or replay checks
+}
+
+// NewServer creates a new aggregation server
+func NewServer(config *ServerConfig) (*Server, error) {
+	if config == nil {
+		config = DefaultServerConfig()
+	}
+
+	if config.DefaultClientConfig == nil {
+		config.DefaultClientConfig = DefaultClientConfig()
+	}
+
+	s := &Server{
+		config:         config,
+		codec:          packet.NewProcessor(0, 0),
+		bonds:          make(map[uint64]*bondState),
+		bondsBySession: make(map[string]*bondState),
+		blockedIPs:     make(map[string]bool),
+		stats:          &ForwardingStats{},
+	}
+
+	for _, cidr := range config.AllowedCIDRs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed CIDR %s: %w", cidr, err)
+		}
+		s.allowedNets = append(s.allowedNets, ipNet)
+	}
+
+	for _, ip := range config.BlockedIPs {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			return nil, fmt.Errorf("invalid blocked IP: %s", ip)
+		}
+		s.blockedIPs[parsed.String()] = true
+	}
+
+	if config.InterClientSubnet != "" {
+		_, ipNet, err := net.ParseCIDR(config.InterClientSubnet)
+		if err != nil {
+			return nil, fmt.Errorf("invalid inter-client subnet: %w", err)
+		}
+		s.interClientNet = ipNet
+	}
+
+	if config.Handshake != nil {
+		encType, err := security.ParseEncryptionType(config.TunnelCipher)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tunnel cipher: %w", err)
+		}
+		if config.Handshake.Initiator {
+			return nil, fmt.Errorf("the server must be the handshake responder")
+		}
+		s.sessionCipher = encType
+		s.pending = make(map[uint64]*security.NoiseSession)
+	} else if config.TunnelPreSharedKey != "" {
+		encType, err := security.ParseEncryptionType(config.TunnelCipher)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tunnel cipher: %w", err)
+		}
+		s.tunnelCipher, err = security.NewTunnelCipher(encType, []byte(config.TunnelPreSharedKey), config.TunnelReplayWindow)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tunnel key: %w", err)
+		}
+	}
+
+	s.sessionManager = NewSessionManager(config)
+	s.natEngine = NewNATEngine(s.sessionManager)
+	s.bandwidthManager = NewBandwidthManager(s.sessionManager, config.TotalUploadBandwidth, config.TotalDownloadBandwidth)
+
+	return s, nil
+}
+
+// AttachTUN attaches the TUN device used to exchange traffic with the internet.
+// Translated client packets are written to it, and replies are read from it.
+func (s *Server) AttachTUN(dev tun.Device) error {
+	if s.running.Load() {
+		return fmt.Errorf("cannot attach TUN device while running")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.tunDevice != nil {
+		return fmt.Errorf("TUN device %s already attached", s.tunDevice.Name())
+	}
+
+	s.tunDevice = dev
+	return nil
+}
+
+// Start starts listening for bonded client sessions
+func (s *Server) Start(ctx context.Context) error {
+	if s.running.Load() {
+		return fmt.Errorf("server already running")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.tunDevice == nil {
+		return fmt.Errorf("no TUN device attached")
+	}
+
+	addr := &net.UDPAddr{
+		IP:   net.ParseIP(s.config.ListenAddr),
+		Port: s.config.ListenPort,
+	}
+
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	s.conn = conn
+
+	if s.config.STUN != nil {
+		s.stunServer = nat.NewSTUNServer(s.config.STUN)
+		if err := s.stunServer.Start(); err != nil {
+			conn.Close()
+			return fmt.Errorf("failed to start STUN server: %w", err)
+		}
+	}
+
+	s.ctx, s.cancel = context.WithCancel(ctx)
+
+	s.sessionManager.Start()
+	s.natEngine.Start()
+	s.bandwidthManager.Start()
+
+	s.wg.Add(4)
+	go s.receiveLoop()
+	go s.tunReaderLoop()
+	go s.cleanupLoop()
+	go s.ackLoop()
+
+	s.running.Store(true)
+
+	return nil
+}
+
+// Stop stops the server
+func (s *Server) Stop() error {
+	if !s.running.Load() {
+		return fmt.Errorf("server not running")
+	}
+
+	s.mu.Lock()
+	s.cancel()
+	// Closing the TUN device unblocks tunReaderLoop
+	s.tunDevice.Close()
+	s.mu.Unlock()
+
+	s.wg.Wait()
+
+	// Stop reorder timers
+	s.mu.RLock()
+	for _, bond := range s.bonds {
+		bond.processor.Close()
+	}
+	s.mu.RUnlock()
+
+	s.bandwidthManager.Stop()
+	s.natEngine.Stop()
+	s.sessionManager.Stop()
+
+	if s.stunServer != nil {
+		s.stunServer.Stop()
+	}
+	s.conn.Close()
+	s.running.Store(false)
+
+	return nil
+}
+
+// LocalAddr returns the address the server is listening on
+func (s *Server) LocalAddr() *net.UDPAddr {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// GetSTUNServer returns the STUN server, or nil when it is not configured
+func (s *Server) GetSTUNServer() *nat.STUNServer {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.stunServer
+}
+
+// GetSessionManager returns the session manager
+func (s *Server) GetSessionManager() *SessionManager {
+	return s.sessionManager
+}
+
+// GetNATEngine returns the NAT engine
+func (s *Server) GetNATEngine() *NATEngine {
+	return s.natEngine
+}
+
+// GetBandwidthManager returns the bandwidth manager
+func (s *Server) GetBandwidthManager() *BandwidthManager {
+	return s.bandwidthManager
+}
+
+// GetReorderStats returns reorder buffer statistics per client session ID
+func (s *Server) GetReorderStats() map[string]packet.ReorderStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stats := make(map[string]packet.ReorderStats, len(s.bondsBySession))
+	for sessionID, bond := range s.bondsBySession {
+		stats[sessionID] = bond.processor.GetReorderStats()
+	}
+	return stats
+}
+
+// GetForwardingStats returns the data-path counters
+func (s *Server) GetForwardingStats() *ForwardingStats {
+	return s.stats
+}
+
+// receiveLoop reads bonded packets from clients
+func (s *Server) receiveLoop() {
+	defer s.wg.Done()
+
+	buf := make([]byte, protocol.MaxPacketSize)
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+
+		default:
+			s.conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+
+			n, addr, err := s.conn.ReadFromUDP(buf)
+			if err != nil {
+				continue
+			}
+
+			s.handleDatagram(buf[:n], addr)
+		}
+	}
+}
+
+// handleDatagram processes a single datagram from a client WAN
+func (s *Server) handleDatagram(data []byte, addr *net.UDPAddr) {
+	received := time.Now()
+
+	pkt, err := s.codec.Decode(data)
+	if err != nil {
+		s.stats.DroppedInvalid.Add(1)
+		return
+	}
+
+	// Handshake messages travel in the clear; Noise protects them itself
+	if s.config.Handshake != nil && !packet.IsEncrypted(data) {
+		s.handleHandshake(pkt, addr)
+		return
+	}
+
+	// With tunnel encryption on, every packet must authenticate; without it,
+	// encrypted packets cannot be read
+	noise := s.bondNoise(pkt.SessionID)
+	cipher := s.tunnelCipher
+	if noise != nil {
+		cipher = noise.Cipher()
+	}
+	if packet.IsEncrypted(data) != (cipher != nil) {
+		s.stats.DroppedAuth.Add(1)
+		return
+	}
+	if cipher != nil {
+		opened, err := packet.Open(cipher, data)
+		if err != nil {
+			s.stats.DroppedAuth.Add(1)
+			return
+		}
+		if pkt, err = s.codec.Decode(opened); err != nil {
+			s.stats.DroppedInvalid.Add(1)
+			return
+		}
+		data = opened
+	}
+
+	bond, err := s.getOrCreateBond(pkt.SessionID, addr, noise)
+	if err != nil {
+		s.stats.DroppedRejected.Add(1)
+		return
+	}
+
+	session := bond.session
+	s.sessionManager.UpdateSessionActivity(session.ID)
+
+	// Binding probes come from a socket of their own, not the WAN's
+	if probe := bindingProbe(pkt); probe != nil {
+		if wanAllowed(session.Config, pkt.WANID) {
+			s.answerBindingProbe(bond, pkt.WANID, addr, probe)
+		}
+		return
+	}
+
+	s.recordWAN(bond, pkt.WANID, addr, len(data))
+
+	if !wanAllowed(session.Config, pkt.WANID) {
+		s.stats.DroppedWANDenied.Add(1)
+		return
+	}
+
+	switch pkt.Type {
+	case protocol.PacketTypeHeartbeat:
+		// Answer probes on the WAN they came in on; measure probe trains
+		hb, err := protocol.DecodeHeartbeat(pkt.Data)
+		switch {
+		case err != nil || hb.IsReply():
+		case hb.IsTrain():
+			if result, ok := bond.trains.Received(pkt.WANID, hb.Seq, len(data), received); ok {
+				s.reportTrain(bond, result)
+			}
+		default:
+			s.sendHeartbeat(bond, pkt.WANID, addr, hb.Reply(received.UnixNano(), time.Now().UnixNano()))
+		}
+
+	case protocol.PacketTypeControl:
+		s.handleControl(bond, pkt, addr)
+
+	case protocol.PacketTypeData:
+		if ack := bond.acks.Received(pkt.WANID, pkt.SequenceID, len(pkt.Data), received); ack != nil {
+			s.sendAck(bond, pkt.WANID, addr, ack)
+		}
+
+		if pkt.Flags&protocol.FlagFragment != 0 {
+			if pkt, _ = bond.fragments.Add(pkt, received); pkt == nil {
+				return
+			}
+		}
+
+		// Released packets are forwarded by the bond's deliver function
+		bond.processor.Reorder(pkt)
+	}
+}
+
+// getOrCreateBond returns the state for a bond session, creating a ClientSession if needed
+// noise carries the bond's handshake state and is ignored for existing bonds
+func (s *Server) getOrCreateBond(bondID uint64, addr *net.UDPAddr, noise *security.NoiseSession) (*bondState, error) {
+	s.mu.RLock()
+	bond, exists := s.bonds[bondID]
+	s.mu.RUnlock()
+
+	if exists {
+		// The session may have been expired by the session manager
+		if _, err := s.sessionManager.GetSession(bond.session.ID); err == nil {
+			return bond, nil
+		}
+		s.removeBond(bond)
+		if noise == nil {
+			noise = bond.noise
+		}
+	}
+
+	if err := s.checkClientAddr(addr.IP); err != nil {
+		return nil, err
+	}
+
+	clientID := fmt.Sprintf("%016x", bondID)
+	session, err := s.sessionManager.CreateSession(clientID, addr, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	processor := packet.NewProcessor(s.config.ReceiveQueueSize, 500*time.Millisecond)
+	processor.SetNextExpectedSeq(1)
+
+	bond = &bondState{
+		bondID:         bondID,
+		session:        session,
+		processor:      processor,
+		noise:          noise,
+		acks:           congestion.NewAckTracker(),
+		fragments:      packet.NewReassembler(500 * time.Millisecond),
+		trains:         bandwidth.NewTrainMeter(),
+		wanAddrs:       make(map[uint8]*net.UDPAddr),
+		wanMTUs:        make(map[uint8]int),
+		bindingAnswers: make(map[uint8]int),
+	}
+	processor.SetDeliverFunc(func(batch [][]byte) {
+		for _, data := range batch {
+			s.forwardOutbound(bond, data)
+		}
+	})
+
+	s.mu.Lock()
+	s.bonds[bondID] = bond
+	s.bondsBySession[session.ID] = bond
+	s.mu.Unlock()
+
+	return bond, nil
+}
+
+// removeBond forgets a bond whose client session is gone
+func (s *Server) removeBond(bond *bondState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if current, exists := s.bonds[bond.bondID]; exists && current == bond {
+		delete(s.bonds, bond.bondID)
+	}
+	delete(s.bondsBySession, bond.session.ID)
+
+	bond.processor.Close()
+}
+
+// checkClientAddr enforces AllowedCIDRs and BlockedIPs
+func (s *Server) checkClientAddr(ip net.IP) error {
+	if s.blockedIPs[ip.String()] {
+		return fmt.Errorf("client %s is blocked", ip)
+	}
+
+	if len(s.allowedNets) == 0 {
+		return nil
+	}
+
+	for _, ipNet := range s.allowedNets {
+		if ipNet.Contains(ip) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("client %s not in allowed ranges", ip)
+}
+
+// recordWAN updates per-WAN state for a client
+func (s *Server) recordWAN(bond *bondState, wanID uint8, addr *net.UDPAddr, n int) {
+	bond.mu.Lock()
+	if _, exists := bond.wanAddrs[wanID]; !exists {
+		bond.wanOrder = append(bond.wanOrder, wanID)
+	}
+	bond.wanAddrs[wanID] = addr
+	bond.mu.Unlock()
+
+	session := bond.session
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	wanState, exists := session.WANInterfaces[wanID]
+	if !exists {
+		wanState = &ClientWANState{WANID: wanID}
+		session.WANInterfaces[wanID] = wanState
+	}
+	wanState.Active = true
+	wanState.BytesReceived += uint64(n)
+	wanState.PacketsReceived++
+	wanState.LastUsed = time.Now()
+	session.PacketsReceived++
+}
+
+// wanAllowed checks the client's AllowedWANs list (empty = all)
+func wanAllowed(config *ClientConfig, wanID uint8) bool {
+	if config == nil || len(config.AllowedWANs) == 0 {
+		return true
+	}
+
+	for _, id := range config.AllowedWANs {
+		if id == wanID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// forwardOutbound translates a decapsulated client packet and sends it to the internet
+func (s *Server) forwardOutbound(bond *bondState, data []byte) {
+	session := bond.session
+
+	flow, err := parseIPv4Flow(data)
+	if err != nil {
+		s.stats.DroppedInvalid.Add(1)
+		return
+	}
+
+	if s.isInterClient(flow.DstIP) && !(s.config.AllowInterClient && session.Config.EnableInterClient) {
+		s.stats.DroppedInterClient.Add(1)
+		return
+	}
+
+	if !s.bandwidthManager.CheckBandwidthLimit(session.ID, uint64(len(data)), 0) {
+		s.stats.DroppedRateLimited.Add(1)
+		s.sessionManager.sendEvent(SessionEvent{
+			Type:      EventBandwidthLimitHit,
+			SessionID: session.ID,
+			ClientID:  session.ClientID,
+			Timestamp: time.Now(),
+			Details:   "Upload limit reached",
+		})
+		return
+	}
+
+	mapping, err := s.natEngine.TranslateOutbound(session.ID, flow.SrcIP, flow.SrcPort, flow.DstIP, flow.DstPort, flow.Protocol)
+	if err != nil {
+		s.stats.DroppedInvalid.Add(1)
+		return
+	}
+
+	session.mu.Lock()
+	if session.PrivateIP == nil {
+		session.PrivateIP = flow.SrcIP
+	}
+	if session.State != ClientStateActive {
+		session.State = ClientStateActive
+		s.sessionManager.sendEvent(SessionEvent{
+			Type:      EventSessionActive,
+			SessionID: session.ID,
+			ClientID:  session.ClientID,
+			Timestamp: time.Now(),
+		})
+	}
+	session.mu.Unlock()
+
+	rewriteIPv4Source(data, flow, mapping.PublicIP, mapping.PublicPort)
+
+	if _, err := s.tunDevice.Write(data); err != nil {
+		s.stats.DroppedInvalid.Add(1)
+		return
+	}
+
+	s.bandwidthManager.AccountTraffic(session.ID, uint64(len(data)), 0)
+	s.natEngine.UpdateMappingStats(session.ID, flow.SrcIP, flow.SrcPort, flow.Protocol, uint64(len(data)), 0)
+	s.stats.PacketsForwarded.Add(1)
+}
+
+// isInterClient checks if a destination belongs to the inter-client subnet
+func (s *Server) isInterClient(ip net.IP) bool {
+	return s.interClientNet != nil && s.interClientNet.Contains(ip)
+}
+
+// tunReaderLoop reads replies from the internet and returns them to clients
+func (s *Server) tunReaderLoop() {
+	defer s.wg.Done()
+
+	buf := make([]byte, protocol.MaxPacketSize)
+
+	for {
+		n, err := s.tunDevice.Read(buf)
+		if err != nil {
+			select {
+			case <-s.ctx.Done():
+				return
+			default:
+			}
+
+			if err == tun.ErrDeviceClosed {
+				return
+			}
+			continue
+		}
+
+		data := make([]byte, n)
+		copy(data, buf[:n])
+
+		s.forwardInbound(data)
+	}
+}
+
+// forwardInbound translates a packet from the internet and sends it to the owning client
+func (s *Server) forwardInbound(data []byte) {
+	flow, err := parseIPv4Flow(data)
+	if err != nil {
+		s.stats.DroppedInvalid.Add(1)
+		return
+	}
+
+	mapping, sessionID, err := s.natEngine.TranslateInbound(flow.DstIP, flow.DstPort, flow.Protocol)
+	if err != nil {
+		s.stats.DroppedNoMapping.Add(1)
+		return
+	}
+
+	s.mu.RLock()
+	bond, exists := s.bondsBySession[sessionID]
+	s.mu.RUnlock()
+
+	if !exists {
+		s.stats.DroppedNoMapping.Add(1)
+		return
+	}
+
+	if !s.bandwidthManager.CheckBandwidthLimit(sessionID, 0, uint64(len(data))) {
+		s.stats.DroppedRateLimited.Add(1)
+		return
+	}
+
+	rewriteIPv4Dest(data, flow, mapping.SourceIP, mapping.SourcePort)
+
+	if err := s.sendToClient(bond, data); err != nil {
+		return
+	}
+
+	s.bandwidthManager.AccountTraffic(sessionID, 0, uint64(len(data)))
+	s.natEngine.UpdateMappingStats(sessionID, mapping.SourceIP, mapping.SourcePort, mapping.Protocol, 0, uint64(len(data)))
+	s.stats.PacketsReturned.Add(1)
+}
+
+// sendToClient encapsulates data and sends it round-robin over the client's allowed WANs
+func (s *Server) sendToClient(bond *bondState, data []byte) error {
+	session := bond.session
+
+	bond.mu.Lock()
+	var wanID uint8
+	var addr *net.UDPAddr
+	mtu := pmtud.DefaultMaxMTU
+	for i := 0; i < len(bond.wanOrder); i++ {
+		id := bond.wanOrder[bond.nextWAN%len(bond.wanOrder)]
+		bond.nextWAN++
+		if wanAllowed(session.Config, id) {
+			wanID = id
+			addr = bond.wanAddrs[id]
+			if wanMTU, exists := bond.wanMTUs[id]; exists {
+				mtu = wanMTU
+			}
+			break
+		}
+	}
+	bond.sequenceID++
+	seq := bond.sequenceID
+	bond.mu.Unlock()
+
+	if addr == nil {
+		return fmt.Errorf("no usable WAN for session %s", session.ID)
+	}
+
+	pkt := &protocol.Packet{
+		Version:    protocol.ProtocolVersion,
+		Type:       protocol.PacketTypeData,
+		SessionID:  bond.bondID,
+		SequenceID: seq,
+		Timestamp:  time.Now().UnixNano(),
+		WANID:      wanID,
+		Priority:   128,
+		Data:       data,
+	}
+
+	datagrams, err := s.datagrams(bond, pkt, mtu)
+	if err != nil {
+		return err
+	}
+
+	sent := 0
+	for _, encoded := range datagrams {
+		if err := s.writeTo(bond, encoded, addr); err != nil {
+			return err
+		}
+		sent += len(encoded)
+	}
+
+	session.mu.Lock()
+	session.PacketsSent++
+	if wanState, exists := session.WANInterfaces[wanID]; exists {
+		wanState.BytesSent += uint64(sent)
+		wanState.PacketsSent++
+		wanState.LastUsed = time.Now()
+	}
+	session.mu.Unlock()
+
+	return nil
+}
+
+// datagrams encodes a packet for a client WAN whose path MTU is mtu, as
+// fragments when it does not fit and the client reassembles fragments
+func (s *Server) datagrams(bond *bondState, pkt *protocol.Packet, mtu int) ([][]byte, error) {
+	maxData := mtu - packet.HeaderSize
+	if cipher := s.bondCipher(bond); cipher != nil {
+		maxData -= cipher.Overhead()
+	}
+
+	fragments := []*protocol.Packet{pkt}
+	if len(pkt.Data) > maxData && bond.fragment.Load() {
+		var err error
+		if fragments, err = packet.Fragment(pkt, bond.fragmentID.Add(1), maxData); err != nil {
+			return nil, err
+		}
+	}
+
+	datagrams := make([][]byte, len(fragments))
+	for i, fragment := range fragments {
+		encoded, err := s.codec.Encode(fragment)
+		if err != nil {
+			return nil, err
+		}
+		datagrams[i] = encoded
+	}
+	return datagrams, nil
+}
+
+// bondCipher returns the cipher that protects a bond's packets, or nil when
+// tunnel encryption is off
+func (s *Server) bondCipher(bond *bondState) *security.TunnelCipher {
+	if bond.noise != nil {
+		return bond.noise.Cipher()
+	}
+	return s.tunnelCipher
+}
+
+// writeTo sends an encoded packet to a client WAN, encrypting it first when
+// tunnel encryption is configured
+func (s *Server) writeTo(bond *bondState, encoded []byte, addr *net.UDPAddr) error {
+	if cipher := s.bondCipher(bond); cipher != nil {
+		sealed, err := packet.Seal(cipher, encoded)
+		if err != nil {
+			return err
+		}
+		encoded = sealed
+	}
+
+	_, err := s.conn.WriteToUDP(encoded, addr)
+	return err
+}
+
+// cleanupLoop drops bond state for sessions expired by the session manager
+func (s *Server) cleanupLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.mu.RLock()
+			bonds := make([]*bondState, 0, len(s.bonds))
+			for _, bond := range s.bonds {
+				bonds = append(bonds, bond)
+			}
+			s.mu.RUnlock()
+
+			for _, bond := range bonds {
+				if _, err := s.sessionManager.GetSession(bond.session.ID); err != nil {
+					s.removeBond(bond)
+				}
+			}
+		}
+	}
+}
+
+// ackLoop sends the acks of client data that has waited long enough
+func (s *Server) ackLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(congestion.AckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.mu.RLock()
+			bonds := make([]*bondState, 0, len(s.bonds))
+			for _, bond := range s.bonds {
+				bonds = append(bonds, bond)
+			}
+			s.mu.RUnlock()
+
+			for _, bond := range bonds {
+				for wanID, ack := range bond.acks.Due(now) {
+					s.sendAckTo(bond, wanID, ack)
+				}
+				s.repeatMissing(bond, now)
+				for _, result := range bond.trains.Expire(now) {
+					s.reportTrain(bond, result)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,517 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/bandwidth"
+	"github.com/thelastdreamer/MultiWANBond/pkg/nat"
+	"github.com/thelastdreamer/MultiWANBond/pkg/network/tun"
+	"github.com/thelastdreamer/MultiWANBond/pkg/packet"
+	"github.com/thelastdreamer/MultiWANBond/pkg/pmtud"
+	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+)
+
+// fakeDevice is an in-memory tun.Device
+type fakeDevice struct {
+	in     chan []byte // packets arriving from the internet
+	out    chan []byte // packets sent to the internet
+	closed chan struct{}
+}
+
+func newFakeDevice() *fakeDevice {
+	return &fakeDevice{
+		in:     make(chan []byte, 16),
+		out:    make(chan []byte, 16),
+		closed: make(chan struct{}),
+	}
+}
+
+func (d *fakeDevice) Name() string { return "fake0" }
+func (d *fakeDevice) MTU() int     { return tun.DefaultMTU }
+
+func (d *fakeDevice) Read(buf []byte) (int, error) {
+	select {
+	case pkt := <-d.in:
+		return copy(buf, pkt), nil
+	case <-d.closed:
+		return 0, tun.ErrDeviceClosed
+	}
+}
+
+func (d *fakeDevice) Write(pkt []byte) (int, error) {
+	d.out <- append([]byte(nil), pkt...)
+	return len(pkt), nil
+}
+
+func (d *fakeDevice) Close() error {
+	select {
+	case <-d.closed:
+	default:
+		close(d.closed)
+	}
+	return nil
+}
+
+// checksum computes the ones-complement checksum of data
+func checksum(data []byte, initial uint32) uint16 {
+	sum := initial
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+// buildUDP builds an IPv4/UDP packet with valid checksums
+func buildUDP(src, dst net.IP, srcPort, dstPort uint16, payload []byte) []byte {
+	pkt := make([]byte, 28+len(payload))
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+	pkt[8] = 64
+	pkt[9] = ipProtoUDP
+	copy(pkt[12:], src.To4())
+	copy(pkt[16:], dst.To4())
+	binary.BigEndian.PutUint16(pkt[10:], checksum(pkt[:20], 0))
+
+	udp := pkt[20:]
+	binary.BigEndian.PutUint16(udp[0:], srcPort)
+	binary.BigEndian.PutUint16(udp[2:], dstPort)
+	binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+	copy(udp[8:], payload)
+	binary.BigEndian.PutUint16(udp[6:], checksum(udp, pseudoHeaderSum(pkt)))
+
+	return pkt
+}
+
+// pseudoHeaderSum returns the partial sum of the UDP/TCP pseudo-header
+func pseudoHeaderSum(pkt []byte) uint32 {
+	var sum uint32
+	for i := 12; i < 20; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(pkt[i:]))
+	}
+	sum += uint32(pkt[9])
+	sum += uint32(len(pkt) - 20)
+	return sum
+}
+
+// verifyChecksums fails the test if the IPv4 or UDP checksum is invalid
+func verifyChecksums(t *testing.T, pkt []byte) {
+	t.Helper()
+	if checksum(pkt[:20], 0) != 0 {
+		t.Fatal("invalid IPv4 header checksum")
+	}
+	if checksum(pkt[20:], pseudoHeaderSum(pkt)) != 0 {
+		t.Fatal("invalid UDP checksum")
+	}
+}
+
+func startTestServer(t *testing.T, clientConfig *ClientConfig) (*Server, *fakeDevice) {
+	t.Helper()
+
+	cfg := DefaultServerConfig()
+	cfg.ListenAddr = "127.0.0.1"
+	cfg.ListenPort = 0
+	if clientConfig != nil {
+		cfg.DefaultClientConfig = clientConfig
+	}
+
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dev := newFakeDevice()
+	if err := srv.AttachTUN(dev); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Stop() })
+
+	return srv, dev
+}
+
+func sendBonded(t *testing.T, conn *net.UDPConn, to *net.UDPAddr, bondID, seq uint64, wanID uint8, data []byte) {
+	t.Helper()
+
+	encoded, err := packet.NewProcessor(0, 0).Encode(&protocol.Packet{
+		Version:    protocol.ProtocolVersion,
+		Type:       protocol.PacketTypeData,
+		SessionID:  bondID,
+		SequenceID: seq,
+		WANID:      wanID,
+		Data:       data,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.WriteToUDP(encoded, to); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerForwardsThroughNAT(t *testing.T) {
+	srv, dev := startTestServer(t, nil)
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	clientIP := net.IPv4(10, 200, 0, 2)
+	remoteIP := net.IPv4(93, 184, 216, 34)
+	out := buildUDP(clientIP, remoteIP, 5000, 53, []byte("query"))
+
+	sendBonded(t, client, srv.LocalAddr(), 42, 1, 1, out)
+
+	var translated []byte
+	select {
+	case translated = <-dev.out:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for translated packet")
+	}
+
+	sessions := srv.GetSessionManager().GetAllSessions()
+	if len(sessions) != 1 {
+		t.Fatalf("expected 1 session, got %d", len(sessions))
+	}
+	session := sessions[0]
+
+	flow, err := parseIPv4Flow(translated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !flow.SrcIP.Equal(session.PublicIP) {
+		t.Fatalf("source not translated: got %s, want %s", flow.SrcIP, session.PublicIP)
+	}
+	if !flow.DstIP.Equal(remoteIP) || flow.DstPort != 53 {
+		t.Fatalf("destination changed: %s:%d", flow.DstIP, flow.DstPort)
+	}
+	verifyChecksums(t, translated)
+
+	// Reply from the internet to the public mapping
+	dev.in <- buildUDP(remoteIP, flow.SrcIP, 53, flow.SrcPort, []byte("answer"))
+
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, protocol.MaxPacketSize)
+	n, _, err := client.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("no reply from server: %v", err)
+	}
+
+	reply, err := packet.NewProcessor(0, 0).Decode(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.SessionID != 42 || reply.SequenceID != 1 {
+		t.Fatalf("unexpected reply header: session=%d seq=%d", reply.SessionID, reply.SequenceID)
+	}
+
+	replyFlow, err := parseIPv4Flow(reply.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !replyFlow.DstIP.Equal(clientIP) || replyFlow.DstPort != 5000 {
+		t.Fatalf("reply not translated back: %s:%d", replyFlow.DstIP, replyFlow.DstPort)
+	}
+	verifyChecksums(t, reply.Data)
+}
+
+func TestServerReassemblesFragments(t *testing.T) {
+	srv, dev := startTestServer(t, nil)
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	out := buildUDP(net.IPv4(10, 200, 0, 2), net.IPv4(93, 184, 216, 34), 5000, 443, make([]byte, 3000))
+	fragments, err := packet.Fragment(&protocol.Packet{
+		Version:    protocol.ProtocolVersion,
+		Type:       protocol.PacketTypeData,
+		SessionID:  42,
+		SequenceID: 1,
+		WANID:      1,
+		Data:       out,
+	}, 1, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The last fragment first; nothing is forwarded until all have arrived
+	codec := packet.NewProcessor(0, 0)
+	for i := len(fragments) - 1; i >= 0; i-- {
+		encoded, err := codec.Encode(fragments[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.WriteToUDP(encoded, srv.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case translated := <-dev.out:
+		if len(translated) != len(out) {
+			t.Fatalf("forwarded %d bytes, want %d", len(translated), len(out))
+		}
+		verifyChecksums(t, translated)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for reassembled packet")
+	}
+}
+
+func TestServerEnforcesAllowedWANs(t *testing.T) {
+	clientConfig := DefaultClientConfig()
+	clientConfig.AllowedWANs = []uint8{1}
+	srv, dev := startTestServer(t, clientConfig)
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	pkt := buildUDP(net.IPv4(10, 200, 0, 2), net.IPv4(1, 1, 1, 1), 6000, 53, nil)
+	sendBonded(t, client, srv.LocalAddr(), 7, 1, 2, pkt)
+
+	select {
+	case <-dev.out:
+		t.Fatal("packet on disallowed WAN was forwarded")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if srv.GetForwardingStats().DroppedWANDenied.Load() != 1 {
+		t.Fatal("expected packet to be counted as WAN denied")
+	}
+}
+
+func TestServerRejectsBlockedClients(t *testing.T) {
+	cfg := DefaultServerConfig()
+	cfg.BlockedIPs = []string{"127.0.0.1"}
+
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := srv.getOrCreateBond(1, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}, nil); err == nil {
+		t.Fatal("expected blocked client to be rejected")
+	}
+}
+
+func TestServerBandwidthProbes(t *testing.T) {
+	srv, _ := startTestServer(t, nil)
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	codec := packet.NewProcessor(0, 0)
+	send := func(typ protocol.PacketType, data []byte) {
+		t.Helper()
+		encoded, err := codec.Encode(&protocol.Packet{
+			Version:   protocol.ProtocolVersion,
+			Type:      typ,
+			SessionID: 42,
+			WANID:     1,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.WriteToUDP(encoded, srv.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A train from the client is measured and reported back
+	for i := 0; i < bandwidth.TrainLength; i++ {
+		hb := protocol.EncodeHeartbeat(&protocol.Heartbeat{Flags: protocol.HeartbeatTrain, Seq: 3})
+		send(protocol.PacketTypeHeartbeat, append(hb, make([]byte, 1000)...))
+		time.Sleep(100 * time.Microsecond)
+	}
+	// Asking for a train gets one back
+	send(protocol.PacketTypeControl, protocol.EncodeControl(&protocol.BandwidthProbe{WANID: 1}))
+
+	var report *protocol.BandwidthReport
+	trainPackets := 0
+	buf := make([]byte, protocol.MaxPacketSize)
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for report == nil || trainPackets < bandwidth.TrainLength {
+		n, _, err := client.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("got report %+v and %d train packets: %v", report, trainPackets, err)
+		}
+		pkt, err := codec.Decode(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		switch pkt.Type {
+		case protocol.PacketTypeControl:
+			if msg, err := protocol.DecodeControl(pkt.Data); err == nil {
+				if r, ok := msg.(*protocol.BandwidthReport); ok {
+					report = r
+				}
+			}
+		case protocol.PacketTypeHeartbeat:
+			if hb, err := protocol.DecodeHeartbeat(pkt.Data); err == nil && hb.IsTrain() {
+				if n != pmtud.DefaultMaxMTU {
+					t.Fatalf("train packet of %d bytes, want %d", n, pmtud.DefaultMaxMTU)
+				}
+				trainPackets++
+			}
+		}
+	}
+
+	if report.WANID != 1 || report.Train != 3 || report.Rate == 0 {
+		t.Errorf("report = %+v", report)
+	}
+}
+
+func TestServerAnswersBindingProbes(t *testing.T) {
+	srv, _ := startTestServer(t, nil)
+
+	listen := func() *net.UDPConn {
+		t.Helper()
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	wan, prober := listen(), listen()
+
+	codec := packet.NewProcessor(0, 0)
+	send := func(conn *net.UDPConn, typ protocol.PacketType, data []byte) {
+		t.Helper()
+		encoded, err := codec.Encode(&protocol.Packet{
+			Version:   protocol.ProtocolVersion,
+			Type:      typ,
+			SessionID: 42,
+			WANID:     1,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.WriteToUDP(encoded, srv.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send(wan, protocol.PacketTypeHeartbeat, protocol.EncodeHeartbeat(&protocol.Heartbeat{Seq: 1}))
+	sent := time.Now()
+	send(prober, protocol.PacketTypeControl, protocol.EncodeControl(&protocol.BindingProbe{WANID: 1, Probe: 5, Idle: 200 * time.Millisecond}))
+
+	// The answer waits out the idle time and goes to the probe's socket
+	buf := make([]byte, protocol.MaxPacketSize)
+	prober.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := prober.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(sent); waited < 200*time.Millisecond {
+		t.Errorf("answered after %v, before the probe's idle time", waited)
+	}
+	pkt, err := codec.Decode(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := protocol.DecodeControl(pkt.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply, ok := msg.(*protocol.BindingProbe); !ok || !reply.Reply || reply.Probe != 5 || reply.WANID != 1 {
+		t.Errorf("answer = %+v", msg)
+	}
+
+	// The probe's socket did not take over the WAN
+	srv.mu.RLock()
+	bond := srv.bonds[42]
+	srv.mu.RUnlock()
+	bond.mu.Lock()
+	addr := bond.wanAddrs[1]
+	bond.mu.Unlock()
+	if addr.String() != wan.LocalAddr().String() {
+		t.Errorf("WAN 1 address = %s, want %s", addr, wan.LocalAddr())
+	}
+
+	// Probes past the limit waiting on a WAN go unanswered
+	for i := 0; i < protocol.MaxPendingBindingProbes+2; i++ {
+		send(prober, protocol.PacketTypeControl, protocol.EncodeControl(&protocol.BindingProbe{WANID: 1, Probe: uint32(10 + i), Idle: 100 * time.Millisecond}))
+	}
+	answers := 0
+	prober.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		if _, _, err := prober.ReadFromUDP(buf); err != nil {
+			break
+		}
+		answers++
+	}
+	if answers != protocol.MaxPendingBindingProbes {
+		t.Errorf("%d probes answered, want %d", answers, protocol.MaxPendingBindingProbes)
+	}
+}
+
+func TestServerAnswersSTUN(t *testing.T) {
+	cfg := DefaultServerConfig()
+	cfg.ListenAddr = "127.0.0.1"
+	cfg.ListenPort = 0
+	cfg.STUN = &nat.STUNServerConfig{
+		Address:          "127.0.0.1:0",
+		AlternateAddress: "127.0.0.2:0",
+		Username:         "bond",
+		Password:         "secret",
+	}
+
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.AttachTUN(newFakeDevice()); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	client, err := nat.NewSTUNClient(&nat.STUNConfig{
+		PrimaryServer: srv.GetSTUNServer().LocalAddr().String(),
+		Timeout:       time.Second,
+		Username:      "bond",
+		Password:      "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	mapping, err := client.DiscoverNATMapping()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mapping.PublicAddr.Port != client.GetLocalAddr().Port || mapping.MappingType != nat.NATTypeFullCone {
+		t.Errorf("mapping = %s (%s)", mapping.PublicAddr, mapping.MappingType)
+	}
+	if stats := srv.GetSTUNServer().GetStats(); stats.Changed == 0 {
+		t.Errorf("no CHANGE-REQUEST answered: %+v", stats)
+	}
+}
@@ -5,6 +5,9 @@ import (
 	"net"
 	"sync"
 	"time"
+
+	"github.com/thelastdreamer/MultiWANBond/pkg/nat"
+	"github.com/thelastdreamer/MultiWANBond/pkg/security"
 )
 
 // ClientSession represents a connected client session
@@ -155,6 +158,19 @@ type ServerConfig struct {
 	AllowedCIDRs          []string // Allowed client IP ranges
 	BlockedIPs            []string // Blocked IPs
 
+	// Tunnel encryption; must match the clients' security config
+	TunnelCipher       string // "chacha20poly1305" or "aes256gcm"
+	TunnelPreSharedKey string // Empty disables tunnel encryption
+	TunnelReplayWindow int    // Packets tracked for replay protection
+
+	// Handshake, when set, derives per-bond session keys with a Noise
+	// handshake instead of TunnelPreSharedKey. The server is always the responder.
+	Handshake *security.NoiseConfig
+
+	// STUN, when set, answers STUN requests so clients can discover their
+	// NAT mapping and type against this server
+	STUN *nat.STUNServerConfig
+
 	// Performance
 	WorkerThreads     int
 	BufferSize        int
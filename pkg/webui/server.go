@@ -13,6 +13,7 @@ import (
 
 	"github.com/thelastdreamer/MultiWANBond/pkg/config"
 	"github.com/thelastdreamer/MultiWANBond/pkg/protocol"
+	"github.com/thelastdreamer/MultiWANBond/pkg/router"
 )
 
 // Session represents a user session
@@ -69,6 +70,7 @@ type MetricsData struct {
 	NATInfo      *NATInfo
 	HealthChecks []HealthCheckInfo
 	TrafficStats *TrafficStats
+	PolicyStats  map[int]router.PolicyStats // By policy ID
 	LastUpdate   time.Time
 }
 
@@ -220,6 +222,12 @@ func (s *Server) handleDashboard(w http.ResponseWriter, r *http.Request) {
 		CurrentBPS:    s.stats.CurrentBPS,
 		ActiveFlows:   s.stats.ActiveFlows,
 		TotalSessions: s.stats.TotalSessions,
+		FECRecovered:     s.stats.FECRecovered,
+		FECUnrecoverable: s.stats.FECUnrecoverable,
+		ReorderDepth:     s.stats.ReorderDepth,
+		ReorderMaxDepth:  s.stats.ReorderMaxDepth,
+		LatePackets:      s.stats.LatePackets,
+		DuplicatesSuppressed: s.stats.DuplicatesSuppressed,
 		NATType:       s.stats.NATType,
 		PublicIP:      s.stats.PublicIP,
 		CGNATDetected: s.stats.CGNATDetected,
@@ -544,17 +552,27 @@ func (s *Server) handleRouting(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
 		// Return stored routing policies
+		s.metricsMu.RLock()
+		policyStats := s.metricsData.PolicyStats
+		s.metricsMu.RUnlock()
+
 		policies := make([]*RoutingPolicy, 0, len(cfg.Routing.Policies))
 		for _, p := range cfg.Routing.Policies {
 			policies = append(policies, &RoutingPolicy{
-				ID:          p.ID,
-				Name:        p.Name,
-				Description: p.Description,
-				Type:        p.Type,
-				Match:       p.Match,
-				TargetWAN:   p.TargetWAN,
-				Priority:    p.Priority,
-				Enabled:     p.Enabled,
+				ID:           p.ID,
+				Name:         p.Name,
+				Description:  p.Description,
+				Type:         p.Type,
+				Match:        p.Match,
+				Protocol:     p.Protocol,
+				Ports:        p.Ports,
+				DSCP:         p.DSCP,
+				TargetWAN:    p.TargetWAN,
+				FallbackWANs: p.FallbackWANs,
+				Priority:     p.Priority,
+				Enabled:      p.Enabled,
+				Hits:         policyStats[p.ID].Hits,
+				Unavailable:  policyStats[p.ID].Unavailable,
 			})
 		}
 		s.sendJSON(w, APIResponse{
@@ -569,6 +587,24 @@ func (s *Server) handleRouting(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		newPolicy := config.RoutingPolicy{
+			Name:         policy.Name,
+			Description:  policy.Description,
+			Type:         policy.Type,
+			Match:        policy.Match,
+			Protocol:     policy.Protocol,
+			Ports:        policy.Ports,
+			DSCP:         policy.DSCP,
+			TargetWAN:    policy.TargetWAN,
+			FallbackWANs: policy.FallbackWANs,
+			Priority:     policy.Priority,
+			Enabled:      policy.Enabled,
+		}
+		if _, err := newPolicy.Rule(); err != nil {
+			s.sendError(w, fmt.Sprintf("Invalid routing policy: %v", err), http.StatusBadRequest)
+			return
+		}
+
 		// Add new routing policy to configuration
 		s.configMu.Lock()
 
@@ -580,18 +616,10 @@ func (s *Server) handleRouting(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 		policy.ID = maxID + 1
+		newPolicy.ID = policy.ID
 
 		// Add to config
-		s.bondConfig.Routing.Policies = append(s.bondConfig.Routing.Policies, config.RoutingPolicy{
-			ID:          policy.ID,
-			Name:        policy.Name,
-			Description: policy.Description,
-			Type:        policy.Type,
-			Match:       policy.Match,
-			TargetWAN:   policy.TargetWAN,
-			Priority:    policy.Priority,
-			Enabled:     policy.Enabled,
-		})
+		s.bondConfig.Routing.Policies = append(s.bondConfig.Routing.Policies, newPolicy)
 
 		// Save to file
 		if err := s.SaveConfig(); err != nil {
@@ -799,6 +827,38 @@ func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "multiwanbond_memory_bytes{type=\"alloc\"} %d\n", m.Alloc)
 	fmt.Fprintf(w, "multiwanbond_memory_bytes{type=\"sys\"} %d\n", m.Sys)
 
+	// FEC metrics
+	s.mu.RLock()
+	fecRecovered := s.stats.FECRecovered
+	fecUnrecoverable := s.stats.FECUnrecoverable
+	reorderDepth := s.stats.ReorderDepth
+	latePackets := s.stats.LatePackets
+	duplicates := s.stats.DuplicatesSuppressed
+	s.mu.RUnlock()
+
+	fmt.Fprintf(w, "# HELP multiwanbond_fec_recovered_packets_total Data packets rebuilt from FEC parity\n")
+	fmt.Fprintf(w, "# TYPE multiwanbond_fec_recovered_packets_total counter\n")
+	fmt.Fprintf(w, "multiwanbond_fec_recovered_packets_total %d\n", fecRecovered)
+
+	fmt.Fprintf(w, "# HELP multiwanbond_fec_unrecoverable_packets_total Lost data packets FEC could not rebuild\n")
+	fmt.Fprintf(w, "# TYPE multiwanbond_fec_unrecoverable_packets_total counter\n")
+	fmt.Fprintf(w, "multiwanbond_fec_unrecoverable_packets_total %d\n", fecUnrecoverable)
+
+	// Reorder metrics
+	fmt.Fprintf(w, "# HELP multiwanbond_reorder_depth Packets waiting in the reorder buffer\n")
+	fmt.Fprintf(w, "# TYPE multiwanbond_reorder_depth gauge\n")
+	fmt.Fprintf(w, "multiwanbond_reorder_depth %d\n", reorderDepth)
+
+	fmt.Fprintf(w, "# HELP multiwanbond_late_packets_total Packets that arrived after their slot was released\n")
+	fmt.Fprintf(w, "# TYPE multiwanbond_late_packets_total counter\n")
+	fmt.Fprintf(w, "multiwanbond_late_packets_total %d\n", latePackets)
+
+	fmt.Fprintf(w, "# HELP multiwanbond_duplicates_suppressed_total Redundant packet copies dropped\n")
+	fmt.Fprintf(w, "# TYPE multiwanbond_duplicates_suppressed_total counter\n")
+	for wanID, suppressed := range duplicates {
+		fmt.Fprintf(w, "multiwanbond_duplicates_suppressed_total{wan_id=\"%d\"} %d\n", wanID, suppressed)
+	}
+
 	// Get metrics data
 	s.metricsMu.RLock()
 	metricsData := s.metricsData
@@ -1042,6 +1102,7 @@ func (s *Server) UpdateStats(metrics map[uint8]*protocol.WANMetrics, wans map[ui
 			Name:      wan.Name,
 			Interface: wan.Name,
 			Status:    status,
+			Priority:  wan.Config.Priority,
 			Weight:    wan.Config.Weight,
 		}
 
@@ -1052,6 +1113,9 @@ func (s *Server) UpdateStats(metrics map[uint8]*protocol.WANMetrics, wans map[ui
 			wanStatus.Latency = m.AvgLatency.Milliseconds()
 			wanStatus.Jitter = m.AvgJitter.Milliseconds()
 			wanStatus.PacketLoss = m.AvgPacketLoss
+			wanStatus.Bandwidth = m.Bandwidth
+			wanStatus.BandwidthUp = m.BandwidthUp
+			wanStatus.BandwidthDown = m.BandwidthDown
 			wanStatus.BytesSent = m.BytesSent
 			wanStatus.BytesReceived = m.BytesReceived
 			wanStatus.PacketsSent = m.PacketsSent
@@ -1071,6 +1135,42 @@ func (s *Server) UpdateStats(metrics map[uint8]*protocol.WANMetrics, wans map[ui
 	s.metricsMu.Unlock()
 }
 
+// UpdateFECStats updates forward error correction statistics
+func (s *Server) UpdateFECStats(recovered, unrecoverable uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.FECRecovered = recovered
+	s.stats.FECUnrecoverable = unrecoverable
+}
+
+// UpdateReorderStats updates reorder buffer statistics
+func (s *Server) UpdateReorderStats(depth, maxDepth int, late uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.ReorderDepth = depth
+	s.stats.ReorderMaxDepth = maxDepth
+	s.stats.LatePackets = late
+}
+
+// UpdateDuplicateStats updates the per-WAN counts of suppressed duplicates
+func (s *Server) UpdateDuplicateStats(suppressed map[uint8]uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.DuplicatesSuppressed = suppressed
+}
+
+// UpdatePolicyStats updates the routing policy hit counters
+func (s *Server) UpdatePolicyStats(stats []router.PolicyStats) {
+	byID := make(map[int]router.PolicyStats, len(stats))
+	for _, st := range stats {
+		byID[st.ID] = st
+	}
+
+	s.metricsMu.Lock()
+	defer s.metricsMu.Unlock()
+	s.metricsData.PolicyStats = byID
+}
+
 // UpdateNATInfo updates NAT traversal information
 func (s *Server) UpdateNATInfo(natInfo *NATInfo) {
 	s.metricsMu.Lock()
@@ -1198,7 +1298,7 @@ func toWANConfig(wan config.WANInterfaceConfig) *WANConfig {
 		ID:                  wan.ID,
 		Name:                wan.Name,
 		Interface:           wan.LocalAddr,
-		Priority:            wan.Weight, // Note: config uses Weight, not Priority field
+		Priority:            wan.Priority,
 		Weight:              wan.Weight,
 		MaxBandwidth:        wan.MaxBandwidth,
 		MaxLatency:          maxLatency.Milliseconds(),
@@ -1224,6 +1324,7 @@ func fromWANConfig(wanCfg *WANConfig) config.WANInterfaceConfig {
 		HealthCheckInterval: fmt.Sprintf("%dms", wanCfg.HealthCheckInterval),
 		FailureThreshold:    3,
 		Weight:              wanCfg.Weight,
+		Priority:            wanCfg.Priority,
 		Enabled:             wanCfg.Enabled,
 	}
 }
@@ -2,6 +2,7 @@
 package webui
 
 import (
+	"sort"
 	"time"
 
 	"github.com/thelastdreamer/MultiWANBond/pkg/dpi"
@@ -100,6 +101,18 @@ type DashboardStats struct {
 	ActiveFlows   int     `json:"active_flows"`
 	TotalSessions int     `json:"total_sessions"`
 
+	// FEC stats
+	FECRecovered     uint64 `json:"fec_recovered"`
+	FECUnrecoverable uint64 `json:"fec_unrecoverable"`
+
+	// Reorder stats
+	ReorderDepth    int    `json:"reorder_depth"`
+	ReorderMaxDepth int    `json:"reorder_max_depth"`
+	LatePackets     uint64 `json:"late_packets"`
+
+	// Duplicate copies suppressed, per WAN
+	DuplicatesSuppressed map[uint8]uint64 `json:"duplicates_suppressed"`
+
 	// NAT stats
 	NATType       string  `json:"nat_type"`
 	PublicIP      string  `json:"public_ip"`
@@ -120,6 +133,8 @@ type WANStatus struct {
 	Jitter           int64                  `json:"jitter_ms"`
 	PacketLoss       float64                `json:"packet_loss"`
 	Bandwidth        uint64                 `json:"bandwidth_bps"`
+	BandwidthUp      uint64                 `json:"bandwidth_up_bps"`   // Estimated upload capacity
+	BandwidthDown    uint64                 `json:"bandwidth_down_bps"` // Estimated download capacity
 	BytesSent        uint64                 `json:"bytes_sent"`
 	BytesReceived    uint64                 `json:"bytes_received"`
 	PacketsSent      uint64                 `json:"packets_sent"`
@@ -185,14 +200,20 @@ type WANConfig struct {
 
 // RoutingPolicy contains routing policy for API
 type RoutingPolicy struct {
-	ID          int    `json:"id"`
-	Name        string `json:"name"`
-	Description string `json:"description"`
-	Type        string `json:"type"` // "source", "destination", "application"
-	Match       string `json:"match"` // IP, CIDR, domain, or app name based on Type
-	TargetWAN   uint8  `json:"target_wan"` // WAN ID to use
-	Priority    int    `json:"priority"`
-	Enabled     bool   `json:"enabled"`
+	ID           int     `json:"id"`
+	Name         string  `json:"name"`
+	Description  string  `json:"description"`
+	Type         string  `json:"type"`  // "source", "destination", "application"
+	Match        string  `json:"match"` // IPs or CIDRs, or app names, based on Type
+	Protocol     string  `json:"protocol,omitempty"`
+	Ports        string  `json:"ports,omitempty"`
+	DSCP         string  `json:"dscp,omitempty"`
+	TargetWAN    uint8   `json:"target_wan"` // WAN ID to use
+	FallbackWANs []uint8 `json:"fallback_wans,omitempty"`
+	Priority     int     `json:"priority"`
+	Enabled      bool    `json:"enabled"`
+	Hits         uint64  `json:"hits"`        // Packets matched since startup
+	Unavailable  uint64  `json:"unavailable"` // Matches sent elsewhere because no target WAN was up
 }
 
 // SystemConfig contains system configuration
@@ -285,6 +306,26 @@ type NATInfo struct {
 	CanDirect     bool   `json:"can_direct_connect"`
 	NeedsRelay    bool   `json:"needs_relay"`
 	RelayAvailable bool  `json:"relay_available"`
+
+	// Interfaces has the NAT each WAN sits behind; the fields above
+	// describe the first of them
+	Interfaces []WANNATInfo `json:"interfaces"`
+}
+
+// WANNATInfo contains NAT traversal information for one WAN
+type WANNATInfo struct {
+	WANID             uint8     `json:"wan_id"`
+	Name              string    `json:"name"`
+	LocalAddr         string    `json:"local_addr"`
+	PublicAddr        string    `json:"public_addr"`
+	NATType           string    `json:"nat_type"`
+	CGNATDetected     bool      `json:"cgnat_detected"`
+	CanDirect         bool      `json:"can_direct_connect"`
+	NeedsRelay        bool      `json:"needs_relay"`
+	RelayAvailable    bool      `json:"relay_available"`
+	KeepAliveInterval int64     `json:"keepalive_interval_ms"`
+	BindingLifetime   int64     `json:"binding_lifetime_ms"` // 0 until measured
+	Updated           time.Time `json:"updated"`
 }
 
 // HealthCheckInfo contains health check information
@@ -398,6 +439,55 @@ func ToNATInfo(caps *nat.TraversalCapabilities) *NATInfo {
 	}
 }
 
+// ToWANNATInfo converts what NAT traversal learned about each WAN to the
+// API type, ordered by WAN ID
+func ToWANNATInfo(wans map[uint8]*protocol.WANInterface, info map[uint8]protocol.WANNATInfo) *NATInfo {
+	ids := make([]int, 0, len(info))
+	for id := range info {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+
+	natInfo := &NATInfo{NATType: "Unknown", Interfaces: make([]WANNATInfo, 0, len(ids))}
+	for _, id := range ids {
+		wanInfo := info[uint8(id)]
+		api := WANNATInfo{
+			WANID:             uint8(id),
+			NATType:           wanInfo.NATType,
+			CGNATDetected:     wanInfo.CGNATDetected,
+			CanDirect:         wanInfo.CanDirectConnect,
+			NeedsRelay:        wanInfo.NeedsRelay,
+			RelayAvailable:    wanInfo.RelayAvailable,
+			KeepAliveInterval: wanInfo.KeepAliveInterval.Milliseconds(),
+			BindingLifetime:   wanInfo.BindingLifetime.Milliseconds(),
+			Updated:           wanInfo.Updated,
+		}
+		if wan := wans[uint8(id)]; wan != nil {
+			api.Name = wan.Name
+		}
+		if wanInfo.LocalAddr != nil {
+			api.LocalAddr = wanInfo.LocalAddr.String()
+		}
+		if wanInfo.PublicAddr != nil {
+			api.PublicAddr = wanInfo.PublicAddr.String()
+		}
+		natInfo.Interfaces = append(natInfo.Interfaces, api)
+	}
+
+	if len(natInfo.Interfaces) > 0 {
+		first := natInfo.Interfaces[0]
+		natInfo.LocalAddr = first.LocalAddr
+		natInfo.PublicAddr = first.PublicAddr
+		natInfo.NATType = first.NATType
+		natInfo.CGNATDetected = first.CGNATDetected
+		natInfo.CanDirect = first.CanDirect
+		natInfo.NeedsRelay = first.NeedsRelay
+		natInfo.RelayAvailable = first.RelayAvailable
+	}
+
+	return natInfo
+}
+
 // ToFlowInfo converts DPI flow to API type
 func ToFlowInfo(flow *dpi.Flow, wanID uint8) *FlowInfo {
 	duration := flow.LastSeen.Sub(flow.FirstSeen)